@@ -5,9 +5,11 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/namsral/flag"
 
+	"github.com/prologic/httpfs/utils"
 	"github.com/prologic/httpfs/webapi"
 )
 
@@ -34,6 +36,19 @@ func main() {
 		tlscert  string
 		tlskey   string
 		readonly bool
+		watch    bool
+		journal  string
+		jsize    int
+		sttl     time.Duration
+		uttl     time.Duration
+		rttl     time.Duration
+		form     string
+		nocase   bool
+		exclude  string
+		rdelete  bool
+		trash    bool
+		tttl     time.Duration
+		nversion int
 		debug    bool
 		bind     string
 		root     string
@@ -43,6 +58,19 @@ func main() {
 	flag.BoolVar(&tls, "tls", false, "Use TLS")
 	flag.BoolVar(&debug, "debug", false, "set debug logging")
 	flag.BoolVar(&readonly, "readonly", false, "set read-only mode")
+	flag.BoolVar(&watch, "watch", true, "publish change events for the served path")
+	flag.StringVar(&journal, "journal", "", "path to change journal (disabled if empty)")
+	flag.IntVar(&jsize, "journal-size", webapi.DefaultJournalSize, "number of changes to retain in the journal")
+	flag.DurationVar(&sttl, "session-ttl", webapi.DefaultSessionTTL, "idle time after which atomic write sessions are abandoned (0 disables atomic writes)")
+	flag.DurationVar(&uttl, "upload-ttl", webapi.DefaultUploadTTL, "idle time after which multipart uploads are aborted (0 disables multipart uploads)")
+	flag.DurationVar(&rttl, "resumable-ttl", webapi.DefaultResumableTTL, "idle time after which unfinished resumable uploads are removed (0 disables resumable uploads)")
+	flag.StringVar(&form, "normalize", "", "normalize the names of created and renamed files to this Unicode form: nfc or nfd")
+	flag.BoolVar(&nocase, "ignore-case", false, "look up names case-insensitively")
+	flag.StringVar(&exclude, "exclude", "", "file of gitignore-style patterns of paths to hide and refuse access to")
+	flag.BoolVar(&rdelete, "recursive-delete", true, "allow deleting directories with everything in them")
+	flag.BoolVar(&trash, "trash", false, "move deleted files into a trash they can be restored from")
+	flag.DurationVar(&tttl, "trash-retention", webapi.DefaultTrashRetention, "time after which deleted files are purged from the trash (0 keeps them forever)")
+	flag.IntVar(&nversion, "versions", 0, "number of previous versions of each file to keep when it is overwritten (0 disables versioning)")
 	flag.StringVar(&tlscert, "tlscert", "server.crt", "server certificate")
 	flag.StringVar(&tlskey, "tlskey", "server.key", "server key")
 	flag.StringVar(&bind, "bind", "0.0.0.0:8000", "[int]:<port> to bind to")
@@ -53,7 +81,67 @@ func main() {
 		log.SetOutput(ioutil.Discard)
 	}
 
-	http.Handle("/", webapi.FileServer(root, readonly))
+	var opts []webapi.Option
+
+	if watch {
+		broker := webapi.NewBroker()
+		if err := webapi.Watch(root, broker); err != nil {
+			log.Printf("E: not watching %s for changes: %s\n", root, err)
+		} else {
+			opts = append(opts, webapi.WithBroker(broker))
+		}
+	}
+
+	if journal != "" {
+		j, err := webapi.OpenJournal(journal, jsize)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer j.Close()
+		opts = append(opts, webapi.WithJournal(j))
+	}
+
+	if sttl > 0 {
+		opts = append(opts, webapi.WithSessions(sttl))
+	}
+
+	if uttl > 0 {
+		opts = append(opts, webapi.WithUploads(uttl))
+	}
+
+	if rttl > 0 {
+		opts = append(opts, webapi.WithResumableUploads(rttl))
+	}
+
+	if form != "" || nocase {
+		names, err := utils.NewNormalizer(form, nocase)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, webapi.WithNormalizer(names))
+	}
+
+	if exclude != "" {
+		excludes := utils.NewIgnore()
+		if err := excludes.AddFile(exclude); err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, webapi.WithExcludes(excludes))
+	}
+
+	if nversion > 0 {
+		opts = append(opts, webapi.WithVersions(nversion))
+	}
+
+	if trash {
+		opts = append(opts, webapi.WithTrash(tttl))
+	}
+
+	if !rdelete {
+		opts = append(opts, webapi.WithoutRecursiveDelete())
+	}
+
+	http.Handle("/", webapi.FileServer(root, readonly, opts...))
 
 	var handler http.Handler
 
@@ -10,6 +10,7 @@ import (
 	"bazil.org/fuse/fs"
 
 	"github.com/prologic/httpfs/fsapi"
+	"github.com/prologic/httpfs/utils"
 )
 
 // debug flag enables logging of debug messages to stderr.
@@ -17,6 +18,33 @@ var debug = flag.Bool("debug", false, "enable debug log messages to stderr")
 var url = flag.String("url", "", "url of httpsfs backend (required)")
 var tlsverify = flag.Bool("tlsverify", false, "enable TLS verification")
 var mount = flag.String("mount", "", "path to mount volume (required)")
+var notify = flag.Bool("notify", true, "invalidate caches on server change events")
+var retries = flag.Int("retries", fsapi.DefaultRetryPolicy.MaxRetries, "number of times to retry failed requests")
+var mode = flag.String("mode", "soft", "behaviour when the server is unreachable: hard (block and retry) or soft (fail after -retries)")
+var healthInterval = flag.Duration("health-interval", fsapi.DefaultHealthInterval, "how often to check the server is responding")
+var offline = flag.String("offline", "", "directory for the offline journal; enables disconnected operation (requires -mode soft)")
+var cacheSize = flag.Int64("cache-size", fsapi.DefaultCacheSize, "bytes of file content to cache for offline use")
+var diskCache = flag.String("disk-cache", "", "directory to cache file content and listings in across remounts")
+var diskCacheSize = flag.Int64("disk-cache-size", fsapi.DefaultDiskCacheSize, "maximum size of the disk cache in bytes")
+var diskCacheMode = flag.String("disk-cache-mode", "block", "disk cache granularity: block (cache the parts that are read) or file (fetch whole files)")
+var wholeFile = flag.Bool("whole-file", false, "download files when opened and upload them when closed")
+var wholeFileMax = flag.Int64("whole-file-max", 0, "largest file in bytes to open in whole-file mode (0 for no limit)")
+var wholeFileDir = flag.String("whole-file-dir", "", "directory for local copies of open files (default system temp directory)")
+var deltaSync = flag.Int64("delta-sync", 0, "in whole-file mode, upload only changed blocks of this many bytes (0 to disable)")
+var atomicWrites = flag.Bool("atomic-writes", false, "make writes visible to others only when files are closed")
+var partSize = flag.Int64("part-size", 0, "upload sequential writes in parts of this many bytes in parallel (0 to disable)")
+var uploadConcurrency = flag.Int("upload-concurrency", fsapi.DefaultUploadConcurrency, "number of parts to upload at the same time")
+var compress = flag.Bool("compress", false, "compress file content sent to and read from the server")
+var compressMin = flag.Int64("compress-min", fsapi.DefaultCompressMin, "smallest write in bytes to compress")
+var verify = flag.Bool("verify", false, "verify data read and written against server side hashes")
+var sparse = flag.Bool("sparse", false, "don't transfer holes in sparse files and write blocks of zeros as holes")
+var normalize = flag.String("normalize", "", "present names in this Unicode normalization form and create files with it: nfc or nfd")
+var ignoreCase = flag.Bool("ignore-case", false, "look up names case-insensitively")
+var versions = flag.Bool("versions", false, "expose previous versions of files kept by the server in /"+fsapi.VersionsDir)
+var ignore = flag.String("ignore", "", "file of gitignore-style patterns of names never to look up on the server, added to the defaults for this OS")
+var missTTL = flag.Duration("miss-ttl", fsapi.DefaultMissTTL, "how long to remember names that don't exist on the server (0 to disable)")
+var metaTimeout = flag.Duration("meta-timeout", fsapi.DefaultMetaTimeout, "timeout for metadata operations (0 to disable)")
+var dataTimeout = flag.Duration("data-timeout", fsapi.DefaultDataTimeout, "timeout for read and write operations (0 to disable)")
 
 func usage() {
 	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
@@ -36,6 +64,32 @@ func main() {
 		os.Exit(2)
 	}
 
+	mountMode, err := fsapi.ParseMountMode(*mode)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cacheMode, err := fsapi.ParseCacheMode(*diskCacheMode)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	names, err := utils.NewNormalizer(*normalize, *ignoreCase)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ignored := utils.NewIgnore(fsapi.DefaultIgnorePatterns()...)
+	if *ignore != "" {
+		if err := ignored.AddFile(*ignore); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *offline != "" && mountMode == fsapi.HardMount {
+		log.Fatal("-offline can't be used with -mode hard")
+	}
+
 	c, err := fuse.Mount(
 		*mount,
 		fuse.FSName("httpfs"),
@@ -58,7 +112,63 @@ func main() {
 		cfg.Debug = debugLog
 	}
 	srv := fs.New(c, cfg)
-	filesys := fsapi.NewHTTPFS(*url, *tlsverify)
+	policy := fsapi.DefaultRetryPolicy
+	policy.MaxRetries = *retries
+
+	opts := []fsapi.Option{
+		fsapi.WithRetryPolicy(policy),
+		fsapi.WithMountMode(mountMode),
+		fsapi.WithTimeouts(*metaTimeout, *dataTimeout),
+		fsapi.WithIgnore(ignored),
+		fsapi.WithMissTTL(*missTTL),
+	}
+	if *atomicWrites {
+		opts = append(opts, fsapi.WithAtomicWrites())
+	}
+	if *partSize > 0 {
+		opts = append(opts, fsapi.WithMultipartUploads(*partSize, *uploadConcurrency))
+	}
+	if *sparse {
+		opts = append(opts, fsapi.WithSparseFiles())
+	}
+	if *verify {
+		opts = append(opts, fsapi.WithVerify())
+	}
+	if *compress {
+		opts = append(opts, fsapi.WithCompression(*compressMin))
+	}
+	if *normalize != "" || *ignoreCase {
+		opts = append(opts, fsapi.WithNormalizer(names))
+	}
+	if *versions {
+		opts = append(opts, fsapi.WithVersions())
+	}
+	if *wholeFile {
+		opts = append(opts, fsapi.WithWholeFile(*wholeFileMax, *wholeFileDir))
+		if *deltaSync > 0 {
+			opts = append(opts, fsapi.WithDeltaSync(*deltaSync))
+		}
+	}
+
+	filesys := fsapi.NewHTTPFS(*url, *tlsverify, opts...)
+
+	if *offline != "" {
+		if err := filesys.EnableOffline(*offline, *cacheSize); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *diskCache != "" {
+		if err := filesys.EnableDiskCache(*diskCache, *diskCacheSize, cacheMode); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	go filesys.Monitor(*healthInterval)
+
+	if *notify {
+		go filesys.Watch(srv)
+	}
 
 	if err := srv.Serve(filesys); err != nil {
 		log.Fatal(err)
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+
+	"github.com/prologic/httpfs/fsapi"
+)
+
+var url = flag.String("url", "", "url of httpsfs backend (required)")
+var tlsverify = flag.Bool("tlsverify", false, "enable TLS verification")
+var retries = flag.Int("retries", fsapi.DefaultRetryPolicy.MaxRetries, "number of times to retry without progress before giving up")
+var verify = flag.Bool("verify", false, "verify the upload against a server side hash")
+var delta = flag.Int64("delta", 0, "send only the blocks of this many bytes that differ from the remote file (0 to disable)")
+var stateDir = flag.String("state", defaultStateDir(), "directory to keep the state of unfinished uploads in")
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] <file> <remote path>\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func defaultStateDir() string {
+	if home := os.Getenv("HOME"); home != "" {
+		return filepath.Join(home, ".httpfsput")
+	}
+	return filepath.Join(os.TempDir(), "httpfsput")
+}
+
+// state identifies an unfinished upload so that it can be resumed by a
+// later run as long as the local file hasn't changed.
+type state struct {
+	URL     string
+	Path    string
+	ID      string
+	Size    int64
+	ModTime int64
+}
+
+func statePath(url, path string) string {
+	sum := sha256.Sum256([]byte(url + path))
+	return filepath.Join(*stateDir, hex.EncodeToString(sum[:8])+".json")
+}
+
+func loadState(p string) (state, bool) {
+	var s state
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return s, false
+	}
+	return s, json.Unmarshal(data, &s) == nil
+}
+
+func saveState(p string, s state) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(p+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(p+".tmp", p)
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if *url == "" || flag.NArg() != 2 {
+		usage()
+		os.Exit(2)
+	}
+	local, remote := flag.Arg(0), flag.Arg(1)
+
+	f, err := os.Open(local)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	client := fsapi.NewClient(*url, *tlsverify)
+	policy := fsapi.DefaultRetryPolicy
+	policy.MaxRetries = *retries
+	client.SetRetryPolicy(policy)
+	client.SetVerify(*verify)
+
+	ctx := context.Background()
+
+	if *delta > 0 {
+		// Delta transfers aren't resumable, but only resend what differs.
+		if err := client.SyncFile(ctx, remote, f, fi.Size(), fi.Mode(), *delta); err != nil {
+			log.Fatalf("error syncing %s: %s", local, err)
+		}
+		return
+	}
+
+	want := state{
+		URL:     *url,
+		Path:    remote,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime().UnixNano(),
+	}
+	sp := statePath(*url, remote)
+
+	s, ok := loadState(sp)
+	resuming := ok && s.Size == want.Size && s.ModTime == want.ModTime
+	for {
+		if resuming {
+			log.Printf("resuming upload %s of %s", s.ID, remote)
+		} else {
+			id, err := client.CreateUpload(ctx, remote, fi.Size(), fi.Mode())
+			if err != nil {
+				log.Fatalf("error creating upload: %s", err)
+			}
+			s = want
+			s.ID = id
+			if err := saveState(sp, s); err != nil {
+				log.Printf("warning: upload can't be resumed: %s", err)
+			}
+		}
+
+		err := client.ResumeUpload(ctx, remote, s.ID, f, fi.Size())
+		if err == fuse.ENOENT && resuming {
+			// The server no longer knows the upload (e.g. it expired);
+			// start over.
+			resuming = false
+			continue
+		}
+		if err != nil {
+			log.Fatalf("error uploading %s: %s", local, err)
+		}
+		break
+	}
+
+	os.Remove(sp)
+}
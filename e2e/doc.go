@@ -0,0 +1,3 @@
+// Package e2e holds end-to-end tests that run fsapi.Client against a
+// webapi.FileServer over HTTP.
+package e2e
@@ -0,0 +1,173 @@
+package e2e_test
+
+import (
+	"crypto/sha256"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/prologic/httpfs/fsapi"
+	"github.com/prologic/httpfs/utils/tempdir"
+	"github.com/prologic/httpfs/webapi"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Sizes and offsets past the limits of 32-bit integers. The files are
+// sparse, so they take up next to no space.
+const (
+	GiB      = int64(1) << 30
+	bigSize  = 5 * GiB
+	bigWrite = 4*GiB + 12345
+)
+
+func setup(t *testing.T) (tempdir.Dir, *fsapi.Client, func()) {
+	if testing.Short() {
+		t.Skip("skipping large file test in short mode")
+	}
+
+	tmp := tempdir.New(t)
+	f, err := os.Create(filepath.Join(tmp.Path, "big"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(bigSize); err != nil {
+		f.Close()
+		tmp.Cleanup()
+		t.Skipf("can't create a %d byte file: %s", bigSize, err)
+	}
+	f.Close()
+
+	srv := httptest.NewServer(webapi.FileServer(tmp.Path, false, webapi.WithUploads(time.Hour)))
+	return tmp, fsapi.NewClient(srv.URL, false), func() {
+		srv.Close()
+		tmp.Cleanup()
+	}
+}
+
+func TestLargeStatAndList(t *testing.T) {
+	assert := assert.New(t)
+
+	_, c, cleanup := setup(t)
+	defer cleanup()
+
+	fi, err := c.Stat(context.Background(), "/big")
+	assert.Nil(err)
+	assert.Equal(bigSize, fi.Size())
+
+	fis, err := c.Readdir(context.Background(), "/")
+	assert.Nil(err)
+	assert.Len(fis, 1)
+	assert.Equal(bigSize, fis[0].Size())
+}
+
+func TestLargeReadWrite(t *testing.T) {
+	assert := assert.New(t)
+
+	tmp, c, cleanup := setup(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	data := []byte("beyond four gigabytes")
+	n, err := c.WriteAt(ctx, "/big", data, os.O_WRONLY, 0644, bigWrite)
+	assert.Nil(err)
+	assert.Equal(len(data), n)
+
+	f, err := os.Open(filepath.Join(tmp.Path, "big"))
+	assert.Nil(err)
+	defer f.Close()
+	got := make([]byte, len(data))
+	_, err = f.ReadAt(got, bigWrite)
+	assert.Nil(err)
+	assert.Equal(data, got)
+
+	buf := make([]byte, len(data)+10)
+	n, err = c.ReadAt(ctx, "/big", buf, bigWrite-5)
+	assert.Nil(err)
+	assert.Equal(len(buf), n)
+	assert.Equal(data, buf[5:5+len(data)])
+
+	// Reads at the very end of the file.
+	n, err = c.ReadAt(ctx, "/big", buf, bigSize-3)
+	assert.Nil(err)
+	assert.Equal(3, n)
+
+	// Writing past the end grows the file beyond 5 GiB.
+	_, err = c.WriteAt(ctx, "/big", data, os.O_WRONLY, 0644, bigSize+GiB)
+	assert.Nil(err)
+	fi, err := f.Stat()
+	assert.Nil(err)
+	assert.Equal(bigSize+GiB+int64(len(data)), fi.Size())
+}
+
+func TestLargeTruncate(t *testing.T) {
+	assert := assert.New(t)
+
+	tmp, c, cleanup := setup(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	for _, size := range []int64{6 * GiB, 3*GiB + 1, 2*GiB + 1, 4*GiB + 1} {
+		assert.Nil(c.Truncate(ctx, "/big", uint64(size)))
+
+		fi, err := os.Stat(filepath.Join(tmp.Path, "big"))
+		assert.Nil(err)
+		assert.Equal(size, fi.Size())
+	}
+}
+
+func TestLargeRanges(t *testing.T) {
+	assert := assert.New(t)
+
+	_, c, cleanup := setup(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	data := []byte("0123456789")
+	_, err := c.WriteAt(ctx, "/big", data, os.O_WRONLY, 0644, bigWrite)
+	assert.Nil(err)
+
+	sum, _, err := c.Hash(ctx, "/big", bigWrite+2, 5)
+	assert.Nil(err)
+	want := sha256.Sum256(data[2:7])
+	assert.Equal(want[:], sum)
+
+	extents, err := c.Extents(ctx, "/big", 4*GiB, GiB)
+	assert.Nil(err)
+	if assert.NotEmpty(extents) {
+		assert.True(extents[0].Offset <= bigWrite)
+		assert.True(extents[0].Offset+extents[0].Length >= bigWrite+int64(len(data)))
+	}
+
+	n, err := c.Copy(ctx, "/big", "/big", bigWrite, bigWrite+GiB/2, int64(len(data)))
+	assert.Nil(err)
+	assert.EqualValues(len(data), n)
+
+	buf := make([]byte, len(data))
+	_, err = c.ReadAt(ctx, "/big", buf, bigWrite+GiB/2)
+	assert.Nil(err)
+	assert.Equal(data, buf)
+}
+
+func TestLargeMultipartUpload(t *testing.T) {
+	assert := assert.New(t)
+
+	_, c, cleanup := setup(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	id, err := c.StartUpload(ctx, "/big", bigWrite, 4, 0644)
+	assert.Nil(err)
+	assert.Nil(c.UploadPart(ctx, "/big", id, 1, []byte("4567")))
+	assert.Nil(c.UploadPart(ctx, "/big", id, 0, []byte("0123")))
+	assert.Nil(c.CompleteUpload(ctx, "/big", id, 2))
+
+	buf := make([]byte, 8)
+	_, err = c.ReadAt(ctx, "/big", buf, bigWrite)
+	assert.Nil(err)
+	assert.Equal("01234567", string(buf))
+}
@@ -0,0 +1,118 @@
+package e2e_test
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/prologic/httpfs/fsapi"
+	"github.com/prologic/httpfs/utils/tempdir"
+	"github.com/prologic/httpfs/webapi"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// names returns file names covering every byte allowed in a POSIX file
+// name (anything but NUL and '/'), alone and surrounded by other bytes,
+// plus sequences that look like escapes.
+func names() []string {
+	var names []string
+	for c := 1; c < 256; c++ {
+		if c == '/' {
+			continue
+		}
+		b := string([]byte{byte(c)})
+		if b != "." {
+			names = append(names, b)
+		}
+		names = append(names, "a"+b+"z")
+	}
+	return append(names, "%", "%25", "%2F", "a+b", "a%20b", "..a", "a..", "...", "?x=1", "#frag", "\xff\xfe")
+}
+
+func TestFileNames(t *testing.T) {
+	tmp := tempdir.New(t)
+	defer tmp.Cleanup()
+
+	srv := httptest.NewServer(webapi.FileServer(tmp.Path, false))
+	defer srv.Close()
+
+	c := fsapi.NewClient(srv.URL, false)
+	ctx := context.Background()
+
+	for _, name := range names() {
+		assert := assert.New(t)
+		p := "/" + name
+
+		_, err := c.WriteAt(ctx, p, []byte(name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644, 0)
+		if !assert.Nil(err, "create %q", name) {
+			continue
+		}
+
+		b, err := ioutil.ReadFile(filepath.Join(tmp.Path, name))
+		assert.Nil(err, "%q on disk", name)
+		assert.Equal(name, string(b))
+
+		fi, err := c.Stat(ctx, p)
+		assert.Nil(err, "stat %q", name)
+		if err == nil {
+			assert.EqualValues(len(name), fi.Size())
+		}
+
+		buf := make([]byte, len(name))
+		_, err = c.ReadAt(ctx, p, buf, 0)
+		assert.Nil(err, "read %q", name)
+		assert.Equal(name, string(buf))
+
+		fis, err := c.Readdir(ctx, "/")
+		assert.Nil(err)
+		if assert.Len(fis, 1, "list %q", name) {
+			assert.Equal(name, fis[0].Name())
+		}
+
+		assert.Nil(c.Link(ctx, p, p+".link"), "link %q", name)
+		_, err = os.Stat(filepath.Join(tmp.Path, name+".link"))
+		assert.Nil(err, "link %q on disk", name)
+		assert.Nil(c.Delete(ctx, p+".link"))
+
+		assert.Nil(c.Rename(ctx, p, p+".new"), "rename %q", name)
+		_, err = os.Stat(filepath.Join(tmp.Path, name+".new"))
+		assert.Nil(err, "renamed %q on disk", name)
+
+		assert.Nil(c.Delete(ctx, p+".new"), "delete %q", name)
+		tmp.CheckEmpty()
+	}
+}
+
+func TestDirectoryNames(t *testing.T) {
+	tmp := tempdir.New(t)
+	defer tmp.Cleanup()
+
+	srv := httptest.NewServer(webapi.FileServer(tmp.Path, false))
+	defer srv.Close()
+
+	c := fsapi.NewClient(srv.URL, false)
+	ctx := context.Background()
+
+	for _, name := range []string{"a b", "a?b", "a#b", "a%b", "%3F", "\xff"} {
+		assert := assert.New(t)
+		p := "/" + name
+
+		assert.Nil(c.Mkdir(ctx, p, 0755), "mkdir %q", name)
+		_, err := c.WriteAt(ctx, p+"/f", []byte("x"), os.O_WRONLY|os.O_CREATE, 0644, 0)
+		assert.Nil(err, "create in %q", name)
+
+		fis, err := c.Readdir(ctx, p)
+		assert.Nil(err, "list %q", name)
+		if assert.Len(fis, 1) {
+			assert.Equal("f", fis[0].Name())
+		}
+
+		assert.Nil(c.Delete(ctx, p), "delete %q", name)
+	}
+	tmp.CheckEmpty()
+}
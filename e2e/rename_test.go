@@ -0,0 +1,121 @@
+package e2e_test
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+
+	"github.com/prologic/httpfs/fsapi"
+	"github.com/prologic/httpfs/utils/tempdir"
+	"github.com/prologic/httpfs/webapi"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenameFollowsNodes(t *testing.T) {
+	assert := assert.New(t)
+
+	tmp := tempdir.New(t)
+	defer tmp.Cleanup()
+
+	assert.Nil(os.Mkdir(filepath.Join(tmp.Path, "dir"), 0755))
+	assert.Nil(ioutil.WriteFile(filepath.Join(tmp.Path, "dir", "f"), []byte("one"), 0644))
+
+	srv := httptest.NewServer(webapi.FileServer(tmp.Path, false))
+	defer srv.Close()
+
+	m := fsapi.NewHTTPFS(srv.URL, false)
+	ctx := context.Background()
+
+	root, _ := m.Root()
+	node, err := root.(fs.NodeStringLookuper).Lookup(ctx, "dir")
+	assert.Nil(err)
+	dir := node.(*fsapi.Dir)
+	node, err = dir.Lookup(ctx, "f")
+	assert.Nil(err)
+	file := node.(*fsapi.File)
+
+	handle, err := file.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	assert.Nil(err)
+	read := func() (string, error) {
+		resp := &fuse.ReadResponse{Data: make([]byte, 0, 16)}
+		err := handle.(fs.HandleReader).Read(ctx, &fuse.ReadRequest{Size: 16}, resp)
+		return string(resp.Data), err
+	}
+	data, err := read()
+	assert.Nil(err)
+	assert.Equal("one", data)
+
+	// The open file and the directory follow the rename.
+	assert.Nil(root.(*fsapi.Dir).Rename(ctx, &fuse.RenameRequest{OldName: "dir", NewName: "other"}, root))
+	assert.Equal("/other", dir.Path())
+	assert.Equal("/other/f", file.Path())
+	data, err = read()
+	assert.Nil(err)
+	assert.Equal("one", data)
+
+	// The same file keeps its node.
+	node, err = dir.Lookup(ctx, "f")
+	assert.Nil(err)
+	assert.True(node == fs.Node(file))
+
+	// Another file renamed over it isn't read through the open file.
+	assert.Nil(ioutil.WriteFile(filepath.Join(tmp.Path, "g"), []byte("two"), 0644))
+	assert.Nil(os.Rename(filepath.Join(tmp.Path, "g"), filepath.Join(tmp.Path, "other", "f")))
+	_, err = read()
+	assert.Equal(fuse.Errno(syscall.ESTALE), err)
+
+	node, err = dir.Lookup(ctx, "f")
+	assert.Nil(err)
+	assert.False(node == fs.Node(file))
+}
+
+func TestRenameFollowsWrites(t *testing.T) {
+	assert := assert.New(t)
+
+	tmp := tempdir.New(t)
+	defer tmp.Cleanup()
+
+	assert.Nil(os.Mkdir(filepath.Join(tmp.Path, "dir"), 0755))
+
+	srv := httptest.NewServer(webapi.FileServer(tmp.Path, false))
+	defer srv.Close()
+
+	m := fsapi.NewHTTPFS(srv.URL, false)
+	ctx := context.Background()
+
+	root, _ := m.Root()
+	node, err := root.(fs.NodeStringLookuper).Lookup(ctx, "dir")
+	assert.Nil(err)
+	dir := node.(*fsapi.Dir)
+
+	// A new file, only ever written through its handle.
+	_, handle, err := dir.Create(ctx, &fuse.CreateRequest{Name: "f", Flags: fuse.OpenWriteOnly, Mode: 0644}, &fuse.CreateResponse{})
+	assert.Nil(err)
+	write := func(data string, offset int64) error {
+		return handle.(fs.HandleWriter).Write(ctx, &fuse.WriteRequest{Data: []byte(data), Offset: offset, FileFlags: fuse.OpenWriteOnly}, &fuse.WriteResponse{})
+	}
+	assert.Nil(write("one", 0))
+
+	// The open file follows the rename.
+	assert.Nil(root.(*fsapi.Dir).Rename(ctx, &fuse.RenameRequest{OldName: "dir", NewName: "other"}, root))
+	assert.Nil(write("two", 3))
+	data, err := ioutil.ReadFile(filepath.Join(tmp.Path, "other", "f"))
+	assert.Nil(err)
+	assert.Equal("onetwo", string(data))
+
+	// Another file renamed over it isn't written through the open file.
+	assert.Nil(ioutil.WriteFile(filepath.Join(tmp.Path, "g"), []byte("three"), 0644))
+	assert.Nil(os.Rename(filepath.Join(tmp.Path, "g"), filepath.Join(tmp.Path, "other", "f")))
+	assert.Equal(fuse.Errno(syscall.ESTALE), write("four", 6))
+	data, err = ioutil.ReadFile(filepath.Join(tmp.Path, "other", "f"))
+	assert.Nil(err)
+	assert.Equal("three", string(data))
+}
@@ -0,0 +1,509 @@
+package fsapi
+
+import (
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultCacheSize is the default number of bytes of file content kept
+// in the cache.
+const DefaultCacheSize = 256 << 20
+
+// maxZeroFill is the largest extension by truncate that is recorded as
+// known zeros in a file whose content is only partially cached.
+const maxZeroFill = 64 << 20
+
+// extent is a run of known file content starting at off.
+type extent struct {
+	off  int64
+	data []byte
+}
+
+func (e extent) end() int64 {
+	return e.off + int64(len(e.data))
+}
+
+// cachedFile is the cached state of a single file or directory.
+type cachedFile struct {
+	stat fileStat
+
+	// extents holds the known content of the file, sorted by offset
+	// and never overlapping or adjacent.
+	extents []extent
+
+	// complete is set when the entire content of the file is known, so
+	// that regions not covered by an extent are holes.
+	complete bool
+
+	// dirty is set when the file has local modifications that haven't
+	// reached the server yet. Dirty files are never evicted.
+	dirty bool
+}
+
+func (cf *cachedFile) bytes() int64 {
+	var n int64
+	for _, e := range cf.extents {
+		n += int64(len(e.data))
+	}
+	return n
+}
+
+// insert records data as the content of the file at off, replacing any
+// content previously known for that range.
+func (cf *cachedFile) insert(off int64, data []byte) {
+	start, end := off, off+int64(len(data))
+	merged := append([]byte(nil), data...)
+
+	var out []extent
+	for _, e := range cf.extents {
+		if e.end() < start || e.off > end {
+			out = append(out, e)
+			continue
+		}
+		if e.off < start {
+			merged = append(append([]byte(nil), e.data[:start-e.off]...), merged...)
+			start = e.off
+		}
+		if e.end() > end {
+			merged = append(merged, e.data[end-e.off:]...)
+			end = e.end()
+		}
+	}
+
+	i := 0
+	for i < len(out) && out[i].off < start {
+		i++
+	}
+	out = append(out, extent{})
+	copy(out[i+1:], out[i:])
+	out[i] = extent{off: start, data: merged}
+
+	cf.extents = out
+}
+
+// truncate discards any known content at or beyond size.
+func (cf *cachedFile) truncate(size int64) {
+	var out []extent
+	for _, e := range cf.extents {
+		switch {
+		case e.off >= size:
+		case e.end() > size:
+			out = append(out, extent{off: e.off, data: e.data[:size-e.off]})
+		default:
+			out = append(out, e)
+		}
+	}
+	cf.extents = out
+}
+
+// read copies the content at off into buf. It reports false if any of
+// the requested range below the file size is not known.
+func (cf *cachedFile) read(buf []byte, off int64) (int, bool) {
+	size := cf.stat.size
+	if off >= size {
+		return 0, true
+	}
+
+	want := int64(len(buf))
+	if off+want > size {
+		want = size - off
+	}
+	buf = buf[:want]
+
+	for i := range buf {
+		buf[i] = 0
+	}
+
+	covered := off
+	for _, e := range cf.extents {
+		if e.end() <= off || e.off >= off+want {
+			continue
+		}
+		if e.off > covered && !cf.complete {
+			return 0, false
+		}
+		from := e.off
+		if from < off {
+			from = off
+		}
+		to := e.end()
+		if to > off+want {
+			to = off + want
+		}
+		copy(buf[from-off:to-off], e.data[from-e.off:to-e.off])
+		covered = to
+	}
+
+	if covered < off+want && !cf.complete {
+		return 0, false
+	}
+
+	return int(want), true
+}
+
+// cache keeps file metadata, directory listings and file content
+// fetched from the server, and applies local modifications on top of
+// them while the server can't be reached.
+type cache struct {
+	sync.Mutex
+	maxBytes int64
+	bytes    int64
+	files    map[string]*cachedFile
+	listings map[string]map[string]struct{}
+}
+
+func newCache(maxBytes int64) *cache {
+	if maxBytes <= 0 {
+		maxBytes = DefaultCacheSize
+	}
+	return &cache{
+		maxBytes: maxBytes,
+		files:    make(map[string]*cachedFile),
+		listings: make(map[string]map[string]struct{}),
+	}
+}
+
+// isBelow reports whether p is dir or inside it.
+func isBelow(p, dir string) bool {
+	return p == dir || dir == "/" || strings.HasPrefix(p, dir+"/")
+}
+
+func (c *cache) file(p string) *cachedFile {
+	cf, ok := c.files[p]
+	if !ok {
+		cf = &cachedFile{stat: fileStat{name: p}}
+		c.files[p] = cf
+	}
+	return cf
+}
+
+func (c *cache) account(cf *cachedFile, before int64) {
+	c.bytes += cf.bytes() - before
+	c.evict()
+}
+
+// evict drops clean file content until the cache is within its size.
+func (c *cache) evict() {
+	for _, cf := range c.files {
+		if c.bytes <= c.maxBytes {
+			return
+		}
+		if cf.dirty || len(cf.extents) == 0 {
+			continue
+		}
+		c.bytes -= cf.bytes()
+		cf.extents = nil
+		cf.complete = false
+	}
+}
+
+func (c *cache) addToListing(p string) {
+	if names, ok := c.listings[path.Dir(p)]; ok {
+		names[path.Base(p)] = struct{}{}
+	}
+}
+
+func (c *cache) removeFromListing(p string) {
+	if names, ok := c.listings[path.Dir(p)]; ok {
+		delete(names, path.Base(p))
+	}
+}
+
+// putStat records stat as the server's view of p. Cached content from a
+// different version of the file is discarded.
+func (c *cache) putStat(p string, stat fileStat) {
+	c.Lock()
+	defer c.Unlock()
+
+	cf := c.file(p)
+	if cf.dirty {
+		return
+	}
+	if cf.stat.etag != stat.etag {
+		c.bytes -= cf.bytes()
+		cf.extents = nil
+		cf.complete = stat.size == 0
+	}
+	stat.name = p
+	cf.stat = stat
+}
+
+// putListing records the entries of directory p.
+func (c *cache) putListing(p string, entries []os.FileInfo) {
+	c.Lock()
+	names := make(map[string]struct{}, len(entries))
+	for _, entry := range entries {
+		names[entry.Name()] = struct{}{}
+	}
+	c.listings[p] = names
+	c.Unlock()
+
+	for _, entry := range entries {
+		if stat, ok := entry.(fileStat); ok {
+			c.putStat(path.Join(p, entry.Name()), stat)
+		}
+	}
+}
+
+// putData records content read from the server version etag of p.
+func (c *cache) putData(p, etag string, off int64, data []byte) {
+	c.Lock()
+	defer c.Unlock()
+
+	cf, ok := c.files[p]
+	if !ok || cf.dirty || cf.stat.etag != etag {
+		return
+	}
+
+	before := cf.bytes()
+	cf.insert(off, data)
+	c.account(cf, before)
+}
+
+// invalidate forgets everything known about p, e.g. after it was
+// modified on the server.
+func (c *cache) invalidate(p string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if cf, ok := c.files[p]; ok && !cf.dirty {
+		c.bytes -= cf.bytes()
+		delete(c.files, p)
+	}
+	delete(c.listings, p)
+	delete(c.listings, path.Dir(p))
+}
+
+// stat returns the cached metadata of p. It returns os.ErrNotExist if p
+// is known not to exist and os.ErrInvalid if nothing is known about it.
+func (c *cache) stat(p string) (os.FileInfo, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if cf, ok := c.files[p]; ok && (cf.stat.etag != "" || cf.dirty) {
+		return cf.stat, nil
+	}
+	if names, ok := c.listings[path.Dir(p)]; ok {
+		if _, ok := names[path.Base(p)]; !ok {
+			return nil, os.ErrNotExist
+		}
+	}
+	return nil, os.ErrInvalid
+}
+
+// listing returns the cached entries of directory p.
+func (c *cache) listing(p string) ([]os.FileInfo, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	names, ok := c.listings[p]
+	if !ok {
+		return nil, false
+	}
+
+	var out []os.FileInfo
+	for name := range names {
+		stat := c.file(path.Join(p, name)).stat
+		stat.name = name
+		out = append(out, stat)
+	}
+	return out, true
+}
+
+// read copies cached content of p at off into buf. It reports false if
+// the content isn't cached.
+func (c *cache) read(p string, buf []byte, off int64) (int, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	cf, ok := c.files[p]
+	if !ok {
+		return 0, false
+	}
+	return cf.read(buf, off)
+}
+
+// content returns the entire locally known content of p with unknown
+// regions zero filled.
+func (c *cache) content(p string) []byte {
+	c.Lock()
+	defer c.Unlock()
+
+	cf, ok := c.files[p]
+	if !ok {
+		return nil
+	}
+	buf := make([]byte, cf.stat.size)
+	for _, e := range cf.extents {
+		if e.off < int64(len(buf)) {
+			copy(buf[e.off:], e.data)
+		}
+	}
+	return buf
+}
+
+// clean marks all local modifications as having reached the server and
+// forgets the affected metadata, which is stale now.
+func (c *cache) clean() {
+	c.Lock()
+	defer c.Unlock()
+
+	for p, cf := range c.files {
+		if cf.dirty {
+			c.bytes -= cf.bytes()
+			delete(c.files, p)
+			delete(c.listings, path.Dir(p))
+		}
+	}
+}
+
+// The methods below apply local modifications made while the server
+// is unreachable.
+
+func (c *cache) create(p string, mode os.FileMode) {
+	c.Lock()
+	defer c.Unlock()
+
+	cf := c.file(p)
+	c.bytes -= cf.bytes()
+	*cf = cachedFile{
+		stat: fileStat{
+			name:  p,
+			mode:  uint32(mode),
+			mtime: time.Now().Unix(),
+		},
+		complete: true,
+		dirty:    true,
+	}
+	c.addToListing(p)
+}
+
+func (c *cache) mkdir(p string, mode os.FileMode) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.files[p] = &cachedFile{
+		stat: fileStat{
+			name:  p,
+			mode:  uint32(os.ModeDir | mode),
+			mtime: time.Now().Unix(),
+			isdir: true,
+		},
+		complete: true,
+		dirty:    true,
+	}
+	c.listings[p] = make(map[string]struct{})
+	c.addToListing(p)
+}
+
+func (c *cache) write(p string, off int64, data []byte) {
+	c.Lock()
+	defer c.Unlock()
+
+	cf := c.file(p)
+	before := cf.bytes()
+	cf.insert(off, data)
+	if end := off + int64(len(data)); end > cf.stat.size {
+		cf.stat.size = end
+	}
+	cf.stat.mtime = time.Now().Unix()
+	cf.dirty = true
+	c.account(cf, before)
+}
+
+func (c *cache) truncate(p string, size int64) {
+	c.Lock()
+	defer c.Unlock()
+
+	cf := c.file(p)
+	before := cf.bytes()
+	if size < cf.stat.size {
+		cf.truncate(size)
+	} else if !cf.complete && size-cf.stat.size <= maxZeroFill {
+		cf.insert(cf.stat.size, make([]byte, size-cf.stat.size))
+	}
+	cf.stat.size = size
+	cf.stat.mtime = time.Now().Unix()
+	cf.dirty = true
+	c.account(cf, before)
+}
+
+func (c *cache) chmod(p string, mode os.FileMode) {
+	c.Lock()
+	defer c.Unlock()
+
+	cf := c.file(p)
+	cf.stat.mode = uint32(os.FileMode(cf.stat.mode)&os.ModeType | mode&os.ModePerm)
+	cf.dirty = true
+}
+
+func (c *cache) remove(p string) {
+	c.Lock()
+	defer c.Unlock()
+
+	for q, cf := range c.files {
+		if isBelow(q, p) {
+			c.bytes -= cf.bytes()
+			delete(c.files, q)
+		}
+	}
+	for q := range c.listings {
+		if isBelow(q, p) {
+			delete(c.listings, q)
+		}
+	}
+	c.removeFromListing(p)
+}
+
+func (c *cache) rename(from, to string) {
+	c.Lock()
+	defer c.Unlock()
+
+	for q, cf := range c.files {
+		if isBelow(q, to) {
+			c.bytes -= cf.bytes()
+			delete(c.files, q)
+		}
+	}
+	for q, cf := range c.files {
+		if isBelow(q, from) {
+			delete(c.files, q)
+			q = to + strings.TrimPrefix(q, from)
+			cf.stat.name = q
+			cf.dirty = true
+			c.files[q] = cf
+		}
+	}
+	for q, names := range c.listings {
+		if isBelow(q, from) {
+			delete(c.listings, q)
+			c.listings[to+strings.TrimPrefix(q, from)] = names
+		}
+	}
+	c.removeFromListing(from)
+	c.addToListing(to)
+}
+
+func (c *cache) link(from, to string, soft bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	cf := &cachedFile{dirty: true, complete: true}
+	if soft {
+		cf.stat = fileStat{
+			mode:  uint32(os.ModeSymlink | 0777),
+			mtime: time.Now().Unix(),
+		}
+	} else if src, ok := c.files[from]; ok {
+		cf.stat = src.stat
+		cf.extents = append([]extent(nil), src.extents...)
+		cf.complete = src.complete
+		c.bytes += cf.bytes()
+	}
+	cf.stat.name = to
+	c.files[to] = cf
+	c.addToListing(to)
+}
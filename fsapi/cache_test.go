@@ -0,0 +1,113 @@
+package fsapi
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheStat(t *testing.T) {
+	assert := assert.New(t)
+
+	c := newCache(0)
+	c.putListing("/", []os.FileInfo{
+		fileStat{name: "f", size: 3, etag: "a"},
+		fileStat{name: "d", isdir: true, etag: "b"},
+	})
+
+	fi, err := c.stat("/f")
+	if assert.Nil(err) {
+		assert.Equal(int64(3), fi.Size())
+	}
+	fi, err = c.stat("/d")
+	if assert.Nil(err) {
+		assert.True(fi.IsDir())
+	}
+	_, err = c.stat("/missing")
+	assert.Equal(os.ErrNotExist, err)
+	_, err = c.stat("/d/unknown")
+	assert.Equal(os.ErrInvalid, err)
+
+	entries, ok := c.listing("/")
+	assert.True(ok)
+	assert.Len(entries, 2)
+	_, ok = c.listing("/d")
+	assert.False(ok)
+
+	c.invalidate("/f")
+	_, err = c.stat("/f")
+	assert.Equal(os.ErrInvalid, err)
+}
+
+func TestCacheRead(t *testing.T) {
+	assert := assert.New(t)
+
+	c := newCache(0)
+	c.putStat("/f", fileStat{size: 10, etag: "a"})
+	c.putData("/f", "a", 0, []byte("01234"))
+	// Content of another version is ignored.
+	c.putData("/f", "b", 5, []byte("56789"))
+
+	buf := make([]byte, 4)
+	n, ok := c.read("/f", buf, 1)
+	assert.True(ok)
+	assert.Equal("1234", string(buf[:n]))
+	_, ok = c.read("/f", buf, 4)
+	assert.False(ok)
+
+	c.putData("/f", "a", 5, []byte("56789"))
+	n, ok = c.read("/f", buf, 4)
+	assert.True(ok)
+	assert.Equal("4567", string(buf[:n]))
+
+	// A new version on the server drops the cached content.
+	c.putStat("/f", fileStat{size: 10, etag: "b"})
+	_, ok = c.read("/f", buf, 0)
+	assert.False(ok)
+}
+
+func TestCacheEviction(t *testing.T) {
+	assert := assert.New(t)
+
+	c := newCache(8)
+	c.putStat("/f", fileStat{size: 5, etag: "a"})
+	c.putData("/f", "a", 0, []byte("01234"))
+	c.write("/g", 0, []byte("dirty"))
+
+	// Clean content makes way for more; local modifications stay.
+	buf := make([]byte, 5)
+	_, ok := c.read("/f", buf, 0)
+	assert.False(ok)
+	n, ok := c.read("/g", buf, 0)
+	assert.True(ok)
+	assert.Equal("dirty", string(buf[:n]))
+	assert.Equal(int64(5), c.bytes)
+}
+
+func TestCacheModifications(t *testing.T) {
+	assert := assert.New(t)
+
+	c := newCache(0)
+	c.putListing("/", nil)
+	c.mkdir("/d", 0755)
+	c.create("/d/f", 0644)
+	c.write("/d/f", 0, []byte("hello"))
+	c.truncate("/d/f", 4)
+	c.rename("/d", "/e")
+
+	_, err := c.stat("/d/f")
+	assert.NotNil(err)
+	assert.Equal([]byte("hell"), c.content("/e/f"))
+
+	c.link("/e/f", "/g", false)
+	assert.Equal([]byte("hell"), c.content("/g"))
+	c.remove("/e")
+	_, err = c.stat("/e")
+	assert.Equal(os.ErrNotExist, err)
+
+	// Once replayed, local modifications are forgotten.
+	c.clean()
+	_, err = c.stat("/g")
+	assert.Equal(os.ErrInvalid, err)
+}
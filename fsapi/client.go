@@ -1,20 +1,27 @@
 package fsapi
 
 import (
+	"bytes"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	//"log"
+	"mime/multipart"
 	"net/http"
 	"os"
+	pathpkg "path"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	httpfstypes "github.com/prologic/httpfs/types"
+	"github.com/prologic/httpfs/utils"
 
 	"bazil.org/fuse"
+	"golang.org/x/net/context"
 )
 
 // ErrorFromStatus ...
@@ -24,17 +31,32 @@ func ErrorFromStatus(code int) fuse.Errno {
 		return fuse.ENOENT
 	case 403:
 		return fuse.EPERM
+	case 501:
+		return fuse.ENOSYS
+	case 412:
+		return fuse.Errno(syscall.ESTALE)
 	default:
 		return fuse.EIO
 	}
 }
 
+// asErrno converts err into an errno for the kernel. Errors that are not
+// already an errno (e.g. transport errors) become EIO.
+func asErrno(err error) fuse.Errno {
+	if errno, ok := err.(fuse.Errno); ok {
+		return errno
+	}
+	return fuse.EIO
+}
+
 type fileStat struct {
 	name  string
 	size  int64
 	mode  uint32
 	mtime int64
 	isdir bool
+	etag  string
+	id    string
 }
 
 func (fs fileStat) Name() string {
@@ -65,8 +87,36 @@ func (fs fileStat) Sys() interface{} {
 type Client struct {
 	baseURL string
 	client  *http.Client
+	retry   RetryPolicy
+	mode    MountMode
+	health  *health
+	offline *offline
+	disk    *diskCache
+	misses  *misses
+
+	// compressMin enables compression of request bodies of at least
+	// that many bytes and of ranged reads.
+	compressMin int64
+
+	// verify enables end-to-end checks of data read and written
+	// against the server's hashes.
+	verify bool
+
+	// sparse keeps holes in files from being sent as zeros.
+	sparse bool
+
+	// metaTimeout and dataTimeout bound the total time spent on a
+	// metadata or data (read/write) operation, including retries.
+	metaTimeout time.Duration
+	dataTimeout time.Duration
 }
 
+// Default operation timeouts
+const (
+	DefaultMetaTimeout = 30 * time.Second
+	DefaultDataTimeout = 5 * time.Minute
+)
+
 // NewClient ...
 func NewClient(url string, tlsverify bool) *Client {
 	if strings.HasPrefix(url, "https://") {
@@ -77,19 +127,27 @@ func NewClient(url string, tlsverify bool) *Client {
 					TLSClientConfig: &tls.Config{InsecureSkipVerify: !tlsverify},
 				},
 			},
+			retry:       DefaultRetryPolicy,
+			health:      newHealth(url),
+			metaTimeout: DefaultMetaTimeout,
+			dataTimeout: DefaultDataTimeout,
 		}
 	}
 
 	return &Client{
-		baseURL: url,
-		client:  &http.Client{},
+		baseURL:     url,
+		client:      &http.Client{},
+		retry:       DefaultRetryPolicy,
+		health:      newHealth(url),
+		metaTimeout: DefaultMetaTimeout,
+		dataTimeout: DefaultDataTimeout,
 	}
 }
 
 // NewRequest ...
 func (c Client) NewRequest(method, path string, body io.Reader) *http.Request {
 	//log.Printf("client.NewRequest(%s, %s)\n", method, path)
-	req, _ := http.NewRequest(method, c.baseURL+path, body)
+	req, _ := http.NewRequest(method, c.baseURL+utils.EscapePath(path), body)
 	return req
 }
 
@@ -109,13 +167,30 @@ func (c Client) Put(path string, body io.Reader) *http.Request {
 }
 
 // Stat ...
-func (c Client) Stat(path string) (os.FileInfo, error) {
+func (c Client) Stat(ctx context.Context, path string) (os.FileInfo, error) {
+	if c.offline.active(c.health) {
+		return c.offline.stat(path)
+	}
+
+	fi, err := c.stat(ctx, path)
+	if c.offline.disconnected(c.health, err) {
+		return c.offline.stat(path)
+	}
+	if err == nil && c.offline != nil {
+		c.offline.cache.putStat(path, fi.(fileStat))
+	}
+
+	return fi, err
+}
+
+func (c Client) stat(ctx context.Context, path string) (os.FileInfo, error) {
 	//log.Printf("client.Stat(%s)\n", path)
-	r, e := c.client.Do(c.Head(path))
+	r, e := c.do(ctx, c.metaTimeout, c.Head(path))
 	if e != nil {
 		//log.Printf(" E: %s\n", e)
 		return nil, e
 	}
+	defer r.Body.Close()
 
 	//log.Printf(" status=%d\n", r.StatusCode)
 
@@ -139,55 +214,125 @@ func (c Client) Stat(path string) (os.FileInfo, error) {
 
 	//log.Printf(" size=%d mtime=%d mode=%d isdir=%b\n", size, mtime, mode, isdir,)
 
-	return fileStat{
+	fi := fileStat{
 		name:  path,
 		size:  size,
 		mode:  mode,
 		mtime: mtime,
 		isdir: isdir,
-	}, nil
+		etag:  r.Header.Get("ETag"),
+		id:    r.Header.Get(FileIDHeader),
+	}
+	if c.disk != nil {
+		c.disk.validate(path, fi)
+	}
+
+	return fi, nil
 }
 
 // Readdir ...
-func (c Client) Readdir(path string) ([]os.FileInfo, error) {
+func (c Client) Readdir(ctx context.Context, path string) ([]os.FileInfo, error) {
+	if c.offline.active(c.health) {
+		return c.offline.readdir(path)
+	}
+
+	entries, err := c.readdir(ctx, path)
+	if c.offline.disconnected(c.health, err) {
+		return c.offline.readdir(path)
+	}
+	if err == nil && c.offline != nil {
+		c.offline.cache.putListing(path, entries)
+	}
+
+	return entries, err
+}
+
+func (c Client) readdir(ctx context.Context, path string) ([]os.FileInfo, error) {
 	var (
-		out     []os.FileInfo
-		entries []httpfstypes.Entry
+		cached []httpfstypes.Entry
+		v      version
 	)
+	if c.disk != nil {
+		cached, v, _ = c.disk.listing(path)
+	}
 
-	r, e := c.client.Do(c.Get(path))
-	defer r.Body.Close()
+	entries, etag, err := c.list(ctx, path, v.ETag)
+	if err == errNotModified {
+		return fileInfos(cached), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	out := fileInfos(entries)
+	if c.disk != nil {
+		c.disk.putListing(path, version{ETag: etag}, entries)
+		for _, fi := range out {
+			c.disk.validate(pathpkg.Join(path, fi.Name()), fi)
+		}
+	}
 
+	return out, nil
+}
+
+// list fetches the entries of the directory at path and its ETag. If
+// etag is not empty and the entries haven't changed since, it returns
+// errNotModified instead.
+func (c Client) list(ctx context.Context, path, etag string) ([]httpfstypes.Entry, string, error) {
+	var entries []httpfstypes.Entry
+
+	req := c.Get(path)
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	r, e := c.do(ctx, c.metaTimeout, req)
 	if e != nil {
-		return nil, e
+		return nil, "", e
 	}
+	defer r.Body.Close()
 
+	if r.StatusCode == http.StatusNotModified {
+		return nil, etag, errNotModified
+	}
 	if r.StatusCode != http.StatusOK {
-		return nil, ErrorFromStatus(r.StatusCode)
+		return nil, "", ErrorFromStatus(r.StatusCode)
 	}
 
 	data, _ := ioutil.ReadAll(r.Body)
 
 	if err := json.Unmarshal(data, &entries); nil != err {
 		//log.Printf("Error: %s\n", err)
-		return nil, err
+		return nil, "", err
 	}
 
+	return entries, r.Header.Get("ETag"), nil
+}
+
+func fileInfos(entries []httpfstypes.Entry) []os.FileInfo {
+	var out []os.FileInfo
 	for _, entry := range entries {
 		out = append(out, fileStat{
-			name:  entry.Name,
+			name:  entry.FileName(),
 			size:  entry.Size,
 			mode:  entry.Mode,
 			mtime: entry.ModTime,
 			isdir: entry.IsDir,
+			etag:  entry.ETag,
 		})
 	}
-
-	return out, nil
+	return out
 }
 
 // Mkdir ...
-func (c Client) Mkdir(path string, perm os.FileMode) error {
+func (c Client) Mkdir(ctx context.Context, path string, perm os.FileMode) error {
+	op := offlineOp{Op: httpfstypes.EventMkdir, Path: path, Mode: uint32(perm)}
+	return c.mutate(ctx, op, func(ctx context.Context) error {
+		return c.mkdir(ctx, path, perm)
+	})
+}
+
+func (c Client) mkdir(ctx context.Context, path string, perm os.FileMode) error {
 	//log.Printf("client.Mkdir(%q, %d)\n", path, perm)
 
 	req := c.NewRequest("MKDIR", path, nil)
@@ -196,11 +341,12 @@ func (c Client) Mkdir(path string, perm os.FileMode) error {
 	q.Add("mode", fmt.Sprintf("%d", perm))
 	req.URL.RawQuery = q.Encode()
 
-	r, e := c.client.Do(req)
+	r, e := c.do(ctx, c.metaTimeout, req)
 	if e != nil {
 		//log.Printf(" E: %s\n", e)
 		return e
 	}
+	defer r.Body.Close()
 
 	if r.StatusCode != http.StatusOK {
 		return ErrorFromStatus(r.StatusCode)
@@ -210,7 +356,14 @@ func (c Client) Mkdir(path string, perm os.FileMode) error {
 }
 
 // Link ...
-func (c Client) Link(path, name string) error {
+func (c Client) Link(ctx context.Context, path, name string) error {
+	op := offlineOp{Op: httpfstypes.EventLink, Path: path, Name: name}
+	return c.mutate(ctx, op, func(ctx context.Context) error {
+		return c.link(ctx, path, name)
+	})
+}
+
+func (c Client) link(ctx context.Context, path, name string) error {
 	//log.Printf("client.Link(%s, %s)\n", path, name)
 
 	req := c.NewRequest("LINK", path, nil)
@@ -219,11 +372,12 @@ func (c Client) Link(path, name string) error {
 	q.Add("name", name)
 	req.URL.RawQuery = q.Encode()
 
-	r, e := c.client.Do(req)
+	r, e := c.do(ctx, c.metaTimeout, req)
 	if e != nil {
 		//log.Printf(" E: %s\n", e)
 		return e
 	}
+	defer r.Body.Close()
 
 	if r.StatusCode != http.StatusOK {
 		return ErrorFromStatus(r.StatusCode)
@@ -233,7 +387,14 @@ func (c Client) Link(path, name string) error {
 }
 
 // Symlink ...
-func (c Client) Symlink(target, name string) error {
+func (c Client) Symlink(ctx context.Context, target, name string) error {
+	op := offlineOp{Op: httpfstypes.EventLink, Path: target, Name: name, Soft: true}
+	return c.mutate(ctx, op, func(ctx context.Context) error {
+		return c.symlink(ctx, target, name)
+	})
+}
+
+func (c Client) symlink(ctx context.Context, target, name string) error {
 	//log.Printf("client.Symlink(%s, %s)\n", target, name)
 
 	req := c.NewRequest("LINK", target, nil)
@@ -243,11 +404,12 @@ func (c Client) Symlink(target, name string) error {
 	q.Add("soft", "1")
 	req.URL.RawQuery = q.Encode()
 
-	r, e := c.client.Do(req)
+	r, e := c.do(ctx, c.metaTimeout, req)
 	if e != nil {
 		//log.Printf(" E: %s\n", e)
 		return e
 	}
+	defer r.Body.Close()
 
 	if r.StatusCode != http.StatusOK {
 		return ErrorFromStatus(r.StatusCode)
@@ -257,38 +419,86 @@ func (c Client) Symlink(target, name string) error {
 }
 
 // Rename ...
-func (c Client) Rename(oldpath, newpath string) error {
-	//log.Printf("client.Rename(%s, %s)\n", oldpath, newpath)
+func (c Client) Rename(ctx context.Context, oldpath, newpath string) error {
+	op := offlineOp{Op: httpfstypes.EventRename, Path: oldpath, Name: newpath}
+	return c.mutate(ctx, op, func(ctx context.Context) error {
+		return c.rename(ctx, oldpath, newpath, 0)
+	})
+}
+
+// RenameFlags renames oldpath to newpath with httpfstypes.RenameNoReplace,
+// which fails with EEXIST if newpath exists, or httpfstypes.RenameExchange,
+// which atomically swaps the two. It fails with EINVAL if the server
+// can't honour flags. The point of these is atomicity, which replaying
+// them later can't provide, so they are never recorded while offline.
+// The mount can't pass the flags on (see Dir.Rename), so RenameFlags is
+// the only way to use them from the client side.
+func (c Client) RenameFlags(ctx context.Context, oldpath, newpath string, flags int) error {
+	if flags == 0 {
+		return c.Rename(ctx, oldpath, newpath)
+	}
+	err := c.rename(ctx, oldpath, newpath, flags)
+	c.invalidate(offlineOp{Op: httpfstypes.EventRename, Path: oldpath, Name: newpath})
+	return err
+}
+
+func (c Client) rename(ctx context.Context, oldpath, newpath string, flags int) error {
+	//log.Printf("client.Rename(%s, %s, %d)\n", oldpath, newpath, flags)
 
 	req := c.NewRequest("RENAME", oldpath, nil)
 
 	q := req.URL.Query()
 	q.Add("name", newpath)
+	if flags != 0 {
+		q.Add("flags", fmt.Sprintf("%d", flags))
+	}
 	req.URL.RawQuery = q.Encode()
 
-	r, e := c.client.Do(req)
+	r, e := c.do(ctx, c.metaTimeout, req)
 	if e != nil {
 		//log.Printf(" E: %s\n", e)
 		return e
 	}
+	defer r.Body.Close()
 
-	if r.StatusCode != http.StatusOK {
-		return ErrorFromStatus(r.StatusCode)
+	switch r.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusConflict:
+		if flags&httpfstypes.RenameNoReplace != 0 {
+			return fuse.Errno(syscall.EEXIST)
+		}
+	case http.StatusBadRequest, http.StatusNotImplemented:
+		if flags != 0 {
+			return fuse.Errno(syscall.EINVAL)
+		}
 	}
+	return ErrorFromStatus(r.StatusCode)
+}
 
-	return nil
+// Chmod ...
+func (c Client) Chmod(ctx context.Context, path string, mode os.FileMode) error {
+	op := offlineOp{Op: httpfstypes.EventChmod, Path: path, Mode: uint32(mode)}
+	return c.mutate(ctx, op, func(ctx context.Context) error {
+		return c.chmod(ctx, path, mode)
+	})
 }
 
-// Delete ...
-func (c Client) Delete(path string) error {
-	//log.Printf("client.Delete(%s)\n", path)
+func (c Client) chmod(ctx context.Context, path string, mode os.FileMode) error {
+	//log.Printf("client.Chmod(%s, %d)\n", path, int(mode))
+
+	req := c.NewRequest("CHMOD", path, nil)
+
+	q := req.URL.Query()
+	q.Add("mode", fmt.Sprintf("%d", mode))
+	req.URL.RawQuery = q.Encode()
 
-	req := c.NewRequest("DELETE", path, nil)
-	r, e := c.client.Do(req)
+	r, e := c.do(ctx, c.metaTimeout, req)
 	if e != nil {
 		//log.Printf(" E: %s\n", e)
 		return e
 	}
+	defer r.Body.Close()
 
 	if r.StatusCode != http.StatusOK {
 		return ErrorFromStatus(r.StatusCode)
@@ -297,21 +507,29 @@ func (c Client) Delete(path string) error {
 	return nil
 }
 
-// Chmod ...
-func (c Client) Chmod(path string, mode os.FileMode) error {
-	//log.Printf("client.Chmod(%s, %d)\n", path, int(mode))
+// Truncate ...
+func (c Client) Truncate(ctx context.Context, path string, size uint64) error {
+	op := offlineOp{Op: httpfstypes.EventTruncate, Path: path, Size: size}
+	return c.mutate(ctx, op, func(ctx context.Context) error {
+		return c.truncate(ctx, path, size)
+	})
+}
 
-	req := c.NewRequest("CHMOD", path, nil)
+func (c Client) truncate(ctx context.Context, path string, size uint64) error {
+	//log.Printf("client.Truncate(%s, %d)\n", path, size)
+
+	req := c.NewRequest("TRUNCATE", path, nil)
 
 	q := req.URL.Query()
-	q.Add("mode", fmt.Sprintf("%d", mode))
+	q.Add("size", fmt.Sprintf("%d", size))
 	req.URL.RawQuery = q.Encode()
 
-	r, e := c.client.Do(req)
+	r, e := c.do(ctx, c.metaTimeout, req)
 	if e != nil {
 		//log.Printf(" E: %s\n", e)
 		return e
 	}
+	defer r.Body.Close()
 
 	if r.StatusCode != http.StatusOK {
 		return ErrorFromStatus(r.StatusCode)
@@ -320,27 +538,243 @@ func (c Client) Chmod(path string, mode os.FileMode) error {
 	return nil
 }
 
-// Truncate ...
-func (c Client) Truncate(path string, size uint64) error {
-	//log.Printf("client.Truncate(%s, %d)\n", path, size)
+// ReadAt reads len(buf) bytes of the file at path starting at offset.
+// It returns io.EOF if offset is at or beyond the end of the file.
+func (c Client) ReadAt(ctx context.Context, path string, buf []byte, offset int64) (int, error) {
+	if c.offline.active(c.health) {
+		return c.offline.readAt(path, buf, offset)
+	}
 
-	req := c.NewRequest("TRUNCATE", path, nil)
+	var (
+		n    int
+		etag string
+		err  error
+	)
+	if c.disk != nil {
+		n, etag, err = c.disk.readAt(ctx, c, path, buf, offset)
+	} else {
+		n, etag, err = c.readAt(ctx, path, buf, offset)
+	}
+	if c.offline.disconnected(c.health, err) {
+		return c.offline.readAt(path, buf, offset)
+	}
+	if err == nil && c.offline != nil {
+		c.offline.cache.putData(path, etag, offset, buf[:n])
+	}
+
+	return n, err
+}
+
+// readAt is ReadAt without the offline and disk caches. It also returns the ETag
+// of the version of the file that was read.
+func (c Client) readAt(ctx context.Context, path string, buf []byte, offset int64) (int, string, error) {
+	req := c.Get(path)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+int64(len(buf))-1))
+	if c.sparse {
+		q := req.URL.Query()
+		q.Add("sparse", "1")
+		req.URL.RawQuery = q.Encode()
+	}
+
+	r, err := c.do(ctx, c.dataTimeout, req)
+	if err != nil {
+		//log.Printf(" E: %s\n", err)
+		return 0, "", asErrno(err)
+	}
+	defer r.Body.Close()
+
+	body, err := responseBody(r)
+	if err != nil {
+		return 0, "", asErrno(err)
+	}
+
+	switch r.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The server ignored the range, e.g. because the file is empty.
+		if _, err := io.CopyN(ioutil.Discard, body, offset); err != nil {
+			return 0, "", io.EOF
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		return 0, "", io.EOF
+	default:
+		//log.Printf(" status=%d\n", r.StatusCode)
+		return 0, "", ErrorFromStatus(r.StatusCode)
+	}
+
+	var n int
+	if boundary, ok := byteRanges(r); ok {
+		n, err = readByteRanges(multipart.NewReader(body, boundary), buf, offset)
+	} else {
+		n, err = io.ReadFull(body, buf)
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			err = nil
+		}
+	}
+	if err != nil {
+		return n, "", asErrno(err)
+	}
+
+	if err := c.verifyRead(ctx, path, r.Header.Get("ETag"), buf[:n], offset); err != nil {
+		return 0, "", err
+	}
+
+	return n, r.Header.Get("ETag"), nil
+}
+
+// WriteAt writes buf to the file at path at offset. flags and perm are
+// used to open (and possibly create) the file on the server. A negative
+// offset is relative to the end of the file.
+func (c Client) WriteAt(ctx context.Context, path string, buf []byte, flags int, perm os.FileMode, offset int64) (int, error) {
+	if flags&os.O_CREATE != 0 && c.offline.active(c.health) {
+		switch _, err := c.offline.stat(path); err {
+		case fuse.ENOENT:
+			op := offlineOp{Op: httpfstypes.EventCreate, Path: path, Mode: uint32(perm)}
+			if err := c.offline.record(op); err != nil {
+				return 0, err
+			}
+			flags &^= os.O_CREATE | os.O_EXCL
+		case nil:
+			flags &^= os.O_CREATE | os.O_EXCL
+		default:
+			// Whether path exists isn't known; let the server
+			// create it on replay if it doesn't.
+			flags &^= os.O_EXCL
+		}
+	}
+
+	n := len(buf)
+	op := offlineOp{
+		Op:     httpfstypes.EventWrite,
+		Path:   path,
+		Data:   buf,
+		Flags:  flags,
+		Mode:   uint32(perm),
+		Offset: offset,
+	}
+	err := c.mutate(ctx, op, func(ctx context.Context) (err error) {
+		n, err = c.writeAt(ctx, path, buf, flags, perm, offset)
+		return
+	})
+	return n, err
+}
+
+func (c Client) writeAt(ctx context.Context, path string, buf []byte, flags int, perm os.FileMode, offset int64) (int, error) {
+	req := c.Put(path, bytes.NewReader(buf))
+	c.setDigest(req, bytes.NewReader(buf))
+	c.compressBody(req, int64(len(buf)), func() io.Reader {
+		return bytes.NewReader(buf)
+	})
 
 	q := req.URL.Query()
-	q.Add("size", fmt.Sprintf("%d", size))
+	q.Add("flags", fmt.Sprintf("%d", flags))
+	q.Add("perm", fmt.Sprintf("%d", perm))
+	q.Add("offset", fmt.Sprintf("%d", offset))
+	if c.sparse {
+		q.Add("sparse", "1")
+	}
 	req.URL.RawQuery = q.Encode()
 
-	r, e := c.client.Do(req)
+	r, err := c.do(ctx, c.dataTimeout, req)
+	if err != nil {
+		//log.Printf(" E: %s\n", err)
+		return 0, asErrno(err)
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode == http.StatusOK {
+		return len(buf), nil
+	} else if r.StatusCode != http.StatusPartialContent {
+		//log.Printf(" status=%d\n", r.StatusCode)
+		return 0, ErrorFromStatus(r.StatusCode)
+	}
+
+	b, e := ioutil.ReadAll(r.Body)
 	if e != nil {
-		//log.Printf(" E: %s\n", e)
-		return e
+		//log.Printf(" E: error reading body: %s\n", e)
+		return 0, e
+	}
+
+	n, e := strconv.ParseInt(string(b), 10, 64)
+	if e != nil {
+		//log.Printf(" E: error parsing body: %s\n", e)
+		return 0, e
 	}
 
+	return int(n), nil
+}
+
+// Changes returns the journaled changes to path and everything below it
+// that happened after the since cursor. Pass the returned Next as since
+// on the following call.
+func (c Client) Changes(ctx context.Context, path string, since uint64) (httpfstypes.Changes, error) {
+	var changes httpfstypes.Changes
+
+	req := c.NewRequest("CHANGES", path, nil)
+
+	q := req.URL.Query()
+	q.Add("since", fmt.Sprintf("%d", since))
+	req.URL.RawQuery = q.Encode()
+
+	r, e := c.do(ctx, c.metaTimeout, req)
+	if e != nil {
+		return changes, e
+	}
+	defer r.Body.Close()
+
 	if r.StatusCode != http.StatusOK {
-		return ErrorFromStatus(r.StatusCode)
+		return changes, ErrorFromStatus(r.StatusCode)
 	}
 
-	return nil
+	if err := json.NewDecoder(r.Body).Decode(&changes); err != nil {
+		return changes, err
+	}
+
+	return changes, nil
+}
+
+// mutate performs a modification through online, or records op in the
+// offline journal if the server can't be reached.
+func (c Client) mutate(ctx context.Context, op offlineOp, online func(context.Context) error) error {
+	if c.offline == nil {
+		err := online(ctx)
+		c.invalidate(op)
+		return err
+	}
+
+	if c.offline.active(c.health) {
+		c.misses.forget(op.Path)
+		c.misses.forget(op.Name)
+		return c.offline.record(op)
+	}
+
+	op.RequestID = newRequestID()
+	err := online(withRequestID(ctx, op.RequestID))
+	if c.offline.disconnected(c.health, err) {
+		c.misses.forget(op.Path)
+		c.misses.forget(op.Name)
+		return c.offline.record(op)
+	}
+
+	c.invalidate(op)
+
+	return err
+}
+
+// invalidate forgets cached content affected by op.
+func (c Client) invalidate(op offlineOp) {
+	for _, p := range []string{op.Path, op.Name} {
+		if p == "" {
+			continue
+		}
+		c.misses.forget(p)
+		if c.offline != nil {
+			c.offline.cache.invalidate(p)
+		}
+		if c.disk != nil {
+			c.disk.invalidate(p)
+		}
+	}
 }
 
 /*
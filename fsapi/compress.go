@@ -0,0 +1,62 @@
+package fsapi
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+)
+
+// DefaultCompressMin is the default size from which request bodies are
+// compressed when compression is enabled.
+const DefaultCompressMin = 1024
+
+// CompressHeader opts a request in to a gzip encoded response, see
+// webapi.CompressHeader.
+const CompressHeader = "X-Compress"
+
+// compressBody gzip encodes the body of req, which newBody produces, if
+// compression is enabled and the body is at least compressMin bytes.
+// newBody is called again if the request has to be retried.
+func (c Client) compressBody(req *http.Request, size int64, newBody func() io.Reader) {
+	if c.compressMin <= 0 || size < c.compressMin {
+		return
+	}
+
+	open := func() (io.ReadCloser, error) {
+		pr, pw := io.Pipe()
+		go func() {
+			gz, _ := gzip.NewWriterLevel(pw, gzip.BestSpeed)
+			_, err := io.Copy(gz, newBody())
+			if err == nil {
+				err = gz.Close()
+			}
+			pw.CloseWithError(err)
+		}()
+		return pr, nil
+	}
+
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	req.Body, _ = open()
+	req.GetBody = open
+	req.ContentLength = -1
+	req.Header.Set("Content-Encoding", "gzip")
+}
+
+// acceptCompressed asks for a gzip encoded response if compression is
+// enabled. The server only compresses whole files, not ranges.
+func (c Client) acceptCompressed(req *http.Request) {
+	if c.compressMin > 0 {
+		req.Header.Set(CompressHeader, "gzip")
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+}
+
+// responseBody returns the decoded body of r.
+func responseBody(r *http.Response) (io.Reader, error) {
+	if r.Header.Get("Content-Encoding") == "gzip" && !r.Uncompressed {
+		return gzip.NewReader(r.Body)
+	}
+	return r.Body, nil
+}
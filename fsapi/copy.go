@@ -0,0 +1,54 @@
+package fsapi
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"golang.org/x/net/context"
+)
+
+// Copy copies the file at src to dst on the server, without the data
+// passing through the client. A negative length copies the whole file,
+// replacing dst; otherwise length bytes from srcOffset are written to
+// dst at dstOffset, like copy_file_range(2). It returns the number of
+// bytes copied.
+//
+// Copy is only available to users of the client API: the FUSE library
+// the mount is built on has no copy_file_range(2) request, so copies
+// made through the mount still read and write all of the data.
+func (c Client) Copy(ctx context.Context, src, dst string, srcOffset, dstOffset, length int64) (int64, error) {
+	req := c.NewRequest("COPY", src, nil)
+
+	q := req.URL.Query()
+	q.Add("name", dst)
+	if length >= 0 {
+		q.Add("offset", fmt.Sprintf("%d", srcOffset))
+		q.Add("length", fmt.Sprintf("%d", length))
+		q.Add("destoffset", fmt.Sprintf("%d", dstOffset))
+	}
+	req.URL.RawQuery = q.Encode()
+
+	r, e := c.do(ctx, c.dataTimeout, req)
+	if e != nil {
+		return 0, asErrno(e)
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		return 0, ErrorFromStatus(r.StatusCode)
+	}
+
+	b, e := ioutil.ReadAll(r.Body)
+	if e != nil {
+		return 0, asErrno(e)
+	}
+	n, e := strconv.ParseInt(string(b), 10, 64)
+	if e != nil {
+		return 0, asErrno(e)
+	}
+
+	c.invalidate(offlineOp{Path: dst})
+	return n, nil
+}
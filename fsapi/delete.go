@@ -0,0 +1,100 @@
+package fsapi
+
+import (
+	//"log"
+	"net/http"
+	"syscall"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+
+	httpfstypes "github.com/prologic/httpfs/types"
+)
+
+// Delete removes path, and if it is a directory everything in it.
+func (c Client) Delete(ctx context.Context, path string) error {
+	op := offlineOp{Op: httpfstypes.EventRemove, Path: path, Recursive: true}
+	return c.mutate(ctx, op, func(ctx context.Context) error {
+		return c.remove(ctx, "DELETE", path)
+	})
+}
+
+// Unlink removes path, which must not be a directory.
+func (c Client) Unlink(ctx context.Context, path string) error {
+	op := offlineOp{Op: httpfstypes.EventRemove, Path: path}
+	return c.mutate(ctx, op, func(ctx context.Context) error {
+		return c.remove(ctx, "UNLINK", path)
+	})
+}
+
+// Rmdir removes the empty directory path.
+func (c Client) Rmdir(ctx context.Context, path string) error {
+	op := offlineOp{Op: httpfstypes.EventRemove, Path: path, Dir: true}
+	return c.mutate(ctx, op, func(ctx context.Context) error {
+		return c.remove(ctx, "RMDIR", path)
+	})
+}
+
+// remove removes path with method, one of UNLINK, RMDIR or DELETE
+// (which is recursive).
+func (c Client) remove(ctx context.Context, method, path string) error {
+	//log.Printf("client.remove(%s, %s)\n", method, path)
+
+	req := c.NewRequest(method, path, nil)
+	if method == "DELETE" {
+		q := req.URL.Query()
+		q.Set("recursive", "1")
+		req.URL.RawQuery = q.Encode()
+	}
+
+	r, e := c.do(ctx, c.metaTimeout, req)
+	if e != nil {
+		//log.Printf(" E: %s\n", e)
+		return e
+	}
+	defer r.Body.Close()
+
+	switch r.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusBadRequest:
+		if method == "UNLINK" {
+			return fuse.Errno(syscall.EISDIR)
+		}
+		if method == "RMDIR" {
+			return fuse.Errno(syscall.ENOTDIR)
+		}
+	case http.StatusConflict:
+		return fuse.Errno(syscall.ENOTEMPTY)
+	case http.StatusMethodNotAllowed:
+		if method != "DELETE" {
+			return c.removeLegacy(ctx, method, path)
+		}
+	}
+	return ErrorFromStatus(r.StatusCode)
+}
+
+// removeLegacy removes path like remove on a server from before UNLINK
+// and RMDIR were added, whose DELETE removes everything. The kind of
+// path is checked first, at the risk of a race with other clients.
+func (c Client) removeLegacy(ctx context.Context, method, path string) error {
+	fi, err := c.stat(ctx, path)
+	if err != nil {
+		return err
+	}
+	switch {
+	case method == "UNLINK" && fi.IsDir():
+		return fuse.Errno(syscall.EISDIR)
+	case method == "RMDIR" && !fi.IsDir():
+		return fuse.Errno(syscall.ENOTDIR)
+	case method == "RMDIR":
+		entries, err := c.readdir(ctx, path)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return fuse.Errno(syscall.ENOTEMPTY)
+		}
+	}
+	return c.remove(ctx, "DELETE", path)
+}
@@ -0,0 +1,283 @@
+package fsapi
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	//"log"
+	"net/http"
+	"os"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+
+	httpfstypes "github.com/prologic/httpfs/types"
+	"github.com/prologic/httpfs/utils"
+)
+
+// DefaultDeltaBlockSize is the default block size of delta transfers.
+const DefaultDeltaBlockSize = 64 << 10
+
+// maxLiteral is the most new data sent in a single delta instruction.
+const maxLiteral = 64 << 10
+
+// errStale is returned by ApplyDelta if the file changed on the server
+// since its signature was taken.
+var errStale = errors.New("file changed since its signature was taken")
+
+// Signature returns the block signature of the file at path.
+func (c Client) Signature(ctx context.Context, path string, blockSize int64) (httpfstypes.Signature, error) {
+	var sig httpfstypes.Signature
+
+	req := c.NewRequest("SIGNATURE", path, nil)
+
+	q := req.URL.Query()
+	q.Add("blocksize", fmt.Sprintf("%d", blockSize))
+	req.URL.RawQuery = q.Encode()
+
+	r, e := c.do(ctx, c.dataTimeout, req)
+	if e != nil {
+		return sig, asErrno(e)
+	}
+	defer r.Body.Close()
+
+	switch r.StatusCode {
+	case http.StatusOK:
+	case http.StatusMethodNotAllowed:
+		// A server from before delta transfers were added.
+		return sig, fuse.ENOSYS
+	default:
+		return sig, ErrorFromStatus(r.StatusCode)
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&sig); err != nil {
+		return sig, fuse.EIO
+	}
+	return sig, nil
+}
+
+// ApplyDelta replaces the content of the file at path, whose signature
+// is sig, with the size bytes of r. Only the parts of r not found in the
+// file are sent. It returns errStale if the file has changed since the
+// signature was taken, and otherwise the SHA-256 of the new content as
+// computed by the server.
+func (c Client) ApplyDelta(ctx context.Context, path string, sig httpfstypes.Signature, r io.ReaderAt, size int64) ([]byte, error) {
+	newBody := func() io.Reader {
+		pr, pw := io.Pipe()
+		go func() {
+			enc := json.NewEncoder(pw)
+			pw.CloseWithError(computeDelta(sig, r, size, func(op httpfstypes.DeltaOp) error {
+				return enc.Encode(op)
+			}))
+		}()
+		return pr
+	}
+
+	req := c.NewRequest("DELTA", path, newBody())
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(newBody()), nil
+	}
+	req.Header.Set("If-Match", sig.ETag)
+	c.compressBody(req, size, newBody)
+
+	resp, e := c.do(ctx, c.dataTimeout, req)
+	if e != nil {
+		return nil, asErrno(e)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusPreconditionFailed:
+		return nil, errStale
+	default:
+		return nil, ErrorFromStatus(resp.StatusCode)
+	}
+
+	b, e := ioutil.ReadAll(resp.Body)
+	if e != nil {
+		return nil, asErrno(e)
+	}
+	c.invalidate(offlineOp{Path: path})
+
+	sum, e := hex.DecodeString(string(b))
+	if e != nil {
+		return nil, fuse.EIO
+	}
+	return sum, nil
+}
+
+// SyncFile replaces the content of the file at path with the size bytes
+// of r like Upload, but sends only the blocks of blockSize bytes that
+// the server doesn't have already (in the style of rsync). It falls
+// back to Upload for new files and if the server doesn't support delta
+// transfers.
+func (c Client) SyncFile(ctx context.Context, path string, r io.ReaderAt, size int64, perm os.FileMode, blockSize int64) error {
+	sig, err := c.Signature(ctx, path, blockSize)
+	switch err {
+	case nil:
+	case fuse.ENOENT, fuse.ENOSYS:
+		return c.Upload(ctx, path, r, size, perm)
+	default:
+		return err
+	}
+	if len(sig.Blocks) == 0 {
+		return c.Upload(ctx, path, r, size, perm)
+	}
+
+	sum, err := c.ApplyDelta(ctx, path, sig, r, size)
+	if err == errStale {
+		//log.Printf(" %s changed while syncing it, uploading it whole\n", path)
+		return c.Upload(ctx, path, r, size, perm)
+	}
+	if err != nil {
+		return err
+	}
+
+	if c.verify {
+		h := sha256.New()
+		if _, err := io.Copy(h, io.NewSectionReader(r, 0, size)); err != nil {
+			return err
+		}
+		if !bytes.Equal(sum, h.Sum(nil)) {
+			return fuse.EIO
+		}
+	}
+	return nil
+}
+
+// deltaWriter collects delta instructions, merging adjacent copies and
+// batching literal data.
+type deltaWriter struct {
+	emit func(httpfstypes.DeltaOp) error
+	copy httpfstypes.DeltaOp
+	lit  []byte
+}
+
+func (d *deltaWriter) flush() error {
+	if d.copy.Length > 0 {
+		if err := d.emit(d.copy); err != nil {
+			return err
+		}
+		d.copy = httpfstypes.DeltaOp{}
+	}
+	if len(d.lit) > 0 {
+		if err := d.emit(httpfstypes.DeltaOp{Data: d.lit}); err != nil {
+			return err
+		}
+		d.lit = nil
+	}
+	return nil
+}
+
+func (d *deltaWriter) copyBlock(offset, length int64) error {
+	if len(d.lit) == 0 && d.copy.Length > 0 && d.copy.Offset+d.copy.Length == offset {
+		d.copy.Length += length
+		return nil
+	}
+	if err := d.flush(); err != nil {
+		return err
+	}
+	d.copy = httpfstypes.DeltaOp{Offset: offset, Length: length}
+	return nil
+}
+
+func (d *deltaWriter) literal(b ...byte) error {
+	if d.copy.Length > 0 {
+		if err := d.flush(); err != nil {
+			return err
+		}
+	}
+	d.lit = append(d.lit, b...)
+	if len(d.lit) >= maxLiteral {
+		return d.flush()
+	}
+	return nil
+}
+
+// computeDelta passes to emit the instructions that turn the file with
+// signature sig into the size bytes of r. A window of the block size is
+// slid over r; wherever it holds one of the file's blocks, as told by
+// the rolling checksum and confirmed by the strong hash, the block is
+// copied, and bytes that aren't part of any block are sent as they are.
+func computeDelta(sig httpfstypes.Signature, r io.ReaderAt, size int64, emit func(httpfstypes.DeltaOp) error) error {
+	bs := sig.BlockSize
+	index := make(map[uint32][]int)
+	for i, b := range sig.Blocks {
+		// Only full blocks can be found with a full window.
+		if int64(i+1)*bs <= sig.Size {
+			index[b.Weak] = append(index[b.Weak], i)
+		}
+	}
+
+	d := &deltaWriter{emit: emit}
+	br := bufio.NewReaderSize(io.NewSectionReader(r, 0, size), 1<<20)
+
+	fill := func() ([]byte, error) {
+		win := make([]byte, bs)
+		n, err := io.ReadFull(br, win)
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			err = nil
+		}
+		return win[:n], err
+	}
+
+	win, err := fill()
+	if err != nil {
+		return err
+	}
+	roll := utils.NewRolling(win)
+
+	for int64(len(win)) == bs {
+		if i, ok := findBlock(sig, index, roll.Sum(), win); ok {
+			if err := d.copyBlock(int64(i)*bs, bs); err != nil {
+				return err
+			}
+			if win, err = fill(); err != nil {
+				return err
+			}
+			roll = utils.NewRolling(win)
+			continue
+		}
+
+		in, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		out := win[0]
+		if err := d.literal(out); err != nil {
+			return err
+		}
+		win = append(win[1:], in)
+		roll.Roll(out, in)
+	}
+
+	if err := d.literal(win...); err != nil {
+		return err
+	}
+	return d.flush()
+}
+
+// findBlock returns the index of the block of sig whose content is win.
+func findBlock(sig httpfstypes.Signature, index map[uint32][]int, weak uint32, win []byte) (int, bool) {
+	candidates, ok := index[weak]
+	if !ok {
+		return 0, false
+	}
+	strong := sha256.Sum256(win)
+	for _, i := range candidates {
+		if bytes.Equal(sig.Blocks[i].Strong, strong[:]) {
+			return i, true
+		}
+	}
+	return 0, false
+}
@@ -4,7 +4,6 @@ import (
 	//"log"
 	"os"
 	"path/filepath"
-	"strings"
 	"sync"
 
 	"bazil.org/fuse"
@@ -20,6 +19,7 @@ var _ fs.NodeRenamer = (*Dir)(nil)
 var _ fs.NodeLinker = (*Dir)(nil)
 var _ fs.NodeSymlinker = (*Dir)(nil)
 var _ fs.NodeStringLookuper = (*Dir)(nil)
+var _ fs.NodeForgetter = (*Dir)(nil)
 
 // Dir ...
 type Dir struct {
@@ -27,10 +27,24 @@ type Dir struct {
 	attr fuse.Attr
 
 	path   string
+	id     string
 	fs     *HTTPFS
 	parent *Dir
 }
 
+// Path returns the path of d on the server, which follows d when it is
+// renamed.
+func (d *Dir) Path() string {
+	d.fs.nodesLock.Lock()
+	defer d.fs.nodesLock.Unlock()
+	return d.path
+}
+
+// Forget ...
+func (d *Dir) Forget() {
+	d.fs.untrack(d)
+}
+
 // Attr ...
 func (d *Dir) Attr(ctx context.Context, o *fuse.Attr) error {
 	d.RLock()
@@ -39,45 +53,46 @@ func (d *Dir) Attr(ctx context.Context, o *fuse.Attr) error {
 	return nil
 }
 
-var ignoreNames = map[string]struct{}{
-	"DCIM":                                {},
-	"Backups.backupdb":                    {},
-	".Spotlight-V100":                     {},
-	"mach_kernel":                         {},
-	".metadata_never_index":               {},
-	".metadata_never_index_unless_rootfs": {},
-	".DS_Store":                           {},
-	".localized":                          {},
-	".hidden":                             {},
-	"._.":                                 {},
-}
-
 // Lookup ...
 func (d *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
-	if _, ignore := ignoreNames[name]; !ignore && !strings.HasPrefix(name, "._") {
+	if d.fs.versions && d.Path() == "/" && name == VersionsDir {
+		return d.fs.newVersionsDir("/"), nil
+	}
+
+	// Ignored names are never looked up on the server, and neither are
+	// names recently found missing.
+	misses := d.fs.client.misses
+	if p := filepath.Join(d.Path(), name); !d.fs.ignored(p) && !misses.has(p) {
 		//log.Printf("dir.Lookup(%s)\n", name)
 
 		d.RLock()
 		defer d.RUnlock()
 
-		path := filepath.Join(d.path, name)
+		path, stats, err := d.resolve(ctx, name)
 		//log.Printf(" path=%s\n", path)
-		stats, err := d.fs.client.Stat(path)
+		if err == fuse.ENOENT {
+			misses.add(path)
+		}
 		if err != nil {
 			//log.Printf(" E: %s\n", err)
-			return nil, fuse.ENOENT
+			return nil, asErrno(err)
+		}
+
+		if node := d.fs.tracked(path, stats); node != nil {
+			//log.Printf(" -> Known node\n")
+			return node, nil
 		}
 
 		switch {
 		case stats.IsDir():
 			//log.Printf(" -> Directory\n")
-			return d.fs.newDir(path, stats.Mode()), nil
+			return d.fs.newDir(path, stats.Mode(), fileIDOf(stats)), nil
 		case stats.Mode()&os.ModeSymlink == os.ModeSymlink:
 			//log.Printf(" -> Symlink\n")
-			return d.fs.newFile(path, stats.Mode()), nil
+			return d.fs.newFile(path, stats.Mode(), fileIDOf(stats)), nil
 		case stats.Mode().IsRegular():
 			//log.Printf(" -> File\n")
-			return d.fs.newFile(path, stats.Mode()), nil
+			return d.fs.newFile(path, stats.Mode(), fileIDOf(stats)), nil
 		default:
 			panic("Unknown type in filesystem")
 		}
@@ -88,19 +103,34 @@ func (d *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
 
 // ReadDirAll ...
 func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
-	//log.Printf("dir.ReadDirAll(%s)\n", d.path)
+	//log.Printf("dir.ReadDirAll(%s)\n", d.Path())
 
 	d.RLock()
+	defer d.RUnlock()
+
 	var out []fuse.Dirent
 
-	files, err := d.fs.client.Readdir(d.path)
+	files, err := d.fs.client.Readdir(ctx, d.Path())
 	if err != nil {
 		//log.Printf(" E: %s\n", err)
 		return nil, err
 	}
 
+	seen := make(map[string]bool)
 	for _, node := range files {
-		de := fuse.Dirent{Name: node.Name()}
+		if d.fs.ignored(filepath.Join(d.Path(), node.Name())) {
+			continue
+		}
+		name := d.fs.names.Normalize(node.Name())
+		key := d.fs.names.Key(name)
+		if seen[key] {
+			// Only the first of the names that are equal under the
+			// name rules can be looked up.
+			//log.Printf(" skipping %q: name collision\n", node.Name())
+			continue
+		}
+		seen[key] = true
+		de := fuse.Dirent{Name: name}
 		if node.IsDir() {
 			de.Type = fuse.DT_Dir
 		} else if node.Mode()&os.ModeSymlink == os.ModeSymlink {
@@ -112,7 +142,6 @@ func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 		out = append(out, de)
 	}
 
-	d.RUnlock()
 	return out, nil
 }
 
@@ -121,15 +150,15 @@ func (d *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error
 	d.Lock()
 	defer d.Unlock()
 	//log.Printf(" req=%+v\n", req)
-	if exists := d.exists(req.Name); exists {
+	if exists := d.exists(ctx, req.Name); exists {
 		//log.Println(" E: directory already exists")
 		return nil, fuse.EEXIST
 	}
 
-	path := filepath.Join(d.path, req.Name)
-	n := d.fs.newDir(path, req.Mode)
+	path := filepath.Join(d.Path(), d.fs.names.Normalize(req.Name))
+	n := d.fs.newDir(path, req.Mode, "")
 
-	if err := d.fs.client.Mkdir(path, req.Mode); err != nil {
+	if err := d.fs.client.Mkdir(ctx, path, req.Mode); err != nil {
 		//log.Printf(" E: %s\n", err)
 		return nil, err
 	}
@@ -142,36 +171,47 @@ func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.Cr
 
 	d.Lock()
 	defer d.Unlock()
-	if exists := d.exists(req.Name); exists {
+	if exists := d.exists(ctx, req.Name); exists {
 		//log.Println(" E: file or directory already exists!")
 		return nil, nil, fuse.EEXIST
 	}
 
-	path := filepath.Join(d.path, req.Name)
+	path := filepath.Join(d.Path(), d.fs.names.Normalize(req.Name))
 
-	f := d.fs.newFile(path, req.Mode)
+	f := d.fs.newFile(path, req.Mode, "")
 	f.created = true
 	f.fs = d.fs
 
-	handle := Handle{
+	handle := &Handle{
 		f:     f,
-		path:  path,
 		flags: int(req.Flags),
 		perm:  req.Mode,
 
 		client: d.fs.client,
+		atomic: d.fs.atomic,
+
+		partSize:    d.fs.partSize,
+		concurrency: d.fs.concurrency,
 	}
 
-	f.handle = &handle
+	c := d.fs.client
+	if d.fs.wholeFile.wants(0) && !c.offline.active(c.health) {
+		if err := handle.create(d.fs.wholeFile); err != nil {
+			//log.Printf(" E: %s\n", err)
+			return nil, nil, asErrno(err)
+		}
+	}
+
+	f.handles = append(f.handles, handle)
 
 	resp.Attr = f.attr
 
-	return f, f, nil
+	return f, handle, nil
 }
 
 // Link ...
 func (d *Dir) Link(ctx context.Context, req *fuse.LinkRequest, old fs.Node) (newNode fs.Node, err error) {
-	//log.Printf("dir.Link(%q, %q)\n", d.path, req.NewName)
+	//log.Printf("dir.Link(%q, %q)\n", d.Path(), req.NewName)
 
 	nd := newNode.(*Dir)
 
@@ -192,14 +232,14 @@ func (d *Dir) Link(ctx context.Context, req *fuse.LinkRequest, old fs.Node) (new
 		defer d.Unlock()
 	}
 
-	if exists := d.exists(req.NewName); !exists {
+	if exists := d.exists(ctx, req.NewName); !exists {
 		//log.Printf(" E: link exists\n")
 		return nil, fuse.ENOENT
 	}
 
-	newPath := filepath.Join(nd.path, req.NewName)
+	newPath := filepath.Join(nd.Path(), d.fs.names.Normalize(req.NewName))
 
-	if err := d.fs.client.Link(d.path, newPath); err != nil {
+	if err := d.fs.client.Link(ctx, d.Path(), newPath); err != nil {
 		//log.Printf(" E: %s\n", err)
 		return nil, err
 	}
@@ -231,15 +271,15 @@ func (d *Dir) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (fs.Node, e
 		defer d.Unlock()
 	}
 
-	if exists := d.exists(req.NewName); exists {
+	if exists := d.exists(ctx, req.NewName); exists {
 		//log.Printf(" E: link exists\n")
 		return nil, fuse.ENOENT
 	}
 
-	targetPath := filepath.Join(d.path, req.Target)
-	newPath := filepath.Join(nd.path, req.NewName)
+	targetPath := filepath.Join(d.Path(), req.Target)
+	newPath := filepath.Join(nd.Path(), d.fs.names.Normalize(req.NewName))
 
-	if err := d.fs.client.Symlink(targetPath, newPath); err != nil {
+	if err := d.fs.client.Symlink(ctx, targetPath, newPath); err != nil {
 		//log.Printf(" E: %s\n", err)
 		return nil, err
 	}
@@ -248,6 +288,11 @@ func (d *Dir) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (fs.Node, e
 }
 
 // Rename ...
+//
+// The FUSE library only speaks the original rename request, without
+// flags, so the kernel itself fails renameat2(2) with RENAME_NOREPLACE
+// or RENAME_EXCHANGE with EINVAL rather than risk a plain rename. Use
+// Client.RenameFlags for those.
 func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
 	//log.Printf("dir.Rename(%s, %s)\n", req.OldName, req.NewName)
 
@@ -270,18 +315,18 @@ func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Nod
 		defer d.Unlock()
 	}
 
-	if exists := d.exists(req.OldName); !exists {
+	oldPath, _, err := d.resolve(ctx, req.OldName)
+	if err != nil {
 		//log.Println(" E: no such file or directory")
 		return fuse.ENOENT
 	}
+	newPath := filepath.Join(nd.Path(), d.fs.names.Normalize(req.NewName))
 
-	oldPath := filepath.Join(d.path, req.OldName)
-	newPath := filepath.Join(nd.path, req.NewName)
-
-	if err := d.fs.client.Rename(oldPath, newPath); err != nil {
+	if err := d.fs.client.Rename(ctx, oldPath, newPath); err != nil {
 		//log.Printf(" E: %s\n", err)
 		return err
 	}
+	d.fs.move(oldPath, newPath)
 
 	return nil
 }
@@ -295,7 +340,8 @@ func (d *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
 
 	//log.Printf(" req=%q\n", req)
 
-	if exists := d.exists(req.Name); !exists {
+	path, _, err := d.resolve(ctx, req.Name)
+	if err != nil {
 		//log.Printf(" E: no such flie or directory\n")
 		return fuse.ENOENT
 	}
@@ -304,21 +350,63 @@ func (d *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
 	// 	return fuse.ENOENT
 	// }
 
-	path := filepath.Join(d.path, req.Name)
-	if err := d.fs.client.Delete(path); err != nil {
+	remove := d.fs.client.Unlink
+	if req.Dir {
+		remove = d.fs.client.Rmdir
+	}
+	if err := remove(ctx, path); err != nil {
 		//log.Printf(" E: %s\n", err)
 		return err
 	}
+	d.fs.forget(path)
 
 	return nil
 }
 
-func (d *Dir) exists(name string) bool {
-	path := filepath.Join(d.path, name)
-	_, err := d.fs.client.Stat(path)
+func (d *Dir) exists(ctx context.Context, name string) bool {
+	_, _, err := d.resolve(ctx, name)
 	if err != nil {
 		return false
 	}
 
 	return true
 }
+
+// resolve returns the path and attributes of the entry of d that name
+// refers to. Under the name rules of the filesystem, a name that doesn't
+// exist as it is refers to the first entry listed that is equal to it,
+// which is the one ReadDirAll presents. The listing is remembered along
+// with the misses, so that looking up many missing names doesn't list
+// d each time.
+func (d *Dir) resolve(ctx context.Context, name string) (string, os.FileInfo, error) {
+	path := filepath.Join(d.Path(), name)
+	stats, err := d.fs.client.Stat(ctx, path)
+	if err != fuse.ENOENT || d.fs.names == nil {
+		return path, stats, err
+	}
+
+	misses := d.fs.client.misses
+	key := d.fs.names.Key(name)
+	match, ok := misses.lookupKey(d.Path(), key)
+	if !ok {
+		files, lerr := d.fs.client.Readdir(ctx, d.Path())
+		if lerr != nil {
+			return path, nil, err
+		}
+		names := make(map[string]string, len(files))
+		for _, node := range files {
+			if k := d.fs.names.Key(node.Name()); names[k] == "" {
+				names[k] = node.Name()
+			}
+		}
+		misses.addKeys(d.Path(), names)
+		match = names[key]
+	}
+	if match == "" || match == name {
+		return path, nil, err
+	}
+
+	path = filepath.Join(d.Path(), match)
+	stats, err = d.fs.client.Stat(ctx, path)
+	return path, stats, err
+}
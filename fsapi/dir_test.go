@@ -0,0 +1,112 @@
+package fsapi
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+
+	"github.com/prologic/httpfs/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLookupRemembersMisses(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newTestServer(t)
+	defer s.Close()
+	m := NewHTTPFS(s.srv.URL, false)
+
+	ctx := context.Background()
+	_, err := m.root.Lookup(ctx, "f")
+	assert.Equal(fuse.ENOENT, err)
+
+	// Created elsewhere: the miss is remembered for a while.
+	s.write(t, "f", "one")
+	_, err = m.root.Lookup(ctx, "f")
+	assert.Equal(fuse.ENOENT, err)
+
+	// Created through the mount: it is forgotten at once.
+	_, err = m.client.WriteAt(ctx, "/f", []byte("two"), os.O_WRONLY|os.O_CREATE, 0644, 0)
+	assert.Nil(err)
+	node, err := m.root.Lookup(ctx, "f")
+	assert.Nil(err)
+	assert.IsType(&File{}, node)
+
+	// Without remembering misses.
+	m = NewHTTPFS(s.srv.URL, false, WithMissTTL(0))
+	_, err = m.root.Lookup(ctx, "g")
+	assert.Equal(fuse.ENOENT, err)
+	s.write(t, "g", "one")
+	_, err = m.root.Lookup(ctx, "g")
+	assert.Nil(err)
+}
+
+func TestIgnoreListingMatchesLookup(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newTestServer(t)
+	defer s.Close()
+	s.write(t, "build", "not a directory")
+	s.write(t, "f", "")
+	m := NewHTTPFS(s.srv.URL, false, WithIgnore(utils.NewIgnore("build/")))
+
+	// A name that can't be looked up isn't listed either.
+	ctx := context.Background()
+	_, err := m.root.Lookup(ctx, "build")
+	assert.Equal(fuse.ENOENT, err)
+
+	entries, err := m.root.ReadDirAll(ctx)
+	assert.Nil(err)
+	assert.Equal([]fuse.Dirent{{Name: "f", Type: fuse.DT_File}}, entries)
+}
+
+func TestLookupNormalizedNames(t *testing.T) {
+	assert := assert.New(t)
+
+	var listings int32
+	s := newTestServer(t)
+	defer s.Close()
+	h := s.srv.Config.Handler
+	s.srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/") {
+			atomic.AddInt32(&listings, 1)
+		}
+		h.ServeHTTP(w, r)
+	})
+	s.write(t, "Foo", "one")
+
+	names, err := utils.NewNormalizer("", true)
+	assert.Nil(err)
+	m := NewHTTPFS(s.srv.URL, false, WithNormalizer(names))
+
+	ctx := context.Background()
+	node, err := m.root.Lookup(ctx, "foo")
+	assert.Nil(err)
+	assert.Equal("/Foo", node.(*File).Path())
+	assert.EqualValues(1, atomic.LoadInt32(&listings))
+
+	// Other missing names are looked up in the same listing.
+	for _, name := range []string{"bar", "baz", "FOO"} {
+		_, err = m.root.Lookup(ctx, name)
+		if name == "FOO" {
+			assert.Nil(err)
+		} else {
+			assert.Equal(fuse.ENOENT, err)
+		}
+	}
+	assert.EqualValues(1, atomic.LoadInt32(&listings))
+
+	// Until something is created in the directory.
+	_, err = m.client.WriteAt(ctx, "/Bar", []byte("two"), os.O_WRONLY|os.O_CREATE, 0644, 0)
+	assert.Nil(err)
+	node, err = m.root.Lookup(ctx, "BAR")
+	assert.Nil(err)
+	assert.Equal("/Bar", node.(*File).Path())
+	assert.EqualValues(2, atomic.LoadInt32(&listings))
+}
@@ -0,0 +1,607 @@
+package fsapi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	httpfstypes "github.com/prologic/httpfs/types"
+
+	"golang.org/x/net/context"
+)
+
+// CacheMode selects the granularity of the disk cache.
+type CacheMode int
+
+// Disk cache modes
+const (
+	// BlockCache fetches and caches files in blocks of
+	// DiskCacheBlockSize as they are read.
+	BlockCache CacheMode = iota
+
+	// FileCache fetches and caches the whole file on the first read.
+	FileCache
+)
+
+// ParseCacheMode parses "block" or "file".
+func ParseCacheMode(s string) (CacheMode, error) {
+	switch s {
+	case "block":
+		return BlockCache, nil
+	case "file":
+		return FileCache, nil
+	default:
+		return BlockCache, fmt.Errorf("invalid cache mode %q (expected block or file)", s)
+	}
+}
+
+func (m CacheMode) String() string {
+	if m == FileCache {
+		return "file"
+	}
+	return "block"
+}
+
+// Disk cache defaults
+const (
+	DiskCacheBlockSize   = 1 << 20
+	DefaultDiskCacheSize = 4 << 30
+
+	diskCacheIndex         = "index.json"
+	diskCacheFlushInterval = 5 * time.Second
+
+	// diskCacheValidity is how long cached content is served after it
+	// was last checked against the server's metadata.
+	diskCacheValidity = time.Second
+)
+
+// errNotModified is returned by list if the cached listing is current.
+var errNotModified = errors.New("not modified")
+
+// version identifies the content of a file or directory on the server.
+type version struct {
+	ETag  string `json:",omitempty"`
+	Size  int64
+	Mtime int64
+}
+
+func versionOf(fi os.FileInfo) version {
+	v := version{Size: fi.Size(), Mtime: fi.ModTime().Unix()}
+	if stat, ok := fi.(fileStat); ok {
+		v.ETag = stat.etag
+	}
+	return v
+}
+
+// matches compares by ETag if both sides have one and by size and mtime
+// otherwise.
+func (v version) matches(o version) bool {
+	if v.ETag != "" && o.ETag != "" {
+		return v.ETag == o.ETag
+	}
+	return v.Size == o.Size && v.Mtime == o.Mtime
+}
+
+// sameETag reports whether content served with etag belongs to v.
+func (v version) sameETag(etag string) bool {
+	return v.ETag == "" || etag == "" || v.ETag == etag
+}
+
+// diskEntry is the index record of one cached file or directory
+// listing. The content lives in a file called Name in the cache
+// directory: a sparse copy of the file or the listing as JSON.
+type diskEntry struct {
+	Version  version
+	Name     string
+	Dir      bool   `json:",omitempty"`
+	Blocks   []byte `json:",omitempty"`
+	Complete bool   `json:",omitempty"`
+	Bytes    int64
+	Atime    int64
+
+	// checked is when Version was last found to match the server.
+	// It isn't saved, so content cached by an earlier mount is
+	// checked before it is served.
+	checked time.Time
+}
+
+func (e *diskEntry) hasBlock(i int64) bool {
+	if e.Complete {
+		return true
+	}
+	return i/8 < int64(len(e.Blocks)) && e.Blocks[i/8]&(1<<uint(i%8)) != 0
+}
+
+func (e *diskEntry) setBlock(i int64) {
+	for int64(len(e.Blocks)) <= i/8 {
+		e.Blocks = append(e.Blocks, 0)
+	}
+	e.Blocks[i/8] |= 1 << uint(i%8)
+}
+
+// diskCache keeps file content and directory listings fetched from the
+// server in a local directory so they survive remounts. File content is
+// validated against the server's metadata whenever it is fetched, and
+// before it is served if that was more than diskCacheValidity ago.
+// Listings are revalidated by their ETag, which the server derives from
+// the entries, on every read. The least recently used entries are
+// evicted once the cache grows beyond maxBytes.
+//
+// The index is only written after the content files it refers to have
+// been synced, and is replaced atomically, so a crash loses at most the
+// most recently cached data but never yields corrupt content.
+type diskCache struct {
+	sync.Mutex
+	dir      string
+	mode     CacheMode
+	maxBytes int64
+	bytes    int64
+	entries  map[string]*diskEntry
+
+	dirty    bool
+	unsynced map[string]bool
+}
+
+func newDiskCache(dir string, maxBytes int64, mode CacheMode) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	d := &diskCache{
+		dir:      dir,
+		mode:     mode,
+		maxBytes: maxBytes,
+		entries:  make(map[string]*diskEntry),
+		unsynced: make(map[string]bool),
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, diskCacheIndex))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &d.entries); err != nil {
+			log.Printf("httpfs: discarding corrupt disk cache index: %s", err)
+			d.entries = make(map[string]*diskEntry)
+		}
+	}
+
+	// Drop entries whose content is gone and content no entry refers
+	// to, e.g. files written just before a crash.
+	known := map[string]bool{diskCacheIndex: true}
+	for p, e := range d.entries {
+		if _, err := os.Stat(filepath.Join(dir, e.Name)); err != nil {
+			delete(d.entries, p)
+			continue
+		}
+		known[e.Name] = true
+		d.bytes += e.Bytes
+	}
+	names, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range names {
+		if !known[fi.Name()] {
+			os.Remove(filepath.Join(dir, fi.Name()))
+		}
+	}
+
+	d.dirty = true
+	d.evict("")
+	if err := d.flush(); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for range time.Tick(diskCacheFlushInterval) {
+			if err := d.flush(); err != nil {
+				log.Printf("httpfs: error writing disk cache index: %s", err)
+			}
+		}
+	}()
+
+	return d, nil
+}
+
+// newName returns a fresh content file name for p. Names are never
+// reused so that a reader racing with an eviction or refill can't see
+// content of another version.
+func newName(p string) string {
+	sum := sha256.Sum256([]byte(p))
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:8]), time.Now().UnixNano())
+}
+
+// flush syncs the content written since the last flush and writes the
+// index.
+func (d *diskCache) flush() error {
+	d.Lock()
+	defer d.Unlock()
+
+	if !d.dirty {
+		return nil
+	}
+
+	for name := range d.unsynced {
+		if f, err := os.OpenFile(filepath.Join(d.dir, name), os.O_RDWR, 0); err == nil {
+			f.Sync()
+			f.Close()
+		}
+	}
+
+	data, err := json.Marshal(d.entries)
+	if err != nil {
+		return err
+	}
+
+	index := filepath.Join(d.dir, diskCacheIndex)
+	f, err := os.Create(index + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(index+".tmp", index); err != nil {
+		return err
+	}
+
+	d.dirty = false
+	d.unsynced = make(map[string]bool)
+	return nil
+}
+
+// drop removes the entry of p. The caller must hold the lock.
+func (d *diskCache) drop(p string) {
+	e, ok := d.entries[p]
+	if !ok {
+		return
+	}
+	os.Remove(filepath.Join(d.dir, e.Name))
+	delete(d.unsynced, e.Name)
+	delete(d.entries, p)
+	d.bytes -= e.Bytes
+	d.dirty = true
+}
+
+// evict drops least recently used entries other than keep until the
+// cache fits. The caller must hold the lock.
+func (d *diskCache) evict(keep string) {
+	for d.bytes > d.maxBytes {
+		var (
+			oldest string
+			atime  int64
+		)
+		for p, e := range d.entries {
+			if p != keep && (oldest == "" || e.Atime < atime) {
+				oldest, atime = p, e.Atime
+			}
+		}
+		if oldest == "" {
+			return
+		}
+		d.drop(oldest)
+	}
+}
+
+// entry returns the entry of p if it is of the given kind.
+func (d *diskCache) entry(p string, dir bool) *diskEntry {
+	e, ok := d.entries[p]
+	if !ok || e.Dir != dir {
+		return nil
+	}
+	e.Atime = time.Now().UnixNano()
+	return e
+}
+
+// validate drops the cached content of p if fi shows it changed on the
+// server. Listings are versioned by their own ETag, which fi doesn't
+// carry, so they are only dropped if p is no longer a directory.
+func (d *diskCache) validate(p string, fi os.FileInfo) {
+	d.Lock()
+	defer d.Unlock()
+
+	e, ok := d.entries[p]
+	if !ok {
+		return
+	}
+	switch {
+	case e.Dir != fi.IsDir():
+		d.drop(p)
+	case e.Dir:
+	case !e.Version.matches(versionOf(fi)):
+		d.drop(p)
+	default:
+		e.checked = time.Now()
+	}
+}
+
+// invalidate drops the cached content of p, e.g. after it was modified
+// through this mount.
+func (d *diskCache) invalidate(p string) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.drop(p)
+	d.drop(path.Dir(p))
+}
+
+// listing returns the cached listing of directory p and the version it
+// was cached at.
+func (d *diskCache) listing(p string) ([]httpfstypes.Entry, version, bool) {
+	d.Lock()
+	defer d.Unlock()
+
+	e := d.entry(p, true)
+	if e == nil {
+		return nil, version{}, false
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(d.dir, e.Name))
+	if err != nil {
+		d.drop(p)
+		return nil, version{}, false
+	}
+	var entries []httpfstypes.Entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		d.drop(p)
+		return nil, version{}, false
+	}
+	return entries, e.Version, true
+}
+
+// putListing caches the listing of directory p at version v.
+func (d *diskCache) putListing(p string, v version, entries []httpfstypes.Entry) {
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	d.drop(p)
+	e := &diskEntry{
+		Version: v,
+		Name:    newName(p),
+		Dir:     true,
+		Bytes:   int64(len(data)),
+		Atime:   time.Now().UnixNano(),
+	}
+	if err := ioutil.WriteFile(filepath.Join(d.dir, e.Name), data, 0600); err != nil {
+		return
+	}
+	d.entries[p] = e
+	d.unsynced[e.Name] = true
+	d.bytes += e.Bytes
+	d.dirty = true
+	d.evict(p)
+}
+
+// read copies cached content of p at off into buf. It reports false if
+// any of it isn't cached.
+func (d *diskCache) read(p string, buf []byte, off int64) (int, bool, error) {
+	d.Lock()
+	e := d.entry(p, false)
+	if e == nil {
+		d.Unlock()
+		return 0, false, nil
+	}
+	size, name := e.Version.Size, e.Name
+	if off >= size {
+		d.Unlock()
+		return 0, true, io.EOF
+	}
+	end := off + int64(len(buf))
+	if end > size {
+		end = size
+	}
+	for i := off / DiskCacheBlockSize; i*DiskCacheBlockSize < end; i++ {
+		if !e.hasBlock(i) {
+			d.Unlock()
+			return 0, false, nil
+		}
+	}
+	d.Unlock()
+
+	f, err := os.Open(filepath.Join(d.dir, name))
+	if err != nil {
+		return 0, false, nil
+	}
+	defer f.Close()
+
+	n, err := f.ReadAt(buf[:end-off], off)
+	if err != nil && err != io.EOF {
+		return 0, false, nil
+	}
+	return n, true, nil
+}
+
+// current returns the entry of p for the version the server has now,
+// creating it if necessary. The server is only asked if the entry
+// wasn't checked within diskCacheValidity.
+func (d *diskCache) current(ctx context.Context, c Client, p string) (diskEntry, error) {
+	d.Lock()
+	if e := d.entry(p, false); e != nil && time.Since(e.checked) < diskCacheValidity {
+		d.Unlock()
+		return *e, nil
+	}
+	d.Unlock()
+
+	// stat drops the entry if it is stale.
+	fi, err := c.stat(ctx, p)
+	if err != nil {
+		return diskEntry{}, err
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	if e := d.entry(p, false); e != nil && e.Version.matches(versionOf(fi)) {
+		e.checked = time.Now()
+		return *e, nil
+	}
+	d.drop(p)
+	e := &diskEntry{
+		Version: versionOf(fi),
+		Name:    newName(p),
+		Atime:   time.Now().UnixNano(),
+		checked: time.Now(),
+	}
+	d.entries[p] = e
+	d.dirty = true
+	return *e, nil
+}
+
+// readAt serves a read of p from the cache, fetching what is missing
+// first. It also returns the ETag of the version that was read.
+func (d *diskCache) readAt(ctx context.Context, c Client, p string, buf []byte, off int64) (int, string, error) {
+	e, err := d.current(ctx, c, p)
+	if err != nil {
+		return 0, "", err
+	}
+	if n, ok, err := d.read(p, buf, off); ok {
+		return n, e.Version.ETag, err
+	}
+
+	if d.mode == FileCache && e.Version.Size <= d.maxBytes {
+		err = d.fillFile(ctx, c, p, e)
+	} else {
+		err = d.fillBlocks(ctx, c, p, e, buf, off)
+	}
+	if err != nil {
+		return 0, "", err
+	}
+
+	if n, ok, err := d.read(p, buf, off); ok {
+		return n, e.Version.ETag, err
+	}
+
+	// Evicted or changed on the server in the meantime.
+	return c.readAt(ctx, p, buf, off)
+}
+
+// fillBlocks fetches the blocks covering the read into the cache.
+func (d *diskCache) fillBlocks(ctx context.Context, c Client, p string, e diskEntry, buf []byte, off int64) error {
+	first := off / DiskCacheBlockSize
+	end := off + int64(len(buf))
+	if end > e.Version.Size {
+		end = e.Version.Size
+	}
+	last := (end - 1) / DiskCacheBlockSize
+
+	data := make([]byte, (last-first+1)*DiskCacheBlockSize)
+	n, etag, err := c.readAt(ctx, p, data, first*DiskCacheBlockSize)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	data = data[:n]
+
+	d.Lock()
+	defer d.Unlock()
+
+	cur, ok := d.entries[p]
+	if !ok || cur.Name != e.Name {
+		return nil
+	}
+	if !cur.Version.sameETag(etag) {
+		d.drop(p)
+		return nil
+	}
+
+	f, err := os.OpenFile(filepath.Join(d.dir, cur.Name), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	if _, err := f.WriteAt(data, first*DiskCacheBlockSize); err != nil {
+		return nil
+	}
+
+	for i := first; i <= last; i++ {
+		blockEnd := (i + 1) * DiskCacheBlockSize
+		if blockEnd > cur.Version.Size {
+			blockEnd = cur.Version.Size
+		}
+		if blockEnd > first*DiskCacheBlockSize+int64(n) {
+			break
+		}
+		if !cur.hasBlock(i) {
+			cur.setBlock(i)
+			cur.Bytes += blockEnd - i*DiskCacheBlockSize
+			d.bytes += blockEnd - i*DiskCacheBlockSize
+		}
+	}
+	d.unsynced[cur.Name] = true
+	d.dirty = true
+	d.evict(p)
+	return nil
+}
+
+// fillFile downloads the whole file into the cache.
+func (d *diskCache) fillFile(ctx context.Context, c Client, p string, e diskEntry) error {
+	r, err := c.do(ctx, c.dataTimeout, c.Get(p))
+	if err != nil {
+		return asErrno(err)
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		return ErrorFromStatus(r.StatusCode)
+	}
+
+	tmp := filepath.Join(d.dir, e.Name+".part")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil
+	}
+	n, err := io.Copy(f, r.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return asErrno(err)
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	cur, ok := d.entries[p]
+	if !ok || cur.Name != e.Name || n != cur.Version.Size ||
+		!cur.Version.sameETag(r.Header.Get("ETag")) {
+		os.Remove(tmp)
+		return nil
+	}
+	if err := os.Rename(tmp, filepath.Join(d.dir, cur.Name)); err != nil {
+		os.Remove(tmp)
+		return nil
+	}
+
+	d.bytes += n - cur.Bytes
+	cur.Bytes = n
+	cur.Complete = true
+	cur.Blocks = nil
+	d.unsynced[cur.Name] = true
+	d.dirty = true
+	d.evict(p)
+	return nil
+}
@@ -0,0 +1,137 @@
+package fsapi
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/prologic/httpfs/utils/tempdir"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newDiskClient returns a client of s with a disk cache in dir.
+func newDiskClient(t *testing.T, s *testServer, dir string, maxBytes int64, mode CacheMode) *Client {
+	d, err := newDiskCache(dir, maxBytes, mode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := s.client()
+	c.disk = d
+	return c
+}
+
+// readAll reads the file at p through c.
+func readAll(c *Client, p string) (string, error) {
+	buf := make([]byte, 64)
+	n, err := c.ReadAt(context.Background(), p, buf, 0)
+	if err == io.EOF {
+		err = nil
+	}
+	return string(buf[:n]), err
+}
+
+func TestDiskCacheRevalidate(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newTestServer(t)
+	defer s.Close()
+	dir := tempdir.New(t)
+	defer dir.Cleanup()
+
+	for _, mode := range []CacheMode{BlockCache, FileCache} {
+		s.write(t, "f", "aaaa")
+		c := newDiskClient(t, s, dir.Path, 1<<30, mode)
+
+		data, err := readAll(c, "/f")
+		assert.Nil(err)
+		assert.Equal("aaaa", data)
+
+		// Changed on the server without this mount noticing.
+		s.write(t, "f", "bbbb")
+		c.disk.Lock()
+		c.disk.entries["/f"].checked = time.Time{}
+		c.disk.Unlock()
+
+		data, err = readAll(c, "/f")
+		assert.Nil(err)
+		assert.Equal("bbbb", data, mode.String())
+		assert.Nil(c.disk.flush())
+
+		// Content cached by an earlier mount is checked too.
+		s.write(t, "f", "cccc")
+		c = newDiskClient(t, s, dir.Path, 1<<30, mode)
+		data, err = readAll(c, "/f")
+		assert.Nil(err)
+		assert.Equal("cccc", data, mode.String())
+	}
+}
+
+func TestDiskCacheListing(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newTestServer(t)
+	defer s.Close()
+	dir := tempdir.New(t)
+	defer dir.Cleanup()
+
+	s.write(t, "f", "aaaa")
+	c := newDiskClient(t, s, dir.Path, 1<<30, BlockCache)
+
+	ctx := context.Background()
+	entries, err := c.Readdir(ctx, "/")
+	if assert.Nil(err) && assert.Len(entries, 1) {
+		assert.Equal(int64(4), entries[0].Size())
+	}
+	_, _, ok := c.disk.listing("/")
+	assert.True(ok)
+
+	// Modifying a file leaves the directory's mtime alone.
+	s.write(t, "f", "aaaaaaaa")
+	entries, err = c.Readdir(ctx, "/")
+	if assert.Nil(err) && assert.Len(entries, 1) {
+		assert.Equal(int64(8), entries[0].Size())
+	}
+
+	// An unchanged listing is served from the cache.
+	before, _, _ := c.disk.listing("/")
+	entries, err = c.Readdir(ctx, "/")
+	assert.Nil(err)
+	assert.Len(entries, 1)
+	after, _, _ := c.disk.listing("/")
+	assert.Equal(before, after)
+}
+
+func TestDiskCacheEviction(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newTestServer(t)
+	defer s.Close()
+	dir := tempdir.New(t)
+	defer dir.Cleanup()
+
+	s.write(t, "f", "012345")
+	s.write(t, "g", "6789ab")
+	c := newDiskClient(t, s, dir.Path, 10, FileCache)
+
+	_, err := readAll(c, "/f")
+	assert.Nil(err)
+	_, err = readAll(c, "/g")
+	assert.Nil(err)
+
+	// The least recently used file made way for the other.
+	c.disk.Lock()
+	_, f := c.disk.entries["/f"]
+	_, g := c.disk.entries["/g"]
+	bytes := c.disk.bytes
+	c.disk.Unlock()
+	assert.False(f)
+	assert.True(g)
+	assert.Equal(int64(6), bytes)
+
+	data, err := readAll(c, "/f")
+	assert.Nil(err)
+	assert.Equal("012345", data)
+}
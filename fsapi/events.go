@@ -0,0 +1,149 @@
+package fsapi
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	httpfstypes "github.com/prologic/httpfs/types"
+
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+)
+
+// reconnectDelay is how long Watch waits before resubscribing after the
+// event stream is lost.
+const reconnectDelay = 5 * time.Second
+
+// Events subscribes to the change event stream for path and everything
+// below it. The returned channel is closed when the stream ends, either
+// because ctx was cancelled or the connection was lost.
+func (c Client) Events(ctx context.Context, path string) (<-chan httpfstypes.Event, error) {
+	req := c.NewRequest("EVENTS", path, nil)
+	req.Header.Set("Accept", "text/event-stream")
+	req = req.WithContext(ctx)
+
+	r, e := c.client.Do(req)
+	if e != nil {
+		return nil, e
+	}
+
+	if r.StatusCode != http.StatusOK {
+		r.Body.Close()
+		return nil, ErrorFromStatus(r.StatusCode)
+	}
+
+	events := make(chan httpfstypes.Event)
+
+	go func() {
+		defer close(events)
+		defer r.Body.Close()
+
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !strings.HasPrefix(line, "data:") {
+				continue
+			}
+
+			var e httpfstypes.Event
+			data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+			if err := json.Unmarshal([]byte(data), &e); err != nil {
+				continue
+			}
+
+			select {
+			case events <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+// Watch subscribes to the server's change events and invalidates the
+// kernel's caches for affected nodes, keeping the mount coherent with
+// changes made on the server or through other mounts. It never returns;
+// run it in its own goroutine alongside srv.Serve.
+func (m *HTTPFS) Watch(srv *fs.Server) {
+	for {
+		events, err := m.client.Events(context.Background(), "/")
+		if err != nil {
+			log.Printf("E: subscribing to change events: %s\n", err)
+			time.Sleep(reconnectDelay)
+			continue
+		}
+
+		// Anything may have changed while we weren't listening.
+		m.invalidateAll(srv)
+
+		for e := range events {
+			m.invalidate(srv, e)
+		}
+
+		log.Printf("W: change event stream lost, reconnecting\n")
+		time.Sleep(reconnectDelay)
+	}
+}
+
+func (m *HTTPFS) invalidate(srv *fs.Server, e httpfstypes.Event) {
+	if e.Op == httpfstypes.EventOverflow {
+		m.client.misses.reset()
+		m.invalidateAll(srv)
+		return
+	}
+	p, name := e.FilePath(), e.DestPath()
+	m.client.misses.forget(p)
+	m.client.misses.forget(name)
+
+	if node := m.node(p); node != nil {
+		srv.InvalidateNodeData(node)
+	}
+
+	if p == "/" {
+		return
+	}
+
+	if parent := m.node(path.Dir(p)); parent != nil {
+		srv.InvalidateEntry(parent, path.Base(p))
+		if e.Op == httpfstypes.EventCreate || e.Op == httpfstypes.EventRemove {
+			srv.InvalidateNodeData(parent)
+		}
+	}
+
+	switch e.Op {
+	case httpfstypes.EventRename:
+		// Changes made elsewhere are followed like our own. For our own
+		// the nodes have already moved and nothing is left at p.
+		m.move(p, name)
+		if parent := m.node(path.Dir(name)); parent != nil {
+			srv.InvalidateEntry(parent, path.Base(name))
+		}
+	case httpfstypes.EventRemove:
+		m.forget(p)
+	}
+}
+
+func (m *HTTPFS) invalidateAll(srv *fs.Server) {
+	m.nodesLock.Lock()
+	nodes := make(map[string]fs.Node, len(m.nodes))
+	for p, node := range m.nodes {
+		nodes[p] = node
+	}
+	m.nodesLock.Unlock()
+
+	for p, node := range nodes {
+		srv.InvalidateNodeData(node)
+		if p != "/" {
+			if parent, ok := nodes[path.Dir(p)]; ok {
+				srv.InvalidateEntry(parent, path.Base(p))
+			}
+		}
+	}
+}
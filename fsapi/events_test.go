@@ -0,0 +1,107 @@
+package fsapi
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+
+	httpfstypes "github.com/prologic/httpfs/types"
+	"github.com/prologic/httpfs/webapi"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForgetUntracks(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newTestServer(t)
+	defer s.Close()
+	s.write(t, "f", "hello")
+	m := NewHTTPFS(s.srv.URL, false)
+
+	ctx := context.Background()
+	old, err := m.root.Lookup(ctx, "f")
+	assert.Nil(err)
+	assert.True(m.node("/f") == old)
+
+	old.(fs.NodeForgetter).Forget()
+	assert.Nil(m.node("/f"))
+
+	// A node forgotten after a newer one was looked up at its path
+	// leaves the newer one tracked.
+	node, err := m.root.Lookup(ctx, "f")
+	assert.Nil(err)
+	assert.False(node == old)
+	old.(fs.NodeForgetter).Forget()
+	assert.True(m.node("/f") == node)
+}
+
+func TestInvalidateFollowsEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newTestServer(t)
+	defer s.Close()
+	assert.Nil(os.Mkdir(s.path("d"), 0755))
+	s.write(t, "d/f", "hello")
+	m := NewHTTPFS(s.srv.URL, false)
+
+	ctx := context.Background()
+	d, err := m.root.Lookup(ctx, "d")
+	assert.Nil(err)
+	f, err := d.(*Dir).Lookup(ctx, "f")
+	assert.Nil(err)
+
+	// Nothing is cached by a kernel here, which the invalidations
+	// tolerate.
+	srv := fs.New(nil, nil)
+
+	m.invalidate(srv, httpfstypes.NewEvent(httpfstypes.EventRename, "/d", "/e"))
+	assert.Nil(m.node("/d/f"))
+	assert.True(m.node("/e/f") == f)
+	assert.Equal("/e/f", f.(*File).Path())
+
+	m.invalidate(srv, httpfstypes.NewEvent(httpfstypes.EventRemove, "/e", ""))
+	assert.Nil(m.node("/e"))
+	assert.Nil(m.node("/e/f"))
+	assert.NotNil(m.node("/"))
+
+	// Misses are forgotten with the paths they are about, or all of
+	// them when events were lost.
+	m.client.misses.add("/g")
+	m.client.misses.add("/h")
+	m.invalidate(srv, httpfstypes.NewEvent(httpfstypes.EventCreate, "/g", ""))
+	assert.False(m.client.misses.has("/g"))
+	assert.True(m.client.misses.has("/h"))
+	m.invalidate(srv, httpfstypes.NewEvent(httpfstypes.EventOverflow, "/", ""))
+	assert.False(m.client.misses.has("/h"))
+}
+
+func TestEventsStream(t *testing.T) {
+	assert := assert.New(t)
+
+	b := webapi.NewBroker()
+	s := newTestServer(t, webapi.WithBroker(b))
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := s.client().Events(ctx, "/a")
+	assert.Nil(err)
+
+	b.Publish(httpfstypes.NewEvent(httpfstypes.EventWrite, "/b", ""))
+	b.Publish(httpfstypes.NewEvent(httpfstypes.EventWrite, "/a/f", ""))
+
+	select {
+	case e := <-events:
+		assert.Equal(httpfstypes.EventWrite, e.Op)
+		assert.Equal("/a/f", e.Path)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+	}
+
+	cancel()
+	for range events {
+	}
+}
@@ -1,7 +1,8 @@
 package fsapi
 
 import (
-	"io"
+	"encoding/hex"
+	"os"
 	//"log"
 	"sync"
 
@@ -13,23 +14,45 @@ import (
 var _ fs.Node = (*File)(nil)
 var _ fs.NodeOpener = (*File)(nil)
 var _ fs.NodeAccesser = (*File)(nil)
-var _ fs.HandleReader = (*File)(nil)
-var _ fs.HandleWriter = (*File)(nil)
-var _ fs.HandleReleaser = (*File)(nil)
+var _ fs.NodeFsyncer = (*File)(nil)
+var _ fs.NodeForgetter = (*File)(nil)
 
 // File ...
 type File struct {
 	sync.RWMutex
 	attr    fuse.Attr
 	path    string
+	id      string
 	created bool
 	fs      *HTTPFS
-	handle  *Handle
+
+	// handles are the open handles of f, oldest first.
+	handles []*Handle
+}
+
+// Path returns the path of f on the server, which follows f when it is
+// renamed.
+func (f *File) Path() string {
+	f.fs.nodesLock.Lock()
+	defer f.fs.nodesLock.Unlock()
+	return f.path
+}
+
+// setID sets the server's id of f, or forgets it if id is empty.
+func (f *File) setID(id string) {
+	f.fs.nodesLock.Lock()
+	f.id = id
+	f.fs.nodesLock.Unlock()
+}
+
+// Forget ...
+func (f *File) Forget() {
+	f.fs.untrack(f)
 }
 
 // Access ...
 func (f *File) Access(ctx context.Context, req *fuse.AccessRequest) error {
-	//log.Printf("file.Access(%s)\n", f.path)
+	//log.Printf("file.Access(%s)\n", f.Path())
 
 	//log.Printf(" ctx=+%v\n", ctx)
 	//log.Printf(" req=+%v\n", req)
@@ -39,10 +62,10 @@ func (f *File) Access(ctx context.Context, req *fuse.AccessRequest) error {
 
 // Attr ...
 func (f *File) Attr(ctx context.Context, o *fuse.Attr) error {
-	//log.Printf("file.Attr(%s)\n", f.path)
+	//log.Printf("file.Attr(%s)\n", f.Path())
 
 	f.RLock()
-	err := f.readAttr()
+	err := f.readAttr(ctx)
 	if err != nil {
 		//log.Printf(" E: %s\n", err)
 	}
@@ -56,13 +79,28 @@ func (f *File) Attr(ctx context.Context, o *fuse.Attr) error {
 	return nil
 }
 
-func (f *File) readAttr() error {
-	stats, err := f.fs.client.Stat(f.path)
+func (f *File) readAttr(ctx context.Context) error {
+	stats, err := f.fs.client.Stat(ctx, f.Path())
 	if err != nil {
 		return err
 	}
+	f.fs.nodesLock.Lock()
+	if f.id == "" {
+		f.id = fileIDOf(stats)
+	}
+	f.fs.nodesLock.Unlock()
 
 	f.attr.Size = uint64(stats.Size())
+	for _, h := range f.handles {
+		if size, ok := h.localSize(); ok {
+			f.attr.Size = uint64(size)
+		}
+	}
+	for _, h := range f.handles {
+		if end, ok := h.pendingEnd(); ok && uint64(end) > f.attr.Size {
+			f.attr.Size = uint64(end)
+		}
+	}
 	f.attr.Mtime = stats.ModTime()
 	f.attr.Mode = stats.Mode()
 
@@ -71,76 +109,105 @@ func (f *File) readAttr() error {
 
 // Open ...
 func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
-	//log.Printf("file.Open(%s, %d, %d)\n", f.path, int(req.Flags), f.attr.Mode)
+	//log.Printf("file.Open(%s, %d, %d)\n", f.Path(), int(req.Flags), f.attr.Mode)
 
 	//log.Printf(" req=%s\n", req)
 
-	handle := Handle{
+	f.Lock()
+	defer f.Unlock()
+
+	if h := f.local(); h != nil {
+		// Already open in whole-file mode; share the local copy.
+		h.opens++
+		return h, nil
+	}
+
+	handle := &Handle{
 		f:     f,
-		path:  f.path,
 		flags: int(req.Flags),
 		perm:  f.attr.Mode,
 
 		client: f.fs.client,
+		atomic: f.fs.atomic,
+
+		partSize:    f.fs.partSize,
+		concurrency: f.fs.concurrency,
 	}
 
-	f.handle = &handle
+	c := f.fs.client
+	if f.fs.wholeFile.enabled && !c.offline.active(c.health) {
+		stats, err := c.Stat(ctx, f.Path())
+		if err != nil {
+			return nil, asErrno(err)
+		}
+		if f.fs.wholeFile.wants(stats.Size()) {
+			if err := handle.fetch(ctx, f.fs.wholeFile); err != nil {
+				//log.Printf(" E: %s\n", err)
+				return nil, asErrno(err)
+			}
+		}
+	}
 
-	return f, nil
-}
+	f.handles = append(f.handles, handle)
 
-// Release ...
-func (f *File) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
-	//log.Printf("file.Release(%s)\n", f.path)
-	return f.handle.Close()
+	return handle, nil
 }
 
-func (f *File) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
-	//log.Printf("file.Read(%s)\n", f.path)
-
-	f.RLock()
-	defer f.RUnlock()
-
-	//log.Printf(" req=%s\n", req)
-
-	if f.handle == nil {
-		//log.Println(" E: file not open")
-		return fuse.ENOTSUP
+// local returns the handle sharing the local copy of f in whole-file
+// mode, if f is open that way.
+func (f *File) local() *Handle {
+	for _, h := range f.handles {
+		if h.local != nil {
+			return h
+		}
 	}
+	return nil
+}
 
-	resp.Data = resp.Data[:req.Size]
-	n, err := f.handle.ReadAt(resp.Data, req.Offset)
-	if err != nil && err != io.EOF {
-		//log.Printf(" E: %s\n", err)
-		return err
+// closed forgets h once it has been released.
+func (f *File) closed(h *Handle) {
+	for i := range f.handles {
+		if f.handles[i] == h {
+			f.handles = append(f.handles[:i], f.handles[i+1:]...)
+			return
+		}
 	}
-	resp.Data = resp.Data[:n]
-	//log.Printf(" %d bytes read\n", n)
+}
 
+// truncating returns the open handle that a truncate of f goes through:
+// the local copy in whole-file mode, or else the most recently opened
+// handle that writes through an atomic session, or nil.
+func (f *File) truncating() *Handle {
+	if h := f.local(); h != nil {
+		return h
+	}
+	for i := len(f.handles) - 1; i >= 0; i-- {
+		if h := f.handles[i]; h.session != "" {
+			return h
+		}
+	}
+	for i := len(f.handles) - 1; i >= 0; i-- {
+		if h := f.handles[i]; h.atomic && h.flags&(os.O_WRONLY|os.O_RDWR) != 0 {
+			return h
+		}
+	}
 	return nil
 }
 
-func (f *File) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
-	//log.Printf("file.Write(%s, %q)\n", f.path, req.Data)
+// Fsync ...
+func (f *File) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	//log.Printf("file.Fsync(%s)\n", f.Path())
 
 	f.Lock()
 	defer f.Unlock()
 
-	//log.Printf(" req=%s\n", req)
-
-	if f.handle == nil {
-		//log.Println(" E: file not open")
-		return fuse.ENOTSUP
-	}
-
-	n, err := f.handle.WriteAt(req.Data, int(req.FileFlags), req.Offset)
-	if err != nil {
-		//log.Printf(" E: %s\n", err)
-		return err
+	// The kernel doesn't tell which handle is synced; flush them all.
+	for _, h := range f.handles {
+		if err := h.flush(ctx); err != nil {
+			//log.Printf(" E: %s\n", err)
+			return asErrno(err)
+		}
 	}
-	resp.Size = n
-	//log.Printf(" %d bytes written\n", n)
-
 	return nil
 }
 
@@ -148,7 +215,7 @@ var _ fs.NodeSetattrer = (*File)(nil)
 
 // Setattr ...
 func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
-	//log.Printf("file.Setattr(%s)\n", f.path)
+	//log.Printf("file.Setattr(%s)\n", f.Path())
 
 	f.Lock()
 	defer f.Unlock()
@@ -160,7 +227,42 @@ func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse
 	valid := req.Valid
 
 	if valid.Size() {
-		err := f.fs.client.Truncate(f.path, req.Size)
+		for _, h := range f.handles {
+			if err := h.sync(ctx); err != nil {
+				//log.Printf(" E: %s\n", err)
+				return err
+			}
+		}
+	}
+
+	h := f.truncating()
+
+	if valid.Size() && h != nil && h.local != nil {
+		if err := h.truncate(int64(req.Size)); err != nil {
+			//log.Printf(" E: %s\n", err)
+			return err
+		}
+		valid &^= fuse.SetattrSize
+	}
+
+	if valid.Size() && h != nil && h.local == nil && h.atomic && h.session == "" {
+		// Truncate a copy rather than the file others see.
+		if err := h.begin(ctx, req.Size == 0); err != nil {
+			//log.Printf(" E: %s\n", err)
+			return err
+		}
+	}
+
+	if valid.Size() && h != nil && h.session != "" {
+		if err := f.fs.client.Truncate(ctx, h.session, req.Size); err != nil {
+			//log.Printf(" E: %s\n", err)
+			return err
+		}
+		valid &^= fuse.SetattrSize
+	}
+
+	if valid.Size() {
+		err := f.fs.client.Truncate(ctx, f.Path(), req.Size)
 		if err != nil {
 			//log.Printf(" E: %s\n", err)
 			return err
@@ -169,7 +271,7 @@ func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse
 	}
 
 	if valid.Mode() {
-		err := f.fs.client.Chmod(f.path, req.Mode)
+		err := f.fs.client.Chmod(ctx, f.Path(), req.Mode)
 		if err != nil {
 			//log.Printf(" E: %s\n", err)
 			return err
@@ -187,3 +289,40 @@ func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse
 	}
 	return nil
 }
+
+var _ fs.NodeGetxattrer = (*File)(nil)
+var _ fs.NodeListxattrer = (*File)(nil)
+
+// Getxattr ...
+func (f *File) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	//log.Printf("file.Getxattr(%s, %s)\n", f.Path(), req.Name)
+
+	if req.Name != XattrSHA256 {
+		return fuse.ErrNoXattr
+	}
+
+	sum, _, err := f.fs.client.Hash(ctx, f.Path(), 0, -1)
+	if err == fuse.ENOSYS {
+		return fuse.ErrNoXattr
+	}
+	if err != nil {
+		//log.Printf(" E: %s\n", err)
+		return err
+	}
+	resp.Xattr = []byte(hex.EncodeToString(sum))
+
+	return nil
+}
+
+// Listxattr ...
+func (f *File) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	//log.Printf("file.Listxattr(%s)\n", f.Path())
+
+	// Tools that copy extended attributes (cp -a, rsync -X, tar) would
+	// have the server hash every file they come across.
+	if f.fs.client.verify {
+		resp.Append(XattrSHA256)
+	}
+
+	return nil
+}
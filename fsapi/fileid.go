@@ -0,0 +1,80 @@
+package fsapi
+
+import (
+	"net/http"
+	"os"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// FileIDHeader carries the id the server gives a file, which follows it
+// across renames, see webapi.FileIDHeader. Sending it with a request
+// makes the server refuse it with 412, reported as ESTALE, if the path
+// is no longer that file.
+const FileIDHeader = "X-File-Id"
+
+// fileIDOf returns the server's id of the file described by fi, or
+// empty if it doesn't give one.
+func fileIDOf(fi os.FileInfo) string {
+	if st, ok := fi.(fileStat); ok {
+		return st.id
+	}
+	return ""
+}
+
+// fileRef pins the requests of an open file to the file it was opened
+// on. It learns the file's id from the first response that carries it,
+// and from then on sends it with every request for the file's path.
+type fileRef struct {
+	sync.Mutex
+	id string
+}
+
+// reset forgets the id, after the file was replaced by one of our own
+// uploads.
+func (f *fileRef) reset() {
+	f.Lock()
+	f.id = ""
+	f.Unlock()
+}
+
+type fileRefKey struct{}
+
+type fileRefValue struct {
+	path string
+	ref  *fileRef
+}
+
+// withFileRef returns a context that makes do pin requests for path to
+// the file of ref.
+func withFileRef(ctx context.Context, path string, ref *fileRef) context.Context {
+	return context.WithValue(ctx, fileRefKey{}, fileRefValue{path, ref})
+}
+
+// pin adds the id of the file req is pinned to by ctx, if any, to req.
+// It returns a function that learns the id from the response to req.
+func (c Client) pin(ctx context.Context, req *http.Request) func(*http.Response) {
+	v, ok := ctx.Value(fileRefKey{}).(fileRefValue)
+	if !ok || req.URL.Path != c.NewRequest(req.Method, v.path, nil).URL.Path {
+		return func(*http.Response) {}
+	}
+
+	v.ref.Lock()
+	id := v.ref.id
+	v.ref.Unlock()
+	if id != "" {
+		req.Header.Set(FileIDHeader, id)
+		return func(*http.Response) {}
+	}
+
+	return func(r *http.Response) {
+		if id := r.Header.Get(FileIDHeader); id != "" && r.StatusCode < 300 {
+			v.ref.Lock()
+			if v.ref.id == "" {
+				v.ref.id = id
+			}
+			v.ref.Unlock()
+		}
+	}
+}
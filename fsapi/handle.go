@@ -1,110 +1,201 @@
 package fsapi
 
 import (
-	"bytes"
-	"fmt"
-	"io/ioutil"
 	//"log"
-	"net/http"
+	"io"
 	"os"
-	"strconv"
+	"sync"
 
 	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
 )
 
-// Handle ...
+var _ fs.HandleReader = (*Handle)(nil)
+var _ fs.HandleWriter = (*Handle)(nil)
+var _ fs.HandleReleaser = (*Handle)(nil)
+var _ fs.HandleFlusher = (*Handle)(nil)
+
+// Handle is an open file. Every open has its own handle, except in
+// whole-file mode where concurrent opens share the local copy.
 type Handle struct {
 	f     *File
-	path  string
 	flags int
 	perm  os.FileMode
 
 	client *Client
+
+	// local is the local copy of the file in whole-file mode, shared
+	// by concurrent opens of the file.
+	local *os.File
+	dirty bool
+	opens int
+
+	// atomic makes writes go through an atomic write session on the
+	// server; session is the path of its temporary file once started.
+	atomic  bool
+	session string
+
+	// partSize enables multipart uploads of runs of sequential writes
+	// with up to concurrency parts in flight; seq is the current run.
+	partSize    int64
+	concurrency int
+	seqLock     sync.Mutex
+	seq         *sequentialWriter
+
+	// ref pins reads and writes to the file that was opened, so that
+	// they fail with ESTALE rather than reach another file that took
+	// its name.
+	ref fileRef
 }
 
-// Close ...
-func (h Handle) Close() error {
-	return nil
+// replaced tells the handle that its file was replaced by an upload or
+// commit of its own, which gives it a new id on the server.
+func (h *Handle) replaced() {
+	h.ref.reset()
+	h.f.setID("")
 }
 
-// ReadAt ...
-func (h Handle) ReadAt(buf []byte, offset int64) (int, error) {
-	//log.Printf("handle.ReadAt(%s, %d)\n", h.path, offset)
+// Read ...
+func (h *Handle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	//log.Printf("handle.Read(%s)\n", h.f.Path())
 
-	req := h.client.Get(h.path)
-	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	h.f.RLock()
+	defer h.f.RUnlock()
 
-	r, err := h.client.client.Do(req)
-	if err != nil {
+	resp.Data = resp.Data[:req.Size]
+	n, err := h.ReadAt(ctx, resp.Data, req.Offset)
+	if err != nil && err != io.EOF {
 		//log.Printf(" E: %s\n", err)
-		return 0, fuse.EIO
+		return err
 	}
-	defer r.Body.Close()
+	resp.Data = resp.Data[:n]
 
-	if r.StatusCode != http.StatusPartialContent {
-		//log.Printf(" status=%d\n", r.StatusCode)
-		return 0, ErrorFromStatus(r.StatusCode)
-	}
+	return nil
+}
+
+// Write ...
+func (h *Handle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	//log.Printf("handle.Write(%s, %q)\n", h.f.Path(), req.Data)
+
+	h.f.Lock()
+	defer h.f.Unlock()
 
-	data, err := ioutil.ReadAll(r.Body)
+	n, err := h.WriteAt(ctx, req.Data, int(req.FileFlags), req.Offset)
 	if err != nil {
-		return 0, fuse.EIO
+		//log.Printf(" E: %s\n", err)
+		return err
 	}
+	resp.Size = n
 
-	copy(buf, data)
-
-	return len(buf), nil
+	return nil
 }
 
-// WriteAt ...
-func (h Handle) WriteAt(buf []byte, flags int, offset int64) (int, error) {
-	//log.Printf("handle.WriteAt(%s, %d, %d)\n", h.path, flags, offset)
+// Flush ...
+func (h *Handle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	//log.Printf("handle.Flush(%s)\n", h.f.Path())
 
-	//log.Printf(" flags=%d\n", flags)
-	//log.Printf(" perm=%d\n", h.perm)
-	//log.Printf(" offset=%d\n", offset)
-	//log.Printf(" len(buf)=%d\n", len(buf))
+	h.f.Lock()
+	defer h.f.Unlock()
 
-	if h.f.created {
-		h.f.created = false
-		flags |= os.O_CREATE | os.O_EXCL
+	if err := h.flush(ctx); err != nil {
+		//log.Printf(" E: %s\n", err)
+		return asErrno(err)
 	}
+	return nil
+}
 
-	body := bytes.NewReader(buf)
+// Release ...
+func (h *Handle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	//log.Printf("handle.Release(%s)\n", h.f.Path())
 
-	req := h.client.Put(h.path, body)
+	h.f.Lock()
+	defer h.f.Unlock()
 
-	q := req.URL.Query()
-	q.Add("flags", fmt.Sprintf("%d", flags))
-	q.Add("perm", fmt.Sprintf("%d", h.perm))
-	q.Add("offset", fmt.Sprintf("%d", offset))
-	req.URL.RawQuery = q.Encode()
+	err := h.close(ctx)
+	if h.local == nil {
+		h.f.closed(h)
+	}
+	return err
+}
 
-	r, err := h.client.client.Do(req)
-	defer r.Body.Close()
-	if err != nil {
-		//log.Printf(" E: %s\n", err)
-		return 0, fuse.EIO
+// close flushes the handle and, in whole-file mode, drops the local
+// copy once the last open sharing it is closed.
+func (h *Handle) close(ctx context.Context) error {
+	err := h.flush(ctx)
+
+	if h.local != nil {
+		h.opens--
+		if h.opens == 0 {
+			h.local.Close()
+			h.local = nil
+		}
 	}
+	return err
+}
 
-	if r.StatusCode == http.StatusOK {
-		return len(buf), nil
-	} else if r.StatusCode != http.StatusPartialContent {
-		//log.Printf(" status=%d\n", r.StatusCode)
-		return 0, ErrorFromStatus(r.StatusCode)
+// flush makes the changes made through the handle visible to others.
+func (h *Handle) flush(ctx context.Context) error {
+	if err := h.sync(ctx); err != nil {
+		return err
+	}
+	if h.session != "" {
+		return h.commit(ctx)
 	}
+	return h.upload(ctx)
+}
 
-	b, e := ioutil.ReadAll(r.Body)
-	if e != nil {
-		//log.Printf(" E: error reading body: %s\n", e)
-		return 0, e
+// ReadAt ...
+func (h *Handle) ReadAt(ctx context.Context, buf []byte, offset int64) (int, error) {
+	//log.Printf("handle.ReadAt(%s, %d)\n", h.f.Path(), offset)
+	if h.local != nil {
+		return h.local.ReadAt(buf, offset)
+	}
+	if err := h.sync(ctx); err != nil {
+		return 0, err
+	}
+	if h.session != "" {
+		return h.client.ReadAt(ctx, h.session, buf, offset)
+	}
+	path := h.f.Path()
+	return h.client.ReadAt(withFileRef(ctx, path, &h.ref), path, buf, offset)
+}
+
+// WriteAt ...
+func (h *Handle) WriteAt(ctx context.Context, buf []byte, flags int, offset int64) (int, error) {
+	//log.Printf("handle.WriteAt(%s, %d, %d)\n", h.f.Path(), flags, offset)
+
+	if h.local != nil {
+		if flags&os.O_APPEND != 0 || offset < 0 {
+			end, err := h.local.Seek(0, io.SeekEnd)
+			if err != nil {
+				return 0, err
+			}
+			offset = end
+		}
+		h.dirty = true
+		return h.local.WriteAt(buf, offset)
+	}
+
+	ctx = withFileRef(ctx, h.f.Path(), &h.ref)
+
+	if h.atomic && h.session == "" && !h.client.offline.active(h.client.health) {
+		if err := h.begin(ctx, false); err != nil {
+			return 0, err
+		}
+	}
+	path := h.f.Path()
+	if h.session != "" {
+		path = h.session
+		flags &^= os.O_CREATE | os.O_EXCL | os.O_TRUNC
+	} else if h.f != nil && h.f.created {
+		h.f.created = false
+		flags |= os.O_CREATE | os.O_EXCL
 	}
 
-	n, e := strconv.ParseInt(string(b), 10, 32)
-	if e != nil {
-		//log.Printf(" E: error parsing body: %s\n", e)
-		return 0, e
+	if h.partSize > 0 && flags&os.O_APPEND == 0 && offset >= 0 && !h.client.offline.active(h.client.health) {
+		return h.writeSequential(ctx, path, buf, flags, offset)
 	}
 
-	return int(n), nil
+	return h.client.WriteAt(ctx, path, buf, flags, h.perm, offset)
 }
@@ -0,0 +1,69 @@
+package fsapi
+
+import (
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+
+	"github.com/prologic/httpfs/webapi"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fsyncFile syncs the file at name in the root of m.
+func fsyncFile(t *testing.T, m *HTTPFS, name string) error {
+	ctx := context.Background()
+	node, err := m.root.Lookup(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return node.(*File).Fsync(ctx, &fuse.FsyncRequest{})
+}
+
+func TestHandlePerOpen(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newTestServer(t, webapi.WithSessions(time.Hour))
+	defer s.Close()
+	s.write(t, "f", "hello")
+	m := NewHTTPFS(s.srv.URL, false, WithAtomicWrites())
+
+	first := openFile(t, m, "f")
+	assert.Nil(writeFile(first, "j", 0))
+
+	// Opening the file again doesn't touch the first open's session.
+	second := openFile(t, m, "f")
+	assert.False(first == second)
+	assert.Equal("hello", readFile(second, 5))
+	assert.Nil(releaseFile(second))
+	assert.Equal("hello", s.read("f"))
+
+	assert.Equal("jello", readFile(first, 5))
+	assert.Nil(releaseFile(first))
+	assert.Equal("jello", s.read("f"))
+	assert.Empty(first.f.handles)
+}
+
+func TestHandleFsyncCommits(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newTestServer(t, webapi.WithSessions(time.Hour))
+	defer s.Close()
+	s.write(t, "f", "hello")
+	m := NewHTTPFS(s.srv.URL, false, WithAtomicWrites())
+
+	h := openFile(t, m, "f")
+	assert.Nil(writeFile(h, "j", 0))
+	assert.Equal("hello", s.read("f"))
+
+	assert.Nil(fsyncFile(t, m, "f"))
+	assert.Equal("jello", s.read("f"))
+
+	// The handle goes on writing through a new session.
+	assert.Nil(writeFile(h, "y", 4))
+	assert.Equal("jello", s.read("f"))
+	assert.Nil(releaseFile(h))
+	assert.Equal("jelly", s.read("f"))
+}
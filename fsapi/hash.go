@@ -0,0 +1,114 @@
+package fsapi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	//"log"
+	"net/http"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+// XattrSHA256 is the (read-only) extended attribute holding the hex
+// encoded SHA-256 of a file's content on the server. It can always be
+// read, but is only listed with WithVerify.
+const XattrSHA256 = "user.httpfs.sha256"
+
+// SetVerify enables or disables checking data read and written against
+// hashes computed by the server.
+func (c *Client) SetVerify(verify bool) {
+	c.verify = verify
+}
+
+// Hash returns the SHA-256 of length bytes of the file at path starting
+// at offset (up to the end if length is negative) as computed by the
+// server, along with the ETag of the version of the file it hashed.
+func (c Client) Hash(ctx context.Context, path string, offset, length int64) ([]byte, string, error) {
+	req := c.NewRequest("HASH", path, nil)
+
+	q := req.URL.Query()
+	q.Add("algo", "sha-256")
+	q.Add("offset", fmt.Sprintf("%d", offset))
+	q.Add("length", fmt.Sprintf("%d", length))
+	req.URL.RawQuery = q.Encode()
+
+	r, e := c.do(ctx, c.dataTimeout, req)
+	if e != nil {
+		return nil, "", asErrno(e)
+	}
+	defer r.Body.Close()
+
+	switch r.StatusCode {
+	case http.StatusOK:
+	case http.StatusMethodNotAllowed:
+		// A server from before HASH was added.
+		return nil, "", fuse.ENOSYS
+	default:
+		return nil, "", ErrorFromStatus(r.StatusCode)
+	}
+
+	b, e := ioutil.ReadAll(r.Body)
+	if e != nil {
+		return nil, "", asErrno(e)
+	}
+	sum, e := hex.DecodeString(string(b))
+	if e != nil {
+		return nil, "", fuse.EIO
+	}
+	return sum, r.Header.Get("ETag"), nil
+}
+
+// contentDigest returns the Content-Digest header value for data.
+func contentDigest(sum []byte) string {
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(sum) + ":"
+}
+
+// setDigest adds a Content-Digest of the request body (before any
+// compression) to req if verification is enabled. The server rejects the
+// request without writing anything if the body it receives doesn't
+// match.
+func (c Client) setDigest(req *http.Request, body io.Reader) error {
+	if !c.verify {
+		return nil
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, body); err != nil {
+		return err
+	}
+	req.Header.Set("Content-Digest", contentDigest(h.Sum(nil)))
+	return nil
+}
+
+// verifyRead checks data read at offset from the version etag of the
+// file at path against the server's hash of the same range. A range
+// that changed on the server since it was read can't be checked and is
+// accepted, as are reads from servers that can't hash.
+func (c Client) verifyRead(ctx context.Context, path, etag string, data []byte, offset int64) error {
+	if !c.verify || len(data) == 0 {
+		return nil
+	}
+
+	sum, hashed, err := c.Hash(ctx, path, offset, int64(len(data)))
+	if err == fuse.ENOSYS {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if etag != "" && hashed != etag {
+		return nil
+	}
+
+	local := sha256.Sum256(data)
+	if !bytes.Equal(sum, local[:]) {
+		//log.Printf("E: %s: data read at %d doesn't match the server's\n", path, offset)
+		return fuse.EIO
+	}
+	return nil
+}
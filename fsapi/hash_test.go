@@ -0,0 +1,49 @@
+package fsapi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestXattrSHA256(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newTestServer(t)
+	defer s.Close()
+	s.write(t, "f", "hello")
+	sum := sha256.Sum256([]byte("hello"))
+
+	for _, verify := range []bool{false, true} {
+		var opts []Option
+		if verify {
+			opts = append(opts, WithVerify())
+		}
+		m := NewHTTPFS(s.srv.URL, false, opts...)
+
+		ctx := context.Background()
+		node, err := m.root.Lookup(ctx, "f")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := node.(*File)
+
+		// It is only listed if asked for, but can always be read.
+		list := &fuse.ListxattrResponse{}
+		assert.Nil(f.Listxattr(ctx, &fuse.ListxattrRequest{}, list))
+		if verify {
+			assert.Equal(XattrSHA256+"\x00", string(list.Xattr))
+		} else {
+			assert.Empty(list.Xattr)
+		}
+
+		get := &fuse.GetxattrResponse{}
+		assert.Nil(f.Getxattr(ctx, &fuse.GetxattrRequest{Name: XattrSHA256}, get))
+		assert.Equal(hex.EncodeToString(sum[:]), string(get.Xattr))
+	}
+}
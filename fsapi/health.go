@@ -0,0 +1,136 @@
+package fsapi
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// MountMode selects how operations behave while the server is
+// unreachable.
+type MountMode int
+
+const (
+	// SoftMount fails operations with ETIMEDOUT once their retries are
+	// exhausted.
+	SoftMount MountMode = iota
+
+	// HardMount blocks operations and keeps retrying until the server
+	// comes back. Blocked operations can still be interrupted.
+	HardMount
+)
+
+// ParseMountMode ...
+func ParseMountMode(s string) (MountMode, error) {
+	switch s {
+	case "soft":
+		return SoftMount, nil
+	case "hard":
+		return HardMount, nil
+	default:
+		return SoftMount, fmt.Errorf("invalid mount mode %q (want hard or soft)", s)
+	}
+}
+
+func (mode MountMode) String() string {
+	if mode == HardMount {
+		return "hard"
+	}
+	return "soft"
+}
+
+// DefaultHealthInterval is how often the server is probed by Monitor.
+const DefaultHealthInterval = 10 * time.Second
+
+// health tracks whether the server is reachable. It is updated by every
+// request as well as by the background probe in Monitor.
+type health struct {
+	sync.Mutex
+	url  string
+	down bool
+	up   chan struct{}
+}
+
+func newHealth(url string) *health {
+	return &health{url: url}
+}
+
+// set records the outcome of talking to the server and logs transitions.
+func (h *health) set(ok bool) {
+	h.Lock()
+	defer h.Unlock()
+
+	switch {
+	case ok && h.down:
+		h.down = false
+		close(h.up)
+		log.Printf("httpfs: server %s OK\n", h.url)
+	case !ok && !h.down:
+		h.down = true
+		h.up = make(chan struct{})
+		log.Printf("httpfs: server %s not responding, still trying\n", h.url)
+	}
+}
+
+func (h *health) isDown() bool {
+	h.Lock()
+	defer h.Unlock()
+	return h.down
+}
+
+// recovered returns a channel that is closed when the server comes back,
+// or nil (which blocks forever) if it is not known to be down.
+func (h *health) recovered() <-chan struct{} {
+	h.Lock()
+	defer h.Unlock()
+	if !h.down {
+		return nil
+	}
+	return h.up
+}
+
+// probe sends a single HEAD request for the root to check that the
+// server is answering.
+func (c Client) probe(timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	r, err := c.client.Do(c.Head("/").WithContext(ctx))
+	if err != nil {
+		return false
+	}
+	r.Body.Close()
+
+	return !retryable(r.StatusCode)
+}
+
+// Monitor probes the server every interval, logging when it stops or
+// starts responding. When the server is lost, idle connections are
+// dropped so that operations reconnect afresh, and operations waiting
+// to retry in a hard mount are woken as soon as it is back. In offline
+// mode, operations recorded while the server was unreachable are
+// replayed once it responds again. It never returns; run it in its own
+// goroutine.
+func (m *HTTPFS) Monitor(interval time.Duration) {
+	c := m.client
+	for {
+		ok := c.probe(interval)
+		if !ok {
+			c.client.CloseIdleConnections()
+		}
+		c.health.set(ok)
+
+		if ok && c.offline.pending() {
+			online := *c
+			online.offline = nil
+			if err := c.offline.replay(context.Background(), online); err != nil {
+				log.Printf("E: replaying offline operations: %s\n", err)
+			}
+		}
+
+		time.Sleep(interval)
+	}
+}
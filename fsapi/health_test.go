@@ -0,0 +1,93 @@
+package fsapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealth(t *testing.T) {
+	assert := assert.New(t)
+
+	h := newHealth("http://localhost")
+	assert.False(h.isDown())
+	assert.Nil(h.recovered())
+
+	h.set(false)
+	assert.True(h.isDown())
+	up := h.recovered()
+	assert.NotNil(up)
+
+	// Staying down keeps the same channel.
+	h.set(false)
+	assert.True(up == h.recovered())
+	select {
+	case <-up:
+		t.Fatal("recovered while down")
+	default:
+	}
+
+	h.set(true)
+	assert.False(h.isDown())
+	assert.Nil(h.recovered())
+	select {
+	case <-up:
+	default:
+		t.Fatal("not woken on recovery")
+	}
+}
+
+func TestHardMountRetriesUntilUp(t *testing.T) {
+	assert := assert.New(t)
+
+	// The server drops connections while down is set.
+	var down int32 = 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&down) != 0 {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	c := NewClient(srv.URL, false)
+	c.mode = HardMount
+	c.retry = RetryPolicy{MaxRetries: 0, MinBackoff: time.Hour, MaxBackoff: time.Hour}
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := c.Stat(context.Background(), "/f")
+		errs <- err
+	}()
+
+	// The operation waits rather than failing.
+	select {
+	case err := <-errs:
+		t.Fatalf("returned while down: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.True(c.health.isDown())
+	assert.False(c.probe(time.Second))
+
+	// It is retried as soon as a probe finds the server back, without
+	// waiting for the backoff.
+	atomic.StoreInt32(&down, 0)
+	c.health.set(c.probe(time.Second))
+	select {
+	case err := <-errs:
+		assert.Nil(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("not retried once up")
+	}
+	assert.False(c.health.isDown())
+}
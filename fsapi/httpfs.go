@@ -2,12 +2,16 @@ package fsapi
 
 import (
 	"os"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
 	"golang.org/x/net/context"
+
+	"github.com/prologic/httpfs/utils"
 )
 
 // HTTPFS ...
@@ -16,7 +20,22 @@ type HTTPFS struct {
 	NodeID uint64
 	size   int64
 
-	client *Client
+	client     *Client
+	wholeFile  wholeFile
+	deltaBlock int64
+	atomic     bool
+	names      *utils.Normalizer
+	ignore     *utils.Ignore
+	versions   bool
+
+	partSize    int64
+	concurrency int
+
+	// nodes maps paths to the most recently looked up node for that
+	// path so that cache invalidations can find them, until the kernel
+	// forgets the node.
+	nodesLock sync.Mutex
+	nodes     map[string]fs.Node
 }
 
 // Compile-time interface checks.
@@ -26,12 +45,131 @@ var _ fs.FSStatfser = (*HTTPFS)(nil)
 // DefaultFileMode ...
 const DefaultFileMode = os.FileMode(int(0777))
 
+// Option configures optional HTTPFS behaviour.
+type Option func(*HTTPFS)
+
+// WithRetryPolicy sets how requests that fail with a transient network
+// or server error are retried.
+func WithRetryPolicy(p RetryPolicy) Option {
+	return func(m *HTTPFS) {
+		m.client.retry = p
+	}
+}
+
+// WithMountMode selects hard or soft mount semantics for server outages.
+func WithMountMode(mode MountMode) Option {
+	return func(m *HTTPFS) {
+		m.client.mode = mode
+	}
+}
+
+// WithTimeouts bounds the time spent on each metadata operation (stat,
+// listing, rename, ...) and each data operation (read, write). In a
+// soft mount slow operations fail with ETIMEDOUT; in a hard mount the
+// timeout applies to each attempt, which is then retried. Zero disables
+// the respective timeout.
+func WithTimeouts(meta, data time.Duration) Option {
+	return func(m *HTTPFS) {
+		m.client.metaTimeout = meta
+		m.client.dataTimeout = data
+	}
+}
+
+// WithWholeFile enables fetch-on-open, upload-on-close operation for
+// files up to maxSize bytes (0 for any size). Such files are downloaded
+// into a temporary file in dir (the system default if empty) when
+// opened, accessed locally and uploaded atomically when closed if they
+// were modified. Larger files are read and written remotely as usual.
+func WithWholeFile(maxSize int64, dir string) Option {
+	return func(m *HTTPFS) {
+		m.wholeFile = wholeFile{enabled: true, maxSize: maxSize, dir: dir}
+	}
+}
+
+// WithDeltaSync makes whole-file mode send only the changed blocks of
+// blockSize bytes when uploading a modified file that already exists on
+// the server, rather than all of it.
+func WithDeltaSync(blockSize int64) Option {
+	return func(m *HTTPFS) {
+		m.deltaBlock = blockSize
+	}
+}
+
+// WithAtomicWrites makes writes to a file invisible to others until the
+// file is closed (or flushed), when they are applied all at once. The
+// server must have atomic write sessions enabled; otherwise files are
+// written in place as usual.
+func WithAtomicWrites() Option {
+	return func(m *HTTPFS) {
+		m.atomic = true
+	}
+}
+
+// WithMultipartUploads sends runs of sequential writes to a file (e.g.
+// from cp or dd) as multipart uploads of partSize byte parts, with up to
+// concurrency parts in flight. Writes are collected until a part is full
+// and written out when the run ends, the file is read, flushed or
+// closed. Servers without multipart support are written to in place.
+func WithMultipartUploads(partSize int64, concurrency int) Option {
+	return func(m *HTTPFS) {
+		m.partSize = partSize
+		m.concurrency = concurrency
+	}
+}
+
+// WithCompression gzip encodes file content written in chunks of at
+// least minSize bytes and asks the server to compress whole files
+// fetched from it (see WithWholeFile); reads of ranges are sent as is.
+// The server skips content that is already compressed.
+func WithCompression(minSize int64) Option {
+	return func(m *HTTPFS) {
+		m.client.compressMin = minSize
+	}
+}
+
+// WithVerify checks all data read and written end to end: writes carry
+// a digest the server verifies before storing them, and reads are
+// compared with the server's hash of the range read. It costs an extra
+// request per read.
+func WithVerify() Option {
+	return func(m *HTTPFS) {
+		m.client.verify = true
+	}
+}
+
+// WithSparseFiles keeps holes in sparse files from crossing the wire:
+// the server leaves out holes when sending file content, and turns
+// aligned blocks of zeros that are written into holes. The mount still
+// doesn't support fallocate(2) or seeking to data and holes.
+func WithSparseFiles() Option {
+	return func(m *HTTPFS) {
+		m.client.sparse = true
+	}
+}
+
+// WithNormalizer presents names as n's rules have it: names listed are
+// normalized, a name that doesn't exist as it is is looked up as the
+// entry n considers equal to it, and new files and directories are
+// created with normalized names. Of several entries that are equal, only
+// the first listed is presented.
+func WithNormalizer(n *utils.Normalizer) Option {
+	return func(m *HTTPFS) {
+		m.names = n
+	}
+}
+
 // NewHTTPFS ...
-func NewHTTPFS(url string, tlsverify bool) *HTTPFS {
+func NewHTTPFS(url string, tlsverify bool, opts ...Option) *HTTPFS {
 	fs := &HTTPFS{
 		client: NewClient(url, tlsverify),
+		ignore: utils.NewIgnore(DefaultIgnorePatterns()...),
+		nodes:  make(map[string]fs.Node),
+	}
+	fs.client.misses = newMisses(DefaultMissTTL)
+	for _, opt := range opts {
+		opt(fs)
 	}
-	fs.root = fs.newDir("/", os.ModeDir|DefaultFileMode)
+	fs.root = fs.newDir("/", os.ModeDir|DefaultFileMode, "")
 	if fs.root.attr.Inode != 1 {
 		panic("Root node should have been assigned id 1")
 	}
@@ -42,9 +180,130 @@ func (m *HTTPFS) nextID() uint64 {
 	return atomic.AddUint64(&m.NodeID, 1)
 }
 
-func (m *HTTPFS) newDir(path string, mode os.FileMode) *Dir {
+func (m *HTTPFS) track(path string, node fs.Node) {
+	m.nodesLock.Lock()
+	m.nodes[path] = node
+	m.nodesLock.Unlock()
+}
+
+// untrack stops tracking node once the kernel has forgotten it, unless
+// another node has been looked up at its path since.
+func (m *HTTPFS) untrack(node fs.Node) {
+	m.nodesLock.Lock()
+	defer m.nodesLock.Unlock()
+
+	var p string
+	switch n := node.(type) {
+	case *Dir:
+		p = n.path
+	case *File:
+		p = n.path
+	}
+	if m.nodes[p] == node {
+		delete(m.nodes, p)
+	}
+}
+
+func (m *HTTPFS) node(path string) fs.Node {
+	m.nodesLock.Lock()
+	defer m.nodesLock.Unlock()
+	return m.nodes[path]
+}
+
+// tracked returns the node last looked up at path if it is still the
+// file described by stats, so that a file keeps its node, and the
+// kernel its inode, for as long as it exists. That can only be told
+// from the server's file ids; without them every lookup makes a node.
+func (m *HTTPFS) tracked(path string, stats os.FileInfo) fs.Node {
+	id := fileIDOf(stats)
+	if id == "" {
+		return nil
+	}
+
+	m.nodesLock.Lock()
+	defer m.nodesLock.Unlock()
+
+	switch n := m.nodes[path].(type) {
+	case *Dir:
+		if stats.IsDir() && n.id == id {
+			return n
+		}
+	case *File:
+		if !stats.IsDir() && n.id == id {
+			return n
+		}
+	}
+	return nil
+}
+
+// within returns the rest of p below root if p is root or below it.
+func within(p, root string) (string, bool) {
+	if p == root {
+		return "", true
+	}
+	if strings.HasPrefix(p, strings.TrimSuffix(root, "/")+"/") {
+		return p[len(root):], true
+	}
+	return "", false
+}
+
+// move re-parents the nodes at oldpath and below after it was renamed
+// to newpath: their paths follow them, so that open files and cached
+// children keep working on the same files. Nodes that were at newpath
+// or below are left behind with their old paths, where requests pinned
+// to their files fail with ESTALE. Nothing changes if there are no
+// nodes at oldpath, e.g. when they have been moved already.
+func (m *HTTPFS) move(oldpath, newpath string) {
+	if oldpath == newpath {
+		return
+	}
+
+	m.nodesLock.Lock()
+	defer m.nodesLock.Unlock()
+
+	moved := make(map[string]fs.Node)
+	for p, node := range m.nodes {
+		if rest, ok := within(p, oldpath); ok {
+			moved[newpath+rest] = node
+			delete(m.nodes, p)
+		}
+	}
+	if len(moved) == 0 {
+		return
+	}
+
+	for p := range m.nodes {
+		if _, ok := within(p, newpath); ok {
+			delete(m.nodes, p)
+		}
+	}
+	for p, node := range moved {
+		switch n := node.(type) {
+		case *Dir:
+			n.path = p
+		case *File:
+			n.path = p
+		}
+		m.nodes[p] = node
+	}
+}
+
+// forget stops tracking the nodes at path and below after it was
+// removed.
+func (m *HTTPFS) forget(path string) {
+	m.nodesLock.Lock()
+	defer m.nodesLock.Unlock()
+
+	for p := range m.nodes {
+		if _, ok := within(p, path); ok {
+			delete(m.nodes, p)
+		}
+	}
+}
+
+func (m *HTTPFS) newDir(path string, mode os.FileMode, id string) *Dir {
 	n := time.Now()
-	return &Dir{
+	d := &Dir{
 		attr: fuse.Attr{
 			Inode:  m.nextID(),
 			Atime:  n,
@@ -54,13 +313,16 @@ func (m *HTTPFS) newDir(path string, mode os.FileMode) *Dir {
 			Mode:   os.ModeDir | mode,
 		},
 		path: path,
+		id:   id,
 		fs:   m,
 	}
+	m.track(path, d)
+	return d
 }
 
-func (m *HTTPFS) newFile(path string, mode os.FileMode) *File {
+func (m *HTTPFS) newFile(path string, mode os.FileMode, id string) *File {
 	n := time.Now()
-	return &File{
+	f := &File{
 		attr: fuse.Attr{
 			Inode:  m.nextID(),
 			Atime:  n,
@@ -70,8 +332,39 @@ func (m *HTTPFS) newFile(path string, mode os.FileMode) *File {
 			Mode:   mode,
 		},
 		path: path,
+		id:   id,
 		fs:   m,
 	}
+	m.track(path, f)
+	return f
+}
+
+// EnableOffline enables disconnected operation. Metadata and up to
+// cacheSize bytes of file content read from the server are cached in
+// memory and served while the server is unreachable. Modifications made
+// meanwhile are recorded in a journal in dir and replayed by Monitor
+// when the server returns. It must be called before serving.
+func (m *HTTPFS) EnableOffline(dir string, cacheSize int64) error {
+	o, err := newOffline(dir, cacheSize)
+	if err != nil {
+		return err
+	}
+	m.client.offline = o
+	return nil
+}
+
+// EnableDiskCache keeps file content and directory listings read from
+// the server in dir, up to maxBytes, so that they survive remounts.
+// Cached content is revalidated against the server's metadata (ETag or
+// size and mtime) and refetched when it changed. It must be called
+// before serving.
+func (m *HTTPFS) EnableDiskCache(dir string, maxBytes int64, mode CacheMode) error {
+	d, err := newDiskCache(dir, maxBytes, mode)
+	if err != nil {
+		return err
+	}
+	m.client.disk = d
+	return nil
 }
 
 // Root ...
@@ -0,0 +1,59 @@
+package fsapi
+
+import (
+	"runtime"
+
+	"github.com/prologic/httpfs/utils"
+)
+
+// defaultIgnore holds per OS the names its desktop probes for or keeps
+// metadata in, which aren't worth a round trip to the server.
+var defaultIgnore = map[string][]string{
+	"darwin": {
+		"/DCIM",
+		"/Backups.backupdb",
+		"/mach_kernel",
+		"/.Spotlight-V100",
+		"/.Trashes",
+		"/.fseventsd",
+		"/.metadata_never_index",
+		"/.metadata_never_index_unless_rootfs",
+		".DS_Store",
+		".localized",
+		".hidden",
+		"._*",
+	},
+	"linux": {
+		"/.xdg-volume-info",
+		"/autorun.inf",
+	},
+	"windows": {
+		"desktop.ini",
+		"Thumbs.db",
+		"/$RECYCLE.BIN/",
+		"/System Volume Information/",
+	},
+}
+
+// DefaultIgnorePatterns returns the ignore patterns used by default on
+// the running OS.
+func DefaultIgnorePatterns() []string {
+	return defaultIgnore[runtime.GOOS]
+}
+
+// ignored reports whether path is ignored. Which names are directories
+// isn't known to lookups without asking, so patterns for directories
+// apply to any name, in listings as well so that what is listed can be
+// looked up.
+func (m *HTTPFS) ignored(path string) bool {
+	return m.ignore.Match(path, true)
+}
+
+// WithIgnore replaces the default ignore patterns with those of i.
+// Ignored names are never looked up on the server: they don't exist as
+// far as lookups go and are left out of listings.
+func WithIgnore(i *utils.Ignore) Option {
+	return func(m *HTTPFS) {
+		m.ignore = i
+	}
+}
@@ -0,0 +1,146 @@
+package fsapi
+
+import (
+	pathpkg "path"
+	"sync"
+	"time"
+)
+
+// DefaultMissTTL is how long a lookup of a name that doesn't exist is
+// remembered by default.
+const DefaultMissTTL = 2 * time.Second
+
+// WithMissTTL sets how long lookups of names that don't exist on the
+// server are remembered, so that programs probing for the same missing
+// files over and over don't cost a round trip each time. Names created
+// through the mount, or reported as created by the server's events, are
+// forgotten at once. Zero disables it.
+func WithMissTTL(ttl time.Duration) Option {
+	return func(m *HTTPFS) {
+		m.client.misses = newMisses(ttl)
+	}
+}
+
+// misses remembers the paths that were found not to exist. With a name
+// normalizer it also remembers the names in directories that were
+// listed to find a name that doesn't exist as it is. A nil misses
+// remembers nothing.
+type misses struct {
+	sync.Mutex
+	ttl     time.Duration
+	entries map[string]time.Time
+	keys    map[string]missKeys
+}
+
+// missKeys maps the normalized names in a directory to its entries.
+type missKeys struct {
+	names   map[string]string
+	expires time.Time
+}
+
+func newMisses(ttl time.Duration) *misses {
+	if ttl <= 0 {
+		return nil
+	}
+	return &misses{
+		ttl:     ttl,
+		entries: make(map[string]time.Time),
+		keys:    make(map[string]missKeys),
+	}
+}
+
+// add remembers that path doesn't exist.
+func (m *misses) add(path string) {
+	if m == nil {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+
+	now := time.Now()
+	for p, expires := range m.entries {
+		if now.After(expires) {
+			delete(m.entries, p)
+		}
+	}
+	m.entries[path] = now.Add(m.ttl)
+}
+
+// has reports whether path is known not to exist.
+func (m *misses) has(path string) bool {
+	if m == nil {
+		return false
+	}
+	m.Lock()
+	defer m.Unlock()
+
+	expires, ok := m.entries[path]
+	return ok && time.Now().Before(expires)
+}
+
+// addKeys remembers the entries of the directory dir by their
+// normalized names.
+func (m *misses) addKeys(dir string, names map[string]string) {
+	if m == nil {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+
+	now := time.Now()
+	for p, k := range m.keys {
+		if now.After(k.expires) {
+			delete(m.keys, p)
+		}
+	}
+	m.keys[dir] = missKeys{names: names, expires: now.Add(m.ttl)}
+}
+
+// lookupKey returns the name of the entry of dir with the normalized
+// name key, and whether the entries of dir are known at all.
+func (m *misses) lookupKey(dir, key string) (string, bool) {
+	if m == nil {
+		return "", false
+	}
+	m.Lock()
+	defer m.Unlock()
+
+	k, ok := m.keys[dir]
+	if !ok || !time.Now().Before(k.expires) {
+		return "", false
+	}
+	return k.names[key], true
+}
+
+// forget forgets what is known about path and below, which may have
+// been created.
+func (m *misses) forget(path string) {
+	if m == nil || path == "" {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+
+	for p := range m.entries {
+		if _, ok := within(p, path); ok {
+			delete(m.entries, p)
+		}
+	}
+	// The entries of its directory changed.
+	for p := range m.keys {
+		if _, ok := within(p, path); ok || p == pathpkg.Dir(path) {
+			delete(m.keys, p)
+		}
+	}
+}
+
+// reset forgets everything.
+func (m *misses) reset() {
+	if m == nil {
+		return
+	}
+	m.Lock()
+	m.entries = make(map[string]time.Time)
+	m.keys = make(map[string]missKeys)
+	m.Unlock()
+}
@@ -0,0 +1,381 @@
+package fsapi
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+// DefaultUploadConcurrency is the default number of parts of a multipart
+// upload sent at the same time.
+const DefaultUploadConcurrency = 4
+
+// StartUpload starts a multipart upload of a region of the file at path
+// beginning at offset. Parts (all partSize bytes long but the last)
+// are then sent with UploadPart, in any order and in parallel, and
+// written to the file together by CompleteUpload. The file is created
+// with perm if it doesn't exist.
+func (c Client) StartUpload(ctx context.Context, path string, offset, partSize int64, perm os.FileMode) (string, error) {
+	req := c.NewRequest("UPLOAD", path, nil)
+
+	q := req.URL.Query()
+	q.Add("offset", fmt.Sprintf("%d", offset))
+	q.Add("partsize", fmt.Sprintf("%d", partSize))
+	q.Add("perm", fmt.Sprintf("%d", perm&os.ModePerm))
+	req.URL.RawQuery = q.Encode()
+
+	r, e := c.do(ctx, c.metaTimeout, req)
+	if e != nil {
+		return "", asErrno(e)
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		return "", ErrorFromStatus(r.StatusCode)
+	}
+
+	b, e := ioutil.ReadAll(r.Body)
+	if e != nil {
+		return "", asErrno(e)
+	}
+	return string(b), nil
+}
+
+// UploadPart sends part n of the multipart upload id.
+func (c Client) UploadPart(ctx context.Context, path, id string, n int, data []byte) error {
+	req := c.NewRequest("PART", path, bytes.NewReader(data))
+	c.setDigest(req, bytes.NewReader(data))
+	c.compressBody(req, int64(len(data)), func() io.Reader {
+		return bytes.NewReader(data)
+	})
+
+	q := req.URL.Query()
+	q.Add("upload", id)
+	q.Add("part", fmt.Sprintf("%d", n))
+	req.URL.RawQuery = q.Encode()
+
+	r, e := c.do(ctx, c.dataTimeout, req)
+	if e != nil {
+		return asErrno(e)
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		return ErrorFromStatus(r.StatusCode)
+	}
+	return nil
+}
+
+// CompleteUpload writes parts 0..parts-1 of the multipart upload id to
+// the file.
+func (c Client) CompleteUpload(ctx context.Context, path, id string, parts int) error {
+	req := c.NewRequest("COMPLETE", path, nil)
+
+	q := req.URL.Query()
+	q.Add("upload", id)
+	q.Add("parts", fmt.Sprintf("%d", parts))
+	req.URL.RawQuery = q.Encode()
+
+	r, e := c.do(ctx, c.dataTimeout, req)
+	if e != nil {
+		return asErrno(e)
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		return ErrorFromStatus(r.StatusCode)
+	}
+
+	c.invalidate(offlineOp{Path: path})
+	return nil
+}
+
+// AbortUpload discards the multipart upload id.
+func (c Client) AbortUpload(ctx context.Context, path, id string) error {
+	req := c.NewRequest("ABORT", path, nil)
+
+	q := req.URL.Query()
+	q.Add("upload", id)
+	req.URL.RawQuery = q.Encode()
+
+	r, e := c.do(ctx, c.metaTimeout, req)
+	if e != nil {
+		return asErrno(e)
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		return ErrorFromStatus(r.StatusCode)
+	}
+	return nil
+}
+
+// sequentialWriter collects a run of sequential writes to a file. Once a
+// full part has been collected the run is sent as a multipart upload
+// with up to concurrency parts in flight, and the upload is completed
+// when the run ends. Runs shorter than a part are written in place.
+//
+// If the server can't be reached part way through the upload, the parts
+// sent so far and the rest of the run are written in place instead,
+// which journals them in offline mode. The parts sent are kept until the
+// upload is completed for this when offline mode is enabled.
+type sequentialWriter struct {
+	client   *Client
+	path     string
+	flags    int
+	perm     os.FileMode
+	partSize int64
+
+	start int64
+	next  int64
+	buf   []byte
+
+	id      string
+	parts   int
+	sent    [][]byte
+	inPlace bool
+	sem     chan struct{}
+	wg      sync.WaitGroup
+
+	errLock sync.Mutex
+	err     error
+}
+
+func newSequentialWriter(c *Client, path string, flags int, perm os.FileMode, offset, partSize int64, concurrency int) *sequentialWriter {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &sequentialWriter{
+		client:   c,
+		path:     path,
+		flags:    flags,
+		perm:     perm,
+		partSize: partSize,
+		start:    offset,
+		next:     offset,
+		sem:      make(chan struct{}, concurrency),
+	}
+}
+
+// end returns the offset just past the data written so far.
+func (s *sequentialWriter) end() int64 {
+	return s.next
+}
+
+func (s *sequentialWriter) fail(err error) {
+	s.errLock.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.errLock.Unlock()
+}
+
+func (s *sequentialWriter) error() error {
+	s.errLock.Lock()
+	defer s.errLock.Unlock()
+	return s.err
+}
+
+// disconnected reports whether err means the server couldn't be reached
+// and the run should be journaled offline instead.
+func (s *sequentialWriter) disconnected(err error) bool {
+	return s.client.offline.disconnected(s.client.health, err)
+}
+
+// writeInPlace writes data at offset without an upload.
+func (s *sequentialWriter) writeInPlace(ctx context.Context, data []byte, offset int64) error {
+	if _, err := s.client.WriteAt(ctx, s.path, data, s.flags, s.perm, offset); err != nil {
+		return err
+	}
+	// The file exists now.
+	s.flags &^= os.O_EXCL
+	return nil
+}
+
+// fallBack gives up on the upload, which the server aborts once it has
+// been idle for long enough, and writes the parts sent so far in place.
+// The rest of the run is written in place too.
+func (s *sequentialWriter) fallBack(ctx context.Context) error {
+	s.wg.Wait()
+
+	s.errLock.Lock()
+	s.err = nil
+	s.errLock.Unlock()
+
+	sent := s.sent
+	s.id, s.sent, s.inPlace = "", nil, true
+	for n, part := range sent {
+		if err := s.writeInPlace(ctx, part, s.start+int64(n)*s.partSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write appends buf to the run. It returns ENOSYS if the server doesn't
+// support multipart uploads, in which case buf has been collected but
+// not written.
+func (s *sequentialWriter) write(ctx context.Context, buf []byte) error {
+	if err := s.error(); err != nil {
+		if !s.disconnected(err) {
+			return err
+		}
+		if err := s.fallBack(ctx); err != nil {
+			return err
+		}
+	}
+
+	s.buf = append(s.buf, buf...)
+	s.next += int64(len(buf))
+
+	for int64(len(s.buf)) >= s.partSize {
+		if s.id == "" && !s.inPlace {
+			if s.client.offline.active(s.client.health) {
+				s.inPlace = true
+			} else {
+				id, err := s.client.StartUpload(ctx, s.path, s.start, s.partSize, s.perm)
+				switch {
+				case err == nil:
+					s.id = id
+				case s.disconnected(err):
+					s.inPlace = true
+				default:
+					return err
+				}
+			}
+		}
+
+		part := s.buf[:s.partSize]
+		s.buf = append([]byte(nil), s.buf[s.partSize:]...)
+		if !s.inPlace {
+			s.send(part)
+			continue
+		}
+		if err := s.writeInPlace(ctx, part, s.start+int64(s.parts)*s.partSize); err != nil {
+			return err
+		}
+		s.parts++
+	}
+
+	return nil
+}
+
+// send uploads the next part in the background, waiting for a slot if
+// too many are in flight already.
+func (s *sequentialWriter) send(part []byte) {
+	n := s.parts
+	s.parts++
+	if s.client.offline != nil {
+		s.sent = append(s.sent, part)
+	}
+
+	s.sem <- struct{}{}
+	s.wg.Add(1)
+	go func() {
+		defer func() {
+			<-s.sem
+			s.wg.Done()
+		}()
+		// The request that queued the part may have returned by now,
+		// so the upload can't be tied to its context.
+		if err := s.client.UploadPart(context.Background(), s.path, s.id, n, part); err != nil {
+			s.fail(err)
+		}
+	}()
+}
+
+// finish writes everything collected so far to the file.
+func (s *sequentialWriter) finish(ctx context.Context) error {
+	if s.id != "" {
+		if len(s.buf) > 0 {
+			s.send(s.buf)
+			s.buf = nil
+		}
+		s.wg.Wait()
+
+		err := s.error()
+		if err == nil {
+			err = s.client.CompleteUpload(ctx, s.path, s.id, s.parts)
+		}
+		switch {
+		case err == nil:
+			return nil
+		case s.disconnected(err):
+			return s.fallBack(ctx)
+		case s.error() != nil:
+			s.client.AbortUpload(ctx, s.path, s.id)
+		}
+		return err
+	}
+
+	if len(s.buf) == 0 {
+		return nil
+	}
+	return s.writeInPlace(ctx, s.buf, s.start+int64(s.parts)*s.partSize)
+}
+
+// writeSequential adds a write to the handle's current run of sequential
+// writes, ending the run first if the write doesn't continue it.
+func (h *Handle) writeSequential(ctx context.Context, path string, buf []byte, flags int, offset int64) (int, error) {
+	h.seqLock.Lock()
+	defer h.seqLock.Unlock()
+
+	if h.seq != nil && (h.seq.path != path || h.seq.end() != offset) {
+		if err := h.finishSequential(ctx); err != nil {
+			return 0, err
+		}
+	}
+	if h.seq == nil {
+		h.seq = newSequentialWriter(h.client, path, flags, h.perm, offset, h.partSize, h.concurrency)
+	}
+
+	err := h.seq.write(ctx, buf)
+	if err == fuse.ENOSYS {
+		// The server doesn't support multipart uploads; write in place
+		// from now on.
+		h.partSize = 0
+		err = h.finishSequential(ctx)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+// finishSequential ends the current run of sequential writes. The
+// caller must hold seqLock.
+func (h *Handle) finishSequential(ctx context.Context) error {
+	if h.seq == nil {
+		return nil
+	}
+	err := h.seq.finish(ctx)
+	h.seq = nil
+	return err
+}
+
+// sync writes out any sequential writes collected by the handle.
+func (h *Handle) sync(ctx context.Context) error {
+	h.seqLock.Lock()
+	defer h.seqLock.Unlock()
+	return h.finishSequential(ctx)
+}
+
+// pendingEnd returns the end of the collected but unwritten data.
+func (h *Handle) pendingEnd() (int64, bool) {
+	if h == nil {
+		return 0, false
+	}
+	h.seqLock.Lock()
+	defer h.seqLock.Unlock()
+	if h.seq == nil {
+		return 0, false
+	}
+	return h.seq.end(), true
+}
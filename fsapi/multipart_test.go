@@ -0,0 +1,175 @@
+package fsapi
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+
+	"github.com/prologic/httpfs/utils/tempdir"
+	"github.com/prologic/httpfs/webapi"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newDroppingServer returns a test server with multipart uploads that
+// drops the connection of requests with method while drop is set.
+func newDroppingServer(t *testing.T, method string, drop *int32) *testServer {
+	tmp := tempdir.New(t)
+	h := webapi.FileServer(tmp.Path, false, webapi.WithUploads(time.Hour))
+	return &testServer{
+		tmp: tmp,
+		srv: httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == method && atomic.LoadInt32(drop) != 0 {
+				conn, _, err := w.(http.Hijacker).Hijack()
+				if err == nil {
+					conn.Close()
+				}
+				return
+			}
+			h.ServeHTTP(w, r)
+		})),
+	}
+}
+
+func TestSequentialWriterUpload(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newTestServer(t, webapi.WithUploads(time.Hour))
+	defer s.Close()
+	c := s.client()
+
+	ctx := context.Background()
+	w := newSequentialWriter(c, "/f", os.O_WRONLY|os.O_CREATE, 0644, 0, 4, 2)
+	for _, data := range []string{"0123", "45", "6789ab", "c"} {
+		assert.Nil(w.write(ctx, []byte(data)))
+	}
+	assert.Equal(int64(13), w.end())
+	assert.NotEqual("", w.id)
+	assert.Nil(w.finish(ctx))
+
+	assert.Equal("0123456789abc", s.read("f"))
+	// The staging file is gone.
+	files, err := ioutil.ReadDir(s.tmp.Path)
+	assert.Nil(err)
+	assert.Len(files, 1)
+}
+
+func TestSequentialWriterShortRun(t *testing.T) {
+	assert := assert.New(t)
+
+	// Without multipart uploads on the server, so that the run can't
+	// have been uploaded.
+	s := newTestServer(t)
+	defer s.Close()
+	s.write(t, "f", "0123456789")
+	c := s.client()
+
+	ctx := context.Background()
+	w := newSequentialWriter(c, "/f", os.O_WRONLY, 0644, 2, 4, 2)
+	assert.Nil(w.write(ctx, []byte("ab")))
+	assert.Nil(w.write(ctx, []byte("c")))
+	assert.Equal("", w.id)
+	assert.Nil(w.finish(ctx))
+
+	assert.Equal("01abc56789", s.read("f"))
+}
+
+func TestSequentialWriterNotSupported(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newTestServer(t)
+	defer s.Close()
+	c := s.client()
+
+	ctx := context.Background()
+	w := newSequentialWriter(c, "/f", os.O_WRONLY|os.O_CREATE, 0644, 0, 4, 2)
+	assert.Equal(error(fuse.ENOSYS), w.write(ctx, []byte("012345")))
+	// The data is kept to be written in place.
+	assert.Nil(w.finish(ctx))
+	assert.Equal("012345", s.read("f"))
+}
+
+func TestSequentialWriterOffline(t *testing.T) {
+	for _, method := range []string{"PART", "COMPLETE"} {
+		t.Run(method, func(t *testing.T) {
+			assert := assert.New(t)
+
+			var drop int32
+			s := newDroppingServer(t, method, &drop)
+			defer s.Close()
+			s.write(t, "f", "xxxxxxxxxx")
+			c, o, cleanup := newOfflineClient(t, s)
+			defer cleanup()
+			c.retry.MaxRetries = 0
+
+			ctx := context.Background()
+			_, err := c.Readdir(ctx, "/")
+			assert.Nil(err)
+
+			atomic.StoreInt32(&drop, 1)
+			w := newSequentialWriter(c, "/f", os.O_WRONLY, 0644, 0, 4, 1)
+			for _, data := range []string{"0123", "4567", "89"} {
+				assert.Nil(w.write(ctx, []byte(data)))
+			}
+			assert.Nil(w.finish(ctx))
+			assert.True(c.health.isDown())
+			assert.Equal("xxxxxxxxxx", s.read("f"))
+
+			atomic.StoreInt32(&drop, 0)
+			assert.Nil(replay(c, o))
+			assert.Equal("0123456789", s.read("f"))
+			assert.False(o.pending())
+		})
+	}
+}
+
+func TestSequentialWriterSurvivesReopen(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newTestServer(t, webapi.WithUploads(time.Hour))
+	defer s.Close()
+	s.write(t, "f", "")
+	m := NewHTTPFS(s.srv.URL, false, WithMultipartUploads(4, 2))
+
+	first := openFile(t, m, "f")
+	for i, data := range []string{"0123", "45"} {
+		assert.Nil(writeFile(first, data, int64(4*i)))
+	}
+
+	// Another open of the file leaves the run of the first alone.
+	second := openFile(t, m, "f")
+	assert.Nil(releaseFile(second))
+
+	assert.Nil(writeFile(first, "67", 6))
+	assert.Nil(releaseFile(first))
+	assert.Equal("01234567", s.read("f"))
+}
+
+func TestSequentialWriterFsync(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newTestServer(t, webapi.WithUploads(time.Hour))
+	defer s.Close()
+	s.write(t, "f", "")
+	m := NewHTTPFS(s.srv.URL, false, WithMultipartUploads(4, 2))
+
+	h := openFile(t, m, "f")
+	assert.Nil(writeFile(h, "0123", 0))
+	assert.Nil(writeFile(h, "45", 4))
+	assert.Equal("", s.read("f"))
+
+	// Syncing the file sends the parts of the run.
+	assert.Nil(fsyncFile(t, m, "f"))
+	assert.Equal("012345", s.read("f"))
+
+	assert.Nil(writeFile(h, "6", 6))
+	assert.Nil(releaseFile(h))
+	assert.Equal("0123456", s.read("f"))
+}
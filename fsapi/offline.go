@@ -0,0 +1,532 @@
+package fsapi
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	httpfstypes "github.com/prologic/httpfs/types"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+// baseUnknown is the base version of an offline operation on a path
+// whose server version was not known, which is never checked for
+// conflicts.
+const baseUnknown = "*"
+
+// offlineOp is a modification made while the server was unreachable.
+type offlineOp struct {
+	Op   string
+	Path string
+	Name string `json:",omitempty"`
+
+	// Base is the ETag of Path on the server when it was last seen, or
+	// empty if it didn't exist. It is compared against the server's
+	// ETag on replay to detect conflicting changes.
+	Base string `json:",omitempty"`
+
+	// RequestID is the id of the request that failed to reach the
+	// server, so that the server can deduplicate it if it did.
+	RequestID string `json:",omitempty"`
+
+	Offset int64  `json:",omitempty"`
+	Data   []byte `json:",omitempty"`
+	Flags  int    `json:",omitempty"`
+	Mode   uint32 `json:",omitempty"`
+	Size   uint64 `json:",omitempty"`
+	Soft   bool   `json:",omitempty"`
+	Time   int64
+
+	// Dir and Recursive tell how Path was removed: as a directory, and
+	// with everything in it.
+	Dir       bool `json:",omitempty"`
+	Recursive bool `json:",omitempty"`
+
+	// RawPath and RawName are set to Path and Name in the journal if
+	// they aren't valid UTF-8, which JSON can't carry.
+	RawPath []byte `json:",omitempty"`
+	RawName []byte `json:",omitempty"`
+}
+
+// marshal encodes op for the journal.
+func (op offlineOp) marshal() ([]byte, error) {
+	if !utf8.ValidString(op.Path) {
+		op.RawPath = []byte(op.Path)
+	}
+	if !utf8.ValidString(op.Name) {
+		op.RawName = []byte(op.Name)
+	}
+	return json.Marshal(op)
+}
+
+// unmarshalOp decodes an op from the journal.
+func unmarshalOp(data []byte) (offlineOp, error) {
+	var op offlineOp
+	if err := json.Unmarshal(data, &op); err != nil {
+		return op, err
+	}
+	if op.RawPath != nil {
+		op.Path = string(op.RawPath)
+	}
+	if op.RawName != nil {
+		op.Name = string(op.RawName)
+	}
+	op.RawPath, op.RawName = nil, nil
+	return op, nil
+}
+
+// offline serves cached content while the server can't be reached and
+// records modifications in a journal that is replayed when it returns.
+type offline struct {
+	sync.Mutex
+	// replaying serializes replays, which run without holding the
+	// lock so that operations can keep being recorded meanwhile.
+	replaying sync.Mutex
+	cache     *cache
+	host      string
+	path      string
+	journal   *os.File
+	ops       []offlineOp
+}
+
+// newOffline opens the journal in dir, creating it if necessary. Any
+// operations left over from a previous mount are applied to the cache
+// and replayed once the server is reachable.
+func newOffline(dir string, cacheSize int64) (*offline, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+
+	o := &offline{
+		cache: newCache(cacheSize),
+		host:  host,
+		path:  filepath.Join(dir, "journal"),
+	}
+
+	if f, err := os.Open(o.path); err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 64<<20)
+		for scanner.Scan() {
+			op, err := unmarshalOp(scanner.Bytes())
+			if err != nil {
+				// A torn final record from a crash; drop it.
+				break
+			}
+			o.ops = append(o.ops, op)
+			o.apply(op)
+		}
+		f.Close()
+	}
+
+	if err := o.rewrite(); err != nil {
+		return nil, err
+	}
+
+	return o, nil
+}
+
+// rewrite replaces the journal on disk with o.ops.
+func (o *offline) rewrite() error {
+	tmp := o.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for _, op := range o.ops {
+		data, err := op.marshal()
+		if err == nil {
+			_, err = w.Write(append(data, '\n'))
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+
+	if err := os.Rename(tmp, o.path); err != nil {
+		return err
+	}
+
+	if o.journal != nil {
+		o.journal.Close()
+	}
+	o.journal, err = os.OpenFile(o.path, os.O_WRONLY|os.O_APPEND, 0600)
+	return err
+}
+
+// apply makes op visible in the cache.
+func (o *offline) apply(op offlineOp) {
+	switch op.Op {
+	case httpfstypes.EventCreate:
+		o.cache.create(op.Path, os.FileMode(op.Mode))
+	case httpfstypes.EventWrite:
+		o.cache.write(op.Path, op.Offset, op.Data)
+	case httpfstypes.EventTruncate:
+		o.cache.truncate(op.Path, int64(op.Size))
+	case httpfstypes.EventChmod:
+		o.cache.chmod(op.Path, os.FileMode(op.Mode))
+	case httpfstypes.EventMkdir:
+		o.cache.mkdir(op.Path, os.FileMode(op.Mode))
+	case httpfstypes.EventRemove:
+		o.cache.remove(op.Path)
+	case httpfstypes.EventRename:
+		o.cache.rename(op.Path, op.Name)
+	case httpfstypes.EventLink:
+		o.cache.link(op.Path, op.Name, op.Soft)
+	}
+}
+
+// active reports whether operations should be served offline: while
+// the server is down and until everything recorded meanwhile has been
+// replayed, so that operations reach the server in order.
+func (o *offline) active(h *health) bool {
+	if o == nil {
+		return false
+	}
+	if h.isDown() {
+		return true
+	}
+	o.Lock()
+	defer o.Unlock()
+	return len(o.ops) > 0
+}
+
+// disconnected reports whether err means the server couldn't be
+// reached and the operation should be handled offline instead.
+func (o *offline) disconnected(h *health, err error) bool {
+	return o != nil && err != nil && err != fuse.EINTR && h.isDown()
+}
+
+// record journals op and applies it to the cache.
+func (o *offline) record(op offlineOp) error {
+	o.Lock()
+	defer o.Unlock()
+
+	op.Time = time.Now().Unix()
+	// Write data is the caller's buffer, which FUSE reuses for later
+	// requests once this one is answered.
+	op.Data = append([]byte(nil), op.Data...)
+
+	o.cache.Lock()
+	cf, ok := o.cache.files[op.Path]
+	o.cache.Unlock()
+	switch {
+	case op.Op == httpfstypes.EventCreate || op.Op == httpfstypes.EventMkdir:
+		op.Base = ""
+		if ok && !cf.dirty {
+			op.Base = cf.stat.etag
+		}
+	case !ok || cf.stat.isdir:
+		op.Base = baseUnknown
+	default:
+		op.Base = cf.stat.etag
+	}
+
+	data, err := op.marshal()
+	if err != nil {
+		return err
+	}
+	if _, err := o.journal.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := o.journal.Sync(); err != nil {
+		return err
+	}
+
+	o.ops = append(o.ops, op)
+	o.apply(op)
+
+	return nil
+}
+
+// stat serves Stat from the cache.
+func (o *offline) stat(path string) (os.FileInfo, error) {
+	fi, err := o.cache.stat(path)
+	switch err {
+	case nil:
+		return fi, nil
+	case os.ErrNotExist:
+		return nil, fuse.ENOENT
+	default:
+		return nil, fuse.EIO
+	}
+}
+
+// readdir serves Readdir from the cache.
+func (o *offline) readdir(path string) ([]os.FileInfo, error) {
+	entries, ok := o.cache.listing(path)
+	if !ok {
+		return nil, fuse.EIO
+	}
+	return entries, nil
+}
+
+// readAt serves ReadAt from the cache.
+func (o *offline) readAt(path string, buf []byte, offset int64) (int, error) {
+	n, ok := o.cache.read(path, buf, offset)
+	if !ok {
+		return 0, fuse.EIO
+	}
+	return n, nil
+}
+
+func (o *offline) pending() bool {
+	if o == nil {
+		return false
+	}
+	o.Lock()
+	defer o.Unlock()
+	return len(o.ops) > 0
+}
+
+// conflictName returns the name under which a local version of path is
+// saved when it conflicts with a change made on the server.
+func (o *offline) conflictName(path string) string {
+	return fmt.Sprintf("%s.conflict-%s-%s", path, o.host, time.Now().Format("20060102T150405"))
+}
+
+// serverETag returns the current ETag of path on the server, or "" if
+// it doesn't exist.
+func serverETag(ctx context.Context, c Client, path string) (string, error) {
+	fi, err := c.Stat(ctx, path)
+	if err == fuse.ENOENT {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if fi.IsDir() {
+		return baseUnknown, nil
+	}
+	return fi.(fileStat).etag, nil
+}
+
+// replay sends the journaled operations to the server through c, which
+// must not itself be in offline mode. Changes to files that were also
+// modified on the server, or that the server refuses, are not applied;
+// instead the local version is saved next to the file under
+// conflictName. Replay stops at the first operation that fails because
+// the server is unreachable again. Operations recorded while replaying
+// are kept for the next replay.
+func (o *offline) replay(ctx context.Context, c Client) error {
+	o.replaying.Lock()
+	defer o.replaying.Unlock()
+
+	o.Lock()
+	ops := o.ops
+	o.Unlock()
+
+	if len(ops) == 0 {
+		return nil
+	}
+
+	log.Printf("httpfs: replaying %d offline operations\n", len(ops))
+
+	checked := make(map[string]bool)
+	conflicts := make(map[string]bool)
+
+	for i, op := range ops {
+		err := o.replayOp(ctx, c, op, checked, conflicts)
+		if err != nil && c.health.isDown() {
+			if err := o.done(i); err != nil {
+				log.Printf("E: rewriting offline journal: %s\n", err)
+			}
+			return err
+		}
+		if err != nil {
+			if p := localVersion(op); p != "" {
+				log.Printf("W: offline %s of %s failed: %s\n", op.Op, op.Path, err)
+				conflicts[p] = true
+			} else {
+				log.Printf("W: dropping offline %s of %s: %s\n", op.Op, op.Path, err)
+			}
+		}
+	}
+
+	for p := range conflicts {
+		if err := o.saveConflict(ctx, c, p); err != nil {
+			log.Printf("E: saving conflicting version of %s: %s\n", p, err)
+		}
+	}
+
+	return o.done(len(ops))
+}
+
+// done removes the first n operations, which have been replayed, from
+// the journal.
+func (o *offline) done(n int) error {
+	o.Lock()
+	defer o.Unlock()
+
+	o.ops = o.ops[n:]
+	if len(o.ops) == 0 {
+		o.ops = nil
+		// Local modifications recorded since are still dirty.
+		o.cache.clean()
+	}
+
+	return o.rewrite()
+}
+
+// localVersion returns the path whose local version must be saved as a
+// conflicting version when op fails on replay, or "" if there is
+// nothing to save.
+func localVersion(op offlineOp) string {
+	switch op.Op {
+	case httpfstypes.EventCreate, httpfstypes.EventWrite, httpfstypes.EventTruncate, httpfstypes.EventChmod:
+		return op.Path
+	case httpfstypes.EventRename:
+		return op.Name
+	default:
+		return ""
+	}
+}
+
+// check compares the server version of path with base the first time
+// path is touched during a replay, and marks it conflicting if they
+// differ.
+func (o *offline) check(ctx context.Context, c Client, path, base string, checked, conflicts map[string]bool) error {
+	if checked[path] || base == baseUnknown {
+		checked[path] = true
+		return nil
+	}
+
+	etag, err := serverETag(ctx, c, path)
+	if err != nil {
+		return err
+	}
+
+	checked[path] = true
+	if etag != base && etag != baseUnknown {
+		log.Printf("W: %s was changed on the server while offline\n", path)
+		conflicts[path] = true
+	}
+
+	return nil
+}
+
+func (o *offline) replayOp(ctx context.Context, c Client, op offlineOp, checked, conflicts map[string]bool) error {
+	if op.RequestID != "" {
+		ctx = withRequestID(ctx, op.RequestID)
+	}
+
+	switch op.Op {
+	case httpfstypes.EventCreate, httpfstypes.EventWrite, httpfstypes.EventTruncate, httpfstypes.EventChmod:
+		if err := o.check(ctx, c, op.Path, op.Base, checked, conflicts); err != nil {
+			return err
+		}
+		if conflicts[op.Path] {
+			return nil
+		}
+	}
+
+	switch op.Op {
+	case httpfstypes.EventCreate:
+		_, err := c.WriteAt(ctx, op.Path, nil, os.O_WRONLY|os.O_CREATE|os.O_EXCL, os.FileMode(op.Mode), 0)
+		return err
+	case httpfstypes.EventWrite:
+		_, err := c.WriteAt(ctx, op.Path, op.Data, op.Flags, os.FileMode(op.Mode), op.Offset)
+		return err
+	case httpfstypes.EventTruncate:
+		return c.Truncate(ctx, op.Path, op.Size)
+	case httpfstypes.EventChmod:
+		return c.Chmod(ctx, op.Path, os.FileMode(op.Mode))
+	case httpfstypes.EventMkdir:
+		return c.Mkdir(ctx, op.Path, os.FileMode(op.Mode))
+	case httpfstypes.EventRemove:
+		if conflicts[op.Path] {
+			// The local version was deleted; keep the server's.
+			delete(conflicts, op.Path)
+			return nil
+		}
+		if err := o.check(ctx, c, op.Path, op.Base, checked, conflicts); err != nil {
+			return err
+		}
+		if conflicts[op.Path] {
+			// Don't delete changes made by someone else.
+			delete(conflicts, op.Path)
+			return nil
+		}
+		switch {
+		case op.Recursive:
+			return c.Delete(ctx, op.Path)
+		case op.Dir:
+			return c.Rmdir(ctx, op.Path)
+		default:
+			return c.Unlink(ctx, op.Path)
+		}
+	case httpfstypes.EventRename:
+		if conflicts[op.Path] {
+			// Our version now lives under the new name; leave the
+			// server's version where it is.
+			delete(conflicts, op.Path)
+			conflicts[op.Name] = true
+			checked[op.Name] = true
+			return nil
+		}
+		checked[op.Name] = true
+		return c.Rename(ctx, op.Path, op.Name)
+	case httpfstypes.EventLink:
+		checked[op.Name] = true
+		if op.Soft {
+			return c.Symlink(ctx, op.Path, op.Name)
+		}
+		return c.Link(ctx, op.Path, op.Name)
+	default:
+		return nil
+	}
+}
+
+// saveConflict uploads the local version of path under conflictName.
+// Directories and files that are no longer cached are left alone.
+func (o *offline) saveConflict(ctx context.Context, c Client, path string) error {
+	if fi, err := o.cache.stat(path); err != nil || fi.IsDir() {
+		return nil
+	}
+
+	data := o.cache.content(path)
+	name := o.conflictName(path)
+
+	log.Printf("W: saving local version of %s as %s\n", path, name)
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	_, err := c.WriteAt(ctx, name, data, flags, 0666, 0)
+	return err
+}
+
+type requestIDKey struct{}
+
+// withRequestID returns a context that makes do use id as the request
+// id of non-idempotent requests instead of generating a new one.
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
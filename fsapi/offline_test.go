@@ -0,0 +1,198 @@
+package fsapi
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	httpfstypes "github.com/prologic/httpfs/types"
+	"github.com/prologic/httpfs/utils/tempdir"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newOfflineClient returns a client of s with offline mode enabled,
+// and the offline state.
+func newOfflineClient(t *testing.T, s *testServer) (*Client, *offline, func()) {
+	dir := tempdir.New(t)
+	o, err := newOffline(dir.Path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := s.client()
+	c.offline = o
+	return c, o, dir.Cleanup
+}
+
+// replay replays what o recorded through a copy of c that is online.
+func replay(c *Client, o *offline) error {
+	c.health.set(true)
+	online := *c
+	online.offline = nil
+	return o.replay(context.Background(), online)
+}
+
+func TestOfflineWriteCopiesData(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newTestServer(t)
+	defer s.Close()
+	c, o, cleanup := newOfflineClient(t, s)
+	defer cleanup()
+
+	ctx := context.Background()
+	_, err := c.Readdir(ctx, "/")
+	assert.Nil(err)
+	c.health.set(false)
+
+	buf := []byte("hello")
+	_, err = c.WriteAt(ctx, "/f", buf, os.O_WRONLY|os.O_CREATE, 0644, 0)
+	assert.Nil(err)
+	// FUSE reuses the buffer of a request once it is answered.
+	copy(buf, "XXXXX")
+
+	assert.Nil(replay(c, o))
+	assert.Equal("hello", s.read("f"))
+	assert.False(o.pending())
+}
+
+// conflicts returns the content of the conflicting versions of name
+// saved on s.
+func (s *testServer) conflicts(name string) []string {
+	matches, _ := filepath.Glob(s.path(name + ".conflict-*"))
+	var out []string
+	for _, m := range matches {
+		data, _ := ioutil.ReadFile(m)
+		out = append(out, string(data))
+	}
+	return out
+}
+
+func TestOfflineWriteUnknownFile(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newTestServer(t)
+	defer s.Close()
+	c, o, cleanup := newOfflineClient(t, s)
+	defer cleanup()
+
+	// Nothing is cached, so whether /f exists isn't known.
+	ctx := context.Background()
+	c.health.set(false)
+	_, err := c.WriteAt(ctx, "/f", []byte("hello"), os.O_WRONLY|os.O_CREATE, 0644, 0)
+	assert.Nil(err)
+
+	assert.Nil(replay(c, o))
+	assert.Equal("hello", s.read("f"))
+}
+
+func TestOfflineReplayConflict(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newTestServer(t)
+	defer s.Close()
+	s.write(t, "f", "aaaa")
+	c, o, cleanup := newOfflineClient(t, s)
+	defer cleanup()
+
+	ctx := context.Background()
+	_, err := c.Readdir(ctx, "/")
+	assert.Nil(err)
+	c.health.set(false)
+
+	_, err = c.WriteAt(ctx, "/f", []byte("bbbb"), os.O_WRONLY, 0644, 0)
+	assert.Nil(err)
+	s.write(t, "f", "server")
+
+	assert.Nil(replay(c, o))
+	assert.Equal("server", s.read("f"))
+	assert.Equal([]string{"bbbb"}, s.conflicts("f"))
+	assert.False(o.pending())
+}
+
+func TestOfflineReplayFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newTestServer(t)
+	defer s.Close()
+	c, o, cleanup := newOfflineClient(t, s)
+	defer cleanup()
+
+	ctx := context.Background()
+	c.health.set(false)
+	_, err := c.WriteAt(ctx, "/f", []byte("hello"), os.O_WRONLY|os.O_CREATE, 0644, 0)
+	assert.Nil(err)
+	// The server refuses the write, which isn't a conflict it can
+	// detect in advance.
+	assert.Nil(os.Mkdir(s.path("f"), 0755))
+
+	assert.Nil(replay(c, o))
+	assert.Equal([]string{"hello"}, s.conflicts("f"))
+	assert.False(o.pending())
+}
+
+func TestOfflineRecordDuringReplay(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newTestServer(t)
+	defer s.Close()
+	c, o, cleanup := newOfflineClient(t, s)
+	defer cleanup()
+
+	ctx := context.Background()
+	_, err := c.Readdir(ctx, "/")
+	assert.Nil(err)
+	c.health.set(false)
+	_, err = c.WriteAt(ctx, "/f", []byte("first"), os.O_WRONLY|os.O_CREATE, 0644, 0)
+	assert.Nil(err)
+
+	// Write another file while the first request of the replay is
+	// being served.
+	h := s.srv.Config.Handler
+	var once sync.Once
+	s.srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		once.Do(func() {
+			_, err := c.WriteAt(ctx, "/g", []byte("second"), os.O_WRONLY|os.O_CREATE, 0644, 0)
+			assert.Nil(err)
+		})
+		h.ServeHTTP(w, r)
+	})
+
+	assert.Nil(replay(c, o))
+	assert.Equal("first", s.read("f"))
+	assert.Equal("", s.read("g"))
+	assert.True(o.pending())
+
+	// The write made meanwhile is replayed next time.
+	assert.Nil(replay(c, o))
+	assert.Equal("second", s.read("g"))
+	assert.False(o.pending())
+}
+
+func TestOfflineJournalRawNames(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := tempdir.New(t)
+	defer dir.Cleanup()
+
+	const raw = "/caf\xe9"
+
+	o, err := newOffline(dir.Path, 0)
+	assert.Nil(err)
+	assert.Nil(o.record(offlineOp{Op: httpfstypes.EventRename, Path: raw, Name: raw + "2"}))
+	o.journal.Close()
+
+	// Names that aren't UTF-8 survive the journal on disk.
+	o, err = newOffline(dir.Path, 0)
+	assert.Nil(err)
+	defer o.journal.Close()
+	if assert.Len(o.ops, 1) {
+		assert.Equal(raw, o.ops[0].Path)
+		assert.Equal(raw+"2", o.ops[0].Name)
+	}
+}
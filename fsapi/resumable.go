@@ -0,0 +1,163 @@
+package fsapi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+// Resumable upload headers
+const (
+	UploadOffsetHeader = "Upload-Offset"
+	UploadLengthHeader = "Upload-Length"
+)
+
+// CreateUpload creates a resumable upload of size bytes to the file at
+// path and returns its id. Keep the id to resume the upload with
+// ResumeUpload after a failure, even from another process.
+func (c Client) CreateUpload(ctx context.Context, path string, size int64, perm os.FileMode) (string, error) {
+	req := c.NewRequest("POST", path, nil)
+	req.Header.Set(UploadLengthHeader, fmt.Sprintf("%d", size))
+
+	q := req.URL.Query()
+	q.Add("perm", fmt.Sprintf("%d", perm&os.ModePerm))
+	req.URL.RawQuery = q.Encode()
+
+	r, e := c.do(ctx, c.metaTimeout, req)
+	if e != nil {
+		return "", asErrno(e)
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusCreated {
+		return "", ErrorFromStatus(r.StatusCode)
+	}
+
+	b, e := ioutil.ReadAll(r.Body)
+	if e != nil {
+		return "", asErrno(e)
+	}
+	return string(b), nil
+}
+
+// UploadOffset returns how many bytes of the resumable upload id the
+// server has received.
+func (c Client) UploadOffset(ctx context.Context, path, id string) (int64, error) {
+	req := c.Head(path)
+
+	q := req.URL.Query()
+	q.Add("upload", id)
+	req.URL.RawQuery = q.Encode()
+
+	r, e := c.do(ctx, c.metaTimeout, req)
+	if e != nil {
+		return 0, asErrno(e)
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		return 0, ErrorFromStatus(r.StatusCode)
+	}
+	return SafeParseInt64(r.Header.Get(UploadOffsetHeader)), nil
+}
+
+// patchUpload sends size-offset bytes read from r at offset to the
+// resumable upload id and returns the server's new offset.
+func (c Client) patchUpload(ctx context.Context, path, id string, r io.ReaderAt, offset, size int64) (int64, error) {
+	req := c.NewRequest("PATCH", path, io.NewSectionReader(r, offset, size-offset))
+	req.ContentLength = size - offset
+	req.Header.Set(UploadOffsetHeader, fmt.Sprintf("%d", offset))
+
+	q := req.URL.Query()
+	q.Add("upload", id)
+	req.URL.RawQuery = q.Encode()
+
+	resp, e := c.do(ctx, c.dataTimeout, req)
+	if e != nil {
+		return offset, asErrno(e)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return offset, ErrorFromStatus(resp.StatusCode)
+	}
+	return SafeParseInt64(resp.Header.Get(UploadOffsetHeader)), nil
+}
+
+// verifyUpload checks the file at path against the size bytes of r it
+// was uploaded from, if verification is enabled.
+func (c Client) verifyUpload(ctx context.Context, path string, r io.ReaderAt, size int64) error {
+	if !c.verify {
+		return nil
+	}
+
+	sum, _, err := c.Hash(ctx, path, 0, -1)
+	if err == fuse.ENOSYS {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(r, 0, size)); err != nil {
+		return err
+	}
+	if !bytes.Equal(sum, h.Sum(nil)) {
+		return fuse.EIO
+	}
+	return nil
+}
+
+// ResumeUpload sends the remainder of the resumable upload id, whose
+// content is the size bytes of r, starting at the offset the server
+// reports. Interrupted transfers are resumed from the new offset; in a
+// soft mount it gives up after the retry policy's MaxRetries attempts
+// without progress. When it returns nil the upload has replaced the
+// file at path.
+func (c Client) ResumeUpload(ctx context.Context, path, id string, r io.ReaderAt, size int64) error {
+	failures := 0
+	for {
+		offset, err := c.UploadOffset(ctx, path, id)
+		if err == nil {
+			var next int64
+			next, err = c.patchUpload(ctx, path, id, r, offset, size)
+			if err == nil && next >= size {
+				return c.verifyUpload(ctx, path, r, size)
+			}
+			if next > offset {
+				failures = 0
+				if err == nil {
+					continue
+				}
+			}
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+		}
+
+		switch err {
+		case fuse.ENOENT, fuse.EPERM, fuse.ENOSYS, fuse.EINTR:
+			return err
+		}
+
+		if c.mode == SoftMount && failures >= c.retry.MaxRetries {
+			return err
+		}
+		//log.Printf(" resuming upload %s of %s: %v\n", id, path, err)
+		select {
+		case <-time.After(c.retry.Backoff(failures)):
+		case <-ctx.Done():
+			return errorFromContext(ctx)
+		}
+		failures++
+	}
+}
@@ -0,0 +1,238 @@
+package fsapi
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"math"
+	mathrand "math/rand"
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+// RequestIDHeader carries the client generated id of a non-idempotent
+// request. The server remembers the response to each id for a while, so
+// a retried request is answered from that record instead of being
+// applied a second time.
+const RequestIDHeader = "X-Request-Id"
+
+// RetryPolicy controls how failed requests are retried.
+type RetryPolicy struct {
+	// MaxRetries is the number of times a request is retried after the
+	// first attempt fails in a soft mount. Zero disables retries. Hard
+	// mounts retry indefinitely.
+	MaxRetries int
+
+	// MinBackoff and MaxBackoff bound the exponential backoff between
+	// attempts. The actual delay is chosen at random below the bound
+	// ("full jitter") so that many clients don't retry in lockstep.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy ...
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries: 5,
+	MinBackoff: 100 * time.Millisecond,
+	MaxBackoff: 5 * time.Second,
+}
+
+// Backoff returns the delay before retry number attempt (starting at 0).
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	bound := float64(p.MinBackoff) * math.Pow(2, float64(attempt))
+	if bound > float64(p.MaxBackoff) {
+		bound = float64(p.MaxBackoff)
+	}
+	if bound <= 0 {
+		return 0
+	}
+	return time.Duration(mathrand.Int63n(int64(bound)) + 1)
+}
+
+// SetRetryPolicy sets how c retries failed requests.
+func (c *Client) SetRetryPolicy(p RetryPolicy) {
+	c.retry = p
+}
+
+// newRequestID returns a random id for RequestIDHeader.
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// idempotent reports whether sending req more than once has the same
+// effect as sending it once.
+func idempotent(req *http.Request) bool {
+	switch req.Method {
+	case "HEAD", "GET", "CHMOD", "TRUNCATE":
+		return true
+	case "CHANGES", "EVENTS", "HASH", "SIGNATURE", "EXTENTS", "TRASH", "VERSIONS":
+		// Read only.
+		return true
+	case "PUT":
+		// Writes at an explicit offset are idempotent; appends and
+		// exclusive creates are not.
+		q := req.URL.Query()
+		flags := int(SafeParseInt64(q.Get("flags")))
+		offset := SafeParseInt64(q.Get("offset"))
+		return flags&(os.O_APPEND|os.O_EXCL) == 0 && offset >= 0
+	default:
+		return false
+	}
+}
+
+// retryable reports whether a response status indicates a transient
+// failure worth retrying.
+func retryable(code int) bool {
+	switch code {
+	case http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout,
+		http.StatusTooManyRequests:
+		return true
+	default:
+		return false
+	}
+}
+
+// cancelBody releases the request context once the response body has
+// been consumed, translating read errors caused by the context into the
+// corresponding errno.
+type cancelBody struct {
+	io.ReadCloser
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (b cancelBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && b.ctx.Err() != nil {
+		err = errorFromContext(b.ctx)
+	}
+	return n, err
+}
+
+func (b cancelBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// errorFromContext maps the reason ctx is done to an errno: EINTR if
+// the operation was interrupted (e.g. by the kernel on Ctrl-C) and
+// ETIMEDOUT if it ran out of time.
+func errorFromContext(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return fuse.Errno(syscall.ETIMEDOUT)
+	}
+	return fuse.EINTR
+}
+
+// do sends req, retrying transport errors and transient server errors
+// with exponential backoff. Non-idempotent requests are tagged with a
+// request id first so that the server can deduplicate retries.
+//
+// In a soft mount, timeout (if non-zero) bounds the whole operation and
+// it fails with ETIMEDOUT once the retries are exhausted. In a hard
+// mount, timeout bounds each attempt and the request is retried until
+// the server answers. Either way it is aborted with EINTR when ctx is
+// cancelled.
+func (c Client) do(ctx context.Context, timeout time.Duration, req *http.Request) (*http.Response, error) {
+	if !idempotent(req) && req.Header.Get(RequestIDHeader) == "" {
+		id := requestIDFrom(ctx)
+		if id == "" {
+			id = newRequestID()
+		}
+		req.Header.Set(RequestIDHeader, id)
+	}
+	learn := c.pin(ctx, req)
+
+	var (
+		opCtx    context.Context
+		cancelOp context.CancelFunc
+	)
+	if c.mode == SoftMount && timeout > 0 {
+		opCtx, cancelOp = context.WithTimeout(ctx, timeout)
+	} else {
+		opCtx, cancelOp = context.WithCancel(ctx)
+	}
+
+	for attempt := 0; ; attempt++ {
+		var (
+			attemptCtx    context.Context
+			cancelAttempt context.CancelFunc
+		)
+		if c.mode == HardMount && timeout > 0 {
+			attemptCtx, cancelAttempt = context.WithTimeout(opCtx, timeout)
+		} else {
+			attemptCtx, cancelAttempt = context.WithCancel(opCtx)
+		}
+		release := func() {
+			cancelAttempt()
+			cancelOp()
+		}
+
+		r, err := c.client.Do(req.WithContext(attemptCtx))
+		if opCtx.Err() != nil {
+			if r != nil {
+				r.Body.Close()
+			}
+			release()
+			return nil, errorFromContext(opCtx)
+		}
+
+		if err == nil && !retryable(r.StatusCode) {
+			c.health.set(true)
+			learn(r)
+			r.Body = cancelBody{r.Body, attemptCtx, release}
+			return r, nil
+		}
+
+		if err != nil {
+			c.health.set(false)
+		}
+
+		exhausted := c.mode == SoftMount && attempt >= c.retry.MaxRetries
+		if exhausted || (req.Body != nil && req.GetBody == nil) {
+			if r != nil {
+				r.Body = cancelBody{r.Body, attemptCtx, release}
+				return r, nil
+			}
+			release()
+			if exhausted {
+				return nil, fuse.Errno(syscall.ETIMEDOUT)
+			}
+			return nil, err
+		}
+
+		if r != nil {
+			r.Body.Close()
+		}
+		cancelAttempt()
+
+		//log.Printf(" retrying %s %s (attempt %d): %v\n", req.Method, req.URL, attempt+1, err)
+		select {
+		case <-time.After(c.retry.Backoff(attempt)):
+		case <-c.health.recovered():
+		case <-opCtx.Done():
+			cancelOp()
+			return nil, errorFromContext(opCtx)
+		}
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				cancelOp()
+				return nil, err
+			}
+			req.Body = body
+		}
+	}
+}
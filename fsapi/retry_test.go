@@ -0,0 +1,98 @@
+package fsapi
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdempotent(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewClient("http://localhost", false)
+	for _, method := range []string{"HEAD", "GET", "CHANGES", "HASH", "SIGNATURE", "EXTENTS", "TRASH", "VERSIONS"} {
+		assert.True(idempotent(c.NewRequest(method, "/foo", nil)), method)
+	}
+	for _, method := range []string{"MKDIR", "RENAME", "DELETE", "DELTA", "RESTORE", "PURGE"} {
+		assert.False(idempotent(c.NewRequest(method, "/foo", nil)), method)
+	}
+
+	put := func(flags int, offset string) bool {
+		req := c.NewRequest("PUT", "/foo", nil)
+		q := req.URL.Query()
+		q.Add("flags", fmt.Sprintf("%d", flags))
+		q.Add("offset", offset)
+		req.URL.RawQuery = q.Encode()
+		return idempotent(req)
+	}
+	assert.True(put(os.O_WRONLY, "10"))
+	assert.False(put(os.O_WRONLY|os.O_APPEND, "0"))
+	assert.False(put(os.O_WRONLY|os.O_CREATE|os.O_EXCL, "0"))
+	assert.False(put(os.O_WRONLY, "-10"))
+}
+
+// newHangingServer returns a server that doesn't answer until the
+// returned function is called.
+func newHangingServer() (*httptest.Server, func()) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	return srv, func() {
+		close(release)
+		srv.Close()
+	}
+}
+
+func TestSoftMountTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	srv, cleanup := newHangingServer()
+	defer cleanup()
+
+	c := NewClient(srv.URL, false)
+	c.metaTimeout = 50 * time.Millisecond
+	c.retry = RetryPolicy{MaxRetries: 2, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+	// The timeout bounds the whole operation, retries included.
+	start := time.Now()
+	_, err := c.Stat(context.Background(), "/f")
+	assert.Equal(fuse.Errno(syscall.ETIMEDOUT), err)
+	assert.True(time.Since(start) < time.Second)
+
+	// So does a server that can't be reached once the retries are
+	// exhausted.
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	c = NewClient(down.URL, false)
+	c.retry = RetryPolicy{MaxRetries: 2, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	_, err = c.Stat(context.Background(), "/f")
+	assert.Equal(fuse.Errno(syscall.ETIMEDOUT), err)
+	assert.True(c.health.isDown())
+}
+
+func TestInterrupted(t *testing.T) {
+	assert := assert.New(t)
+
+	srv, cleanup := newHangingServer()
+	defer cleanup()
+
+	for _, mode := range []MountMode{SoftMount, HardMount} {
+		c := NewClient(srv.URL, false)
+		c.mode = mode
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		_, err := c.Stat(ctx, "/f")
+		assert.Equal(fuse.EINTR, err, mode.String())
+	}
+}
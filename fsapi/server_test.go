@@ -0,0 +1,53 @@
+package fsapi
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/prologic/httpfs/utils/tempdir"
+	"github.com/prologic/httpfs/webapi"
+)
+
+// testServer serves a temporary directory to the tests.
+type testServer struct {
+	tmp tempdir.Dir
+	srv *httptest.Server
+}
+
+func newTestServer(t *testing.T, opts ...webapi.Option) *testServer {
+	tmp := tempdir.New(t)
+	return &testServer{
+		tmp: tmp,
+		srv: httptest.NewServer(webapi.FileServer(tmp.Path, false, opts...)),
+	}
+}
+
+func (s *testServer) Close() {
+	s.srv.Close()
+	s.tmp.Cleanup()
+}
+
+// client returns a client of the server.
+func (s *testServer) client() *Client {
+	return NewClient(s.srv.URL, false)
+}
+
+// path returns the local path of name on the server.
+func (s *testServer) path(name string) string {
+	return filepath.Join(s.tmp.Path, filepath.FromSlash(name))
+}
+
+// read returns the content of name on the server.
+func (s *testServer) read(name string) string {
+	data, _ := ioutil.ReadFile(s.path(name))
+	return string(data)
+}
+
+// write sets the content of name on the server.
+func (s *testServer) write(t *testing.T, name, data string) {
+	if err := ioutil.WriteFile(s.path(name), []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
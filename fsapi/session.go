@@ -0,0 +1,92 @@
+package fsapi
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+// Begin starts an atomic write session for the file at path and returns
+// the path of the session's temporary file on the server. Writes to that
+// path become visible at path all at once when the session is committed
+// with Commit. If trunc is false the temporary file starts out as a copy
+// of the file at path; perm is used if the file doesn't exist yet.
+func (c Client) Begin(ctx context.Context, path string, trunc bool, perm os.FileMode) (string, error) {
+	req := c.NewRequest("BEGIN", path, nil)
+
+	q := req.URL.Query()
+	if trunc {
+		q.Add("trunc", "1")
+	}
+	q.Add("perm", fmt.Sprintf("%d", perm&os.ModePerm))
+	req.URL.RawQuery = q.Encode()
+
+	r, e := c.do(ctx, c.dataTimeout, req)
+	if e != nil {
+		return "", asErrno(e)
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		return "", ErrorFromStatus(r.StatusCode)
+	}
+
+	b, e := ioutil.ReadAll(r.Body)
+	if e != nil {
+		return "", asErrno(e)
+	}
+	return string(b), nil
+}
+
+// Commit atomically replaces the target of the session whose temporary
+// file is at session with it.
+func (c Client) Commit(ctx context.Context, session string) error {
+	req := c.NewRequest("COMMIT", session, nil)
+
+	r, e := c.do(ctx, c.dataTimeout, req)
+	if e != nil {
+		return asErrno(e)
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		return ErrorFromStatus(r.StatusCode)
+	}
+
+	return nil
+}
+
+// begin starts the handle's write session, falling back to writing in
+// place if the server doesn't support sessions.
+func (h *Handle) begin(ctx context.Context, trunc bool) error {
+	session, err := h.client.Begin(ctx, h.f.Path(), trunc, h.perm)
+	if err == fuse.ENOSYS {
+		h.atomic = false
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	h.session = session
+	if h.f != nil {
+		h.f.created = false
+	}
+	return nil
+}
+
+// commit commits the handle's write session. The session is kept on
+// failure so that a later flush or close can try again.
+func (h *Handle) commit(ctx context.Context) error {
+	if err := h.client.Commit(ctx, h.session); err != nil {
+		return err
+	}
+	h.client.invalidate(offlineOp{Path: h.session, Name: h.f.Path()})
+	h.session = ""
+	h.replaced()
+	return nil
+}
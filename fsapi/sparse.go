@@ -0,0 +1,125 @@
+package fsapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+
+	httpfstypes "github.com/prologic/httpfs/types"
+)
+
+// Extents and Fallocate are only available to users of the client API:
+// the FUSE library the mount is built on has no fallocate(2) or lseek(2)
+// requests, so fallocate and SEEK_DATA/SEEK_HOLE fail on the mount.
+
+// Fallocate modes
+const (
+	FallocateAllocate  = ""
+	FallocateKeepSize  = "keep-size"
+	FallocatePunchHole = "punch-hole"
+	FallocateZeroRange = "zero-range"
+)
+
+// Extents returns the extents of the file at path between offset and
+// offset+length (the end of the file if length is negative) that hold
+// data. The rest of the range consists of holes.
+func (c Client) Extents(ctx context.Context, path string, offset, length int64) ([]httpfstypes.Extent, error) {
+	var extents []httpfstypes.Extent
+
+	req := c.NewRequest("EXTENTS", path, nil)
+
+	q := req.URL.Query()
+	q.Add("offset", fmt.Sprintf("%d", offset))
+	q.Add("length", fmt.Sprintf("%d", length))
+	req.URL.RawQuery = q.Encode()
+
+	r, e := c.do(ctx, c.metaTimeout, req)
+	if e != nil {
+		return nil, asErrno(e)
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		return nil, ErrorFromStatus(r.StatusCode)
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&extents); err != nil {
+		return nil, fuse.EIO
+	}
+	return extents, nil
+}
+
+// Fallocate allocates, zeroes or deallocates length bytes of the file
+// at path from offset, depending on mode, like fallocate(2).
+func (c Client) Fallocate(ctx context.Context, path, mode string, offset, length int64) error {
+	req := c.NewRequest("FALLOCATE", path, nil)
+
+	q := req.URL.Query()
+	q.Add("mode", mode)
+	q.Add("offset", fmt.Sprintf("%d", offset))
+	q.Add("length", fmt.Sprintf("%d", length))
+	req.URL.RawQuery = q.Encode()
+
+	r, e := c.do(ctx, c.metaTimeout, req)
+	if e != nil {
+		return asErrno(e)
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		return ErrorFromStatus(r.StatusCode)
+	}
+
+	c.invalidate(offlineOp{Path: path})
+	return nil
+}
+
+// byteRanges returns the boundary of a multipart/byteranges response.
+func byteRanges(r *http.Response) (string, bool) {
+	mt, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mt != "multipart/byteranges" {
+		return "", false
+	}
+	return params["boundary"], true
+}
+
+// readByteRanges reads the parts of a multipart/byteranges response to
+// a read of len(buf) bytes at offset into buf; what they don't cover is
+// a hole and reads as zeros. It returns the number of bytes read, up to
+// the end of the last part.
+func readByteRanges(mr *multipart.Reader, buf []byte, offset int64) (int, error) {
+	for i := range buf {
+		buf[i] = 0
+	}
+
+	n := 0
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		var start, end, size int64
+		if _, err := fmt.Sscanf(part.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &size); err != nil {
+			return 0, fuse.EIO
+		}
+		if start < offset || end < start || end-offset >= int64(len(buf)) {
+			return 0, fuse.EIO
+		}
+		if _, err := io.ReadFull(part, buf[start-offset:end-offset+1]); err != nil {
+			return 0, err
+		}
+		if int(end-offset+1) > n {
+			n = int(end - offset + 1)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package fsapi
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+
+	httpfstypes "github.com/prologic/httpfs/types"
+)
+
+// Trash lists the items in the server's trash that were deleted from
+// path or below it, oldest first. It returns ENOSYS if the server keeps
+// no trash.
+func (c Client) Trash(ctx context.Context, path string) ([]httpfstypes.TrashItem, error) {
+	r, e := c.do(ctx, c.metaTimeout, c.NewRequest("TRASH", path, nil))
+	if e != nil {
+		return nil, asErrno(e)
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		return nil, ErrorFromStatus(r.StatusCode)
+	}
+
+	var items []httpfstypes.TrashItem
+	if err := json.NewDecoder(r.Body).Decode(&items); err != nil {
+		return nil, fuse.EIO
+	}
+	return items, nil
+}
+
+// Restore moves the item id out of the server's trash to path, which
+// must not exist.
+func (c Client) Restore(ctx context.Context, id, path string) error {
+	req := c.NewRequest("RESTORE", path, nil)
+
+	q := req.URL.Query()
+	q.Add("id", id)
+	req.URL.RawQuery = q.Encode()
+
+	r, e := c.do(ctx, c.metaTimeout, req)
+	if e != nil {
+		return asErrno(e)
+	}
+	defer r.Body.Close()
+
+	switch r.StatusCode {
+	case http.StatusOK:
+	case http.StatusConflict:
+		return fuse.EEXIST
+	default:
+		return ErrorFromStatus(r.StatusCode)
+	}
+	c.invalidate(offlineOp{Op: httpfstypes.EventCreate, Path: path})
+	return nil
+}
+
+// Purge removes the item id from the server's trash for good, or if id
+// is empty all items deleted from path or below it.
+func (c Client) Purge(ctx context.Context, path, id string) error {
+	req := c.NewRequest("PURGE", path, nil)
+
+	if id != "" {
+		q := req.URL.Query()
+		q.Add("id", id)
+		req.URL.RawQuery = q.Encode()
+	}
+
+	r, e := c.do(ctx, c.metaTimeout, req)
+	if e != nil {
+		return asErrno(e)
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		return ErrorFromStatus(r.StatusCode)
+	}
+	return nil
+}
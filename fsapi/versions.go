@@ -0,0 +1,265 @@
+package fsapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	//"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+
+	httpfstypes "github.com/prologic/httpfs/types"
+)
+
+// VersionsDir is the name of the read-only directory in the root of the
+// mount that exposes the previous versions of files kept by the server.
+// It mirrors the directories of the mount, with each file a directory
+// holding its versions named by their id, e.g. /.versions/a/b/<id> is a
+// version of /a/b. It isn't listed, only looked up.
+const VersionsDir = ".versions"
+
+// WithVersions exposes the previous versions of files kept by the
+// server in the VersionsDir directory.
+func WithVersions() Option {
+	return func(m *HTTPFS) {
+		m.versions = true
+	}
+}
+
+// Versions returns the previous versions of the file at path kept by
+// the server, newest first. It returns ENOSYS if the server doesn't keep
+// versions.
+func (c Client) Versions(ctx context.Context, path string) ([]httpfstypes.Version, error) {
+	r, e := c.do(ctx, c.metaTimeout, c.NewRequest("VERSIONS", path, nil))
+	if e != nil {
+		return nil, asErrno(e)
+	}
+	defer r.Body.Close()
+
+	switch r.StatusCode {
+	case http.StatusOK:
+	case http.StatusMethodNotAllowed:
+		// A server from before versioning was added.
+		return nil, fuse.ENOSYS
+	default:
+		return nil, ErrorFromStatus(r.StatusCode)
+	}
+
+	var list []httpfstypes.Version
+	if err := json.NewDecoder(r.Body).Decode(&list); err != nil {
+		return nil, fuse.EIO
+	}
+	return list, nil
+}
+
+// ReadVersion reads from the version id of the file at path into buf at
+// offset.
+func (c Client) ReadVersion(ctx context.Context, path, id string, buf []byte, offset int64) (int, error) {
+	req := c.Get(path)
+	q := req.URL.Query()
+	q.Add("version", id)
+	req.URL.RawQuery = q.Encode()
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+int64(len(buf))-1))
+
+	r, err := c.do(ctx, c.dataTimeout, req)
+	if err != nil {
+		return 0, asErrno(err)
+	}
+	defer r.Body.Close()
+
+	switch r.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusRequestedRangeNotSatisfiable:
+		return 0, io.EOF
+	case http.StatusOK:
+		if _, err := io.CopyN(ioutil.Discard, r.Body, offset); err != nil {
+			return 0, io.EOF
+		}
+	default:
+		return 0, ErrorFromStatus(r.StatusCode)
+	}
+
+	n, err := io.ReadFull(r.Body, buf)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		err = nil
+	}
+	if err != nil {
+		return n, asErrno(err)
+	}
+	return n, nil
+}
+
+var _ fs.Node = (*versionsDir)(nil)
+var _ fs.NodeStringLookuper = (*versionsDir)(nil)
+var _ fs.HandleReadDirAller = (*versionsDir)(nil)
+
+// versionsDir mirrors the directory path in VersionsDir.
+type versionsDir struct {
+	attr fuse.Attr
+	path string
+	fs   *HTTPFS
+}
+
+func (m *HTTPFS) newVersionsDir(path string) *versionsDir {
+	return &versionsDir{
+		attr: fuse.Attr{Inode: m.nextID(), Mode: os.ModeDir | 0555},
+		path: path,
+		fs:   m,
+	}
+}
+
+// Attr ...
+func (d *versionsDir) Attr(ctx context.Context, o *fuse.Attr) error {
+	*o = d.attr
+	return nil
+}
+
+// Lookup ...
+func (d *versionsDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	path := filepath.Join(d.path, name)
+	stats, err := d.fs.client.Stat(ctx, path)
+	if err != nil {
+		return nil, asErrno(err)
+	}
+
+	switch {
+	case stats.IsDir():
+		return d.fs.newVersionsDir(path), nil
+	case stats.Mode().IsRegular():
+		return &versionList{
+			attr: fuse.Attr{Inode: d.fs.nextID(), Mode: os.ModeDir | 0555},
+			path: path,
+			fs:   d.fs,
+		}, nil
+	default:
+		return nil, fuse.ENOENT
+	}
+}
+
+// ReadDirAll ...
+func (d *versionsDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	files, err := d.fs.client.Readdir(ctx, d.path)
+	if err != nil {
+		return nil, asErrno(err)
+	}
+
+	var out []fuse.Dirent
+	for _, node := range files {
+		if !node.IsDir() && !node.Mode().IsRegular() {
+			continue
+		}
+		if d.fs.ignored(filepath.Join(d.path, node.Name())) {
+			continue
+		}
+		// Files are directories of their versions.
+		out = append(out, fuse.Dirent{Name: node.Name(), Type: fuse.DT_Dir})
+	}
+	return out, nil
+}
+
+var _ fs.Node = (*versionList)(nil)
+var _ fs.NodeStringLookuper = (*versionList)(nil)
+var _ fs.HandleReadDirAller = (*versionList)(nil)
+
+// versionList lists the versions of the file path.
+type versionList struct {
+	attr fuse.Attr
+	path string
+	fs   *HTTPFS
+}
+
+// Attr ...
+func (l *versionList) Attr(ctx context.Context, o *fuse.Attr) error {
+	*o = l.attr
+	return nil
+}
+
+// Lookup ...
+func (l *versionList) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	list, err := l.fs.client.Versions(ctx, l.path)
+	if err != nil {
+		return nil, asErrno(err)
+	}
+	for _, v := range list {
+		if v.ID == name {
+			mtime := time.Unix(v.ModTime, 0)
+			return &versionFile{
+				attr: fuse.Attr{
+					Inode:  l.fs.nextID(),
+					Size:   uint64(v.Size),
+					Mode:   0444,
+					Atime:  mtime,
+					Mtime:  mtime,
+					Ctime:  time.Unix(v.Time, 0),
+					Crtime: mtime,
+				},
+				path: l.path,
+				id:   v.ID,
+				fs:   l.fs,
+			}, nil
+		}
+	}
+	return nil, fuse.ENOENT
+}
+
+// ReadDirAll ...
+func (l *versionList) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	list, err := l.fs.client.Versions(ctx, l.path)
+	if err != nil {
+		return nil, asErrno(err)
+	}
+
+	var out []fuse.Dirent
+	for _, v := range list {
+		out = append(out, fuse.Dirent{Name: v.ID, Type: fuse.DT_File})
+	}
+	return out, nil
+}
+
+var _ fs.Node = (*versionFile)(nil)
+var _ fs.NodeOpener = (*versionFile)(nil)
+var _ fs.HandleReader = (*versionFile)(nil)
+
+// versionFile is the version id of the file path. Versions never
+// change, so their content may stay cached.
+type versionFile struct {
+	attr fuse.Attr
+	path string
+	id   string
+	fs   *HTTPFS
+}
+
+// Attr ...
+func (v *versionFile) Attr(ctx context.Context, o *fuse.Attr) error {
+	*o = v.attr
+	return nil
+}
+
+// Open ...
+func (v *versionFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	if !req.Flags.IsReadOnly() {
+		return nil, fuse.Errno(syscall.EROFS)
+	}
+	resp.Flags |= fuse.OpenKeepCache
+	return v, nil
+}
+
+// Read ...
+func (v *versionFile) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	buf := make([]byte, req.Size)
+	n, err := v.fs.client.ReadVersion(ctx, v.path, v.id, buf, req.Offset)
+	if err != nil && err != io.EOF {
+		//log.Printf(" E: %s\n", err)
+		return asErrno(err)
+	}
+	resp.Data = buf[:n]
+	return nil
+}
@@ -0,0 +1,189 @@
+package fsapi
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	pathpkg "path"
+
+	"golang.org/x/net/context"
+
+	"github.com/prologic/httpfs/utils"
+)
+
+// wholeFile configures fetch-on-open, upload-on-close operation: files
+// up to maxSize bytes (any size if maxSize is 0) are downloaded to a
+// temporary file in dir when opened, read and written locally, and
+// uploaded in one piece when closed if they were modified. This gives
+// close-to-open consistency: an open sees everything written by closes
+// that completed before it, and other clients see a file either as it
+// was before or after a close, never half written.
+type wholeFile struct {
+	enabled bool
+	maxSize int64
+	dir     string
+}
+
+// wants reports whether a file of the given size should be opened in
+// whole-file mode.
+func (w wholeFile) wants(size int64) bool {
+	return w.enabled && (w.maxSize == 0 || size <= w.maxSize)
+}
+
+// openLocal creates the (already unlinked) local copy of a file.
+func (w wholeFile) openLocal() (*os.File, error) {
+	f, err := ioutil.TempFile(w.dir, "httpfs-")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(f.Name())
+	return f, nil
+}
+
+// Download copies the content of the file at path into w.
+func (c Client) Download(ctx context.Context, path string, w io.Writer) error {
+	req := c.Get(path)
+	c.acceptCompressed(req)
+
+	r, err := c.do(ctx, c.dataTimeout, req)
+	if err != nil {
+		return asErrno(err)
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		return ErrorFromStatus(r.StatusCode)
+	}
+
+	body, err := responseBody(r)
+	if err != nil {
+		return asErrno(err)
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		return asErrno(err)
+	}
+	return nil
+}
+
+// Upload atomically replaces the file at path with size bytes read from
+// r. The content is written to a temporary sibling first which is then
+// renamed over path, so readers never see a partial upload. The server
+// removes the temporary file if the upload is abandoned.
+func (c Client) Upload(ctx context.Context, path string, r io.ReaderAt, size int64, perm os.FileMode) error {
+	tmp := pathpkg.Join(pathpkg.Dir(path), utils.TempName(pathpkg.Base(path), "put", newRequestID()[:16]))
+
+	req := c.Put(tmp, io.NewSectionReader(r, 0, size))
+	req.ContentLength = size
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(io.NewSectionReader(r, 0, size)), nil
+	}
+	if err := c.setDigest(req, io.NewSectionReader(r, 0, size)); err != nil {
+		return asErrno(err)
+	}
+	c.compressBody(req, size, func() io.Reader {
+		return io.NewSectionReader(r, 0, size)
+	})
+
+	q := req.URL.Query()
+	q.Add("flags", fmt.Sprintf("%d", os.O_WRONLY|os.O_CREATE|os.O_EXCL))
+	q.Add("perm", fmt.Sprintf("%d", perm&os.ModePerm))
+	q.Add("offset", "0")
+	req.URL.RawQuery = q.Encode()
+
+	resp, err := c.do(ctx, c.dataTimeout, req)
+	if err != nil {
+		return asErrno(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode != http.StatusConflict {
+			c.remove(ctx, "UNLINK", tmp)
+		}
+		return ErrorFromStatus(resp.StatusCode)
+	}
+
+	if err := c.Rename(ctx, tmp, path); err != nil {
+		c.remove(ctx, "UNLINK", tmp)
+		return err
+	}
+	return nil
+}
+
+// fetch downloads the file into a new local copy.
+func (h *Handle) fetch(ctx context.Context, w wholeFile) error {
+	local, err := w.openLocal()
+	if err != nil {
+		return err
+	}
+	if err := h.client.Download(ctx, h.f.Path(), local); err != nil {
+		local.Close()
+		return err
+	}
+	h.local = local
+	h.opens = 1
+	return nil
+}
+
+// create starts a local copy of a file that doesn't exist on the server
+// yet. It is uploaded when closed even if nothing was written.
+func (h *Handle) create(w wholeFile) error {
+	local, err := w.openLocal()
+	if err != nil {
+		return err
+	}
+	h.local = local
+	h.opens = 1
+	h.dirty = true
+	return nil
+}
+
+// localSize returns the size of the local copy if it has been modified.
+func (h *Handle) localSize() (int64, bool) {
+	if h == nil || h.local == nil || !h.dirty {
+		return 0, false
+	}
+	fi, err := h.local.Stat()
+	if err != nil {
+		return 0, false
+	}
+	return fi.Size(), true
+}
+
+// truncate resizes the local copy.
+func (h *Handle) truncate(size int64) error {
+	if err := h.local.Truncate(size); err != nil {
+		return err
+	}
+	h.dirty = true
+	return nil
+}
+
+// upload uploads the local copy if it has been modified.
+func (h *Handle) upload(ctx context.Context) error {
+	if h.local == nil || !h.dirty {
+		return nil
+	}
+
+	fi, err := h.local.Stat()
+	if err != nil {
+		return err
+	}
+	if h.f != nil && !h.f.created && h.f.fs.deltaBlock > 0 {
+		err = h.client.SyncFile(ctx, h.f.Path(), h.local, fi.Size(), h.perm, h.f.fs.deltaBlock)
+	} else {
+		err = h.client.Upload(ctx, h.f.Path(), h.local, fi.Size(), h.perm)
+	}
+	if err != nil {
+		return err
+	}
+
+	h.dirty = false
+	if h.f != nil {
+		h.f.created = false
+	}
+	h.replaced()
+	return nil
+}
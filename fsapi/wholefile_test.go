@@ -0,0 +1,163 @@
+package fsapi
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+
+	"github.com/prologic/httpfs/utils/tempdir"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newWholeFileFS returns a file system of s in whole-file mode for
+// files up to maxSize bytes.
+func newWholeFileFS(t *testing.T, s *testServer, maxSize int64) (*HTTPFS, func()) {
+	dir := tempdir.New(t)
+	return NewHTTPFS(s.srv.URL, false, WithWholeFile(maxSize, dir.Path)), dir.Cleanup
+}
+
+// openFile looks up and opens name in the root of m.
+func openFile(t *testing.T, m *HTTPFS, name string) *Handle {
+	ctx := context.Background()
+	node, err := m.root.Lookup(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &fuse.OpenRequest{Flags: fuse.OpenReadWrite}
+	h, err := node.(*File).Open(ctx, req, &fuse.OpenResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h.(*Handle)
+}
+
+func readFile(h *Handle, size int) string {
+	req := &fuse.ReadRequest{Size: size}
+	resp := &fuse.ReadResponse{Data: make([]byte, size)}
+	if err := h.Read(context.Background(), req, resp); err != nil {
+		return err.Error()
+	}
+	return string(resp.Data)
+}
+
+func writeFile(h *Handle, data string, offset int64) error {
+	req := &fuse.WriteRequest{Data: []byte(data), Offset: offset, FileFlags: fuse.OpenReadWrite}
+	return h.Write(context.Background(), req, &fuse.WriteResponse{})
+}
+
+func releaseFile(h *Handle) error {
+	return h.Release(context.Background(), &fuse.ReleaseRequest{})
+}
+
+func TestWholeFileFetchOnOpen(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newTestServer(t)
+	defer s.Close()
+	s.write(t, "f", "hello")
+	s.write(t, "big", "hello world")
+	m, cleanup := newWholeFileFS(t, s, 5)
+	defer cleanup()
+
+	f := openFile(t, m, "f")
+	big := openFile(t, m, "big")
+	assert.NotNil(f.local)
+	assert.Nil(big.local)
+
+	// Reads are served from the copy made when the file was opened;
+	// larger files are read from the server.
+	s.write(t, "f", "HELLO")
+	s.write(t, "big", "HELLO WORLD")
+	assert.Equal("hello", readFile(f, 5))
+	assert.Equal("HELLO WORLD", readFile(big, 11))
+
+	assert.Nil(releaseFile(f))
+	assert.Nil(releaseFile(big))
+	// Nothing was written, so nothing is uploaded.
+	assert.Equal("HELLO", s.read("f"))
+}
+
+func TestWholeFileSharesLocalCopy(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newTestServer(t)
+	defer s.Close()
+	s.write(t, "f", "hello")
+	m, cleanup := newWholeFileFS(t, s, 0)
+	defer cleanup()
+
+	f := openFile(t, m, "f")
+	local := f.local
+	assert.True(f == openFile(t, m, "f"))
+	assert.Equal(local, f.local)
+	assert.Equal(2, f.opens)
+
+	assert.Nil(writeFile(f, "j", 0))
+	assert.Equal("jello", readFile(f, 5))
+
+	// Closing one leaves the copy to the other.
+	assert.Nil(releaseFile(f))
+	assert.Equal(local, f.local)
+	assert.Nil(writeFile(f, "y", 0))
+	assert.Equal("yello", readFile(f, 5))
+
+	assert.Nil(releaseFile(f))
+	assert.Nil(f.local)
+	assert.Empty(f.f.handles)
+	assert.Equal("yello", s.read("f"))
+}
+
+func TestWholeFileUploadOnClose(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newTestServer(t)
+	defer s.Close()
+	s.write(t, "f", "hello")
+	m, cleanup := newWholeFileFS(t, s, 0)
+	defer cleanup()
+
+	f := openFile(t, m, "f")
+	assert.Nil(writeFile(f, " world", 5))
+
+	// Others don't see the changes until the file is closed.
+	assert.Equal("hello", s.read("f"))
+	assert.Nil(releaseFile(f))
+	assert.Equal("hello world", s.read("f"))
+
+	// The upload went through a temporary file that is gone now.
+	names, err := ioutil.ReadDir(s.tmp.Path)
+	assert.Nil(err)
+	if assert.Len(names, 1) {
+		assert.Equal("f", names[0].Name())
+	}
+
+	// New files are uploaded even if nothing was written.
+	ctx := context.Background()
+	req := &fuse.CreateRequest{Name: "g", Flags: fuse.OpenReadWrite | fuse.OpenCreate, Mode: 0644}
+	_, h, err := m.root.Create(ctx, req, &fuse.CreateResponse{})
+	if assert.Nil(err) {
+		assert.Nil(releaseFile(h.(*Handle)))
+	}
+	_, err = ioutil.ReadFile(s.path("g"))
+	assert.Nil(err)
+}
+
+func TestWholeFileFetchCompressed(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newTestServer(t)
+	defer s.Close()
+	data := strings.Repeat("hello world ", 1000)
+	s.write(t, "f", data)
+	dir := tempdir.New(t)
+	defer dir.Cleanup()
+	m := NewHTTPFS(s.srv.URL, false, WithWholeFile(0, dir.Path), WithCompression(DefaultCompressMin))
+
+	f := openFile(t, m, "f")
+	assert.Equal(data, readFile(f, len(data)))
+	assert.Nil(releaseFile(f))
+}
@@ -1,5 +1,10 @@
 package types
 
+import (
+	"time"
+	"unicode/utf8"
+)
+
 // Entry ...
 type Entry struct {
 	Name    string
@@ -7,4 +12,161 @@ type Entry struct {
 	Mode    uint32
 	ModTime int64
 	IsDir   bool
+	ETag    string `json:",omitempty"`
+
+	// RawName is set to the name if it isn't valid UTF-8, which JSON
+	// can't carry in Name.
+	RawName []byte `json:",omitempty"`
+}
+
+// FileName returns the entry's name.
+func (e Entry) FileName() string {
+	if e.RawName != nil {
+		return string(e.RawName)
+	}
+	return e.Name
+}
+
+// Event operations
+const (
+	EventCreate   = "create"
+	EventWrite    = "write"
+	EventTruncate = "truncate"
+	EventRemove   = "remove"
+	EventMkdir    = "mkdir"
+	EventChmod    = "chmod"
+	EventRename   = "rename"
+	EventLink     = "link"
+	EventOverflow = "overflow"
+)
+
+// Rename flags, the flags= parameter of RENAME. They have the values of
+// renameat2(2)'s RENAME_NOREPLACE and RENAME_EXCHANGE.
+const (
+	// RenameNoReplace fails the rename if the destination exists.
+	RenameNoReplace = 1 << iota
+	// RenameExchange atomically swaps the source and the destination,
+	// which must both exist.
+	RenameExchange
+)
+
+// Event describes a change to a path under the served root. Path is
+// always absolute with respect to the root, e.g. "/foo/bar.txt". Name
+// is the destination path of a rename or link.
+//
+// Seq is only set for events read from the change journal.
+type Event struct {
+	Seq  uint64 `json:",omitempty"`
+	Op   string
+	Path string
+	Name string `json:",omitempty"`
+	Time int64
+
+	// RawPath and RawName are set to Path and Name if they aren't
+	// valid UTF-8, which JSON can't carry.
+	RawPath []byte `json:",omitempty"`
+	RawName []byte `json:",omitempty"`
+}
+
+// NewEvent returns an event for op on path happening now. name is the
+// destination of a rename or link and empty otherwise.
+func NewEvent(op, path, name string) Event {
+	e := Event{
+		Op:   op,
+		Path: path,
+		Name: name,
+		Time: time.Now().Unix(),
+	}
+	if !utf8.ValidString(path) {
+		e.RawPath = []byte(path)
+	}
+	if !utf8.ValidString(name) {
+		e.RawName = []byte(name)
+	}
+	return e
+}
+
+// FilePath returns the event's path.
+func (e Event) FilePath() string {
+	if e.RawPath != nil {
+		return string(e.RawPath)
+	}
+	return e.Path
+}
+
+// DestPath returns the destination path of a rename or link.
+func (e Event) DestPath() string {
+	if e.RawName != nil {
+		return string(e.RawName)
+	}
+	return e.Name
+}
+
+// Changes is the response to a CHANGES request. Next is the cursor to
+// pass as since= on the following request. More is set when the
+// response was truncated by a limit. Resync is set when the requested
+// cursor is older than the journal retains, in which case Events is
+// empty and the caller must walk the tree to resynchronize before
+// continuing from Next.
+type Changes struct {
+	Events []Event
+	Next   uint64
+	More   bool
+	Resync bool
+}
+
+// BlockSum is the signature of one block of a file: a weak rolling
+// checksum (see utils.Rolling) and the block's SHA-256.
+type BlockSum struct {
+	Weak   uint32
+	Strong []byte
+}
+
+// Signature is the response to a SIGNATURE request. It lists the sums
+// of the file's consecutive blocks of BlockSize bytes, the last of which
+// may be shorter. ETag identifies the version of the file it describes.
+type Signature struct {
+	BlockSize int64
+	Size      int64
+	ETag      string
+	Blocks    []BlockSum
+}
+
+// DeltaOp is one instruction of a DELTA request, which rebuilds a file
+// from pieces of its current content and new data: either copy Length
+// bytes of the current file starting at Offset, or append Data.
+type DeltaOp struct {
+	Offset int64  `json:",omitempty"`
+	Length int64  `json:",omitempty"`
+	Data   []byte `json:",omitempty"`
+}
+
+// Extent is a range of a file that holds data, as opposed to a hole.
+type Extent struct {
+	Offset int64
+	Length int64
+}
+
+// TrashItem is a file or directory that was deleted into the server's
+// trash. Path is where it was deleted from, Deleted the Unix time it was
+// deleted at and Client who deleted it.
+type TrashItem struct {
+	ID      string
+	Path    string
+	Deleted int64
+	Client  string
+	IsDir   bool
+	Size    int64
+}
+
+// Version is a previous version of a file kept by the server. Time is
+// the Unix time it was replaced at; ModTime and ETag are those of its
+// content when it was current.
+type Version struct {
+	ID      string
+	Path    string
+	Time    int64
+	Size    int64
+	ModTime int64
+	ETag    string
 }
@@ -0,0 +1,33 @@
+package utils
+
+import (
+	"strings"
+)
+
+const upperhex = "0123456789ABCDEF"
+
+// EscapePath returns the canonical URL encoding of a file path used by
+// the protocol: every byte other than '/' and the unreserved characters
+// of RFC 3986 (letters, digits, '-', '.', '_' and '~') is percent-encoded.
+// Any POSIX file name, including ones that aren't valid UTF-8, survives
+// the round trip through a URL (decoded as net/url does) unchanged.
+func EscapePath(p string) string {
+	var b strings.Builder
+	b.Grow(len(p))
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if unreserved(c) || c == '/' {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(upperhex[c>>4])
+		b.WriteByte(upperhex[c&15])
+	}
+	return b.String()
+}
+
+func unreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
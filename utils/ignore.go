@@ -0,0 +1,177 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// ignorePattern is a single compiled line of an ignore file.
+type ignorePattern struct {
+	re       *regexp.Regexp
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// Ignore is a list of gitignore-style patterns selecting paths to leave
+// out. A pattern without a slash matches a name at any depth, one with a
+// slash (other than a trailing one) matches a path relative to the root,
+// a trailing slash matches directories only, "*" and "?" match within a
+// name, "**" matches across directories and a leading "!" re-includes
+// what earlier patterns left out. Everything below a directory that is
+// left out is left out too. A nil *Ignore matches nothing.
+type Ignore struct {
+	patterns []ignorePattern
+}
+
+// NewIgnore returns an Ignore holding the given patterns, one per line
+// of an ignore file.
+func NewIgnore(patterns ...string) *Ignore {
+	i := &Ignore{}
+	i.Add(patterns...)
+	return i
+}
+
+// Add appends patterns, which take precedence over the existing ones.
+// Blank lines and comments starting with "#" are skipped.
+func (i *Ignore) Add(patterns ...string) {
+	for _, line := range patterns {
+		if p, ok := parseIgnorePattern(line); ok {
+			i.patterns = append(i.patterns, p)
+		}
+	}
+}
+
+// AddFile appends the patterns in the ignore file at name.
+func (i *Ignore) AddFile(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var lines []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		lines = append(lines, s.Text())
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	i.Add(lines...)
+	return nil
+}
+
+// Match reports whether the path p, relative to the root the patterns
+// apply to, is left out. isDir tells whether p is a directory.
+func (i *Ignore) Match(p string, isDir bool) bool {
+	if i == nil || len(i.patterns) == 0 {
+		return false
+	}
+	rel := strings.Trim(path.Clean("/"+p), "/")
+	if rel == "" {
+		return false
+	}
+	parts := strings.Split(rel, "/")
+	for k := 1; k <= len(parts); k++ {
+		if i.match(strings.Join(parts[:k], "/"), k < len(parts) || isDir) {
+			return true
+		}
+	}
+	return false
+}
+
+func (i *Ignore) match(rel string, isDir bool) bool {
+	ignored := false
+	for _, p := range i.patterns {
+		if p.dirOnly && !isDir {
+			continue
+		}
+		target := rel
+		if !p.anchored {
+			target = path.Base(rel)
+		}
+		if p.re.MatchString(target) {
+			ignored = !p.negate
+		}
+	}
+	return ignored
+}
+
+func parseIgnorePattern(line string) (ignorePattern, bool) {
+	var p ignorePattern
+
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return p, false
+	}
+	if strings.HasPrefix(line, "!") {
+		p.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if strings.Contains(line, "/") {
+		p.anchored = true
+		line = strings.TrimLeft(line, "/")
+	}
+	if line == "" {
+		return p, false
+	}
+
+	re, err := regexp.Compile("^" + globToRegexp(line) + "$")
+	if err != nil {
+		return p, false
+	}
+	p.re = re
+	return p, true
+}
+
+// globToRegexp translates a gitignore glob into a regular expression.
+func globToRegexp(glob string) string {
+	var b bytes.Buffer
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "/**") && i+3 == len(glob):
+			b.WriteString("/.*")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '\\' && i+1 < len(glob):
+			i++
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Normalizer holds the rules for comparing and creating file names: the
+// Unicode normalization form names of new files are converted to, and
+// whether lookups ignore case. A nil *Normalizer leaves names alone.
+type Normalizer struct {
+	form       norm.Form
+	normalize  bool
+	ignoreCase bool
+}
+
+// NewNormalizer returns a Normalizer converting new names to form, one
+// of "nfc", "nfd" or "" to keep them as they are, and comparing names
+// without regard to case if ignoreCase is set. Names are always compared
+// without regard to their normalization form.
+func NewNormalizer(form string, ignoreCase bool) (*Normalizer, error) {
+	n := &Normalizer{ignoreCase: ignoreCase}
+	switch strings.ToLower(form) {
+	case "":
+	case "nfc":
+		n.form, n.normalize = norm.NFC, true
+	case "nfd":
+		n.form, n.normalize = norm.NFD, true
+	default:
+		return nil, fmt.Errorf("unknown normalization form %q", form)
+	}
+	return n, nil
+}
+
+// Normalize returns name in the normalization form of new names.
+func (n *Normalizer) Normalize(name string) string {
+	if n == nil || !n.normalize {
+		return name
+	}
+	return n.form.String(name)
+}
+
+// Key returns a key for name that is the same for all names that n
+// considers equal.
+func (n *Normalizer) Key(name string) string {
+	if n == nil {
+		return name
+	}
+	if n.ignoreCase {
+		// Casers are stateful and can't be shared.
+		name = cases.Fold().String(name)
+	}
+	return norm.NFC.String(name)
+}
@@ -0,0 +1,35 @@
+package utils
+
+// Rolling is the rsync rolling checksum of a window of bytes. It can be
+// updated in constant time as the window slides along by one byte, which
+// makes it cheap to look for known blocks at every offset of a file.
+type Rolling struct {
+	a, b uint32
+	n    uint32
+}
+
+// NewRolling returns the checksum of window.
+func NewRolling(window []byte) *Rolling {
+	r := &Rolling{n: uint32(len(window))}
+	for i, x := range window {
+		r.a += uint32(x)
+		r.b += uint32(len(window)-i) * uint32(x)
+	}
+	return r
+}
+
+// Roll slides the window by one byte, dropping out and adding in.
+func (r *Rolling) Roll(out, in byte) {
+	r.a += uint32(in) - uint32(out)
+	r.b += r.a - r.n*uint32(out)
+}
+
+// Sum returns the checksum of the current window.
+func (r *Rolling) Sum() uint32 {
+	return r.a&0xffff | r.b<<16
+}
+
+// WeakSum returns the rolling checksum of block.
+func WeakSum(block []byte) uint32 {
+	return NewRolling(block).Sum()
+}
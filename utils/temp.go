@@ -0,0 +1,32 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"unicode/utf8"
+)
+
+// MaxTempBase is the longest name of a file kept whole in the names of
+// its temporary files, which must stay within the file system's limit
+// on name length (usually 255 bytes).
+const MaxTempBase = 128
+
+// TempName returns the name of the hidden temporary file with the given
+// kind ("" for atomic write sessions) and id of the file named name.
+// Longer names than MaxTempBase are cut short and made unique again with
+// a hash of the whole name, which ends the shortened name after a "~".
+func TempName(name, kind, id string) string {
+	if len(name) > MaxTempBase {
+		sum := sha256.Sum256([]byte(name))
+		n := MaxTempBase - 17
+		for n > 0 && !utf8.RuneStart(name[n]) {
+			n--
+		}
+		name = name[:n] + "~" + hex.EncodeToString(sum[:8])
+	}
+	if kind == "" {
+		return fmt.Sprintf(".%s.httpfs-%s", name, id)
+	}
+	return fmt.Sprintf(".%s.httpfs-%s-%s", name, kind, id)
+}
@@ -1,9 +1,11 @@
 package utils
 
 import (
+	"fmt"
 	"io"
 	"os"
 	"strconv"
+	"unicode/utf8"
 
 	"github.com/prologic/httpfs/types"
 )
@@ -28,12 +30,22 @@ func ReadDir(dirname string) ([]types.Entry, error) {
 			Mode:    uint32(x.Mode()),
 			ModTime: x.ModTime().UTC().Unix(),
 			IsDir:   x.IsDir(),
+			ETag:    ETag(x),
+		}
+		if !utf8.ValidString(x.Name()) {
+			entries[i].RawName = []byte(x.Name())
 		}
 	}
 
 	return entries, nil
 }
 
+// ETag returns a strong entity tag identifying the current version of
+// a file, derived from its modification time and size.
+func ETag(fi os.FileInfo) string {
+	return fmt.Sprintf("\"%x-%x\"", fi.ModTime().UnixNano(), fi.Size())
+}
+
 // FileSize return the size of the open file
 func FileSize(f *os.File) (int64, error) {
 	size, err := f.Seek(0, io.SeekEnd)
@@ -74,6 +86,16 @@ func SafeParseInt64(s string, d int64) int64 {
 	return n
 }
 
+// SafeParseMode parses a file mode, which may have bits set beyond the
+// range of a 32-bit int (e.g. os.ModeDir).
+func SafeParseMode(s string, d os.FileMode) os.FileMode {
+	n, e := strconv.ParseUint(s, 10, 32)
+	if e != nil {
+		return d
+	}
+	return os.FileMode(n)
+}
+
 // SafeStatSize ...
 func SafeStatSize(path string) int64 {
 	d, err := os.Stat(path)
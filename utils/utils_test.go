@@ -1,9 +1,12 @@
 package utils_test
 
 import (
+	"net/url"
 	"os"
 	"path"
+	"strings"
 	"testing"
+	"unicode/utf8"
 
 	"github.com/prologic/httpfs/utils"
 	"github.com/prologic/httpfs/utils/tempdir"
@@ -136,6 +139,25 @@ func TestSafeParseInt64(t *testing.T) {
 	}
 }
 
+var modetests = []struct {
+	in  string
+	out os.FileMode
+	def os.FileMode
+}{
+	{"420", 0644, 0666},
+	{"2147484141", os.ModeDir | 0755, 0},
+	{"-1", 0666, 0666},
+	{"asdf", 0666, 0666},
+	{"4294967297", 0666, 0666},
+}
+
+func TestSafeParseMode(t *testing.T) {
+	for _, tt := range modetests {
+		m := utils.SafeParseMode(tt.in, tt.def)
+		assert.Equal(t, tt.out, m)
+	}
+}
+
 func TestSafeStatSize(t *testing.T) {
 	assert := assert.New(t)
 
@@ -156,3 +178,86 @@ func TestSafeStatSizeNonExistent(t *testing.T) {
 	size := utils.SafeStatSize("imalittle-0xDEADBEEF-teapot")
 	assert.EqualValues(t, size, 0)
 }
+
+func TestRolling(t *testing.T) {
+	data := []byte("The quick brown fox jumps over the lazy dog")
+	n := 8
+
+	r := utils.NewRolling(data[:n])
+	for i := 1; i+n <= len(data); i++ {
+		r.Roll(data[i-1], data[i-1+n])
+		assert.Equal(t, utils.WeakSum(data[i:i+n]), r.Sum())
+	}
+}
+
+func TestEscapePath(t *testing.T) {
+	assert.Equal(t, "/a%20b/c%3Fd%23e%25f%2Bg", utils.EscapePath("/a b/c?d#e%f+g"))
+
+	// Every byte but NUL may appear in a POSIX file name.
+	for c := 1; c < 256; c++ {
+		p := "/x" + string([]byte{byte(c)}) + "y"
+		u, err := url.Parse("http://host" + utils.EscapePath(p))
+		assert.Nil(t, err)
+		assert.Equal(t, p, u.Path, "byte %d", c)
+	}
+}
+
+var ignoretests = []struct {
+	path  string
+	isDir bool
+	out   bool
+}{
+	{"/.DS_Store", false, true},
+	{"/a/b/.DS_Store", false, true},
+	{"/._foo", false, true},
+	{"/foo", false, false},
+	{"/build", true, true},
+	{"/build", false, false},
+	{"/build/out.o", false, true},
+	{"/src/build", true, true},
+	{"/logs/a.log", false, true},
+	{"/logs/keep.log", false, false},
+	{"/a.log", false, false},
+	{"/docs/x/y/z.tmp", false, true},
+	{"/z.tmp", false, false},
+	{"/cache/x", false, true},
+	{"/cache", true, false},
+	{"/file1", false, true},
+	{"/filea", false, false},
+}
+
+func TestIgnore(t *testing.T) {
+	i := utils.NewIgnore(
+		"# comment",
+		"",
+		".DS_Store",
+		"._*",
+		"build/",
+		"/logs/*.log",
+		"!/logs/keep.log",
+		"docs/**/*.tmp",
+		"cache/**",
+		"file[0-9]",
+	)
+	for _, tt := range ignoretests {
+		assert.Equal(t, tt.out, i.Match(tt.path, tt.isDir), tt.path)
+	}
+
+	var none *utils.Ignore
+	assert.False(t, none.Match("/.DS_Store", false))
+}
+
+func TestTempName(t *testing.T) {
+	assert := assert.New(t)
+
+	id := "0123456789abcdef"
+	assert.Equal(".f.httpfs-"+id, utils.TempName("f", "", id))
+	assert.Equal(".f.httpfs-upload-"+id, utils.TempName("f", "upload", id))
+
+	// Long names are shortened, keeping them apart.
+	long := strings.Repeat("é", 120)
+	name := utils.TempName(long, "resumable", id) + ".info"
+	assert.True(len(name) < 255, name)
+	assert.True(utf8.ValidString(name))
+	assert.NotEqual(name, utils.TempName(long+"x", "resumable", id)+".info")
+}
@@ -0,0 +1,52 @@
+package webapi
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+)
+
+// copyAttrs gives the file at dst the mode, ownership and extended
+// attributes of the file at src, described by fi.
+func copyAttrs(src, dst string, fi os.FileInfo) error {
+	if err := os.Chmod(dst, fi.Mode().Perm()); err != nil {
+		return err
+	}
+
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		if err := os.Lchown(dst, int(st.Uid), int(st.Gid)); err != nil && !os.IsPermission(err) {
+			return err
+		}
+	}
+
+	size, err := syscall.Listxattr(src, nil)
+	if err != nil || size == 0 {
+		// Not supported by the file system or nothing to copy.
+		return nil
+	}
+	names := make([]byte, size)
+	size, err = syscall.Listxattr(src, names)
+	if err != nil {
+		return nil
+	}
+
+	for _, name := range bytes.Split(names[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		n, err := syscall.Getxattr(src, string(name), nil)
+		if err != nil {
+			continue
+		}
+		value := make([]byte, n)
+		n, err = syscall.Getxattr(src, string(name), value)
+		if err != nil {
+			continue
+		}
+		if err := syscall.Setxattr(dst, string(name), value[:n], 0); err != nil && err != syscall.EPERM {
+			return err
+		}
+	}
+
+	return nil
+}
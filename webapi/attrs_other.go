@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package webapi
+
+import (
+	"os"
+)
+
+// copyAttrs gives the file at dst the mode of the file at src, described
+// by fi.
+func copyAttrs(src, dst string, fi os.FileInfo) error {
+	return os.Chmod(dst, fi.Mode().Perm())
+}
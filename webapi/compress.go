@@ -0,0 +1,153 @@
+package webapi
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/prologic/httpfs/utils"
+)
+
+// MinCompressSize is the smallest response body worth compressing.
+const MinCompressSize = 1024
+
+// CompressHeader set to "gzip" opts a GET in to a gzip encoded response.
+// Accept-Encoding alone isn't enough, as Go's HTTP client sends it with
+// every request.
+const CompressHeader = "X-Compress"
+
+var errUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// compressedTypes are content types that don't benefit from being
+// compressed again.
+var compressedTypes = map[string]bool{
+	"application/gzip":             true,
+	"application/x-gzip":           true,
+	"application/zip":              true,
+	"application/x-bzip2":          true,
+	"application/x-xz":             true,
+	"application/x-7z-compressed":  true,
+	"application/x-rar-compressed": true,
+	"application/zstd":             true,
+	"application/pdf":              true,
+	"application/wasm":             true,
+	"font/woff":                    true,
+	"font/woff2":                   true,
+}
+
+func compressible(contentType string) bool {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType == ""
+	}
+	switch {
+	case strings.HasPrefix(t, "image/") && t != "image/svg+xml":
+		return false
+	case strings.HasPrefix(t, "audio/"), strings.HasPrefix(t, "video/"):
+		return false
+	default:
+		return !compressedTypes[t]
+	}
+}
+
+// acceptsGzip reports whether the client accepts gzip encoded responses.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		if strings.TrimSpace(strings.SplitN(enc, ";", 2)[0]) == "gzip" {
+			return true
+		}
+	}
+	return false
+}
+
+// wantsGzip reports whether the response to r should be gzip encoded:
+// the client must have opted in with CompressHeader, and not asked for
+// a range, whose bytes are only of use to it as they are.
+func wantsGzip(r *http.Request) bool {
+	return r.Header.Get(CompressHeader) == "gzip" && acceptsGzip(r) && r.Header.Get("Range") == ""
+}
+
+// gzipResponseWriter gzip encodes the response body if it is large
+// enough and of a type that compresses. The decision is made when the
+// header is written.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz      *gzip.Writer
+	decided bool
+}
+
+func newGzipResponseWriter(w http.ResponseWriter) *gzipResponseWriter {
+	return &gzipResponseWriter{ResponseWriter: w}
+}
+
+func (g *gzipResponseWriter) decide(code int, body []byte) {
+	g.decided = true
+
+	h := g.Header()
+	if code != http.StatusOK {
+		return
+	}
+	if h.Get("Content-Encoding") != "" {
+		return
+	}
+	if cl := h.Get("Content-Length"); cl != "" && utils.SafeParseInt64(cl, 0) < MinCompressSize {
+		return
+	}
+	if h.Get("Content-Type") == "" && body != nil {
+		h.Set("Content-Type", http.DetectContentType(body))
+	}
+	if !compressible(h.Get("Content-Type")) {
+		return
+	}
+
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", "gzip")
+	h.Add("Vary", "Accept-Encoding")
+	g.gz, _ = gzip.NewWriterLevel(g.ResponseWriter, gzip.BestSpeed)
+}
+
+func (g *gzipResponseWriter) WriteHeader(code int) {
+	if !g.decided {
+		g.decide(code, nil)
+	}
+	g.ResponseWriter.WriteHeader(code)
+}
+
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !g.decided {
+		g.decide(http.StatusOK, b)
+		g.ResponseWriter.WriteHeader(http.StatusOK)
+	}
+	if g.gz != nil {
+		return g.gz.Write(b)
+	}
+	return g.ResponseWriter.Write(b)
+}
+
+// Close flushes the compressed stream.
+func (g *gzipResponseWriter) Close() error {
+	if g.gz != nil {
+		return g.gz.Close()
+	}
+	return nil
+}
+
+// requestBody returns the body of r, decoding it if the client sent it
+// gzip encoded.
+func requestBody(r *http.Request) (io.Reader, bool, error) {
+	switch r.Header.Get("Content-Encoding") {
+	case "":
+		return r.Body, false, nil
+	case "gzip":
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, false, err
+		}
+		return gz, true, nil
+	default:
+		return nil, false, errUnsupportedEncoding
+	}
+}
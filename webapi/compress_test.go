@@ -0,0 +1,76 @@
+package webapi_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prologic/httpfs/utils/tempdir"
+	"github.com/prologic/httpfs/webapi"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompression(t *testing.T) {
+	assert := assert.New(t)
+
+	tmp := tempdir.New(t)
+	defer tmp.Cleanup()
+
+	data := strings.Repeat("hello world ", 1000)
+	handler := webapi.FileServer(tmp.Path, false)
+
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	gz.Write([]byte(data))
+	gz.Close()
+
+	r := httptest.NewRequest("PUT", "/foo.txt?flags=577&perm=420", &body)
+	r.Header.Set("Content-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	handler(w, r)
+	assert.Equal(http.StatusOK, w.Code)
+
+	b, err := ioutil.ReadFile(filepath.Join(tmp.Path, "foo.txt"))
+	assert.Nil(err)
+	assert.Equal(data, string(b))
+
+	// Ranges are sent as is.
+	r = httptest.NewRequest("GET", "/foo.txt", nil)
+	r.Header.Set(webapi.CompressHeader, "gzip")
+	r.Header.Set("Accept-Encoding", "gzip")
+	r.Header.Set("Range", "bytes=12-6011")
+	w = httptest.NewRecorder()
+	handler(w, r)
+	assert.Equal(http.StatusPartialContent, w.Code)
+	assert.Equal("", w.Header().Get("Content-Encoding"))
+	assert.Equal(data[12:6012], w.Body.String())
+
+	// Accepting gzip isn't enough, as Go's client always does.
+	r = httptest.NewRequest("GET", "/foo.txt", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	handler(w, r)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("", w.Header().Get("Content-Encoding"))
+	assert.Equal(data, w.Body.String())
+
+	r = httptest.NewRequest("GET", "/foo.txt", nil)
+	r.Header.Set(webapi.CompressHeader, "gzip")
+	r.Header.Set("Accept-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	handler(w, r)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("gzip", w.Header().Get("Content-Encoding"))
+
+	zr, err := gzip.NewReader(w.Body)
+	assert.Nil(err)
+	b, err = ioutil.ReadAll(zr)
+	assert.Nil(err)
+	assert.Equal(data, string(b))
+}
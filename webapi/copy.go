@@ -0,0 +1,214 @@
+package webapi
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	//"log"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"time"
+
+	"github.com/prologic/httpfs/types"
+	"github.com/prologic/httpfs/utils"
+)
+
+// copyName matches the temporary file a whole-file copy is made in.
+var copyName = regexp.MustCompile(`^\..+\.httpfs-copy-[0-9a-f]{16}$`)
+
+// startCopy removes temporary files left behind by copies interrupted by
+// a previous run of the server below root.
+func startCopy(root string) {
+	go removeStale(root, copyName, time.Hour)
+}
+
+// serveCopy handles
+//
+//	COPY /path?name=&offset=&length=&destoffset=
+//
+// which copies the file at path to the path name without the data
+// leaving the server. Without a range the
+// destination is replaced by a copy of the whole file, cloned if the
+// host filesystem supports reflinks, which is made next to it and then
+// renamed into place; "Overwrite: F" makes that fail if the destination
+// exists. With offset or length, length bytes (up to
+// the end of the file if negative) starting at offset are written into
+// the destination at destoffset, like copy_file_range(2). Either way the
+// response is the number of bytes copied.
+func (s *fileServer) serveCopy(w http.ResponseWriter, r *http.Request, dir, localPath string) {
+	query := r.URL.Query()
+
+	destPath, ok := nameParam(r)
+	if !ok {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	destLocal, err := s.resolve(dir, destPath)
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	ranged := query.Get("offset") != "" || query.Get("length") != ""
+	offset := utils.SafeParseInt64(query.Get("offset"), 0)
+	length := utils.SafeParseInt64(query.Get("length"), -1)
+	destOffset := utils.SafeParseInt64(query.Get("destoffset"), 0)
+	if offset < 0 || destOffset < 0 {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	src, err := os.Open(localPath)
+	if err != nil {
+		//log.Printf("E: os.Open('%s') -> %s\n", localPath, err)
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	defer src.Close()
+
+	fi, err := src.Stat()
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	if !fi.Mode().IsRegular() {
+		http.Error(w, "Not A File", http.StatusBadRequest)
+		return
+	}
+
+	if !ranged && destLocal == path.Clean(localPath) {
+		http.Error(w, "Source And Destination Are The Same", http.StatusBadRequest)
+		return
+	}
+
+	if !ranged {
+		s.copyWhole(w, r, src, fi, destLocal, destPath)
+		return
+	}
+
+	_, statErr := os.Lstat(destLocal)
+	created := os.IsNotExist(statErr)
+
+	dst, err := os.OpenFile(destLocal, os.O_WRONLY|os.O_CREATE, fi.Mode().Perm())
+	if err != nil {
+		//log.Printf("E: os.OpenFile('%s') -> %s\n", destLocal, err)
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	defer dst.Close()
+
+	n, err := copyRange(dst, src, offset, destOffset, length)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if err != nil {
+		//log.Printf("E: copying '%s' to '%s' -> %s\n", localPath, destLocal, err)
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+
+	if created {
+		s.record(types.EventCreate, destPath, "")
+	}
+	s.record(types.EventWrite, destPath, "")
+
+	w.Write([]byte(fmt.Sprintf("%d", n)))
+}
+
+// copyWhole replaces the file at destLocal with a copy of src, whose
+// FileInfo is fi. The copy is made in a temporary file next to it and
+// renamed into place, so that nobody sees a partial copy and a failed
+// one leaves the destination as it was.
+func (s *fileServer) copyWhole(w http.ResponseWriter, r *http.Request, src *os.File, fi os.FileInfo, destLocal, destPath string) {
+	overwrite := r.Header.Get("Overwrite") != "F"
+	if overwrite && !s.saveVersion(w, destLocal) {
+		return
+	}
+
+	destFi, statErr := os.Lstat(destLocal)
+	created := os.IsNotExist(statErr)
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	tmp := path.Join(path.Dir(destLocal), utils.TempName(path.Base(destLocal), "copy", hex.EncodeToString(b)))
+
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+	if err != nil {
+		//log.Printf("E: os.OpenFile('%s') -> %s\n", tmp, err)
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+
+	n, err := copyFile(dst, src, fi.Size())
+	if err == nil {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && statErr == nil && destFi.Mode().IsRegular() {
+		// An overwritten file keeps its mode and owner.
+		err = copyAttrs(destLocal, tmp, destFi)
+	}
+	if err == nil {
+		if overwrite {
+			err = os.Rename(tmp, destLocal)
+		} else {
+			// Linking fails if the destination exists by now.
+			err = os.Link(tmp, destLocal)
+		}
+	}
+	if err != nil || !overwrite {
+		os.Remove(tmp)
+	}
+	if err != nil {
+		//log.Printf("E: copying to '%s' -> %s\n", destLocal, err)
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+
+	if created {
+		s.record(types.EventCreate, destPath, "")
+	}
+	s.record(types.EventWrite, destPath, "")
+
+	w.Write([]byte(fmt.Sprintf("%d", n)))
+}
+
+// copyFile copies all size bytes of src to the empty file dst, sharing
+// the data if possible.
+func copyFile(dst, src *os.File, size int64) (int64, error) {
+	if err := reflink(dst, src); err == nil {
+		return size, nil
+	}
+	return io.Copy(dst, src)
+}
+
+// copyRange copies length bytes (or up to the end of src if negative)
+// from offset in src to destOffset in dst. io.Copy between files uses
+// copy_file_range(2) where available, which lets the filesystem share
+// or copy the data without it passing through the server.
+func copyRange(dst, src *os.File, offset, destOffset, length int64) (int64, error) {
+	if _, err := src.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if _, err := dst.Seek(destOffset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if length < 0 {
+		return io.Copy(dst, src)
+	}
+	return io.Copy(dst, io.LimitReader(src, length))
+}
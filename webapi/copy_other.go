@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package webapi
+
+import (
+	"os"
+	"syscall"
+)
+
+// reflink is not supported on this platform.
+func reflink(dst, src *os.File) error {
+	return syscall.ENOTSUP
+}
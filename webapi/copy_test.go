@@ -0,0 +1,102 @@
+package webapi_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prologic/httpfs/utils/tempdir"
+	"github.com/prologic/httpfs/webapi"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCopy(t *testing.T) {
+	assert := assert.New(t)
+
+	tmp := tempdir.New(t)
+	defer tmp.Cleanup()
+
+	assert.Nil(ioutil.WriteFile(filepath.Join(tmp.Path, "foo"), []byte("0123456789"), 0640))
+
+	handler := webapi.FileServer(tmp.Path, false)
+
+	do := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("COPY", url, nil))
+		return w
+	}
+
+	w := do("/foo?name=/bar")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("10", w.Body.String())
+
+	b, err := ioutil.ReadFile(filepath.Join(tmp.Path, "bar"))
+	assert.Nil(err)
+	assert.Equal("0123456789", string(b))
+
+	w = do("/foo?name=/bar&offset=7&length=3&destoffset=1")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("3", w.Body.String())
+
+	b, err = ioutil.ReadFile(filepath.Join(tmp.Path, "bar"))
+	assert.Nil(err)
+	assert.Equal("0789456789", string(b))
+
+	assert.Equal(http.StatusBadRequest, do("/foo?name=/foo").Code)
+}
+
+func TestCopyReplacesWhole(t *testing.T) {
+	assert := assert.New(t)
+
+	tmp := tempdir.New(t)
+	defer tmp.Cleanup()
+
+	assert.Nil(ioutil.WriteFile(filepath.Join(tmp.Path, "foo"), []byte("new"), 0644))
+	assert.Nil(ioutil.WriteFile(filepath.Join(tmp.Path, "bar"), []byte("old content"), 0600))
+
+	handler := webapi.FileServer(tmp.Path, false)
+
+	do := func(url string, overwrite bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("COPY", url, nil)
+		if !overwrite {
+			r.Header.Set("Overwrite", "F")
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+
+	// Readers of the old destination keep seeing all of it.
+	old, err := os.Open(filepath.Join(tmp.Path, "bar"))
+	assert.Nil(err)
+	defer old.Close()
+
+	assert.Equal(http.StatusOK, do("/foo?name=/bar", true).Code)
+
+	b, err := ioutil.ReadAll(old)
+	assert.Nil(err)
+	assert.Equal("old content", string(b))
+	b, err = ioutil.ReadFile(filepath.Join(tmp.Path, "bar"))
+	assert.Nil(err)
+	assert.Equal("new", string(b))
+	fi, err := os.Stat(filepath.Join(tmp.Path, "bar"))
+	assert.Nil(err)
+	assert.Equal(os.FileMode(0600), fi.Mode().Perm())
+
+	// Without overwriting, an existing destination is left alone.
+	assert.Nil(ioutil.WriteFile(filepath.Join(tmp.Path, "foo"), []byte("newer"), 0644))
+	assert.NotEqual(http.StatusOK, do("/foo?name=/bar", false).Code)
+	b, err = ioutil.ReadFile(filepath.Join(tmp.Path, "bar"))
+	assert.Nil(err)
+	assert.Equal("new", string(b))
+	assert.Equal(http.StatusOK, do("/foo?name=/baz", false).Code)
+
+	// No temporary files are left behind.
+	files, err := ioutil.ReadDir(tmp.Path)
+	assert.Nil(err)
+	assert.Len(files, 3)
+}
@@ -0,0 +1,100 @@
+package webapi
+
+import (
+	//"log"
+	"net/http"
+	"os"
+	"syscall"
+
+	"github.com/prologic/httpfs/types"
+)
+
+// WithoutRecursiveDelete refuses to delete directories with everything
+// in them; only empty directories can be removed.
+func WithoutRecursiveDelete() Option {
+	return func(s *fileServer) {
+		s.noRecursiveDelete = true
+	}
+}
+
+// isNotEmpty reports whether err is the error of removing a directory
+// that isn't empty.
+func isNotEmpty(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	return err == syscall.ENOTEMPTY || err == syscall.EEXIST
+}
+
+// checkEmpty returns an error for which isNotEmpty is true if the
+// directory p isn't empty.
+func checkEmpty(p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if names, _ := f.Readdirnames(1); len(names) > 0 {
+		return &os.PathError{Op: "remove", Path: p, Err: syscall.ENOTEMPTY}
+	}
+	return nil
+}
+
+// serveDelete handles
+//
+//	UNLINK /path
+//	RMDIR /path
+//	DELETE /path?recursive=
+//
+// UNLINK removes a file that isn't a directory, and RMDIR an empty
+// directory; each fails with 400 if the path is of the other kind.
+// DELETE removes either, and with recursive=1 a directory with
+// everything in it unless the server disallows that. Removing a
+// directory that isn't empty fails with 409. With the trash enabled,
+// what is deleted is moved into it instead.
+func (s *fileServer) serveDelete(w http.ResponseWriter, r *http.Request, localPath, urlPath string) {
+	recursive := r.Method == "DELETE" && r.URL.Query().Get("recursive") == "1"
+	if recursive && s.noRecursiveDelete {
+		http.Error(w, "Recursive Delete Disabled", http.StatusForbidden)
+		return
+	}
+
+	fi, err := os.Lstat(localPath)
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+
+	switch {
+	case r.Method == "UNLINK" && fi.IsDir():
+		http.Error(w, "Is A Directory", http.StatusBadRequest)
+		return
+	case r.Method == "RMDIR" && !fi.IsDir():
+		http.Error(w, "Not A Directory", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case s.trash != nil:
+		if fi.IsDir() && !recursive {
+			err = checkEmpty(localPath)
+		}
+		if err == nil {
+			err = s.trash.put(localPath, urlPath, clientID(r))
+		}
+	case recursive:
+		err = os.RemoveAll(localPath)
+	default:
+		err = os.Remove(localPath)
+	}
+	if err != nil {
+		//log.Printf("E: remove('%s') -> %s\n", localPath, err)
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+
+	s.record(types.EventRemove, urlPath, "")
+}
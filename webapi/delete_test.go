@@ -0,0 +1,51 @@
+package webapi_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/prologic/httpfs/webapi"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDelete(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newTestServer(t)
+	defer s.Close()
+
+	assert.Nil(os.MkdirAll(s.path("dir/sub"), 0755))
+	assert.Nil(ioutil.WriteFile(s.path("dir/sub/f"), []byte("x"), 0644))
+	assert.Nil(os.Mkdir(s.path("empty"), 0755))
+
+	assert.Equal(http.StatusBadRequest, s.do("UNLINK", "/dir", "").Code)
+	assert.Equal(http.StatusBadRequest, s.do("RMDIR", "/dir/sub/f", "").Code)
+	assert.Equal(http.StatusConflict, s.do("RMDIR", "/dir", "").Code)
+	assert.Equal(http.StatusConflict, s.do("DELETE", "/dir", "").Code)
+	assert.True(s.exists("dir/sub/f"))
+
+	assert.Equal(http.StatusOK, s.do("RMDIR", "/empty", "").Code)
+	assert.False(s.exists("empty"))
+	assert.Equal(http.StatusNotFound, s.do("RMDIR", "/empty", "").Code)
+
+	assert.Equal(http.StatusOK, s.do("UNLINK", "/dir/sub/f", "").Code)
+	assert.False(s.exists("dir/sub/f"))
+
+	assert.Equal(http.StatusOK, s.do("DELETE", "/dir?recursive=1", "").Code)
+	assert.False(s.exists("dir"))
+}
+
+func TestDeleteNotRecursive(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newTestServer(t, webapi.WithoutRecursiveDelete())
+	defer s.Close()
+
+	assert.Nil(os.MkdirAll(s.path("dir/sub"), 0755))
+
+	assert.Equal(http.StatusForbidden, s.do("DELETE", "/dir?recursive=1", "").Code)
+	assert.True(s.exists("dir/sub"))
+}
@@ -0,0 +1,220 @@
+package webapi
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	//"log"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"time"
+
+	"github.com/prologic/httpfs/types"
+	"github.com/prologic/httpfs/utils"
+)
+
+// Delta transfer block sizes
+const (
+	DefaultBlockSize = 64 << 10
+	MinBlockSize     = 512
+	MaxBlockSize     = MaxPartSize
+)
+
+var errBadDelta = errors.New("malformed delta")
+
+// deltaName matches the hidden file a DELTA request builds the new
+// content of a file in.
+var deltaName = regexp.MustCompile(`^\..+\.httpfs-delta-[0-9a-f]{16}$`)
+
+// startDelta removes files left behind by DELTA requests that were
+// interrupted by a previous run of the server below root.
+func startDelta(root string) {
+	go removeStale(root, deltaName, time.Hour)
+}
+
+// serveSignature handles
+//
+//	SIGNATURE /path?blocksize=
+//
+// by responding with the types.Signature of the file, which a client
+// uses to work out which parts of its copy the server already has.
+func (s *fileServer) serveSignature(w http.ResponseWriter, r *http.Request, localPath string) {
+	blockSize := utils.SafeParseInt64(r.URL.Query().Get("blocksize"), DefaultBlockSize)
+	if blockSize < MinBlockSize || blockSize > MaxBlockSize {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	f, err := os.Open(localPath)
+	if err != nil {
+		//log.Printf("E: os.Open('%s') -> %s\n", localPath, err)
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	if !fi.Mode().IsRegular() {
+		http.Error(w, "Not A File", http.StatusBadRequest)
+		return
+	}
+
+	sig := types.Signature{
+		BlockSize: blockSize,
+		Size:      fi.Size(),
+		ETag:      utils.ETag(fi),
+	}
+	buf := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			strong := sha256.Sum256(buf[:n])
+			sig.Blocks = append(sig.Blocks, types.BlockSum{
+				Weak:   utils.WeakSum(buf[:n]),
+				Strong: strong[:],
+			})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			msg, code := toHTTPError(err)
+			http.Error(w, msg, code)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sig)
+}
+
+// serveDelta handles
+//
+//	DELTA /path
+//
+// whose body is a stream of JSON encoded types.DeltaOp. The new content
+// is built next to the file from ranges of its current content and
+// literal data, then replaces it, keeping its attributes. If-Match must
+// name the version of the file the delta was computed against; the
+// response is the hex encoded SHA-256 of the new content.
+func (s *fileServer) serveDelta(w http.ResponseWriter, r *http.Request, localPath, urlPath string) {
+	base, err := os.Open(localPath)
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	defer base.Close()
+
+	fi, err := base.Stat()
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	if !fi.Mode().IsRegular() {
+		http.Error(w, "Not A File", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("If-Match") != utils.ETag(fi) {
+		http.Error(w, "Precondition Failed", http.StatusPreconditionFailed)
+		return
+	}
+
+	body, _, err := requestBody(r)
+	if err != nil {
+		http.Error(w, "Unsupported Media Type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	tmp := path.Join(path.Dir(localPath), utils.TempName(path.Base(localPath), "delta", hex.EncodeToString(b)))
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+	if err != nil {
+		//log.Printf("E: os.OpenFile('%s') -> %s\n", tmp, err)
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	defer os.Remove(tmp)
+
+	h := sha256.New()
+	err = applyDelta(io.MultiWriter(f, h), base, fi.Size(), json.NewDecoder(body))
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err == errBadDelta {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+
+	if err := copyAttrs(localPath, tmp, fi); err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	// The file may have changed while the delta was applied, in which
+	// case the result is based on stale content.
+	if cur, err := os.Stat(localPath); err != nil || !os.SameFile(fi, cur) || utils.ETag(cur) != utils.ETag(fi) {
+		http.Error(w, "Precondition Failed", http.StatusPreconditionFailed)
+		return
+	}
+	if !s.saveVersion(w, localPath) {
+		return
+	}
+	if err := os.Rename(tmp, localPath); err != nil {
+		//log.Printf("E: os.Rename('%s', '%s') -> %s\n", tmp, localPath, err)
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+
+	s.record(types.EventWrite, urlPath, "")
+	w.Write([]byte(hex.EncodeToString(h.Sum(nil))))
+}
+
+// applyDelta writes the content described by the ops read from dec to w.
+func applyDelta(w io.Writer, base io.ReaderAt, size int64, dec *json.Decoder) error {
+	for {
+		var op types.DeltaOp
+		if err := dec.Decode(&op); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errBadDelta
+		}
+
+		if op.Length > 0 {
+			if op.Offset < 0 || op.Offset+op.Length > size {
+				return errBadDelta
+			}
+			if _, err := io.Copy(w, io.NewSectionReader(base, op.Offset, op.Length)); err != nil {
+				return err
+			}
+		}
+		if _, err := w.Write(op.Data); err != nil {
+			return err
+		}
+	}
+}
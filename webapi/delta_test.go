@@ -0,0 +1,107 @@
+package webapi_test
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prologic/httpfs/types"
+	"github.com/prologic/httpfs/utils/tempdir"
+	"github.com/prologic/httpfs/webapi"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDelta(t *testing.T) {
+	assert := assert.New(t)
+
+	tmp := tempdir.New(t)
+	defer tmp.Cleanup()
+
+	target := filepath.Join(tmp.Path, "foo")
+	assert.Nil(ioutil.WriteFile(target, []byte(strings.Repeat("a", 512)+strings.Repeat("b", 512)+"c"), 0644))
+
+	handler := webapi.FileServer(tmp.Path, false)
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("SIGNATURE", "/foo?blocksize=512", nil))
+	assert.Equal(http.StatusOK, w.Code)
+
+	var sig types.Signature
+	assert.Nil(json.NewDecoder(w.Body).Decode(&sig))
+	assert.EqualValues(1025, sig.Size)
+	assert.Len(sig.Blocks, 3)
+
+	delta := `{"Offset":512,"Length":512}` + "\n" + `{"Data":"eHl6"}` + "\n" + `{"Length":512}`
+
+	// The file must not have changed since the signature was taken.
+	r := httptest.NewRequest("DELTA", "/foo", strings.NewReader(delta))
+	r.Header.Set("If-Match", `"stale"`)
+	w = httptest.NewRecorder()
+	handler(w, r)
+	assert.Equal(http.StatusPreconditionFailed, w.Code)
+
+	r = httptest.NewRequest("DELTA", "/foo", strings.NewReader(delta))
+	r.Header.Set("If-Match", sig.ETag)
+	w = httptest.NewRecorder()
+	handler(w, r)
+	assert.Equal(http.StatusOK, w.Code)
+
+	b, err := ioutil.ReadFile(target)
+	assert.Nil(err)
+	assert.Equal(strings.Repeat("b", 512)+"xyz"+strings.Repeat("a", 512), string(b))
+}
+
+// changingReader calls change once r has been read to the end.
+type changingReader struct {
+	r      io.Reader
+	change func()
+}
+
+func (c *changingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if err == io.EOF && c.change != nil {
+		c.change()
+		c.change = nil
+	}
+	return n, err
+}
+
+func TestDeltaFileChangedMeanwhile(t *testing.T) {
+	assert := assert.New(t)
+
+	tmp := tempdir.New(t)
+	defer tmp.Cleanup()
+
+	target := filepath.Join(tmp.Path, "foo")
+	assert.Nil(ioutil.WriteFile(target, []byte(strings.Repeat("a", 512)), 0644))
+
+	handler := webapi.FileServer(tmp.Path, false)
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("SIGNATURE", "/foo?blocksize=512", nil))
+	var sig types.Signature
+	assert.Nil(json.NewDecoder(w.Body).Decode(&sig))
+
+	// Someone else writes the file while the delta is being applied.
+	delta := &changingReader{
+		r: strings.NewReader(`{"Length":512}` + "\n" + `{"Data":"eHl6"}`),
+		change: func() {
+			assert.Nil(ioutil.WriteFile(target, []byte("theirs"), 0644))
+		},
+	}
+	r := httptest.NewRequest("DELTA", "/foo", delta)
+	r.Header.Set("If-Match", sig.ETag)
+	w = httptest.NewRecorder()
+	handler(w, r)
+	assert.Equal(http.StatusPreconditionFailed, w.Code)
+
+	b, err := ioutil.ReadFile(target)
+	assert.Nil(err)
+	assert.Equal("theirs", string(b))
+}
@@ -0,0 +1,125 @@
+package webapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prologic/httpfs/types"
+)
+
+// subscriberBacklog is the number of events buffered per subscriber
+// before it is considered too slow and disconnected.
+const subscriberBacklog = 1024
+
+// keepAliveInterval is how often an idle event stream is sent a comment
+// line so that proxies and clients don't time the connection out.
+const keepAliveInterval = 30 * time.Second
+
+// Broker fans out change events to any number of subscribers.
+type Broker struct {
+	sync.Mutex
+	subs map[chan types.Event]struct{}
+}
+
+// NewBroker ...
+func NewBroker() *Broker {
+	return &Broker{
+		subs: make(map[chan types.Event]struct{}),
+	}
+}
+
+// Subscribe returns a channel on which all future events are delivered.
+// The channel is closed if the subscriber falls too far behind, in which
+// case it must assume it has missed events and resynchronize.
+func (b *Broker) Subscribe() chan types.Event {
+	ch := make(chan types.Event, subscriberBacklog)
+	b.Lock()
+	b.subs[ch] = struct{}{}
+	b.Unlock()
+	return ch
+}
+
+// Unsubscribe ...
+func (b *Broker) Unsubscribe(ch chan types.Event) {
+	b.Lock()
+	defer b.Unlock()
+	if _, ok := b.subs[ch]; ok {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+// Publish delivers e to all subscribers without blocking.
+func (b *Broker) Publish(e types.Event) {
+	b.Lock()
+	defer b.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// underPath reports whether p is root or a descendant of root.
+func underPath(p, root string) bool {
+	if root == "/" || p == root {
+		return true
+	}
+	return strings.HasPrefix(p, strings.TrimSuffix(root, "/")+"/")
+}
+
+// serveEvents streams change events for urlPath and everything below it
+// as Server-Sent Events until the client goes away.
+func (s *fileServer) serveEvents(w http.ResponseWriter, r *http.Request, urlPath string) {
+	if s.broker == nil {
+		http.Error(w, "Not Implemented", http.StatusNotImplemented)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming Unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	events := s.broker.Subscribe()
+	defer s.broker.Unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case e, ok := <-events:
+			if !ok {
+				// We fell behind; the client must resynchronize.
+				return
+			}
+			if e.Op != types.EventOverflow && !underPath(e.FilePath(), urlPath) {
+				continue
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "data: %s\n\n", data)
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,46 @@
+package webapi_test
+
+import (
+	"testing"
+
+	"github.com/prologic/httpfs/types"
+	"github.com/prologic/httpfs/webapi"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBroker(t *testing.T) {
+	assert := assert.New(t)
+
+	b := webapi.NewBroker()
+	fast := b.Subscribe()
+	slow := b.Subscribe()
+
+	e := types.NewEvent(types.EventWrite, "/a", "")
+	b.Publish(e)
+	assert.Equal(e, <-fast)
+
+	// A subscriber that doesn't keep up is dropped rather than holding
+	// up the others.
+	for i := 0; i < 2048; i++ {
+		b.Publish(e)
+		select {
+		case <-fast:
+		default:
+		}
+	}
+	n := 0
+	for range slow {
+		n++
+	}
+	assert.True(n < 2048)
+
+	b.Publish(e)
+	assert.Equal(e, <-fast)
+
+	b.Unsubscribe(fast)
+	_, ok := <-fast
+	assert.False(ok)
+	// Publishing to nobody is fine.
+	b.Publish(e)
+}
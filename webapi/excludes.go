@@ -0,0 +1,79 @@
+package webapi
+
+import (
+	"errors"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/prologic/httpfs/types"
+	"github.com/prologic/httpfs/utils"
+)
+
+// errExcluded is returned for paths hidden by the server's excludes. It
+// is reported as if the file didn't exist.
+var errExcluded = errors.New("excluded")
+
+// WithExcludes hides the files and directories matched by the patterns
+// of i, relative to the served directory, from listings and refuses
+// access to them as if they didn't exist. Nothing can be created under
+// an excluded name either.
+func WithExcludes(i *utils.Ignore) Option {
+	return func(s *fileServer) {
+		s.excludes = i
+	}
+}
+
+// isInternal reports whether rel, a path relative to the served
+// directory, is in the trash or the versions kept by the server.
+func isInternal(rel string) bool {
+	rel = path.Clean("/" + rel)
+	for _, d := range []string{TrashDir, VersionsDir} {
+		if rel == "/"+d || strings.HasPrefix(rel, "/"+d+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// tempName matches the hidden temporary files kept next to a file while
+// it is written: those of atomic write sessions, multipart, resumable
+// and delta uploads, whole-file copies, and clients' whole-file
+// uploads.
+var tempName = regexp.MustCompile(`^\..+\.httpfs-([a-z]+-)?[0-9a-f]{16}(\.info)?$`)
+
+// isTemp reports whether the file named name is a temporary file. They
+// are left out of listings and change events, but stay accessible to
+// the clients writing them.
+func isTemp(name string) bool {
+	return tempName.MatchString(name)
+}
+
+// excluded reports whether the local path p inside dir is excluded.
+// The server's internal directories always are.
+func (s *fileServer) excluded(dir, p string) bool {
+	rel := strings.TrimPrefix(p, path.Clean(dir))
+	if isInternal(rel) {
+		return true
+	}
+	if s.excludes == nil {
+		return false
+	}
+	fi, err := os.Lstat(p)
+	return s.excludes.Match(rel, err == nil && fi.IsDir())
+}
+
+// filterExcluded removes the excluded entries, and temporary files,
+// from the listing of the local directory p inside dir.
+func (s *fileServer) filterExcluded(dir, p string, entries []types.Entry) []types.Entry {
+	rel := strings.TrimPrefix(p, path.Clean(dir))
+	out := entries[:0]
+	for _, e := range entries {
+		p := path.Join(rel, e.FileName())
+		if !isInternal(p) && !isTemp(e.FileName()) && !s.excludes.Match(p, e.IsDir) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
@@ -0,0 +1,111 @@
+package webapi_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prologic/httpfs/types"
+	"github.com/prologic/httpfs/utils"
+	"github.com/prologic/httpfs/utils/tempdir"
+	"github.com/prologic/httpfs/webapi"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExcludes(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newTestServer(t, webapi.WithExcludes(utils.NewIgnore("secret/", "*.tmp")))
+	defer s.Close()
+
+	assert.Nil(os.Mkdir(s.path("secret"), 0755))
+	assert.Nil(ioutil.WriteFile(s.path("secret/key"), []byte("x"), 0644))
+	assert.Nil(ioutil.WriteFile(s.path("a.tmp"), []byte("x"), 0644))
+	assert.Nil(ioutil.WriteFile(s.path("a.txt"), []byte("x"), 0644))
+
+	w := s.do("GET", "/", "")
+	assert.Equal(http.StatusOK, w.Code)
+	var entries []types.Entry
+	assert.Nil(json.NewDecoder(w.Body).Decode(&entries))
+	if assert.Len(entries, 1) {
+		assert.Equal("a.txt", entries[0].Name)
+	}
+
+	assert.Equal(http.StatusNotFound, s.do("HEAD", "/a.tmp", "").Code)
+	assert.Equal(http.StatusNotFound, s.do("GET", "/secret/key", "").Code)
+	assert.Equal(http.StatusNotFound, s.do("DELETE", "/secret", "").Code)
+	assert.Equal(http.StatusNotFound, s.do("PUT", "/b.tmp", "x").Code)
+	assert.Equal(http.StatusNotFound, s.do("RENAME", "/a.txt?name=/a.tmp", "").Code)
+	assert.Equal(http.StatusOK, s.do("HEAD", "/a.txt", "").Code)
+
+	assert.True(s.exists("secret/key"))
+	assert.False(s.exists("b.tmp"))
+}
+
+func TestTempFilesHidden(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newTestServer(t)
+	defer s.Close()
+
+	names := []string{
+		".f.httpfs-0123456789abcdef",
+		".f.httpfs-upload-0123456789abcdef",
+		".f.httpfs-resumable-0123456789abcdef",
+		".f.httpfs-resumable-0123456789abcdef.info",
+		".f.httpfs-delta-0123456789abcdef",
+		".f.httpfs-put-0123456789abcdef",
+	}
+	for _, name := range append(names, "f", ".f.httpfs-notes") {
+		assert.Nil(ioutil.WriteFile(s.path(name), []byte("x"), 0644))
+	}
+
+	w := s.do("GET", "/", "")
+	assert.Equal(http.StatusOK, w.Code)
+	var entries []types.Entry
+	assert.Nil(json.NewDecoder(w.Body).Decode(&entries))
+	var listed []string
+	for _, e := range entries {
+		listed = append(listed, e.Name)
+	}
+	assert.ElementsMatch([]string{"f", ".f.httpfs-notes"}, listed)
+
+	// They can still be accessed by those writing them.
+	for _, name := range names {
+		assert.Equal(http.StatusOK, s.do("HEAD", "/"+name, "").Code, name)
+	}
+}
+
+func TestStaleUploadsRemoved(t *testing.T) {
+	assert := assert.New(t)
+
+	tmp := tempdir.New(t)
+	defer tmp.Cleanup()
+
+	// Left behind by a client's whole-file upload, and one in progress.
+	stale := filepath.Join(tmp.Path, ".f.httpfs-put-0123456789abcdef")
+	fresh := filepath.Join(tmp.Path, ".g.httpfs-put-0123456789abcdef")
+	for _, p := range []string{stale, fresh} {
+		assert.Nil(ioutil.WriteFile(p, []byte("x"), 0644))
+	}
+	long := time.Now().Add(-24 * time.Hour)
+	assert.Nil(os.Chtimes(stale, long, long))
+
+	webapi.FileServer(tmp.Path, false)
+
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(stale); os.IsNotExist(err) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	_, err := os.Stat(stale)
+	assert.True(os.IsNotExist(err))
+	_, err = os.Stat(fresh)
+	assert.Nil(err)
+}
@@ -0,0 +1,33 @@
+package webapi
+
+import (
+	"net/http"
+	"os"
+)
+
+// FileIDHeader carries the id of a file, which stays the same while the
+// file is renamed and is never that of another file while it exists.
+// Stat responses (HEAD and GET) and writes (PUT) include it where the
+// host OS provides one. A request that includes it is refused with 412 unless path is
+// still the file with that id, so that clients holding on to a file
+// don't operate on another one that took its name.
+const FileIDHeader = "X-File-Id"
+
+// checkFileID responds with 412 and returns false if r names the id of
+// a file that localPath no longer is.
+func checkFileID(w http.ResponseWriter, r *http.Request, localPath string) bool {
+	id := r.Header.Get(FileIDHeader)
+	if id == "" {
+		return true
+	}
+	fi, err := os.Lstat(localPath)
+	if err == nil && fileID(fi) == "" {
+		// Ids aren't supported here; nothing to compare.
+		return true
+	}
+	if err != nil || fileID(fi) != id {
+		http.Error(w, "Stale File Id", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
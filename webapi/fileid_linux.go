@@ -0,0 +1,16 @@
+package webapi
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// fileID returns the id of the file described by fi: its device and
+// inode numbers.
+func fileID(fi os.FileInfo) string {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return fmt.Sprintf("%x-%x", uint64(st.Dev), uint64(st.Ino))
+	}
+	return ""
+}
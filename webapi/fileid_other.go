@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package webapi
+
+import (
+	"os"
+)
+
+// fileID is not supported on this platform.
+func fileID(fi os.FileInfo) string {
+	return ""
+}
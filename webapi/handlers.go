@@ -1,22 +1,49 @@
 package webapi
 
 import (
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io"
 	//"log"
 	"net/http"
-	"net/url"
 	"os"
 	"path"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/prologic/httpfs/types"
 	"github.com/prologic/httpfs/utils"
 )
 
+// putTTL is how long a whole-file upload may sit idle before it is
+// considered abandoned.
+const putTTL = time.Hour
+
+// putName matches the hidden file a client uploads a whole file to
+// before renaming it over the target.
+var putName = regexp.MustCompile(`^\..+\.httpfs-put-[0-9a-f]{16}$`)
+
+// startPut removes whole-file uploads abandoned by clients below root.
+func startPut(root string) {
+	go func() {
+		for {
+			removeStale(root, putName, putTTL)
+			time.Sleep(putTTL / 4)
+		}
+	}()
+}
+
 func toHTTPError(err error) (msg string, httpStatus int) {
 	switch {
+	case err == errNameCollision:
+		return "Name Collision", http.StatusConflict
+	case err == errExcluded:
+		return "File Not Found", http.StatusNotFound
+	case isNotEmpty(err):
+		return "Directory Not Empty", http.StatusConflict
 	case os.IsPermission(err):
 		return "Forbidden", http.StatusForbidden
 	case os.IsNotExist(err):
@@ -28,6 +55,17 @@ func toHTTPError(err error) (msg string, httpStatus int) {
 	}
 }
 
+// nameParam returns the cleaned, rooted path in the name= parameter of
+// r that names the other file of a RENAME, LINK or COPY. Like the
+// request path, it can't refer to anything outside the served directory.
+func nameParam(r *http.Request) (string, bool) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		return "", false
+	}
+	return path.Clean("/" + name), true
+}
+
 func addStatHeaders(w http.ResponseWriter, stat os.FileInfo) {
 	if w.Header().Get("Content-Length") == "" {
 		w.Header().Set(
@@ -43,6 +81,10 @@ func addStatHeaders(w http.ResponseWriter, stat os.FileInfo) {
 		)
 	}
 
+	if w.Header().Get("ETag") == "" {
+		w.Header().Set("ETag", utils.ETag(stat))
+	}
+
 	if w.Header().Get("X-File-Mode") == "" {
 		w.Header().Set(
 			"X-File-Mode",
@@ -56,16 +98,159 @@ func addStatHeaders(w http.ResponseWriter, stat os.FileInfo) {
 			fmt.Sprintf("%t", stat.IsDir()),
 		)
 	}
+
+	if id := fileID(stat); id != "" && w.Header().Get(FileIDHeader) == "" {
+		w.Header().Set(FileIDHeader, id)
+	}
+}
+
+type fileServer struct {
+	broker     *Broker
+	journal    *Journal
+	requests   *requestCache
+	sessions   *sessions
+	uploads    *uploads
+	resumables *resumables
+	names      *utils.Normalizer
+	excludes   *utils.Ignore
+	trash      *trash
+	versions   *versions
+
+	noRecursiveDelete bool
+}
+
+// Option configures optional FileServer behaviour.
+type Option func(*fileServer)
+
+// WithBroker enables the EVENTS method, streaming change events
+// published to b.
+func WithBroker(b *Broker) Option {
+	return func(s *fileServer) {
+		s.broker = b
+	}
+}
+
+// WithJournal records every mutation in j and enables the CHANGES
+// method for reading it back.
+func WithJournal(j *Journal) Option {
+	return func(s *fileServer) {
+		s.journal = j
+	}
 }
 
 // FileServer ...
-func FileServer(dir string, readonly bool) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
+func FileServer(dir string, readonly bool, opts ...Option) http.HandlerFunc {
+	s := &fileServer{
+		requests: newRequestCache(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.sessions != nil && !readonly {
+		s.sessions.start(dir)
+	}
+	if s.uploads != nil && !readonly {
+		s.uploads.start(dir)
+	}
+	if s.resumables != nil && !readonly {
+		s.resumables.start(dir)
+	}
+	if !readonly {
+		startDelta(dir)
+		startCopy(dir)
+		startPut(dir)
+	}
+	if s.versions != nil {
+		s.versions.root = path.Clean(dir)
+		s.versions.dir = path.Join(dir, VersionsDir)
+	}
+	if s.trash != nil {
+		s.trash.dir = path.Join(dir, TrashDir)
+		if !readonly {
+			s.trash.start()
+		}
+	}
+
+	serve := func(w http.ResponseWriter, r *http.Request) {
 		urlPath := path.Clean(r.URL.Path)
-		localPath := path.Join(dir, urlPath)
+		localPath, err := s.resolve(dir, urlPath)
+		if err != nil {
+			msg, code := toHTTPError(err)
+			http.Error(w, msg, code)
+			return
+		}
+		if !checkFileID(w, r, localPath) {
+			return
+		}
 
 		switch r.Method {
+		case "EVENTS":
+			s.serveEvents(w, r, urlPath)
+			return
+		case "HASH":
+			s.serveHash(w, r, localPath)
+			return
+		case "SIGNATURE":
+			s.serveSignature(w, r, localPath)
+			return
+		case "EXTENTS":
+			s.serveExtents(w, r, localPath)
+			return
+		case "FALLOCATE":
+			if readonly {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			s.serveFallocate(w, r, localPath, urlPath)
+			return
+		case "COPY":
+			if readonly {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			s.serveCopy(w, r, dir, localPath)
+			return
+		case "DELTA":
+			if readonly {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			s.serveDelta(w, r, localPath, urlPath)
+			return
+		case "CHANGES":
+			s.serveChanges(w, r, urlPath)
+			return
+		case "BEGIN", "COMMIT":
+			if readonly {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			if r.Method == "BEGIN" {
+				s.serveBegin(w, r, localPath, urlPath)
+			} else {
+				s.serveCommit(w, r, localPath, urlPath)
+			}
+			return
+		case "UPLOAD", "PART", "COMPLETE", "ABORT":
+			if readonly {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			s.serveUploads(w, r, localPath, urlPath)
+			return
+		case "POST", "PATCH":
+			if readonly {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			s.serveResumable(w, r, localPath, urlPath)
+			return
 		case "HEAD":
+			if r.URL.Query().Get("upload") != "" {
+				s.serveResumable(w, r, localPath, urlPath)
+				return
+			}
+
 			d, err := os.Lstat(localPath)
 			if err != nil {
 				//log.Printf("E: os.Lstat('%s') -> %s\n", localPath, err)
@@ -77,20 +262,25 @@ func FileServer(dir string, readonly bool) http.HandlerFunc {
 			addStatHeaders(w, d)
 
 			return
-		case "DELETE":
+		case "VERSIONS":
+			s.serveVersions(w, r, localPath)
+			return
+		case "TRASH":
+			s.serveTrash(w, r, localPath, urlPath)
+			return
+		case "RESTORE", "PURGE":
 			if readonly {
 				http.Error(w, "Forbidden", http.StatusForbidden)
 				return
 			}
-
-			err := os.RemoveAll(localPath)
-			if err != nil {
-				//log.Printf("E: os.RemoveAll('%s') -> %s\n", localPath, err)
-				msg, code := toHTTPError(err)
-				http.Error(w, msg, code)
+			s.serveTrash(w, r, localPath, urlPath)
+			return
+		case "DELETE", "UNLINK", "RMDIR":
+			if readonly {
+				http.Error(w, "Forbidden", http.StatusForbidden)
 				return
 			}
-
+			s.serveDelete(w, r, localPath, urlPath)
 			return
 		case "PUT":
 			if readonly {
@@ -100,12 +290,7 @@ func FileServer(dir string, readonly bool) http.HandlerFunc {
 
 			query := r.URL.Query()
 
-			perm := os.FileMode(
-				utils.SafeParseInt(
-					query.Get("perm"),
-					0666,
-				),
-			)
+			perm := utils.SafeParseMode(query.Get("perm"), 0666)
 
 			flags := utils.SafeParseInt(
 				query.Get("flags"),
@@ -123,6 +308,25 @@ func FileServer(dir string, readonly bool) http.HandlerFunc {
 			//log.Printf(" flags=%d\n", flags)
 			//log.Printf(" offset=%d\n", offset)
 
+			body, encoded, err := requestBody(r)
+			if err != nil {
+				http.Error(w, "Unsupported Media Type", http.StatusUnsupportedMediaType)
+				return
+			}
+			body, done, err := verifiedBody(r, body)
+			if err != nil {
+				verifyError(w, err)
+				return
+			}
+			defer done()
+
+			_, statErr := os.Lstat(localPath)
+			created := os.IsNotExist(statErr)
+
+			if flags&os.O_TRUNC != 0 && !s.saveVersion(w, localPath) {
+				return
+			}
+
 			f, err := os.OpenFile(localPath, flags, perm)
 			defer f.Close()
 			if err != nil {
@@ -131,6 +335,12 @@ func FileServer(dir string, readonly bool) http.HandlerFunc {
 				http.Error(w, msg, code)
 				return
 			}
+			// Let writers that created the file pin it by its id.
+			if fi, err := f.Stat(); err == nil {
+				if id := fileID(fi); id != "" {
+					w.Header().Set(FileIDHeader, id)
+				}
+			}
 
 			SeekType := io.SeekStart
 
@@ -144,7 +354,30 @@ func FileServer(dir string, readonly bool) http.HandlerFunc {
 
 			cl := utils.SafeParseInt64(r.Header.Get("Content-Length"), 0)
 
-			n, err := io.Copy(f, r.Body)
+			var dst io.Writer = f
+			var sw *sparseWriter
+			if query.Get("sparse") == "1" && SeekType == io.SeekStart && flags&os.O_APPEND == 0 {
+				// Leave holes where the client sends blocks of zeros.
+				sw = newSparseWriter(f, offset)
+				dst = sw
+			}
+
+			n, err := io.Copy(dst, body)
+			if sw != nil && err == nil {
+				err = sw.Close()
+			}
+			if encoded && err == nil {
+				// The decoder verified the whole body arrived intact.
+				cl = n
+			}
+
+			if created {
+				s.record(types.EventCreate, urlPath, "")
+			}
+			if n > 0 {
+				s.record(types.EventWrite, urlPath, "")
+			}
+
 			if err != nil {
 				//log.Printf("E: io.Copy(...) -> %s\n", localPath, err)
 				msg, code := toHTTPError(err)
@@ -152,7 +385,7 @@ func FileServer(dir string, readonly bool) http.HandlerFunc {
 				return
 			}
 
-			if cl != 0 && n == cl {
+			if n == cl {
 				return
 			}
 
@@ -161,6 +394,18 @@ func FileServer(dir string, readonly bool) http.HandlerFunc {
 			http.Error(w, "Partial Content", http.StatusPartialContent)
 			return
 		case "GET":
+			if wantsGzip(r) {
+				gw := newGzipResponseWriter(w)
+				defer gw.Close()
+				w = gw
+			}
+
+			if q := r.URL.Query(); q.Get("version") != "" || q.Get("at") != "" {
+				if s.serveVersion(w, r, localPath, urlPath) {
+					return
+				}
+			}
+
 			d, err := os.Stat(localPath)
 			if err != nil {
 				//log.Printf("E: os.Stat('%s') -> %s\n", localPath, err)
@@ -170,7 +415,7 @@ func FileServer(dir string, readonly bool) http.HandlerFunc {
 			}
 
 			if d.IsDir() && !strings.HasSuffix(r.URL.Path, "/") {
-				http.Redirect(w, r, r.URL.Path+"/", 302)
+				http.Redirect(w, r, utils.EscapePath(r.URL.Path)+"/", 302)
 				return
 			}
 
@@ -182,8 +427,23 @@ func FileServer(dir string, readonly bool) http.HandlerFunc {
 					http.Error(w, msg, code)
 					return
 				}
+				entries = s.filterExcluded(dir, localPath, entries)
+				data, err := json.Marshal(entries)
+				if err != nil {
+					http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+					return
+				}
+				// The ETag covers the entries, which change without
+				// the directory's mtime when a file in it does.
+				sum := sha256.Sum256(data)
+				etag := fmt.Sprintf("\"%x\"", sum[:8])
+				w.Header().Set("ETag", etag)
+				if r.Header.Get("If-None-Match") == etag {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
 				w.Header().Set("Content-Type", "application/json")
-				json.NewEncoder(w).Encode(entries)
+				w.Write(append(data, '\n'))
 			} else {
 				f, err := os.Open(localPath)
 				if err != nil {
@@ -196,6 +456,9 @@ func FileServer(dir string, readonly bool) http.HandlerFunc {
 				//log.Printf("Serving: %s\n", localPath)
 
 				addStatHeaders(w, d)
+				if r.URL.Query().Get("sparse") == "1" && serveSparse(w, r, f, d) {
+					return
+				}
 				http.ServeContent(w, r, d.Name(), d.ModTime(), f)
 			}
 			return
@@ -205,9 +468,9 @@ func FileServer(dir string, readonly bool) http.HandlerFunc {
 				return
 			}
 
-			mode := utils.SafeParseInt(r.URL.Query().Get("mode"), 0)
+			mode := utils.SafeParseMode(r.URL.Query().Get("mode"), 0)
 
-			err := os.Chmod(localPath, os.FileMode(mode))
+			err := os.Chmod(localPath, mode)
 			if err != nil {
 				//log.Printf("E: os.Chmod('%s', %d) -> %s\n", localPath, mode, err,)
 				msg, code := toHTTPError(err)
@@ -215,6 +478,8 @@ func FileServer(dir string, readonly bool) http.HandlerFunc {
 				return
 			}
 
+			s.record(types.EventChmod, urlPath, "")
+
 			return
 		case "MKDIR":
 			if readonly {
@@ -222,12 +487,7 @@ func FileServer(dir string, readonly bool) http.HandlerFunc {
 				return
 			}
 
-			perm := os.FileMode(
-				utils.SafeParseInt(
-					r.URL.Query().Get("perm"),
-					0777,
-				),
-			)
+			perm := utils.SafeParseMode(r.URL.Query().Get("perm"), 0777)
 
 			err := os.Mkdir(localPath, perm)
 
@@ -238,6 +498,8 @@ func FileServer(dir string, readonly bool) http.HandlerFunc {
 				return
 			}
 
+			s.record(types.EventMkdir, urlPath, "")
+
 			return
 		case "LINK":
 			if readonly {
@@ -245,16 +507,14 @@ func FileServer(dir string, readonly bool) http.HandlerFunc {
 				return
 			}
 
-			nameReq := r.URL.Query().Get("name")
-			if nameReq == "" {
+			namePath, ok := nameParam(r)
+			if !ok {
 				//log.Printf(" E: No ?name= specified for LINK request\n")
 				http.Error(w, "Bad Request", http.StatusBadRequest)
 				return
 			}
-
-			nameReq, err := url.QueryUnescape(nameReq)
+			toPath, err := s.resolve(dir, namePath)
 			if err != nil {
-				//log.Printf("E: %s\n", err)
 				msg, code := toHTTPError(err)
 				http.Error(w, msg, code)
 				return
@@ -262,10 +522,7 @@ func FileServer(dir string, readonly bool) http.HandlerFunc {
 
 			soft := utils.SafeParseBool(r.URL.Query().Get("soft"), false)
 
-			namePath := path.Clean(nameReq)
-			toPath := path.Join(dir, namePath)
-
-			//log.Printf(" name=%q\n", nameReq)
+			//log.Printf(" name=%q\n", namePath)
 			//log.Printf(" localPath=%q\n", localPath)
 			//log.Printf(" toPath=%q\n", toPath)
 
@@ -282,6 +539,8 @@ func FileServer(dir string, readonly bool) http.HandlerFunc {
 				return
 			}
 
+			s.record(types.EventLink, urlPath, namePath)
+
 			return
 		case "RENAME":
 			if readonly {
@@ -289,23 +548,7 @@ func FileServer(dir string, readonly bool) http.HandlerFunc {
 				return
 			}
 
-			nameReq := r.URL.Query().Get("name")
-			if nameReq == "" {
-				//log.Printf("E: No ?name= specified for RENAME request\n")
-				http.Error(w, "Bad Request", http.StatusBadRequest)
-				return
-			}
-
-			namePath := path.Clean(nameReq)
-			toPath := path.Join(dir, namePath)
-
-			err := os.Rename(localPath, toPath)
-			if err != nil {
-				//log.Printf( "E: os.Rename('%s', '%s') -> %s\n", localPath, toPath, err,)
-				msg, code := toHTTPError(err)
-				http.Error(w, msg, code)
-				return
-			}
+			s.serveRename(w, r, dir, localPath, urlPath)
 
 			return
 		case "TRUNCATE":
@@ -321,11 +564,15 @@ func FileServer(dir string, readonly bool) http.HandlerFunc {
 				return
 			}
 
-			size, err := strconv.ParseInt(sizeReq, 10, 32)
-			if err != nil {
-				//log.Printf( "E: strconv.ParseInt('%s', 10, 32) -> %s\n", sizeReq, err,)
-				msg, code := toHTTPError(err)
-				http.Error(w, msg, code)
+			size, err := strconv.ParseInt(sizeReq, 10, 64)
+			if err != nil || size < 0 {
+				//log.Printf( "E: strconv.ParseInt('%s', 10, 64) -> %s\n", sizeReq, err,)
+				http.Error(w, "Bad Request", http.StatusBadRequest)
+				return
+			}
+
+			// Only shrinking a file loses any of its content.
+			if fi, err := os.Stat(localPath); err == nil && size < fi.Size() && !s.saveVersion(w, localPath) {
 				return
 			}
 
@@ -337,10 +584,16 @@ func FileServer(dir string, readonly bool) http.HandlerFunc {
 				return
 			}
 
+			s.record(types.EventTruncate, urlPath, "")
+
 			return
 		default:
 			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 			return
 		}
 	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.requests.dedup(w, r, serve)
+	}
 }
@@ -0,0 +1,179 @@
+package webapi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	//"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/prologic/httpfs/utils"
+)
+
+// hashes are the algorithms the HASH method and digest verification
+// support, by their Content-Digest name.
+var hashes = map[string]func() hash.Hash{
+	"sha-256": sha256.New,
+}
+
+var (
+	errBadDigest      = errors.New("malformed digest")
+	errDigestMismatch = errors.New("digest mismatch")
+)
+
+// serveHash handles
+//
+//	HASH /path?algo=&offset=&length=
+//
+// by responding with the hex encoded digest of length bytes of the file
+// starting at offset (the whole file by default). algo defaults to
+// sha-256. The ETag of the file that was hashed is sent along so clients
+// can tell whether it changed since they read it.
+func (s *fileServer) serveHash(w http.ResponseWriter, r *http.Request, localPath string) {
+	query := r.URL.Query()
+
+	algo := query.Get("algo")
+	if algo == "" {
+		algo = "sha-256"
+	}
+	newHash, ok := hashes[algo]
+	if !ok {
+		http.Error(w, "Unsupported Algorithm", http.StatusBadRequest)
+		return
+	}
+
+	offset := utils.SafeParseInt64(query.Get("offset"), 0)
+	length := utils.SafeParseInt64(query.Get("length"), -1)
+	if offset < 0 {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	f, err := os.Open(localPath)
+	if err != nil {
+		//log.Printf("E: os.Open('%s') -> %s\n", localPath, err)
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	if !fi.Mode().IsRegular() {
+		http.Error(w, "Not A File", http.StatusBadRequest)
+		return
+	}
+
+	var src io.Reader = io.NewSectionReader(f, offset, fi.Size()-offset)
+	if length >= 0 {
+		src = io.LimitReader(src, length)
+	}
+
+	h := newHash()
+	if _, err := io.Copy(h, src); err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+
+	w.Header().Set("ETag", utils.ETag(fi))
+	w.Write([]byte(hex.EncodeToString(h.Sum(nil))))
+}
+
+// requestDigest returns the digest the client sent for the request body
+// in a Content-Digest (or the older Digest) header and the algorithm's
+// constructor. Digests are of the decoded body. It returns nil if there
+// is no digest in a supported algorithm.
+func requestDigest(r *http.Request) ([]byte, func() hash.Hash, error) {
+	if v := r.Header.Get("Content-Digest"); v != "" {
+		// sha-256=:<base64>:, ...
+		for _, d := range strings.Split(v, ",") {
+			kv := strings.SplitN(strings.TrimSpace(d), "=", 2)
+			newHash, ok := hashes[strings.ToLower(kv[0])]
+			if !ok || len(kv) != 2 {
+				continue
+			}
+			sum, err := base64.StdEncoding.DecodeString(strings.Trim(kv[1], ":"))
+			if err != nil {
+				return nil, nil, errBadDigest
+			}
+			return sum, newHash, nil
+		}
+	}
+	if v := r.Header.Get("Digest"); v != "" {
+		// SHA-256=<base64>, ...
+		for _, d := range strings.Split(v, ",") {
+			kv := strings.SplitN(strings.TrimSpace(d), "=", 2)
+			newHash, ok := hashes[strings.ToLower(kv[0])]
+			if !ok || len(kv) != 2 {
+				continue
+			}
+			sum, err := base64.StdEncoding.DecodeString(kv[1])
+			if err != nil {
+				return nil, nil, errBadDigest
+			}
+			return sum, newHash, nil
+		}
+	}
+	return nil, nil, nil
+}
+
+// verifiedBody checks body against the digest sent with r, if any,
+// before anything is written. The body is spooled to an unlinked
+// temporary file while it is hashed, which is returned to be read
+// instead; the caller closes it.
+func verifiedBody(r *http.Request, body io.Reader) (io.Reader, func(), error) {
+	want, newHash, err := requestDigest(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if want == nil {
+		return body, func() {}, nil
+	}
+
+	spool, err := ioutil.TempFile("", "httpfsd-")
+	if err != nil {
+		return nil, nil, err
+	}
+	os.Remove(spool.Name())
+
+	h := newHash()
+	if _, err := io.Copy(spool, io.TeeReader(body, h)); err != nil {
+		spool.Close()
+		return nil, nil, err
+	}
+	if !bytes.Equal(h.Sum(nil), want) {
+		spool.Close()
+		return nil, nil, errDigestMismatch
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		spool.Close()
+		return nil, nil, err
+	}
+	return spool, func() { spool.Close() }, nil
+}
+
+// verifyError responds to an error from verifiedBody.
+func verifyError(w http.ResponseWriter, err error) {
+	switch err {
+	case errBadDigest:
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+	case errDigestMismatch:
+		http.Error(w, "Digest Mismatch", http.StatusBadRequest)
+	default:
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+	}
+}
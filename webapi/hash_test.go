@@ -0,0 +1,117 @@
+package webapi_test
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prologic/httpfs/utils/tempdir"
+	"github.com/prologic/httpfs/webapi"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashAndDigest(t *testing.T) {
+	assert := assert.New(t)
+
+	tmp := tempdir.New(t)
+	defer tmp.Cleanup()
+
+	target := filepath.Join(tmp.Path, "foo")
+	assert.Nil(ioutil.WriteFile(target, []byte("0123456789"), 0644))
+
+	handler := webapi.FileServer(tmp.Path, false)
+
+	do := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+	digest := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+	}
+
+	w := do(httptest.NewRequest("HASH", "/foo?offset=2&length=3", nil))
+	assert.Equal(http.StatusOK, w.Code)
+	sum := sha256.Sum256([]byte("234"))
+	assert.Equal(hex.EncodeToString(sum[:]), w.Body.String())
+
+	// A body that doesn't match its digest is rejected before anything
+	// is written.
+	r := httptest.NewRequest("PUT", "/foo?flags=1&offset=0", strings.NewReader("abc"))
+	r.Header.Set("Content-Digest", digest("abd"))
+	assert.Equal(http.StatusBadRequest, do(r).Code)
+
+	b, err := ioutil.ReadFile(target)
+	assert.Nil(err)
+	assert.Equal("0123456789", string(b))
+
+	r = httptest.NewRequest("PUT", "/foo?flags=1&offset=0", strings.NewReader("abc"))
+	r.Header.Set("Content-Digest", digest("abc"))
+	assert.Equal(http.StatusOK, do(r).Code)
+
+	b, err = ioutil.ReadFile(target)
+	assert.Nil(err)
+	assert.Equal("abc3456789", string(b))
+}
+
+func TestDigestOfParts(t *testing.T) {
+	assert := assert.New(t)
+
+	tmp := tempdir.New(t)
+	defer tmp.Cleanup()
+
+	handler := webapi.FileServer(tmp.Path, false,
+		webapi.WithUploads(time.Hour), webapi.WithResumableUploads(time.Hour))
+
+	do := func(method, url, body, digest string, header ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, url, strings.NewReader(body))
+		if digest != "" {
+			sum := sha256.Sum256([]byte(digest))
+			r.Header.Set("Content-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":")
+		}
+		for i := 0; i+1 < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+
+	// Multipart upload parts.
+	w := do("UPLOAD", "/foo?offset=0&partsize=3", "", "")
+	assert.Equal(http.StatusOK, w.Code)
+	id := w.Body.String()
+
+	assert.Equal(http.StatusBadRequest, do("PART", "/foo?upload="+id+"&part=0", "abc", "abd").Code)
+	assert.Equal(http.StatusBadRequest, do("COMPLETE", "/foo?upload="+id+"&parts=1", "", "").Code)
+	assert.Equal(http.StatusOK, do("PART", "/foo?upload="+id+"&part=0", "abc", "abc").Code)
+	assert.Equal(http.StatusOK, do("COMPLETE", "/foo?upload="+id+"&parts=1", "", "").Code)
+
+	b, err := ioutil.ReadFile(filepath.Join(tmp.Path, "foo"))
+	assert.Nil(err)
+	assert.Equal("abc", string(b))
+
+	// Resumable upload chunks.
+	w = do("POST", "/bar", "", "", webapi.UploadLengthHeader, "3")
+	assert.Equal(http.StatusCreated, w.Code)
+	id = w.Body.String()
+
+	w = do("PATCH", "/bar?upload="+id, "abc", "abd", webapi.UploadOffsetHeader, "0")
+	assert.Equal(http.StatusBadRequest, w.Code)
+	assert.Equal("0", w.Header().Get(webapi.UploadOffsetHeader))
+	w = do("PATCH", "/bar?upload="+id, "abc", "abc", webapi.UploadOffsetHeader, "0")
+	assert.Equal(http.StatusNoContent, w.Code)
+
+	b, err = ioutil.ReadFile(filepath.Join(tmp.Path, "bar"))
+	assert.Nil(err)
+	assert.Equal("abc", string(b))
+}
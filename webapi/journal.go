@@ -0,0 +1,272 @@
+package webapi
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/prologic/httpfs/types"
+	"github.com/prologic/httpfs/utils"
+)
+
+// DefaultJournalSize is the default number of events a Journal retains.
+const DefaultJournalSize = 100000
+
+// DefaultChangesLimit is the maximum number of events returned by a
+// single CHANGES request unless the client asks for fewer.
+const DefaultChangesLimit = 1000
+
+// Journal is a durable, sequence-numbered log of every mutation made
+// through FileServer. It is stored as one JSON encoded event per line
+// and compacted once it grows past its retention limit.
+type Journal struct {
+	sync.Mutex
+	path   string
+	f      *os.File
+	size   int
+	events []types.Event
+	next   uint64
+
+	// end is the length of the journal on disk.
+	end int64
+
+	// compactAt is the number of events at which the journal is next
+	// compacted. It is pushed back when compaction fails so that it
+	// isn't retried on every event.
+	compactAt int
+}
+
+// OpenJournal opens the journal at path, creating it if necessary. At
+// most size events are retained; older events are discarded when the
+// journal is compacted.
+func OpenJournal(path string, size int) (*Journal, error) {
+	if size <= 0 {
+		size = DefaultJournalSize
+	}
+
+	j := &Journal{
+		path:      path,
+		size:      size,
+		next:      1,
+		compactAt: size + size/4 + 1,
+	}
+
+	if err := j.load(); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	j.f = f
+
+	return j, nil
+}
+
+// load reads any existing events from disk. A partially written final
+// record, left behind by a crash, is discarded.
+func (j *Journal) load() error {
+	f, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var valid int64
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			break
+		}
+
+		var e types.Event
+		if err := json.Unmarshal(line, &e); err != nil || e.Seq < j.next {
+			break
+		}
+
+		j.events = append(j.events, e)
+		j.next = e.Seq + 1
+		valid += int64(len(line))
+	}
+
+	j.end = valid
+	return os.Truncate(j.path, valid)
+}
+
+// Close ...
+func (j *Journal) Close() error {
+	j.Lock()
+	defer j.Unlock()
+	return j.f.Close()
+}
+
+// Record appends an event for op on path to the journal and syncs it to
+// disk. name is the destination of a rename or link and empty otherwise.
+func (j *Journal) Record(op, path, name string) error {
+	j.Lock()
+	defer j.Unlock()
+
+	e := types.NewEvent(op, path, name)
+	e.Seq = j.next
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	data = append(data, '\n')
+	if n, err := j.f.Write(data); err != nil {
+		if n > 0 {
+			// Don't leave a torn record in front of later ones.
+			j.f.Truncate(j.end)
+		}
+		return err
+	}
+	j.end += int64(len(data))
+
+	// The event is in the journal even if it can't be synced, so its
+	// sequence number must not be used again.
+	j.events = append(j.events, e)
+	j.next++
+
+	if err := j.f.Sync(); err != nil {
+		return err
+	}
+
+	if len(j.events) >= j.compactAt {
+		if err := j.compact(); err != nil {
+			j.compactAt = len(j.events) + j.size/4 + 1
+			return err
+		}
+		j.compactAt = j.size + j.size/4 + 1
+	}
+
+	return nil
+}
+
+// compact rewrites the journal keeping only the most recent size events.
+// The new journal is written aside and renamed into place so that a
+// crash leaves either the old or the new journal intact. It is written
+// through the file that later events are appended to, so that the
+// journal is never left without one.
+func (j *Journal) compact() error {
+	events := j.events[len(j.events)-j.size:]
+
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, e := range events {
+		if err := enc.Encode(e); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := os.Rename(tmp, j.path); err != nil {
+		f.Close()
+		return err
+	}
+
+	j.f.Close()
+	j.f = f
+	j.end = fi.Size()
+	j.events = append([]types.Event(nil), events...)
+
+	return nil
+}
+
+// Since returns up to limit events with a sequence number greater than
+// since that affect root or anything below it.
+func (j *Journal) Since(since uint64, root string, limit int) types.Changes {
+	j.Lock()
+	defer j.Unlock()
+
+	last := j.next - 1
+	changes := types.Changes{
+		Events: []types.Event{},
+		Next:   last,
+	}
+
+	first := j.next
+	if len(j.events) > 0 {
+		first = j.events[0].Seq
+	}
+
+	// Events between since and the oldest retained one have been
+	// compacted away, or the journal was reset underneath the client.
+	if since+1 < first || since > last {
+		changes.Resync = true
+		return changes
+	}
+
+	for _, e := range j.events[since+1-first:] {
+		if len(changes.Events) == limit {
+			changes.More = true
+			break
+		}
+		changes.Next = e.Seq
+		if underPath(e.FilePath(), root) || (e.Name != "" && underPath(e.DestPath(), root)) {
+			changes.Events = append(changes.Events, e)
+		}
+	}
+
+	return changes
+}
+
+// serveChanges responds to a CHANGES request with the journal entries
+// after the ?since= cursor.
+func (s *fileServer) serveChanges(w http.ResponseWriter, r *http.Request, urlPath string) {
+	if s.journal == nil {
+		http.Error(w, "Not Implemented", http.StatusNotImplemented)
+		return
+	}
+
+	query := r.URL.Query()
+
+	since := uint64(utils.SafeParseInt64(query.Get("since"), 0))
+	limit := utils.SafeParseInt(query.Get("limit"), DefaultChangesLimit)
+	if limit <= 0 || limit > DefaultChangesLimit {
+		limit = DefaultChangesLimit
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.journal.Since(since, urlPath, limit))
+}
+
+// record adds a mutation to the journal, if one is configured.
+func (s *fileServer) record(op, path, name string) {
+	if s.journal == nil {
+		return
+	}
+	if err := s.journal.Record(op, path, name); err != nil {
+		log.Printf("E: journal.Record(%q, %q) -> %s\n", op, path, err)
+	}
+}
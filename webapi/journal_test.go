@@ -0,0 +1,152 @@
+package webapi_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/prologic/httpfs/types"
+	"github.com/prologic/httpfs/utils/tempdir"
+	"github.com/prologic/httpfs/webapi"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJournalSince(t *testing.T) {
+	assert := assert.New(t)
+
+	tmp := tempdir.New(t)
+	defer tmp.Cleanup()
+
+	j, err := webapi.OpenJournal(path.Join(tmp.Path, "journal"), 10)
+	assert.Nil(err)
+	defer j.Close()
+
+	assert.Nil(j.Record(types.EventMkdir, "/a", ""))
+	assert.Nil(j.Record(types.EventCreate, "/b", ""))
+	assert.Nil(j.Record(types.EventRename, "/b", "/a/b"))
+
+	changes := j.Since(0, "/", 10)
+	assert.False(changes.Resync)
+	assert.Len(changes.Events, 3)
+	assert.EqualValues(3, changes.Next)
+
+	changes = j.Since(1, "/a", 10)
+	assert.Len(changes.Events, 1)
+	assert.Equal("/a/b", changes.Events[0].Name)
+
+	changes = j.Since(0, "/", 2)
+	assert.True(changes.More)
+	assert.EqualValues(2, changes.Next)
+}
+
+func TestJournalCompaction(t *testing.T) {
+	assert := assert.New(t)
+
+	tmp := tempdir.New(t)
+	defer tmp.Cleanup()
+
+	j, err := webapi.OpenJournal(path.Join(tmp.Path, "journal"), 4)
+	assert.Nil(err)
+
+	for i := 0; i < 6; i++ {
+		assert.Nil(j.Record(types.EventWrite, "/a", ""))
+	}
+
+	changes := j.Since(0, "/", 10)
+	assert.True(changes.Resync)
+	assert.Empty(changes.Events)
+	assert.EqualValues(6, changes.Next)
+
+	changes = j.Since(2, "/", 10)
+	assert.False(changes.Resync)
+	assert.Len(changes.Events, 4)
+
+	assert.Nil(j.Close())
+
+	// Reopening resumes the sequence where it left off.
+	j, err = webapi.OpenJournal(path.Join(tmp.Path, "journal"), 4)
+	assert.Nil(err)
+	defer j.Close()
+
+	assert.Nil(j.Record(types.EventWrite, "/a", ""))
+	changes = j.Since(6, "/", 10)
+	assert.Len(changes.Events, 1)
+	assert.EqualValues(7, changes.Events[0].Seq)
+}
+
+func TestJournalResetCursor(t *testing.T) {
+	tmp := tempdir.New(t)
+	defer tmp.Cleanup()
+
+	j, err := webapi.OpenJournal(path.Join(tmp.Path, "journal"), 4)
+	assert.Nil(t, err)
+	defer j.Close()
+
+	assert.True(t, j.Since(42, "/", 10).Resync)
+}
+
+func TestJournalRawNames(t *testing.T) {
+	assert := assert.New(t)
+
+	tmp := tempdir.New(t)
+	defer tmp.Cleanup()
+
+	const raw = "/caf\xe9"
+
+	j, err := webapi.OpenJournal(path.Join(tmp.Path, "journal"), 10)
+	assert.Nil(err)
+	assert.Nil(j.Record(types.EventRename, raw, raw+"2"))
+	assert.Nil(j.Close())
+
+	// Names that aren't UTF-8 survive the journal on disk.
+	j, err = webapi.OpenJournal(path.Join(tmp.Path, "journal"), 10)
+	assert.Nil(err)
+	defer j.Close()
+
+	changes := j.Since(0, raw, 10)
+	if assert.Len(changes.Events, 1) {
+		assert.Equal(raw, changes.Events[0].FilePath())
+		assert.Equal(raw+"2", changes.Events[0].DestPath())
+	}
+}
+
+func TestJournalCompactionFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	tmp := tempdir.New(t)
+	defer tmp.Cleanup()
+
+	p := path.Join(tmp.Path, "journal")
+	j, err := webapi.OpenJournal(p, 4)
+	assert.Nil(err)
+	defer j.Close()
+
+	// The compacted journal can't be written aside.
+	assert.Nil(os.Mkdir(p+".tmp", 0755))
+	for i := 0; i < 5; i++ {
+		assert.Nil(j.Record(types.EventWrite, "/a", ""))
+	}
+	assert.NotNil(j.Record(types.EventWrite, "/a", ""))
+
+	// It isn't tried again for a while, and events are still recorded.
+	assert.Nil(os.Remove(p + ".tmp"))
+	assert.Nil(j.Record(types.EventWrite, "/a", ""))
+	data, err := ioutil.ReadFile(p)
+	assert.Nil(err)
+	assert.Equal(7, bytes.Count(data, []byte("\n")))
+
+	// Then it is compacted, and written to afterwards.
+	assert.Nil(j.Record(types.EventWrite, "/a", ""))
+	assert.Nil(j.Record(types.EventWrite, "/a", ""))
+	data, err = ioutil.ReadFile(p)
+	assert.Nil(err)
+	assert.Equal(5, bytes.Count(data, []byte("\n")))
+
+	changes := j.Since(5, "/", 10)
+	assert.False(changes.Resync)
+	assert.Len(changes.Events, 4)
+	assert.EqualValues(9, changes.Next)
+}
@@ -0,0 +1,36 @@
+package webapi_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListingETag(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newTestServer(t)
+	defer s.Close()
+
+	assert.Nil(ioutil.WriteFile(s.path("foo"), []byte("hello"), 0644))
+
+	w := s.do("GET", "/", "")
+	assert.Equal(http.StatusOK, w.Code)
+	etag := w.Header().Get("ETag")
+	assert.NotEmpty(etag)
+
+	w = s.do("GET", "/", "", "If-None-Match", etag)
+	assert.Equal(http.StatusNotModified, w.Code)
+	assert.Equal(0, w.Body.Len())
+
+	// Modifying a file doesn't touch the directory's mtime but changes
+	// its entry.
+	assert.Nil(ioutil.WriteFile(s.path("foo"), []byte("hello world"), 0644))
+
+	w = s.do("GET", "/", "", "If-None-Match", etag)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.NotEqual(etag, w.Header().Get("ETag"))
+	assert.Contains(w.Body.String(), `"Size":11`)
+}
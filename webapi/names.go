@@ -0,0 +1,100 @@
+package webapi
+
+import (
+	"errors"
+	//"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/prologic/httpfs/utils"
+)
+
+// errNameCollision is returned when a name matches more than one file
+// under the server's name rules, e.g. both "Foo" and "foo" exist in a
+// case-insensitive lookup.
+var errNameCollision = errors.New("name collision")
+
+// WithNormalizer makes the server apply the name rules of n: the names
+// of files and directories it creates or renames are normalized, and
+// names in requests that don't exist as they are match the one existing
+// name n considers equal to them.
+func WithNormalizer(n *utils.Normalizer) Option {
+	return func(s *fileServer) {
+		s.names = n
+	}
+}
+
+// resolve returns the path under dir that urlPath refers to, or
+// errExcluded if that is excluded. Without name rules that is simply
+// urlPath inside dir. With them, each component of urlPath is matched
+// with an existing name, and the components from the first one that
+// doesn't exist on are normalized for creating them.
+func (s *fileServer) resolve(dir, urlPath string) (string, error) {
+	local, err := s.resolveNames(dir, urlPath)
+	if err == nil && s.excluded(dir, local) {
+		return "", errExcluded
+	}
+	return local, err
+}
+
+func (s *fileServer) resolveNames(dir, urlPath string) (string, error) {
+	if s.names == nil {
+		return path.Join(dir, urlPath), nil
+	}
+
+	local := dir
+	parts := strings.Split(strings.TrimPrefix(path.Clean(urlPath), "/"), "/")
+	for i, name := range parts {
+		if name == "" {
+			continue
+		}
+		match, err := s.lookupName(local, name)
+		if err != nil {
+			return "", err
+		}
+		if match == "" {
+			for _, name := range parts[i:] {
+				local = path.Join(local, s.names.Normalize(name))
+			}
+			return local, nil
+		}
+		local = path.Join(local, match)
+	}
+	return local, nil
+}
+
+// lookupName returns the name in the directory dir that name refers to,
+// or "" if there is none. A name that exists as it is always refers to
+// itself.
+func (s *fileServer) lookupName(dir, name string) (string, error) {
+	if _, err := os.Lstat(path.Join(dir, name)); err == nil {
+		return name, nil
+	}
+
+	f, err := os.Open(dir)
+	if err != nil {
+		// Let the operation itself report the problem.
+		return "", nil
+	}
+	defer f.Close()
+
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return "", nil
+	}
+
+	key := s.names.Key(name)
+	match := ""
+	for _, n := range names {
+		if s.names.Key(n) != key {
+			continue
+		}
+		if match != "" {
+			//log.Printf("E: %q matches both %q and %q in %s\n", name, match, n, dir)
+			return "", errNameCollision
+		}
+		match = n
+	}
+	return match, nil
+}
@@ -0,0 +1,49 @@
+package webapi_test
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/prologic/httpfs/utils"
+	"github.com/prologic/httpfs/webapi"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizer(t *testing.T) {
+	assert := assert.New(t)
+
+	names, err := utils.NewNormalizer("nfc", true)
+	assert.Nil(err)
+	s := newTestServer(t, webapi.WithNormalizer(names))
+	defer s.Close()
+
+	const nfc, nfd = "Caf\u00e9", "Cafe\u0301"
+
+	// New names are normalized.
+	assert.Equal(http.StatusOK, s.do("PUT", utils.EscapePath("/"+nfd), "x").Code)
+	assert.True(s.exists(nfc))
+	assert.False(s.exists(nfd))
+
+	// Lookups ignore case and normalization form.
+	assert.Equal(http.StatusOK, s.do("HEAD", utils.EscapePath("/café"), "").Code)
+	assert.Equal(http.StatusOK, s.do("HEAD", utils.EscapePath("/CAFÉ"), "").Code)
+	assert.Equal(http.StatusConflict, s.do("PUT", utils.EscapePath("/CAFÉ"), "x").Code)
+
+	// A rename can change just the case.
+	assert.Equal(http.StatusOK, s.do("RENAME", utils.EscapePath("/"+nfc)+"?name="+url.QueryEscape("/CAFÉ"), "").Code)
+	assert.True(s.exists("CAFÉ"))
+	assert.False(s.exists(nfc))
+
+	assert.Equal(http.StatusOK, s.do("MKDIR", "/Dir", "").Code)
+	assert.Equal(http.StatusOK, s.do("PUT", utils.EscapePath("/dir/e\u0301"), "x").Code)
+	assert.True(s.exists("Dir/\u00e9"))
+
+	// Names that are equal under the rules can't be told apart.
+	assert.Nil(os.Mkdir(s.path("ab"), 0755))
+	assert.Nil(os.Mkdir(s.path("AB"), 0755))
+	assert.Equal(http.StatusOK, s.do("HEAD", "/ab", "").Code)
+	assert.Equal(http.StatusConflict, s.do("HEAD", "/Ab", "").Code)
+}
@@ -0,0 +1,88 @@
+package webapi
+
+import (
+	//"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"syscall"
+
+	"github.com/prologic/httpfs/types"
+)
+
+// serveRename handles
+//
+//	RENAME /path?name=&flags=
+//
+// which renames path to name, replacing name if it exists. flags holds
+// types.RenameNoReplace, to fail with 409 instead if name exists, or
+// types.RenameExchange, to atomically swap path and name, which must
+// both exist. Asking for both fails with 400, and so does a flag the
+// host filesystem can't honour; 501 means the host OS can't do either.
+func (s *fileServer) serveRename(w http.ResponseWriter, r *http.Request, dir, localPath, urlPath string) {
+	namePath, ok := nameParam(r)
+	if !ok {
+		//log.Printf("E: No ?name= specified for RENAME request\n")
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	var flags uint64
+	if f := r.URL.Query().Get("flags"); f != "" {
+		var err error
+		flags, err = strconv.ParseUint(f, 10, 32)
+		if err != nil || flags&^(types.RenameNoReplace|types.RenameExchange) != 0 ||
+			flags == types.RenameNoReplace|types.RenameExchange {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+	}
+
+	toPath, err := s.resolve(dir, namePath)
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	if toPath == localPath && path.Clean(namePath) != urlPath {
+		// A rename to a name that only differs in case or
+		// normalization form.
+		toPath = path.Join(path.Dir(localPath), s.names.Normalize(path.Base(namePath)))
+	}
+
+	// Only a plain rename loses what was at the destination.
+	if flags == 0 && toPath != localPath && !s.saveVersion(w, toPath) {
+		return
+	}
+
+	if flags == 0 {
+		err = os.Rename(localPath, toPath)
+	} else {
+		err = renameat2(localPath, toPath, uint(flags))
+	}
+	if err != nil {
+		//log.Printf( "E: rename('%s', '%s', %d) -> %s\n", localPath, toPath, flags, err,)
+		msg, code := renameError(err)
+		http.Error(w, msg, code)
+		return
+	}
+
+	s.record(types.EventRename, urlPath, namePath)
+	if flags == types.RenameExchange {
+		s.record(types.EventRename, namePath, urlPath)
+	}
+}
+
+func renameError(err error) (string, int) {
+	if le, ok := err.(*os.LinkError); ok {
+		err = le.Err
+	}
+	switch err {
+	case syscall.EINVAL:
+		return "Invalid Rename", http.StatusBadRequest
+	case syscall.ENOSYS, syscall.ENOTSUP:
+		return "Not Implemented", http.StatusNotImplemented
+	}
+	return toHTTPError(err)
+}
@@ -0,0 +1,16 @@
+package webapi
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// renameat2 renames oldpath to newpath with renameat2(2) flags.
+func renameat2(oldpath, newpath string, flags uint) error {
+	err := unix.Renameat2(unix.AT_FDCWD, oldpath, unix.AT_FDCWD, newpath, flags)
+	if err != nil {
+		return &os.LinkError{Op: "renameat2", Old: oldpath, New: newpath, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package webapi
+
+import (
+	"syscall"
+)
+
+// renameat2 is not supported on this platform.
+func renameat2(oldpath, newpath string, flags uint) error {
+	return syscall.ENOTSUP
+}
@@ -0,0 +1,57 @@
+package webapi_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/prologic/httpfs/types"
+	"github.com/prologic/httpfs/utils/tempdir"
+	"github.com/prologic/httpfs/webapi"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenameFlags(t *testing.T) {
+	assert := assert.New(t)
+
+	tmp := tempdir.New(t)
+	defer tmp.Cleanup()
+
+	write := func(name, data string) {
+		assert.Nil(ioutil.WriteFile(filepath.Join(tmp.Path, name), []byte(data), 0644))
+	}
+	read := func(name string) string {
+		data, _ := ioutil.ReadFile(filepath.Join(tmp.Path, name))
+		return string(data)
+	}
+	write("a", "a")
+	write("b", "b")
+
+	handler := webapi.FileServer(tmp.Path, false)
+
+	rename := func(from, to string, flags int) int {
+		w := httptest.NewRecorder()
+		url := fmt.Sprintf("%s?name=%s&flags=%d", from, to, flags)
+		handler(w, httptest.NewRequest("RENAME", url, nil))
+		return w.Code
+	}
+
+	assert.Equal(http.StatusBadRequest, rename("/a", "/b", types.RenameNoReplace|types.RenameExchange))
+	assert.Equal(http.StatusBadRequest, rename("/a", "/b", 4))
+
+	assert.Equal(http.StatusConflict, rename("/a", "/b", types.RenameNoReplace))
+	assert.Equal("a", read("a"))
+	assert.Equal("b", read("b"))
+
+	assert.Equal(http.StatusOK, rename("/a", "/b", types.RenameExchange))
+	assert.Equal("b", read("a"))
+	assert.Equal("a", read("b"))
+	assert.Equal(http.StatusNotFound, rename("/a", "/c", types.RenameExchange))
+
+	assert.Equal(http.StatusOK, rename("/a", "/c", types.RenameNoReplace))
+	assert.Equal("b", read("c"))
+}
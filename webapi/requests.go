@@ -0,0 +1,176 @@
+package webapi
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RequestIDHeader carries the client generated id of a non-idempotent
+// request, see fsapi.RequestIDHeader.
+const RequestIDHeader = "X-Request-Id"
+
+const (
+	// requestCacheSize bounds the number of remembered responses.
+	requestCacheSize = 10000
+
+	// requestCacheTTL is how long a response is remembered. It only
+	// needs to outlive the client's retry window.
+	requestCacheTTL = 10 * time.Minute
+
+	// maxCachedBody bounds the size of a remembered response body.
+	// Only the status of larger responses is replayed.
+	maxCachedBody = 64 << 10
+)
+
+// cachedResponse is the recorded outcome of a request. done is closed
+// once the original request has completed, so that a retry arriving
+// while the original is still running waits for it instead of
+// applying the change again. Only the status is kept if the body is
+// too large to remember (truncated).
+type cachedResponse struct {
+	done      chan struct{}
+	expires   time.Time
+	code      int
+	header    http.Header
+	body      []byte
+	truncated bool
+}
+
+// requestCache remembers the responses to recent requests by method,
+// path and id.
+type requestCache struct {
+	sync.Mutex
+	entries map[string]*cachedResponse
+	order   []string
+}
+
+func newRequestCache() *requestCache {
+	return &requestCache{
+		entries: make(map[string]*cachedResponse),
+	}
+}
+
+// begin returns the entry for key and whether it already existed. If it
+// didn't, the caller owns the new entry and must call finish on it.
+func (c *requestCache) begin(key string) (*cachedResponse, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+
+	for len(c.order) > 0 {
+		oldest := c.entries[c.order[0]]
+		if len(c.order) < requestCacheSize && now.Before(oldest.expires) {
+			break
+		}
+		delete(c.entries, c.order[0])
+		c.order = c.order[1:]
+	}
+
+	if entry, ok := c.entries[key]; ok {
+		return entry, true
+	}
+
+	entry := &cachedResponse{
+		done:    make(chan struct{}),
+		expires: now.Add(requestCacheTTL),
+	}
+	c.entries[key] = entry
+	c.order = append(c.order, key)
+
+	return entry, false
+}
+
+// finish records the response captured by rec and wakes any waiters.
+func (c *requestCache) finish(entry *cachedResponse, rec *responseRecorder) {
+	c.Lock()
+	entry.code = rec.code
+	entry.header = make(http.Header)
+	for k, v := range rec.Header() {
+		entry.header[k] = v
+	}
+	entry.body = rec.body.Bytes()
+	entry.truncated = rec.truncated
+	entry.expires = time.Now().Add(requestCacheTTL)
+	c.Unlock()
+
+	close(entry.done)
+}
+
+// replay writes the recorded response to w.
+func (entry *cachedResponse) replay(w http.ResponseWriter) {
+	<-entry.done
+
+	if entry.truncated {
+		w.WriteHeader(entry.code)
+		return
+	}
+	for k, v := range entry.header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(entry.code)
+	w.Write(entry.body)
+}
+
+// responseRecorder passes a response through to the client while
+// keeping a copy of it, or of its status only once the body grows past
+// maxCachedBody.
+type responseRecorder struct {
+	http.ResponseWriter
+	code      int
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (rec *responseRecorder) WriteHeader(code int) {
+	rec.code = code
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	switch {
+	case rec.truncated:
+	case rec.body.Len()+len(b) > maxCachedBody:
+		rec.truncated = true
+		rec.body = bytes.Buffer{}
+	default:
+		rec.body.Write(b)
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+// mutating reports whether requests with method may change anything.
+// Only their responses are worth remembering; others can simply run
+// again.
+func mutating(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "EVENTS", "CHANGES", "HASH", "SIGNATURE", "EXTENTS", "TRASH", "VERSIONS":
+		return false
+	default:
+		return true
+	}
+}
+
+// dedup runs handler for r unless the same request (by method, path and
+// id) has been seen before, in which case the original response is
+// replayed.
+func (c *requestCache) dedup(w http.ResponseWriter, r *http.Request, handler http.HandlerFunc) {
+	id := r.Header.Get(RequestIDHeader)
+	if id == "" || !mutating(r.Method) {
+		handler(w, r)
+		return
+	}
+
+	entry, seen := c.begin(r.Method + " " + r.URL.Path + " " + id)
+	if seen {
+		entry.replay(w)
+		return
+	}
+
+	rec := &responseRecorder{ResponseWriter: w, code: http.StatusOK}
+	defer c.finish(entry, rec)
+
+	handler(rec, r)
+}
@@ -0,0 +1,63 @@
+package webapi_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prologic/httpfs/utils/tempdir"
+	"github.com/prologic/httpfs/webapi"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestIDDeduplication(t *testing.T) {
+	assert := assert.New(t)
+
+	tmp := tempdir.New(t)
+	defer tmp.Cleanup()
+
+	handler := webapi.FileServer(tmp.Path, false)
+
+	mkdir := func(id string) int {
+		req := httptest.NewRequest("MKDIR", "/foo", nil)
+		if id != "" {
+			req.Header.Set(webapi.RequestIDHeader, id)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w.Code
+	}
+
+	assert.Equal(http.StatusOK, mkdir("1234"))
+
+	// A retry with the same id is answered from the first response.
+	assert.Equal(http.StatusOK, mkdir("1234"))
+
+	// A genuinely new request is applied and fails.
+	assert.Equal(http.StatusConflict, mkdir("5678"))
+	assert.Equal(http.StatusConflict, mkdir(""))
+
+	do := func(method, url, id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, nil)
+		req.Header.Set(webapi.RequestIDHeader, id)
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	// Ids are scoped by method and path.
+	assert.Equal(http.StatusOK, do("MKDIR", "/bar", "1234").Code)
+	assert.Equal(http.StatusOK, do("RMDIR", "/bar", "1234").Code)
+	_, err := os.Stat(filepath.Join(tmp.Path, "bar"))
+	assert.True(os.IsNotExist(err))
+
+	// Requests that change nothing aren't remembered.
+	assert.Nil(ioutil.WriteFile(filepath.Join(tmp.Path, "f"), []byte("one"), 0644))
+	first := do("HASH", "/f", "9999").Body.String()
+	assert.Nil(ioutil.WriteFile(filepath.Join(tmp.Path, "f"), []byte("two"), 0644))
+	assert.NotEqual(first, do("HASH", "/f", "9999").Body.String())
+}
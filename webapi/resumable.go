@@ -0,0 +1,307 @@
+package webapi
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	//"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prologic/httpfs/types"
+	"github.com/prologic/httpfs/utils"
+)
+
+// DefaultResumableTTL is how long an unfinished resumable upload is kept
+// after it last received data.
+const DefaultResumableTTL = 24 * time.Hour
+
+// Resumable upload headers
+const (
+	UploadOffsetHeader = "Upload-Offset"
+	UploadLengthHeader = "Upload-Length"
+)
+
+// resumableName matches the staging and info files of resumable uploads.
+var resumableName = regexp.MustCompile(`^\..+\.httpfs-resumable-[0-9a-f]{16}(\.info)?$`)
+
+var resumableID = regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+// resumableInfo is the durable state of a resumable upload besides the
+// data received so far, whose length is the upload's offset.
+type resumableInfo struct {
+	Length int64
+	Perm   os.FileMode
+}
+
+// resumables tracks resumable uploads (in the style of tus.io): POST
+// creates an upload of a given length, HEAD reports how much of it the
+// server has, and PATCH appends data from that offset. Once all data has
+// arrived the upload replaces the target. The state of an upload lives
+// entirely in files next to the target, so uploads survive restarts of
+// both client and server; ones that receive no data for ttl are removed.
+type resumables struct {
+	sync.Mutex
+	ttl    time.Duration
+	active map[string]*sync.Mutex
+}
+
+// WithResumableUploads enables resumable uploads. Unfinished uploads
+// idle for longer than ttl are removed.
+func WithResumableUploads(ttl time.Duration) Option {
+	return func(s *fileServer) {
+		s.resumables = &resumables{
+			ttl:    ttl,
+			active: make(map[string]*sync.Mutex),
+		}
+	}
+}
+
+func (rs *resumables) start(root string) {
+	go func() {
+		for {
+			rs.gc(root)
+			time.Sleep(rs.ttl / 4)
+		}
+	}()
+}
+
+// gc removes the uploads under root that have received no data for
+// longer than the ttl. Uploads expire by the staging file, which every
+// PATCH touches; the info file written at POST goes along with it.
+func (rs *resumables) gc(root string) {
+	filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() || !resumableName.MatchString(fi.Name()) {
+			return nil
+		}
+
+		if staging := strings.TrimSuffix(p, ".info"); staging != p {
+			// An info file without its staging file is left over from
+			// a failed POST.
+			if _, err := os.Lstat(staging); os.IsNotExist(err) && time.Since(fi.ModTime()) > rs.ttl {
+				os.Remove(p)
+			}
+			return nil
+		}
+
+		if time.Since(fi.ModTime()) <= rs.ttl {
+			return nil
+		}
+		unlock := rs.lock(p)
+		if fi, err := os.Stat(p); err == nil && time.Since(fi.ModTime()) > rs.ttl {
+			//log.Printf("removing abandoned resumable upload %s\n", p)
+			os.Remove(p)
+			os.Remove(p + ".info")
+		}
+		unlock()
+		rs.remove(p)
+		return nil
+	})
+}
+
+// lock serializes access to the upload with the given staging file.
+func (rs *resumables) lock(staging string) func() {
+	rs.Lock()
+	l, ok := rs.active[staging]
+	if !ok {
+		l = &sync.Mutex{}
+		rs.active[staging] = l
+	}
+	rs.Unlock()
+
+	l.Lock()
+	return l.Unlock
+}
+
+func (rs *resumables) remove(staging string) {
+	rs.Lock()
+	delete(rs.active, staging)
+	rs.Unlock()
+}
+
+func resumableStaging(localPath, id string) string {
+	return path.Join(path.Dir(localPath), utils.TempName(path.Base(localPath), "resumable", id))
+}
+
+// serveResumable handles the resumable upload requests:
+//
+//	POST  /path              create an upload (Upload-Length, ?perm=); responds with its id
+//	HEAD  /path?upload=id    report the offset (Upload-Offset, Upload-Length)
+//	PATCH /path?upload=id    append the body at Upload-Offset
+func (s *fileServer) serveResumable(w http.ResponseWriter, r *http.Request, localPath, urlPath string) {
+	if s.resumables == nil {
+		http.Error(w, "Not Implemented", http.StatusNotImplemented)
+		return
+	}
+
+	if r.Method == "POST" {
+		s.createResumable(w, r, localPath)
+		return
+	}
+
+	id := r.URL.Query().Get("upload")
+	if !resumableID.MatchString(id) {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	staging := resumableStaging(localPath, id)
+
+	unlock := s.resumables.lock(staging)
+	defer unlock()
+
+	info, err := readResumableInfo(staging)
+	if err != nil {
+		http.Error(w, "Upload Not Found", http.StatusNotFound)
+		return
+	}
+	fi, err := os.Stat(staging)
+	if err != nil {
+		http.Error(w, "Upload Not Found", http.StatusNotFound)
+		return
+	}
+	offset := fi.Size()
+
+	w.Header().Set(UploadLengthHeader, fmt.Sprintf("%d", info.Length))
+
+	if r.Method == "HEAD" {
+		w.Header().Set(UploadOffsetHeader, fmt.Sprintf("%d", offset))
+		return
+	}
+
+	if utils.SafeParseInt64(r.Header.Get(UploadOffsetHeader), -1) != offset {
+		w.Header().Set(UploadOffsetHeader, fmt.Sprintf("%d", offset))
+		http.Error(w, "Offset Mismatch", http.StatusConflict)
+		return
+	}
+
+	// A body sent with a digest is kept only if it all arrived intact;
+	// otherwise keep whatever arrived even if the body was cut short.
+	// Either way the client resumes from the new offset.
+	body, done, err := verifiedBody(r, r.Body)
+	if err != nil {
+		w.Header().Set(UploadOffsetHeader, fmt.Sprintf("%d", offset))
+		verifyError(w, err)
+		return
+	}
+	defer done()
+
+	f, err := os.OpenFile(staging, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+
+	n, copyErr := io.Copy(f, io.LimitReader(body, info.Length-offset))
+	syncErr := f.Sync()
+	f.Close()
+	offset += n
+
+	w.Header().Set(UploadOffsetHeader, fmt.Sprintf("%d", offset))
+	if copyErr != nil || syncErr != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if offset < info.Length {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if fi, err := os.Lstat(localPath); err == nil && fi.Mode().IsRegular() {
+		if err := copyAttrs(localPath, staging, fi); err != nil {
+			msg, code := toHTTPError(err)
+			http.Error(w, msg, code)
+			return
+		}
+	}
+	if !s.saveVersion(w, localPath) {
+		return
+	}
+	if err := os.Rename(staging, localPath); err != nil {
+		//log.Printf("E: os.Rename('%s', '%s') -> %s\n", staging, localPath, err)
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	os.Remove(staging + ".info")
+	s.resumables.remove(staging)
+
+	s.record(types.EventWrite, urlPath, "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *fileServer) createResumable(w http.ResponseWriter, r *http.Request, localPath string) {
+	info := resumableInfo{
+		Length: utils.SafeParseInt64(r.Header.Get(UploadLengthHeader), -1),
+		Perm:   utils.SafeParseMode(r.URL.Query().Get("perm"), 0666) & os.ModePerm,
+	}
+	if info.Length < 0 {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	id := hex.EncodeToString(b)
+	staging := resumableStaging(localPath, id)
+
+	data, _ := json.Marshal(info)
+	if err := writeSynced(staging+".info", data); err != nil {
+		//log.Printf("E: writing upload info %s -> %s\n", staging, err)
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	f, err := os.OpenFile(staging, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Perm)
+	if err != nil {
+		os.Remove(staging + ".info")
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	f.Close()
+
+	//log.Printf("created resumable upload %s of %s\n", id, localPath)
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(id))
+}
+
+func readResumableInfo(staging string) (resumableInfo, error) {
+	var info resumableInfo
+	data, err := ioutil.ReadFile(staging + ".info")
+	if err != nil {
+		return info, err
+	}
+	err = json.Unmarshal(data, &info)
+	return info, err
+}
+
+// writeSynced creates the file at p with data and syncs it to disk.
+func writeSynced(p string, data []byte) error {
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
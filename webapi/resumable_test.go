@@ -0,0 +1,82 @@
+package webapi_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prologic/httpfs/webapi"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResumableUpload(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newTestServer(t, webapi.WithResumableUploads(time.Hour))
+	defer s.Close()
+
+	w := s.do("POST", "/foo", "", webapi.UploadLengthHeader, "10")
+	assert.Equal(http.StatusCreated, w.Code)
+	id := w.Body.String()
+
+	assert.Equal(http.StatusNoContent, s.do("PATCH", "/foo?upload="+id, "0123", webapi.UploadOffsetHeader, "0").Code)
+
+	w = s.do("HEAD", "/foo?upload="+id, "")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("4", w.Header().Get(webapi.UploadOffsetHeader))
+	assert.Equal("10", w.Header().Get(webapi.UploadLengthHeader))
+
+	// Data must continue exactly where the server is.
+	w = s.do("PATCH", "/foo?upload="+id, "23456789", webapi.UploadOffsetHeader, "2")
+	assert.Equal(http.StatusConflict, w.Code)
+	assert.Equal("4", w.Header().Get(webapi.UploadOffsetHeader))
+
+	// Nothing is visible until the upload is complete.
+	assert.False(s.exists("foo"))
+
+	assert.Equal(http.StatusNoContent, s.do("PATCH", "/foo?upload="+id, "456789", webapi.UploadOffsetHeader, "4").Code)
+
+	data, err := ioutil.ReadFile(s.path("foo"))
+	assert.Nil(err)
+	assert.Equal("0123456789", string(data))
+
+	files, _ := ioutil.ReadDir(s.tmp.Path)
+	assert.Len(files, 1)
+	assert.Equal(http.StatusNotFound, s.do("HEAD", "/foo?upload="+id, "").Code)
+}
+
+func TestResumableUploadExpiry(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newTestServer(t, webapi.WithResumableUploads(time.Second))
+	defer s.Close()
+
+	w := s.do("POST", "/foo", "", webapi.UploadLengthHeader, "10")
+	assert.Equal(http.StatusCreated, w.Code)
+	id := w.Body.String()
+	assert.Equal(http.StatusNoContent, s.do("PATCH", "/foo?upload="+id, "0123", webapi.UploadOffsetHeader, "0").Code)
+
+	infos, _ := filepath.Glob(s.path(".foo.httpfs-resumable-*.info"))
+	if !assert.Len(infos, 1) {
+		return
+	}
+	staging := infos[0][:len(infos[0])-len(".info")]
+	long := time.Now().Add(-time.Hour)
+
+	// An upload that still receives data is kept, however long ago it
+	// was created.
+	assert.Nil(os.Chtimes(infos[0], long, long))
+	time.Sleep(500 * time.Millisecond)
+	assert.Equal(http.StatusNoContent, s.do("PATCH", "/foo?upload="+id, "45", webapi.UploadOffsetHeader, "4").Code)
+
+	// An idle one is removed altogether.
+	assert.Nil(os.Chtimes(staging, long, long))
+	time.Sleep(500 * time.Millisecond)
+	files, _ := ioutil.ReadDir(s.tmp.Path)
+	assert.Len(files, 0)
+	assert.Equal(http.StatusNotFound, s.do("HEAD", "/foo?upload="+id, "").Code)
+}
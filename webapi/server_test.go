@@ -0,0 +1,54 @@
+package webapi_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prologic/httpfs/utils/tempdir"
+	"github.com/prologic/httpfs/webapi"
+)
+
+// testServer serves a temporary directory to the tests.
+type testServer struct {
+	tmp     tempdir.Dir
+	handler http.HandlerFunc
+}
+
+func newTestServer(t *testing.T, opts ...webapi.Option) *testServer {
+	tmp := tempdir.New(t)
+	return &testServer{
+		tmp:     tmp,
+		handler: webapi.FileServer(tmp.Path, false, opts...),
+	}
+}
+
+func (s *testServer) Close() {
+	s.tmp.Cleanup()
+}
+
+// do sends a request with body and header, given as pairs of names and
+// values, to the server.
+func (s *testServer) do(method, url, body string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, url, strings.NewReader(body))
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	s.handler(w, r)
+	return w
+}
+
+// path returns the local path of name on the server.
+func (s *testServer) path(name string) string {
+	return filepath.Join(s.tmp.Path, filepath.FromSlash(name))
+}
+
+// exists reports whether name exists on the server.
+func (s *testServer) exists(name string) bool {
+	_, err := os.Lstat(s.path(name))
+	return err == nil
+}
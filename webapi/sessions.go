@@ -0,0 +1,258 @@
+package webapi
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/prologic/httpfs/types"
+	"github.com/prologic/httpfs/utils"
+)
+
+// DefaultSessionTTL is how long an atomic write session may sit idle
+// before its temporary file is removed.
+const DefaultSessionTTL = time.Hour
+
+// sessionName matches the hidden temporary file of an atomic write
+// session for the file named by the first group.
+var sessionName = regexp.MustCompile(`^\.(.+)\.httpfs-[0-9a-f]{16}$`)
+
+// shortName matches the end of target names cut short by
+// utils.TempName.
+var shortName = regexp.MustCompile(`~[0-9a-f]{16}$`)
+
+// sessions tracks atomic write sessions. A session writes into a hidden
+// temporary file next to its target (BEGIN) which is renamed over the
+// target on COMMIT. Until then the target is untouched, so readers never
+// see a partially written file and a crashed or abandoned session leaves
+// nothing but a temporary file, which is eventually garbage collected.
+type sessions struct {
+	sync.Mutex
+	ttl    time.Duration
+	active map[string]string
+}
+
+// WithSessions enables the BEGIN and COMMIT methods for atomic writes.
+// Sessions that see no writes for ttl are abandoned.
+func WithSessions(ttl time.Duration) Option {
+	return func(s *fileServer) {
+		s.sessions = &sessions{
+			ttl:    ttl,
+			active: make(map[string]string),
+		}
+	}
+}
+
+// start garbage collects abandoned sessions, including any left behind
+// by a previous run of the server below root.
+func (ss *sessions) start(root string) {
+	go func() {
+		removeStale(root, sessionName, ss.ttl)
+
+		for range time.Tick(ss.ttl / 4) {
+			ss.gc()
+		}
+	}()
+}
+
+// removeStale removes files below root whose names match pattern and
+// that haven't been modified for ttl.
+func removeStale(root string, pattern *regexp.Regexp, ttl time.Duration) {
+	filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() && pattern.MatchString(fi.Name()) &&
+			time.Since(fi.ModTime()) > ttl {
+			os.Remove(p)
+		}
+		return nil
+	})
+}
+
+// gc removes the temporary files of sessions that have been idle for
+// longer than the ttl.
+func (ss *sessions) gc() {
+	ss.Lock()
+	defer ss.Unlock()
+
+	for p := range ss.active {
+		fi, err := os.Stat(p)
+		if err != nil {
+			delete(ss.active, p)
+			continue
+		}
+		if time.Since(fi.ModTime()) > ss.ttl {
+			log.Printf("removing abandoned write session %s", p)
+			os.Remove(p)
+			delete(ss.active, p)
+		}
+	}
+}
+
+func (ss *sessions) add(p, target string) {
+	ss.Lock()
+	ss.active[p] = target
+	ss.Unlock()
+}
+
+// target returns the name of the target of the session with the
+// temporary file at p, named name in it. Sessions of targets with long
+// names can't be committed once forgotten, e.g. by a restart, as their
+// temporary files only carry part of the name.
+func (ss *sessions) target(p, name string) (string, bool) {
+	ss.Lock()
+	defer ss.Unlock()
+
+	if target, ok := ss.active[p]; ok {
+		return target, true
+	}
+	short := len(name) > utils.MaxTempBase-4 && shortName.MatchString(name)
+	return name, !short
+}
+
+func (ss *sessions) remove(p string) {
+	ss.Lock()
+	delete(ss.active, p)
+	ss.Unlock()
+}
+
+// serveBegin starts an atomic write session for the file at urlPath and
+// responds with the path of the session's temporary file. Unless
+// ?trunc=1 is given the temporary file starts as a copy of the target.
+// Writes go to the temporary file with the usual methods (PUT,
+// TRUNCATE, ...) until it is committed with COMMIT or discarded with
+// DELETE.
+func (s *fileServer) serveBegin(w http.ResponseWriter, r *http.Request, localPath, urlPath string) {
+	if s.sessions == nil {
+		http.Error(w, "Not Implemented", http.StatusNotImplemented)
+		return
+	}
+
+	query := r.URL.Query()
+	trunc := utils.SafeParseBool(query.Get("trunc"), false)
+	perm := utils.SafeParseMode(query.Get("perm"), 0666)
+
+	src, err := os.Open(localPath)
+	switch {
+	case err == nil:
+		defer src.Close()
+		fi, err := src.Stat()
+		if err != nil {
+			msg, code := toHTTPError(err)
+			http.Error(w, msg, code)
+			return
+		}
+		if !fi.Mode().IsRegular() {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		perm = fi.Mode().Perm()
+	case os.IsNotExist(err):
+		src = nil
+	default:
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	name := utils.TempName(path.Base(urlPath), "", hex.EncodeToString(id))
+	tmpPath := path.Join(path.Dir(localPath), name)
+	tmpURL := path.Join(path.Dir(urlPath), name)
+
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		//log.Printf("E: os.OpenFile('%s') -> %s\n", tmpPath, err)
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	defer tmp.Close()
+
+	if src != nil && !trunc {
+		if _, err := io.Copy(tmp, src); err != nil {
+			os.Remove(tmpPath)
+			msg, code := toHTTPError(err)
+			http.Error(w, msg, code)
+			return
+		}
+	}
+
+	s.sessions.add(tmpPath, path.Base(urlPath))
+	s.record(types.EventCreate, tmpURL, "")
+
+	w.Write([]byte(tmpURL))
+}
+
+// serveCommit atomically replaces the target of the session whose
+// temporary file is at urlPath with it, preserving the target's mode,
+// ownership and extended attributes.
+func (s *fileServer) serveCommit(w http.ResponseWriter, r *http.Request, localPath, urlPath string) {
+	if s.sessions == nil {
+		http.Error(w, "Not Implemented", http.StatusNotImplemented)
+		return
+	}
+
+	m := sessionName.FindStringSubmatch(path.Base(urlPath))
+	if m == nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	target, ok := s.sessions.target(localPath, m[1])
+	if !ok {
+		http.Error(w, "Session Not Found", http.StatusNotFound)
+		return
+	}
+	targetPath := path.Join(path.Dir(localPath), target)
+	targetURL := path.Join(path.Dir(urlPath), target)
+
+	tmp, err := os.OpenFile(localPath, os.O_RDWR, 0)
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	err = tmp.Sync()
+	tmp.Close()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if fi, err := os.Lstat(targetPath); err == nil && fi.Mode().IsRegular() {
+		if err := copyAttrs(targetPath, localPath, fi); err != nil {
+			//log.Printf("E: copyAttrs('%s', '%s') -> %s\n", targetPath, localPath, err)
+			msg, code := toHTTPError(err)
+			http.Error(w, msg, code)
+			return
+		}
+	}
+
+	if !s.saveVersion(w, targetPath) {
+		return
+	}
+	if err := os.Rename(localPath, targetPath); err != nil {
+		//log.Printf("E: os.Rename('%s', '%s') -> %s\n", localPath, targetPath, err)
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+
+	if d, err := os.Open(path.Dir(targetPath)); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	s.sessions.remove(localPath)
+	s.record(types.EventRename, urlPath, targetURL)
+}
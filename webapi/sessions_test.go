@@ -0,0 +1,85 @@
+package webapi_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prologic/httpfs/utils/tempdir"
+	"github.com/prologic/httpfs/webapi"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAtomicWriteSession(t *testing.T) {
+	assert := assert.New(t)
+
+	tmp := tempdir.New(t)
+	defer tmp.Cleanup()
+
+	target := filepath.Join(tmp.Path, "foo")
+	assert.Nil(ioutil.WriteFile(target, []byte("hello world"), 0640))
+
+	handler := webapi.FileServer(tmp.Path, false, webapi.WithSessions(time.Hour))
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("BEGIN", "/foo", nil))
+	assert.Equal(http.StatusOK, w.Code)
+	session := w.Body.String()
+	assert.True(strings.HasPrefix(session, "/.foo.httpfs-"))
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("PUT", session+"?flags=1&offset=6", strings.NewReader("WORLD")))
+	assert.Equal(http.StatusOK, w.Code)
+
+	// The target is untouched until the session is committed.
+	data, err := ioutil.ReadFile(target)
+	assert.Nil(err)
+	assert.Equal("hello world", string(data))
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("COMMIT", session, nil))
+	assert.Equal(http.StatusOK, w.Code)
+
+	data, err = ioutil.ReadFile(target)
+	assert.Nil(err)
+	assert.Equal("hello WORLD", string(data))
+
+	fi, err := os.Stat(target)
+	assert.Nil(err)
+	assert.Equal(os.FileMode(0640), fi.Mode().Perm())
+
+	_, err = os.Stat(filepath.Join(tmp.Path, session))
+	assert.True(os.IsNotExist(err))
+
+	// Only session files can be committed.
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("COMMIT", "/foo", nil))
+	assert.Equal(http.StatusBadRequest, w.Code)
+}
+
+func TestAtomicWriteSessionLongName(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newTestServer(t, webapi.WithSessions(time.Hour))
+	defer s.Close()
+
+	name := strings.Repeat("x", 250)
+	w := s.do("BEGIN", "/"+name+"?trunc=1", "")
+	assert.Equal(http.StatusOK, w.Code)
+	session := w.Body.String()
+
+	assert.Equal(http.StatusOK, s.do("PUT", session+"?flags=65&offset=0", "hello").Code)
+	assert.Equal(http.StatusOK, s.do("COMMIT", session, "").Code)
+
+	data, err := ioutil.ReadFile(s.path(name))
+	assert.Nil(err)
+	assert.Equal("hello", string(data))
+	files, _ := ioutil.ReadDir(s.tmp.Path)
+	assert.Len(files, 1)
+}
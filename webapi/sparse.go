@@ -0,0 +1,300 @@
+package webapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	//"log"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/prologic/httpfs/types"
+	"github.com/prologic/httpfs/utils"
+)
+
+// sparseBlock is the granularity at which sparse writes turn zeros into
+// holes.
+const sparseBlock = 4096
+
+var (
+	errBadMode      = errors.New("unknown fallocate mode")
+	errNotSupported = errors.New("not supported")
+)
+
+// serveExtents handles
+//
+//	EXTENTS /path?offset=&length=
+//
+// by responding with the JSON encoded list of types.Extent holding data
+// between offset and offset+length (the end of the file by default).
+// Everything else is a hole.
+func (s *fileServer) serveExtents(w http.ResponseWriter, r *http.Request, localPath string) {
+	query := r.URL.Query()
+	offset := utils.SafeParseInt64(query.Get("offset"), 0)
+	length := utils.SafeParseInt64(query.Get("length"), -1)
+	if offset < 0 {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	f, err := os.Open(localPath)
+	if err != nil {
+		//log.Printf("E: os.Open('%s') -> %s\n", localPath, err)
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+
+	end := fi.Size()
+	if length >= 0 && offset+length < end {
+		end = offset + length
+	}
+	extents, err := dataExtents(f, offset, end)
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	if extents == nil {
+		extents = []types.Extent{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", utils.ETag(fi))
+	json.NewEncoder(w).Encode(extents)
+}
+
+// serveFallocate handles
+//
+//	FALLOCATE /path?mode=&offset=&length=
+//
+// which manipulates the allocated space of the file like fallocate(2).
+// mode is empty to allocate (growing the file if needed), keep-size to
+// allocate without changing the size, punch-hole to turn the range into
+// a hole or zero-range to zero it.
+func (s *fileServer) serveFallocate(w http.ResponseWriter, r *http.Request, localPath, urlPath string) {
+	query := r.URL.Query()
+	offset := utils.SafeParseInt64(query.Get("offset"), -1)
+	length := utils.SafeParseInt64(query.Get("length"), -1)
+	if offset < 0 || length <= 0 {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	f, err := os.OpenFile(localPath, os.O_WRONLY, 0)
+	if err != nil {
+		//log.Printf("E: os.OpenFile('%s') -> %s\n", localPath, err)
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	defer f.Close()
+
+	switch err := fallocate(f, query.Get("mode"), offset, length); err {
+	case nil:
+	case errBadMode:
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	case errNotSupported:
+		http.Error(w, "Not Implemented", http.StatusNotImplemented)
+		return
+	default:
+		//log.Printf("E: fallocate('%s') -> %s\n", localPath, err)
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+
+	s.record(types.EventWrite, urlPath, "")
+}
+
+// serveSparse answers a GET of a single range of the file f with
+// ?sparse=1 by sending only the parts of the range that hold data, as a
+// multipart/byteranges response; the rest is zeros. The last byte of the
+// range is always included so the client learns where it ends. It
+// returns false if the request should be served normally instead, e.g.
+// because the range holds no holes.
+func serveSparse(w http.ResponseWriter, r *http.Request, f *os.File, fi os.FileInfo) bool {
+	start, end, ok := parseRange(r.Header.Get("Range"), fi.Size())
+	if !ok {
+		return false
+	}
+
+	extents, err := dataExtents(f, start, end)
+	if err != nil {
+		return false
+	}
+	if len(extents) == 1 && extents[0].Offset == start && extents[0].Length == end-start {
+		return false
+	}
+	if n := len(extents); n == 0 || extents[n-1].Offset+extents[n-1].Length < end {
+		extents = append(extents, types.Extent{Offset: end - 1, Length: 1})
+	}
+
+	mw := multipart.NewWriter(w)
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	w.WriteHeader(http.StatusPartialContent)
+
+	for _, e := range extents {
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Range": {fmt.Sprintf("bytes %d-%d/%d", e.Offset, e.Offset+e.Length-1, fi.Size())},
+		})
+		if err != nil {
+			return true
+		}
+		if _, err := io.Copy(part, io.NewSectionReader(f, e.Offset, e.Length)); err != nil {
+			return true
+		}
+	}
+	mw.Close()
+	return true
+}
+
+// parseRange parses a Range header holding a single satisfiable range of
+// a file of the given size into its start and (exclusive) end.
+func parseRange(s string, size int64) (int64, int64, bool) {
+	if !strings.HasPrefix(s, "bytes=") || strings.Contains(s, ",") {
+		return 0, 0, false
+	}
+	se := strings.SplitN(strings.TrimPrefix(s, "bytes="), "-", 2)
+	if len(se) != 2 || se[0] == "" {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(se[0], 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+	end := size
+	if se[1] != "" {
+		last, err := strconv.ParseInt(se[1], 10, 64)
+		if err != nil || last < start {
+			return 0, 0, false
+		}
+		if last+1 < end {
+			end = last + 1
+		}
+	}
+	return start, end, true
+}
+
+// sparseWriter writes to a file from an offset, turning aligned blocks
+// of zeros into holes rather than writing them.
+type sparseWriter struct {
+	f   *os.File
+	off int64
+
+	// the pending run of zero blocks
+	holeOff int64
+	holeLen int64
+}
+
+func newSparseWriter(f *os.File, offset int64) *sparseWriter {
+	return &sparseWriter{f: f, off: offset}
+}
+
+func (s *sparseWriter) Write(p []byte) (int, error) {
+	// data is the start of the data in p not written yet.
+	data := 0
+	for i := 0; i < len(p); {
+		off := s.off + int64(i)
+		l := sparseBlock - int(off%sparseBlock)
+		if l > len(p)-i {
+			l = len(p) - i
+		}
+		if l == sparseBlock && isZero(p[i:i+l]) {
+			if err := s.writeData(p[data:i], s.off+int64(data)); err != nil {
+				return data, err
+			}
+			if err := s.addHole(off, int64(l)); err != nil {
+				return data, err
+			}
+			data = i + l
+		}
+		i += l
+	}
+	if err := s.writeData(p[data:], s.off+int64(data)); err != nil {
+		return data, err
+	}
+	s.off += int64(len(p))
+	return len(p), nil
+}
+
+func (s *sparseWriter) writeData(b []byte, off int64) error {
+	if len(b) == 0 {
+		return nil
+	}
+	_, err := s.f.WriteAt(b, off)
+	return err
+}
+
+func (s *sparseWriter) addHole(off, length int64) error {
+	if s.holeLen > 0 && s.holeOff+s.holeLen == off {
+		s.holeLen += length
+		return nil
+	}
+	if err := s.flushHole(); err != nil {
+		return err
+	}
+	s.holeOff, s.holeLen = off, length
+	return nil
+}
+
+// flushHole punches the pending hole, or writes zeros if the filesystem
+// doesn't support holes.
+func (s *sparseWriter) flushHole() error {
+	if s.holeLen == 0 {
+		return nil
+	}
+	off, length := s.holeOff, s.holeLen
+	s.holeLen = 0
+
+	if fallocate(s.f, "punch-hole", off, length) == nil {
+		return nil
+	}
+	zeros := make([]byte, sparseBlock)
+	for ; length > 0; length -= sparseBlock {
+		if _, err := s.f.WriteAt(zeros, off); err != nil {
+			return err
+		}
+		off += sparseBlock
+	}
+	return nil
+}
+
+// Close finishes the write, growing the file to cover a trailing hole.
+func (s *sparseWriter) Close() error {
+	if err := s.flushHole(); err != nil {
+		return err
+	}
+	fi, err := s.f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() < s.off {
+		return s.f.Truncate(s.off)
+	}
+	return nil
+}
+
+func isZero(b []byte) bool {
+	for _, x := range b {
+		if x != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,77 @@
+package webapi
+
+import (
+	"errors"
+	"os"
+	"syscall"
+
+	"github.com/prologic/httpfs/types"
+)
+
+// lseek(2) whence values for finding data and holes
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// fallocate(2) mode flags
+const (
+	fallocKeepSize  = 0x01
+	fallocPunchHole = 0x02
+	fallocZeroRange = 0x10
+)
+
+// dataExtents returns the extents of f between offset and end that hold
+// data. If the filesystem can't tell, all of it is data.
+func dataExtents(f *os.File, offset, end int64) ([]types.Extent, error) {
+	var extents []types.Extent
+	for offset < end {
+		data, err := f.Seek(offset, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			// Only a hole is left.
+			break
+		}
+		if errors.Is(err, syscall.EINVAL) {
+			return []types.Extent{{Offset: offset, Length: end - offset}}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if data >= end {
+			break
+		}
+
+		hole, err := f.Seek(data, seekHole)
+		if err != nil {
+			return nil, err
+		}
+		if hole > end {
+			hole = end
+		}
+		extents = append(extents, types.Extent{Offset: data, Length: hole - data})
+		offset = hole
+	}
+	return extents, nil
+}
+
+// fallocate allocates, zeroes or deallocates length bytes of f from
+// offset according to mode (see FALLOCATE).
+func fallocate(f *os.File, mode string, offset, length int64) error {
+	var flags uint32
+	switch mode {
+	case "":
+	case "keep-size":
+		flags = fallocKeepSize
+	case "punch-hole":
+		flags = fallocPunchHole | fallocKeepSize
+	case "zero-range":
+		flags = fallocZeroRange
+	default:
+		return errBadMode
+	}
+	err := syscall.Fallocate(int(f.Fd()), flags, offset, length)
+	if err == syscall.EOPNOTSUPP {
+		return errNotSupported
+	}
+	return err
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package webapi
+
+import (
+	"os"
+
+	"github.com/prologic/httpfs/types"
+)
+
+// dataExtents returns the extents of f between offset and end that hold
+// data. This platform can't find holes, so all of it is data.
+func dataExtents(f *os.File, offset, end int64) ([]types.Extent, error) {
+	if offset >= end {
+		return nil, nil
+	}
+	return []types.Extent{{Offset: offset, Length: end - offset}}, nil
+}
+
+// fallocate is not supported on this platform.
+func fallocate(f *os.File, mode string, offset, length int64) error {
+	return errNotSupported
+}
@@ -0,0 +1,54 @@
+package webapi_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/prologic/httpfs/types"
+	"github.com/prologic/httpfs/utils/tempdir"
+	"github.com/prologic/httpfs/webapi"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSparseWrite(t *testing.T) {
+	assert := assert.New(t)
+
+	tmp := tempdir.New(t)
+	defer tmp.Cleanup()
+
+	handler := webapi.FileServer(tmp.Path, false)
+
+	data := make([]byte, 64<<10)
+	copy(data[10:], "hello")
+	copy(data[40<<10:], "world")
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("PUT", "/foo?flags=65&offset=0&sparse=1", bytes.NewReader(data)))
+	assert.Equal(http.StatusOK, w.Code)
+
+	// Writing zeros at the end still grows the file.
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("PUT", "/foo?flags=1&offset=65536&sparse=1", bytes.NewReader(make([]byte, 8192))))
+	assert.Equal(http.StatusOK, w.Code)
+
+	b, err := ioutil.ReadFile(filepath.Join(tmp.Path, "foo"))
+	assert.Nil(err)
+	assert.Equal(append(data, make([]byte, 8192)...), b)
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("EXTENTS", "/foo", nil))
+	assert.Equal(http.StatusOK, w.Code)
+
+	var extents []types.Extent
+	assert.Nil(json.NewDecoder(w.Body).Decode(&extents))
+	assert.NotEmpty(extents)
+	for _, e := range extents {
+		assert.True(e.Offset+e.Length <= int64(len(b)))
+	}
+}
@@ -0,0 +1,283 @@
+package webapi
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prologic/httpfs/types"
+)
+
+// TrashDir is the directory in the served directory that deleted files
+// are kept in when the trash is enabled. It is hidden from clients.
+const TrashDir = ".httpfs-trash"
+
+// DefaultTrashRetention is how long deleted files are kept by default.
+const DefaultTrashRetention = 30 * 24 * time.Hour
+
+// trashID matches the id of an item in the trash.
+var trashID = regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+var errNoTrashItem = errors.New("no such item in the trash")
+
+// trash keeps deleted files and directories so that they can be
+// restored. Each item is a directory in TrashDir named by its id, which
+// holds the deleted entry as data and its types.TrashItem as info.json.
+// Items older than the retention are purged.
+type trash struct {
+	sync.Mutex
+	dir       string
+	retention time.Duration
+}
+
+// WithTrash makes deletes move files and directories into the trash
+// rather than removing them, and enables the TRASH, RESTORE and PURGE
+// methods for managing it. Items are purged retention after they were
+// deleted, or never if it is zero.
+func WithTrash(retention time.Duration) Option {
+	return func(s *fileServer) {
+		s.trash = &trash{retention: retention}
+	}
+}
+
+// start purges expired items periodically.
+func (t *trash) start() {
+	if t.retention <= 0 {
+		return
+	}
+	interval := t.retention / 4
+	if interval > time.Hour {
+		interval = time.Hour
+	}
+	go func() {
+		t.gc()
+
+		for range time.Tick(interval) {
+			t.gc()
+		}
+	}()
+}
+
+func (t *trash) gc() {
+	items, err := t.list("/")
+	if err != nil {
+		return
+	}
+	for _, item := range items {
+		if time.Since(time.Unix(item.Deleted, 0)) > t.retention {
+			log.Printf("purging %s (deleted from %s) from the trash", item.ID, item.Path)
+			t.purge(item.ID)
+		}
+	}
+}
+
+// clientID identifies the client that made r: the user it authenticated
+// as, if any, and its address.
+func clientID(r *http.Request) string {
+	if user, _, ok := r.BasicAuth(); ok && user != "" {
+		return user + "@" + r.RemoteAddr
+	}
+	return r.RemoteAddr
+}
+
+// put moves the file or directory at localPath, deleted from urlPath by
+// client, into the trash.
+func (t *trash) put(localPath, urlPath, client string) error {
+	fi, err := os.Lstat(localPath)
+	if err != nil {
+		return err
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	item := types.TrashItem{
+		ID:      hex.EncodeToString(b),
+		Path:    urlPath,
+		Deleted: time.Now().Unix(),
+		Client:  client,
+		IsDir:   fi.IsDir(),
+		Size:    fi.Size(),
+	}
+
+	itemDir := path.Join(t.dir, item.ID)
+	if err := os.MkdirAll(itemDir, 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path.Join(itemDir, "info.json"), data, 0600); err != nil {
+		os.RemoveAll(itemDir)
+		return err
+	}
+	if err := os.Rename(localPath, path.Join(itemDir, "data")); err != nil {
+		os.RemoveAll(itemDir)
+		return err
+	}
+	return nil
+}
+
+// list returns the items deleted from urlPath or below it, oldest first.
+func (t *trash) list(urlPath string) ([]types.TrashItem, error) {
+	f, err := os.Open(t.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ids, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := strings.TrimSuffix(path.Clean(urlPath), "/") + "/"
+	var items []types.TrashItem
+	for _, id := range ids {
+		item, err := t.item(id)
+		if err != nil {
+			continue
+		}
+		if item.Path == path.Clean(urlPath) || strings.HasPrefix(item.Path, prefix) {
+			items = append(items, item)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Deleted < items[j].Deleted
+	})
+	return items, nil
+}
+
+func (t *trash) item(id string) (types.TrashItem, error) {
+	var item types.TrashItem
+	if !trashID.MatchString(id) {
+		return item, errNoTrashItem
+	}
+	data, err := ioutil.ReadFile(path.Join(t.dir, id, "info.json"))
+	if os.IsNotExist(err) {
+		return item, errNoTrashItem
+	}
+	if err != nil {
+		return item, err
+	}
+	if err := json.Unmarshal(data, &item); err != nil {
+		return item, err
+	}
+	return item, nil
+}
+
+// restore moves the item id back to localPath, which must not exist.
+func (t *trash) restore(id, localPath string) (types.TrashItem, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	item, err := t.item(id)
+	if err != nil {
+		return item, err
+	}
+	if _, err := os.Lstat(localPath); err == nil {
+		return item, &os.PathError{Op: "restore", Path: localPath, Err: syscall.EEXIST}
+	}
+	if err := os.MkdirAll(path.Dir(localPath), 0777); err != nil {
+		return item, err
+	}
+	if err := os.Rename(path.Join(t.dir, id, "data"), localPath); err != nil {
+		return item, err
+	}
+	return item, os.RemoveAll(path.Join(t.dir, id))
+}
+
+func (t *trash) purge(id string) error {
+	t.Lock()
+	defer t.Unlock()
+
+	if _, err := t.item(id); err != nil {
+		return err
+	}
+	return os.RemoveAll(path.Join(t.dir, id))
+}
+
+// serveTrash dispatches the trash methods:
+//
+//	TRASH   /path        list the items deleted from path or below it
+//	RESTORE /path?id=    move item id back to path
+//	PURGE   /path?id=    remove item id for good, or without id all the
+//	                     items deleted from path or below it
+func (s *fileServer) serveTrash(w http.ResponseWriter, r *http.Request, localPath, urlPath string) {
+	if s.trash == nil {
+		http.Error(w, "Not Implemented", http.StatusNotImplemented)
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+
+	switch r.Method {
+	case "TRASH":
+		items, err := s.trash.list(urlPath)
+		if err != nil {
+			msg, code := toHTTPError(err)
+			http.Error(w, msg, code)
+			return
+		}
+		if items == nil {
+			items = []types.TrashItem{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(items)
+	case "RESTORE":
+		item, err := s.trash.restore(id, localPath)
+		if err != nil {
+			trashError(w, err)
+			return
+		}
+		if item.IsDir {
+			s.record(types.EventMkdir, urlPath, "")
+		} else {
+			s.record(types.EventCreate, urlPath, "")
+		}
+	case "PURGE":
+		if id != "" {
+			if err := s.trash.purge(id); err != nil {
+				trashError(w, err)
+			}
+			return
+		}
+		items, err := s.trash.list(urlPath)
+		if err != nil {
+			trashError(w, err)
+			return
+		}
+		for _, item := range items {
+			if err := s.trash.purge(item.ID); err != nil && err != errNoTrashItem {
+				trashError(w, err)
+				return
+			}
+		}
+	}
+}
+
+func trashError(w http.ResponseWriter, err error) {
+	if err == errNoTrashItem {
+		http.Error(w, "Item Not Found", http.StatusNotFound)
+		return
+	}
+	//log.Printf("E: trash -> %s\n", err)
+	msg, code := toHTTPError(err)
+	http.Error(w, msg, code)
+}
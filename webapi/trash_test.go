@@ -0,0 +1,74 @@
+package webapi_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prologic/httpfs/types"
+	"github.com/prologic/httpfs/webapi"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrash(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newTestServer(t, webapi.WithTrash(time.Hour))
+	defer s.Close()
+
+	assert.Nil(os.MkdirAll(s.path("dir/sub"), 0755))
+	assert.Nil(ioutil.WriteFile(s.path("dir/sub/f"), []byte("x"), 0644))
+	assert.Nil(ioutil.WriteFile(s.path("g"), []byte("y"), 0644))
+
+	list := func(url string) []types.TrashItem {
+		var items []types.TrashItem
+		w := s.do("TRASH", url, "")
+		assert.Equal(http.StatusOK, w.Code)
+		assert.Nil(json.NewDecoder(w.Body).Decode(&items))
+		return items
+	}
+
+	assert.Empty(list("/"))
+
+	// Non-recursive deletes of directories that aren't empty still fail.
+	assert.Equal(http.StatusConflict, s.do("RMDIR", "/dir", "").Code)
+	assert.Equal(http.StatusOK, s.do("DELETE", "/dir?recursive=1", "").Code)
+	assert.Equal(http.StatusOK, s.do("UNLINK", "/g", "").Code)
+	assert.False(s.exists("dir"))
+	assert.False(s.exists("g"))
+
+	items := make(map[string]types.TrashItem)
+	for _, item := range list("/") {
+		items[item.Path] = item
+	}
+	if !assert.Len(items, 2) {
+		return
+	}
+	assert.True(items["/dir"].IsDir)
+	assert.Equal("192.0.2.1:1234", items["/dir"].Client)
+	assert.False(items["/g"].IsDir)
+	assert.EqualValues(1, items["/g"].Size)
+	assert.Len(list("/dir"), 1)
+
+	// The trash is hidden.
+	w := s.do("GET", "/", "")
+	var entries []types.Entry
+	assert.Nil(json.NewDecoder(w.Body).Decode(&entries))
+	assert.Empty(entries)
+	assert.Equal(http.StatusNotFound, s.do("HEAD", "/"+webapi.TrashDir, "").Code)
+
+	// Restore it elsewhere, and refuse to overwrite.
+	assert.Equal(http.StatusOK, s.do("RESTORE", "/restored/dir?id="+items["/dir"].ID, "").Code)
+	assert.True(s.exists("restored/dir/sub/f"))
+	assert.Equal(http.StatusNotFound, s.do("RESTORE", "/dir?id="+items["/dir"].ID, "").Code)
+	assert.Nil(ioutil.WriteFile(s.path("g"), []byte("z"), 0644))
+	assert.Equal(http.StatusConflict, s.do("RESTORE", "/g?id="+items["/g"].ID, "").Code)
+
+	assert.Equal(http.StatusNotFound, s.do("PURGE", "/?id=../../etc", "").Code)
+	assert.Equal(http.StatusOK, s.do("PURGE", "/", "").Code)
+	assert.Empty(list("/"))
+}
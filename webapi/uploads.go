@@ -0,0 +1,304 @@
+package webapi
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/prologic/httpfs/types"
+	"github.com/prologic/httpfs/utils"
+)
+
+// Multipart upload defaults
+const (
+	DefaultUploadTTL = time.Hour
+	MaxPartSize      = 64 << 20
+	MaxUploadSize    = 1 << 40
+)
+
+// uploadName matches the hidden staging file of a multipart upload.
+var uploadName = regexp.MustCompile(`^\..+\.httpfs-upload-[0-9a-f]{16}$`)
+
+// upload is an in-progress multipart upload. Part n is staged at offset
+// n*partSize of a hidden file next to the target; completing the upload
+// copies the staged data into the target at offset.
+type upload struct {
+	sync.Mutex
+	staging  string
+	target   string
+	offset   int64
+	partSize int64
+	perm     os.FileMode
+	parts    map[int]int64
+	touched  time.Time
+}
+
+// uploads tracks multipart uploads, which let a client send a large
+// region of a file as numbered parts in parallel and in any order and
+// then apply it in one step. An upload spans at most MaxUploadSize
+// bytes. Uploads that see no parts for ttl are aborted and their staged
+// data removed.
+type uploads struct {
+	sync.Mutex
+	ttl    time.Duration
+	active map[string]*upload
+}
+
+// WithUploads enables the UPLOAD, PART, COMPLETE and ABORT methods for
+// multipart uploads. Uploads idle for longer than ttl are aborted.
+func WithUploads(ttl time.Duration) Option {
+	return func(s *fileServer) {
+		s.uploads = &uploads{
+			ttl:    ttl,
+			active: make(map[string]*upload),
+		}
+	}
+}
+
+// start garbage collects abandoned uploads, including staging files
+// left behind by a previous run of the server below root.
+func (us *uploads) start(root string) {
+	go func() {
+		removeStale(root, uploadName, us.ttl)
+
+		for range time.Tick(us.ttl / 4) {
+			us.gc()
+		}
+	}()
+}
+
+func (us *uploads) gc() {
+	us.Lock()
+	defer us.Unlock()
+
+	for id, u := range us.active {
+		u.Lock()
+		if time.Since(u.touched) > us.ttl {
+			log.Printf("aborting abandoned upload %s of %s", id, u.target)
+			os.Remove(u.staging)
+			delete(us.active, id)
+		}
+		u.Unlock()
+	}
+}
+
+func (us *uploads) get(id string) *upload {
+	us.Lock()
+	defer us.Unlock()
+	return us.active[id]
+}
+
+func (us *uploads) remove(id string) {
+	us.Lock()
+	defer us.Unlock()
+	delete(us.active, id)
+}
+
+// serveUploads dispatches the multipart upload methods:
+//
+//	UPLOAD   /path?offset=&partsize=&perm=   start an upload; responds with its id
+//	PART     /path?upload=&part=             stage part n (body)
+//	COMPLETE /path?upload=&parts=            write parts 0..parts-1 to the file
+//	ABORT    /path?upload=                   discard the upload
+func (s *fileServer) serveUploads(w http.ResponseWriter, r *http.Request, localPath, urlPath string) {
+	if s.uploads == nil {
+		http.Error(w, "Not Implemented", http.StatusNotImplemented)
+		return
+	}
+
+	query := r.URL.Query()
+
+	if r.Method == "UPLOAD" {
+		s.startUpload(w, r, localPath, urlPath)
+		return
+	}
+
+	id := query.Get("upload")
+	u := s.uploads.get(id)
+	if u == nil || u.target != localPath {
+		http.Error(w, "Upload Not Found", http.StatusNotFound)
+		return
+	}
+
+	u.Lock()
+	u.touched = time.Now()
+	u.Unlock()
+
+	switch r.Method {
+	case "PART":
+		// Parts are written concurrently; only the bookkeeping is
+		// serialized.
+		n := utils.SafeParseInt(query.Get("part"), -1)
+		if n < 0 {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		if int64(n) >= MaxUploadSize/u.partSize {
+			http.Error(w, "Upload Too Large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		body, _, err := requestBody(r)
+		if err != nil {
+			http.Error(w, "Unsupported Media Type", http.StatusUnsupportedMediaType)
+			return
+		}
+		body, done, err := verifiedBody(r, body)
+		if err != nil {
+			verifyError(w, err)
+			return
+		}
+		defer done()
+		written, err := u.write(n, body)
+		if err != nil {
+			msg, code := toHTTPError(err)
+			http.Error(w, msg, code)
+			return
+		}
+		if written > u.partSize {
+			http.Error(w, "Part Too Large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		u.Lock()
+		u.parts[n] = written
+		u.Unlock()
+	case "COMPLETE":
+		u.Lock()
+		defer u.Unlock()
+
+		parts := utils.SafeParseInt(query.Get("parts"), -1)
+		size, ok := u.size(parts)
+		if !ok {
+			http.Error(w, "Missing Or Short Parts", http.StatusBadRequest)
+			return
+		}
+		if err := u.complete(size); err != nil {
+			//log.Printf("E: completing upload of %s -> %s\n", u.target, err)
+			msg, code := toHTTPError(err)
+			http.Error(w, msg, code)
+			return
+		}
+		os.Remove(u.staging)
+		s.uploads.remove(id)
+		s.record(types.EventWrite, urlPath, "")
+	case "ABORT":
+		os.Remove(u.staging)
+		s.uploads.remove(id)
+	}
+}
+
+func (s *fileServer) startUpload(w http.ResponseWriter, r *http.Request, localPath, urlPath string) {
+	query := r.URL.Query()
+
+	u := &upload{
+		target:   localPath,
+		offset:   utils.SafeParseInt64(query.Get("offset"), 0),
+		partSize: utils.SafeParseInt64(query.Get("partsize"), 0),
+		perm:     utils.SafeParseMode(query.Get("perm"), 0666),
+		parts:    make(map[int]int64),
+		touched:  time.Now(),
+	}
+	if u.offset < 0 || u.partSize <= 0 || u.partSize > MaxPartSize {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if u.offset > math.MaxInt64-MaxUploadSize {
+		http.Error(w, "Upload Too Large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	id := hex.EncodeToString(b)
+	u.staging = path.Join(path.Dir(localPath), utils.TempName(path.Base(urlPath), "upload", id))
+
+	f, err := os.OpenFile(u.staging, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		//log.Printf("E: os.OpenFile('%s') -> %s\n", u.staging, err)
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	f.Close()
+
+	s.uploads.Lock()
+	s.uploads.active[id] = u
+	s.uploads.Unlock()
+
+	w.Write([]byte(id))
+}
+
+// write stages part n read from r. It returns the number of bytes read,
+// which exceeds the part size if r is too long; nothing is staged then,
+// as the excess would overwrite the next part.
+func (u *upload) write(n int, r io.Reader) (int64, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, u.partSize+1))
+	if err != nil {
+		return 0, err
+	}
+	if int64(len(data)) > u.partSize {
+		return int64(len(data)), nil
+	}
+
+	f, err := os.OpenFile(u.staging, os.O_WRONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if _, err := f.WriteAt(data, int64(n)*u.partSize); err != nil {
+		return 0, err
+	}
+	return int64(len(data)), nil
+}
+
+// size returns the total size of parts 0..n-1 and whether they are all
+// present with only the last one shorter than the part size.
+func (u *upload) size(n int) (int64, bool) {
+	if n <= 0 {
+		return 0, false
+	}
+	var size int64
+	for i := 0; i < n; i++ {
+		l, ok := u.parts[i]
+		if !ok || (i < n-1 && l != u.partSize) {
+			return 0, false
+		}
+		size += l
+	}
+	return size, true
+}
+
+// complete copies size bytes of staged data into the target.
+func (u *upload) complete(size int64) error {
+	src, err := os.Open(u.staging)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(u.target, os.O_WRONLY|os.O_CREATE, u.perm)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	if _, err := dst.Seek(u.offset, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, io.LimitReader(src, size)); err != nil {
+		return err
+	}
+	return dst.Sync()
+}
@@ -0,0 +1,102 @@
+package webapi_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prologic/httpfs/webapi"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMultipartUpload(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newTestServer(t, webapi.WithUploads(time.Hour))
+	defer s.Close()
+
+	target := s.path("foo")
+	assert.Nil(ioutil.WriteFile(target, []byte("0123456789"), 0644))
+
+	w := s.do("UPLOAD", "/foo?offset=2&partsize=3", "")
+	assert.Equal(http.StatusOK, w.Code)
+	id := w.Body.String()
+
+	// Parts may arrive in any order.
+	assert.Equal(http.StatusOK, s.do("PART", "/foo?upload="+id+"&part=2", "gh").Code)
+	assert.Equal(http.StatusOK, s.do("PART", "/foo?upload="+id+"&part=0", "abc").Code)
+	// The excess of a part that is too large doesn't overwrite the next
+	// part.
+	assert.Equal(http.StatusRequestEntityTooLarge, s.do("PART", "/foo?upload="+id+"&part=1", "defX").Code)
+
+	// A missing part fails the upload without touching the file.
+	assert.Equal(http.StatusBadRequest, s.do("COMPLETE", "/foo?upload="+id+"&parts=3", "").Code)
+	data, _ := ioutil.ReadFile(target)
+	assert.Equal("0123456789", string(data))
+
+	assert.Equal(http.StatusOK, s.do("PART", "/foo?upload="+id+"&part=1", "def").Code)
+	assert.Equal(http.StatusOK, s.do("COMPLETE", "/foo?upload="+id+"&parts=3", "").Code)
+
+	data, _ = ioutil.ReadFile(target)
+	assert.Equal("01abcdefgh", string(data))
+
+	// The staging file is gone and the upload can't be used again.
+	files, _ := ioutil.ReadDir(s.tmp.Path)
+	assert.Len(files, 1)
+	assert.Equal(http.StatusNotFound, s.do("PART", "/foo?upload="+id+"&part=0", "abc").Code)
+}
+
+func TestMultipartUploadCompressed(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newTestServer(t, webapi.WithUploads(time.Hour))
+	defer s.Close()
+
+	w := s.do("UPLOAD", "/foo?partsize=5", "")
+	assert.Equal(http.StatusOK, w.Code)
+	id := w.Body.String()
+
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	gz.Write([]byte("hello"))
+	gz.Close()
+
+	w = s.do("PART", "/foo?upload="+id+"&part=0", body.String(), "Content-Encoding", "gzip")
+	assert.Equal(http.StatusOK, w.Code)
+
+	w = s.do("COMPLETE", "/foo?upload="+id+"&parts=1", "")
+	assert.Equal(http.StatusOK, w.Code)
+
+	data, _ := ioutil.ReadFile(s.path("foo"))
+	assert.Equal("hello", string(data))
+}
+
+func TestMultipartUploadTooLarge(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newTestServer(t, webapi.WithUploads(time.Hour))
+	defer s.Close()
+
+	w := s.do("UPLOAD", fmt.Sprintf("/foo?partsize=%d", webapi.MaxPartSize), "")
+	assert.Equal(http.StatusOK, w.Code)
+	id := w.Body.String()
+
+	// Parts past the maximum size of an upload are refused rather than
+	// staged at a huge offset.
+	past := fmt.Sprintf("%d", webapi.MaxUploadSize/webapi.MaxPartSize)
+	assert.Equal(http.StatusRequestEntityTooLarge, s.do("PART", "/foo?upload="+id+"&part="+past, "abcd").Code)
+	assert.Equal(http.StatusBadRequest, s.do("PART", "/foo?upload="+id+"&part=9223372036854775807", "abcd").Code)
+	fi, err := os.Stat(s.path(".foo.httpfs-upload-" + id))
+	if assert.Nil(err) {
+		assert.Equal(int64(0), fi.Size())
+	}
+
+	// So are uploads that would end past the largest offset.
+	assert.Equal(http.StatusRequestEntityTooLarge, s.do("UPLOAD", "/foo?partsize=4&offset=9223372036854775800", "").Code)
+}
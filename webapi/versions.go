@@ -0,0 +1,331 @@
+package webapi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	//"log"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prologic/httpfs/types"
+	"github.com/prologic/httpfs/utils"
+)
+
+// VersionsDir is the directory in the served directory that previous
+// versions of files are kept in when versioning is enabled. It is
+// hidden from clients.
+const VersionsDir = ".httpfs-versions"
+
+// DefaultVersions is the default number of versions kept per file.
+const DefaultVersions = 10
+
+// versionFormat is the layout of version ids, the UTC time the version
+// was saved at, which sort in the order the versions were saved.
+const versionFormat = "20060102T150405.000000000Z"
+
+// versionID matches a version id.
+var versionID = regexp.MustCompile(`^[0-9]{8}T[0-9]{6}\.[0-9]{9}Z$`)
+
+var errNoVersion = errors.New("no such version")
+
+// versions keeps previous versions of files, saved before they are
+// overwritten, truncated or renamed over. The versions of a file are
+// kept in a directory of VersionsDir named by a hash of its path (the
+// path of the file it resolves to, however clients spell it); each
+// version is a copy of its content named by its id, next to its
+// types.Version as <id>.json. Only the newest keep versions are kept.
+type versions struct {
+	sync.Mutex
+	root string
+	dir  string
+	keep int
+}
+
+// WithVersions saves the previous content of files before they are
+// overwritten (opened with O_TRUNC, replaced by COPY, DELTA, COMMIT or
+// a resumable upload), truncated or renamed over, and enables the
+// VERSIONS method and the version= and at= parameters of GET for
+// reading them. Copies are cloned where the host filesystem supports
+// reflinks. The newest keep versions of each file are kept, or all if
+// keep is zero. Writes into the middle of a file don't save a version.
+func WithVersions(keep int) Option {
+	return func(s *fileServer) {
+		s.versions = &versions{keep: keep}
+	}
+}
+
+// key returns the path of the file at localPath relative to the served
+// directory.
+func (vs *versions) key(localPath string) string {
+	return path.Join("/", strings.TrimPrefix(path.Clean(localPath), vs.root))
+}
+
+func (vs *versions) fileDir(localPath string) string {
+	sum := sha256.Sum256([]byte(vs.key(localPath)))
+	return path.Join(vs.dir, hex.EncodeToString(sum[:16]))
+}
+
+// save saves the content of the file at localPath as a new version.
+// Nothing is saved if it doesn't exist or isn't a regular file, or if
+// its content is that of the newest version already.
+func (vs *versions) save(localPath string) error {
+	if vs == nil {
+		return nil
+	}
+
+	vs.Lock()
+	defer vs.Unlock()
+
+	src, err := os.Open(localPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil
+	}
+
+	list, err := vs.list(localPath)
+	if err != nil {
+		return err
+	}
+	if len(list) > 0 && list[0].ETag == utils.ETag(fi) {
+		return nil
+	}
+
+	now := time.Now()
+	v := types.Version{
+		ID:      now.UTC().Format(versionFormat),
+		Path:    vs.key(localPath),
+		Time:    now.Unix(),
+		Size:    fi.Size(),
+		ModTime: fi.ModTime().Unix(),
+		ETag:    utils.ETag(fi),
+	}
+
+	d := vs.fileDir(localPath)
+	if err := os.MkdirAll(d, 0700); err != nil {
+		return err
+	}
+	dst, err := os.OpenFile(path.Join(d, v.ID), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = copyFile(dst, src, fi.Size())
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		var data []byte
+		if data, err = json.Marshal(v); err == nil {
+			err = ioutil.WriteFile(path.Join(d, v.ID+".json"), data, 0600)
+		}
+	}
+	if err != nil {
+		os.Remove(path.Join(d, v.ID))
+		return err
+	}
+
+	list = append([]types.Version{v}, list...)
+	if vs.keep > 0 && len(list) > vs.keep {
+		for _, old := range list[vs.keep:] {
+			os.Remove(path.Join(d, old.ID))
+			os.Remove(path.Join(d, old.ID+".json"))
+		}
+	}
+	return nil
+}
+
+// list returns the versions of the file at localPath, newest first.
+func (vs *versions) list(localPath string) ([]types.Version, error) {
+	f, err := os.Open(vs.fileDir(localPath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var list []types.Version
+	for _, name := range names {
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		v, err := vs.version(localPath, strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			continue
+		}
+		list = append(list, v)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID > list[j].ID
+	})
+	return list, nil
+}
+
+func (vs *versions) version(localPath, id string) (types.Version, error) {
+	var v types.Version
+	if !versionID.MatchString(id) {
+		return v, errNoVersion
+	}
+	data, err := ioutil.ReadFile(path.Join(vs.fileDir(localPath), id+".json"))
+	if os.IsNotExist(err) {
+		return v, errNoVersion
+	}
+	if err != nil {
+		return v, err
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return v, err
+	}
+	return v, nil
+}
+
+// at returns the version of the file at localPath that was current at
+// t. It returns false if that is the current content.
+func (vs *versions) at(localPath string, t time.Time) (types.Version, bool, error) {
+	list, err := vs.list(localPath)
+	if err != nil {
+		return types.Version{}, false, err
+	}
+	// The oldest version replaced after t was current at t.
+	for i := len(list) - 1; i >= 0; i-- {
+		v := list[i]
+		if v.Time > t.Unix() {
+			if v.ModTime > t.Unix() {
+				return v, false, errNoVersion
+			}
+			return v, true, nil
+		}
+	}
+	return types.Version{}, false, nil
+}
+
+// parseTime parses the at= parameter, an RFC 3339 time or Unix time.
+func parseTime(s string) (time.Time, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// serveVersions handles
+//
+//	VERSIONS /path
+//
+// by responding with the JSON encoded list of types.Version of the file
+// at path, newest first.
+func (s *fileServer) serveVersions(w http.ResponseWriter, r *http.Request, localPath string) {
+	if s.versions == nil {
+		http.Error(w, "Not Implemented", http.StatusNotImplemented)
+		return
+	}
+
+	list, err := s.versions.list(localPath)
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return
+	}
+	if list == nil {
+		list = []types.Version{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// serveVersion answers a GET with version=<id>, or at=<time> for the
+// version that was current at that time, with the content of that
+// version of the file. The X-Version header holds its id. It returns
+// false if the request is for the current content, which is to be
+// served as usual.
+func (s *fileServer) serveVersion(w http.ResponseWriter, r *http.Request, localPath, urlPath string) bool {
+	if s.versions == nil {
+		http.Error(w, "Not Implemented", http.StatusNotImplemented)
+		return true
+	}
+
+	query := r.URL.Query()
+
+	var v types.Version
+	var err error
+	if id := query.Get("version"); id != "" {
+		v, err = s.versions.version(localPath, id)
+	} else {
+		t, perr := parseTime(query.Get("at"))
+		if perr != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return true
+		}
+		var old bool
+		v, old, err = s.versions.at(localPath, t)
+		if err == nil && !old {
+			// The current content, if it hasn't changed since t.
+			fi, err := os.Stat(localPath)
+			if err == nil && fi.ModTime().After(t) {
+				http.Error(w, "Version Not Found", http.StatusNotFound)
+				return true
+			}
+			return false
+		}
+	}
+	if err == errNoVersion {
+		http.Error(w, "Version Not Found", http.StatusNotFound)
+		return true
+	}
+	if err != nil {
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return true
+	}
+
+	f, err := os.Open(path.Join(s.versions.fileDir(localPath), v.ID))
+	if err != nil {
+		//log.Printf("E: os.Open('%s') -> %s\n", v.ID, err)
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return true
+	}
+	defer f.Close()
+
+	w.Header().Set("ETag", v.ETag)
+	w.Header().Set("X-Version", v.ID)
+	http.ServeContent(w, r, path.Base(urlPath), time.Unix(v.ModTime, 0), f)
+	return true
+}
+
+// saveVersion saves the content of the file at localPath as a version
+// before it is replaced. If that fails it responds with the error and
+// returns false, and the file must be left alone.
+func (s *fileServer) saveVersion(w http.ResponseWriter, localPath string) bool {
+	if err := s.versions.save(localPath); err != nil {
+		//log.Printf("E: versions.save('%s') -> %s\n", localPath, err)
+		msg, code := toHTTPError(err)
+		http.Error(w, msg, code)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,106 @@
+package webapi_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prologic/httpfs/types"
+	"github.com/prologic/httpfs/utils"
+	"github.com/prologic/httpfs/webapi"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVersions(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newTestServer(t, webapi.WithVersions(2))
+	defer s.Close()
+
+	assert.Nil(ioutil.WriteFile(s.path("f"), []byte("one"), 0644))
+	before := time.Now().Add(-time.Hour)
+	assert.Nil(os.Chtimes(s.path("f"), before, before))
+
+	list := func() []types.Version {
+		var list []types.Version
+		w := s.do("VERSIONS", "/f", "")
+		assert.Equal(http.StatusOK, w.Code)
+		assert.Nil(json.NewDecoder(w.Body).Decode(&list))
+		return list
+	}
+
+	assert.Empty(list())
+
+	put := fmt.Sprintf("/f?flags=%d", os.O_WRONLY|os.O_TRUNC)
+	assert.Equal(http.StatusOK, s.do("PUT", put, "two").Code)
+	assert.Equal(http.StatusOK, s.do("TRUNCATE", "/f?size=1", "").Code)
+
+	versions := list()
+	if assert.Len(versions, 2) {
+		// Newest first.
+		w := s.do("GET", "/f?version="+versions[0].ID, "")
+		assert.Equal(http.StatusOK, w.Code)
+		assert.Equal("two", w.Body.String())
+		assert.Equal(versions[0].ID, w.Header().Get("X-Version"))
+
+		w = s.do("GET", "/f?version="+versions[1].ID, "")
+		assert.Equal("one", w.Body.String())
+
+		// The content that was current before any of the changes.
+		w = s.do("GET", fmt.Sprintf("/f?at=%d", before.Add(time.Minute).Unix()), "")
+		assert.Equal(http.StatusOK, w.Code)
+		assert.Equal("one", w.Body.String())
+	}
+	assert.Equal("t", s.do("GET", "/f", "").Body.String())
+	assert.Equal(http.StatusNotFound, s.do("GET", "/f?version=20000101T000000.000000000Z", "").Code)
+
+	// Only the newest two versions are kept.
+	assert.Equal(http.StatusOK, s.do("PUT", put, "three").Code)
+	versions = list()
+	if assert.Len(versions, 2) {
+		assert.Equal("t", s.do("GET", "/f?version="+versions[0].ID, "").Body.String())
+		assert.Equal("two", s.do("GET", "/f?version="+versions[1].ID, "").Body.String())
+	}
+
+	// Growing a file loses nothing, so no version is saved.
+	assert.Equal(http.StatusOK, s.do("TRUNCATE", "/f?size=10", "").Code)
+	versions = list()
+	if assert.Len(versions, 2) {
+		assert.Equal("t", s.do("GET", "/f?version="+versions[0].ID, "").Body.String())
+	}
+
+	// The versions themselves are hidden.
+	assert.NotContains(s.do("GET", "/", "").Body.String(), webapi.VersionsDir)
+	assert.Equal(http.StatusNotFound, s.do("GET", "/"+webapi.VersionsDir+"/", "").Code)
+}
+
+func TestVersionsOfNormalizedNames(t *testing.T) {
+	assert := assert.New(t)
+
+	names, err := utils.NewNormalizer("", true)
+	assert.Nil(err)
+	s := newTestServer(t, webapi.WithVersions(0), webapi.WithNormalizer(names))
+	defer s.Close()
+
+	assert.Nil(ioutil.WriteFile(s.path("File"), []byte("one"), 0644))
+
+	// However the file is spelled, its versions are the same.
+	put := fmt.Sprintf("?flags=%d", os.O_WRONLY|os.O_TRUNC)
+	assert.Equal(http.StatusOK, s.do("PUT", "/file"+put, "two").Code)
+	assert.Equal(http.StatusOK, s.do("PUT", "/FILE"+put, "three").Code)
+
+	var list []types.Version
+	w := s.do("VERSIONS", "/File", "")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Nil(json.NewDecoder(w.Body).Decode(&list))
+	if assert.Len(list, 2) {
+		assert.Equal("/File", list[0].Path)
+		assert.Equal("two", s.do("GET", "/file?version="+list[0].ID, "").Body.String())
+		assert.Equal("one", s.do("GET", "/file?version="+list[1].ID, "").Body.String())
+	}
+}
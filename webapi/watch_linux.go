@@ -0,0 +1,161 @@
+package webapi
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/prologic/httpfs/types"
+)
+
+const watchMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY |
+	syscall.IN_ATTRIB | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO |
+	syscall.IN_DELETE_SELF | syscall.IN_ONLYDIR
+
+type watcher struct {
+	fd     int
+	root   string
+	broker *Broker
+	dirs   map[int]string
+}
+
+// Watch watches root and all of its subdirectories with inotify and
+// publishes every change to b. It returns once the initial watches are
+// in place; events are then delivered from a background goroutine.
+func Watch(root string, b *Broker) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return os.NewSyscallError("inotify_init1", err)
+	}
+
+	w := &watcher{
+		fd:     fd,
+		root:   filepath.Clean(root),
+		broker: b,
+		dirs:   make(map[int]string),
+	}
+
+	if err := w.addTree(w.root); err != nil {
+		syscall.Close(fd)
+		return err
+	}
+
+	go w.run()
+
+	return nil
+}
+
+// addTree adds a watch for dir and every directory below it.
+func (w *watcher) addTree(dir string) error {
+	return filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Entries may disappear while we walk; that's fine.
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, p, watchMask)
+		if err != nil {
+			return os.NewSyscallError("inotify_add_watch", err)
+		}
+		w.dirs[wd] = p
+		return nil
+	})
+}
+
+// removeTree removes the watches of dir and every directory below it.
+func (w *watcher) removeTree(dir string) {
+	for wd, p := range w.dirs {
+		if p == dir || strings.HasPrefix(p, dir+string(filepath.Separator)) {
+			syscall.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.dirs, wd)
+		}
+	}
+}
+
+func (w *watcher) publish(op, localPath string) {
+	rel, err := filepath.Rel(w.root, localPath)
+	if err != nil || isInternal(filepath.ToSlash(rel)) || isTemp(filepath.Base(rel)) {
+		return
+	}
+	w.broker.Publish(types.NewEvent(op, filepath.ToSlash(filepath.Join("/", rel)), ""))
+}
+
+func (w *watcher) run() {
+	var buf [syscall.SizeofInotifyEvent * 4096]byte
+
+	for {
+		n, err := syscall.Read(w.fd, buf[:])
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || n <= 0 {
+			syscall.Close(w.fd)
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(raw.Len)]
+			name := string(bytes.TrimRight(nameBytes, "\x00"))
+			offset += syscall.SizeofInotifyEvent + int(raw.Len)
+
+			w.handle(raw.Wd, raw.Mask, name)
+		}
+	}
+}
+
+func (w *watcher) handle(wd int32, mask uint32, name string) {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		w.broker.Publish(types.NewEvent(types.EventOverflow, "/", ""))
+		return
+	}
+
+	dir, ok := w.dirs[int(wd)]
+	if !ok {
+		return
+	}
+
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(w.dirs, int(wd))
+		return
+	}
+
+	if mask&syscall.IN_DELETE_SELF != 0 {
+		return
+	}
+
+	p := filepath.Join(dir, name)
+
+	switch {
+	case mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0:
+		if mask&syscall.IN_ISDIR != 0 {
+			// Watch the new subtree; anything created in it before the
+			// watch was added is covered by the parent's create event.
+			w.addTree(p)
+		}
+		w.publish(types.EventCreate, p)
+	case mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0:
+		if mask&(syscall.IN_ISDIR|syscall.IN_MOVED_FROM) == syscall.IN_ISDIR|syscall.IN_MOVED_FROM {
+			// The watches below a moved directory know it by its old
+			// path. They are added again under the new one if it was
+			// moved within root.
+			w.removeTree(p)
+		}
+		w.publish(types.EventRemove, p)
+	case mask&syscall.IN_MODIFY != 0:
+		w.publish(types.EventWrite, p)
+	case mask&syscall.IN_ATTRIB != 0:
+		if name == "" {
+			p = dir
+		}
+		w.publish(types.EventChmod, p)
+	}
+}
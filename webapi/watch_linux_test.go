@@ -0,0 +1,98 @@
+package webapi_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prologic/httpfs/types"
+	"github.com/prologic/httpfs/utils/tempdir"
+	"github.com/prologic/httpfs/webapi"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// next returns the next event published to events.
+func next(t *testing.T, events chan types.Event) types.Event {
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+		return types.Event{}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	assert := assert.New(t)
+
+	tmp := tempdir.New(t)
+	defer tmp.Cleanup()
+
+	b := webapi.NewBroker()
+	events := b.Subscribe()
+	defer b.Unsubscribe(events)
+	assert.Nil(webapi.Watch(tmp.Path, b))
+
+	assert.Nil(os.Mkdir(filepath.Join(tmp.Path, "d"), 0755))
+	e := next(t, events)
+	assert.Equal(types.EventCreate, e.Op)
+	assert.Equal("/d", e.Path)
+
+	// New directories are watched too. Temporary files aren't
+	// published.
+	assert.Nil(ioutil.WriteFile(filepath.Join(tmp.Path, "d", ".f.httpfs-0123456789abcdef"), nil, 0644))
+	assert.Nil(ioutil.WriteFile(filepath.Join(tmp.Path, "d", "f"), nil, 0644))
+	e = next(t, events)
+	assert.Equal(types.EventCreate, e.Op)
+	assert.Equal("/d/f", e.Path)
+
+	assert.Nil(os.Remove(filepath.Join(tmp.Path, "d", "f")))
+	e = next(t, events)
+	assert.Equal(types.EventRemove, e.Op)
+	assert.Equal("/d/f", e.Path)
+}
+
+func TestWatchRenamedDirectory(t *testing.T) {
+	assert := assert.New(t)
+
+	tmp := tempdir.New(t)
+	defer tmp.Cleanup()
+	out := tempdir.New(t)
+	defer out.Cleanup()
+
+	assert.Nil(os.MkdirAll(filepath.Join(tmp.Path, "d", "e"), 0755))
+	assert.Nil(ioutil.WriteFile(filepath.Join(tmp.Path, "d", "e", "f"), nil, 0644))
+
+	b := webapi.NewBroker()
+	events := b.Subscribe()
+	defer b.Unsubscribe(events)
+	assert.Nil(webapi.Watch(tmp.Path, b))
+
+	assert.Nil(os.Rename(filepath.Join(tmp.Path, "d"), filepath.Join(tmp.Path, "g")))
+	e := next(t, events)
+	assert.Equal(types.EventRemove, e.Op)
+	assert.Equal("/d", e.Path)
+	e = next(t, events)
+	assert.Equal(types.EventCreate, e.Op)
+	assert.Equal("/g", e.Path)
+
+	// Changes below the directory are published under its new name.
+	assert.Nil(os.Remove(filepath.Join(tmp.Path, "g", "e", "f")))
+	e = next(t, events)
+	assert.Equal(types.EventRemove, e.Op)
+	assert.Equal("/g/e/f", e.Path)
+
+	// Once moved out of the tree they aren't published at all.
+	assert.Nil(os.Rename(filepath.Join(tmp.Path, "g"), filepath.Join(out.Path, "g")))
+	e = next(t, events)
+	assert.Equal(types.EventRemove, e.Op)
+	assert.Equal("/g", e.Path)
+	assert.Nil(os.Mkdir(filepath.Join(out.Path, "g", "e", "x"), 0755))
+	assert.Nil(os.Mkdir(filepath.Join(tmp.Path, "h"), 0755))
+	e = next(t, events)
+	assert.Equal(types.EventCreate, e.Op)
+	assert.Equal("/h", e.Path)
+}
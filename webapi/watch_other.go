@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package webapi
+
+import (
+	"errors"
+)
+
+// Watch is only supported on Linux.
+func Watch(root string, b *Broker) error {
+	return errors.New("change notifications are not supported on this platform")
+}